@@ -0,0 +1,12 @@
+CREATE TABLE devices (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL,       -- light, switch, sensor, ...
+    protocol TEXT NOT NULL,   -- how the server talks to the device (mqtt, zigbee, ...)
+    address TEXT NOT NULL DEFAULT '',
+    capabilities TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_devices_name ON devices(name);
@@ -0,0 +1,4 @@
+ALTER TABLE devices DROP COLUMN room_id;
+
+DROP TABLE rooms;
+DROP TABLE floors;
@@ -0,0 +1,20 @@
+CREATE TABLE floors (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    level INTEGER NOT NULL DEFAULT 0,  -- Used for ordering, 0 is the ground floor
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE rooms (
+    id BIGSERIAL PRIMARY KEY,
+    floor_id BIGINT REFERENCES floors(id) ON DELETE SET NULL,
+    name TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_rooms_floor_id ON rooms(floor_id);
+
+ALTER TABLE devices ADD COLUMN room_id BIGINT REFERENCES rooms(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_devices_room_id ON devices(room_id);
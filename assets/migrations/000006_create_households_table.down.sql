@@ -0,0 +1,7 @@
+ALTER TABLE devices DROP COLUMN household_id;
+ALTER TABLE rooms DROP COLUMN household_id;
+ALTER TABLE floors DROP COLUMN household_id;
+
+DROP TABLE household_invitations;
+DROP TABLE household_members;
+DROP TABLE households;
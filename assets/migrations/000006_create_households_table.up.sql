@@ -0,0 +1,57 @@
+CREATE TABLE households (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE household_members (
+    household_id BIGINT NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'member', 'guest')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (household_id, user_id)
+);
+
+CREATE INDEX idx_household_members_user_id ON household_members(user_id);
+
+-- Invitations are matched against users.email (lower-cased) when the invitee next logs in
+CREATE TABLE household_invitations (
+    id BIGSERIAL PRIMARY KEY,
+    household_id BIGINT NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    role TEXT NOT NULL CHECK (role IN ('admin', 'member', 'guest')),
+    invited_by BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (household_id, email)
+);
+
+CREATE INDEX idx_household_invitations_email ON household_invitations(email);
+
+-- Existing installations were single household, so move everything into one
+INSERT INTO households (name)
+SELECT 'Home'
+WHERE EXISTS (SELECT 1 FROM users)
+   OR EXISTS (SELECT 1 FROM devices)
+   OR EXISTS (SELECT 1 FROM rooms)
+   OR EXISTS (SELECT 1 FROM floors);
+
+INSERT INTO household_members (household_id, user_id, role)
+SELECT h.id, u.id, CASE WHEN u.id = (SELECT MIN(id) FROM users) THEN 'owner' ELSE 'member' END
+FROM households h CROSS JOIN users u;
+
+ALTER TABLE floors ADD COLUMN household_id BIGINT REFERENCES households(id) ON DELETE CASCADE;
+ALTER TABLE rooms ADD COLUMN household_id BIGINT REFERENCES households(id) ON DELETE CASCADE;
+ALTER TABLE devices ADD COLUMN household_id BIGINT REFERENCES households(id) ON DELETE CASCADE;
+
+UPDATE floors SET household_id = (SELECT MIN(id) FROM households);
+UPDATE rooms SET household_id = (SELECT MIN(id) FROM households);
+UPDATE devices SET household_id = (SELECT MIN(id) FROM households);
+
+ALTER TABLE floors ALTER COLUMN household_id SET NOT NULL;
+ALTER TABLE rooms ALTER COLUMN household_id SET NOT NULL;
+ALTER TABLE devices ALTER COLUMN household_id SET NOT NULL;
+
+CREATE INDEX idx_floors_household_id ON floors(household_id);
+CREATE INDEX idx_rooms_household_id ON rooms(household_id);
+CREATE INDEX idx_devices_household_id ON devices(household_id);
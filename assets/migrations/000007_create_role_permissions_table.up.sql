@@ -0,0 +1,27 @@
+CREATE TABLE role_permissions (
+    role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'member', 'guest')),
+    permission TEXT NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('owner', 'devices:view'),
+    ('owner', 'devices:control'),
+    ('owner', 'devices:edit'),
+    ('owner', 'automations:view'),
+    ('owner', 'automations:edit'),
+    ('owner', 'admin:users'),
+    ('admin', 'devices:view'),
+    ('admin', 'devices:control'),
+    ('admin', 'devices:edit'),
+    ('admin', 'automations:view'),
+    ('admin', 'automations:edit'),
+    ('admin', 'admin:users'),
+    ('member', 'devices:view'),
+    ('member', 'devices:control'),
+    ('member', 'devices:edit'),
+    ('member', 'automations:view'),
+    ('member', 'automations:edit'),
+    ('guest', 'devices:view'),
+    ('guest', 'devices:control'),
+    ('guest', 'automations:view');
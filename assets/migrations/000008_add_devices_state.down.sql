@@ -0,0 +1,2 @@
+ALTER TABLE devices DROP COLUMN state_updated_at;
+ALTER TABLE devices DROP COLUMN state;
@@ -0,0 +1,2 @@
+ALTER TABLE devices ADD COLUMN state JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE devices ADD COLUMN state_updated_at TIMESTAMPTZ;
@@ -0,0 +1,11 @@
+CREATE TABLE state_history (
+    id BIGSERIAL PRIMARY KEY,
+    household_id BIGINT NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    device_id BIGINT NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    state JSONB NOT NULL,    -- Full state after the change
+    changes JSONB NOT NULL,  -- Only the attributes that were written
+    recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_state_history_device_recorded_at ON state_history(device_id, recorded_at);
+CREATE INDEX idx_state_history_recorded_at ON state_history(recorded_at);
@@ -0,0 +1,17 @@
+CREATE TABLE automations (
+    id BIGSERIAL PRIMARY KEY,
+    household_id BIGINT NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    triggers JSONB NOT NULL DEFAULT '[]',
+    conditions JSONB NOT NULL DEFAULT '[]',
+    actions JSONB NOT NULL DEFAULT '[]',
+    last_triggered_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_automations_household_id ON automations(household_id);
+
+-- Finds automations by trigger, e.g. triggers @> '[{"type": "time"}]'
+CREATE INDEX idx_automations_triggers ON automations USING GIN (triggers jsonb_path_ops);
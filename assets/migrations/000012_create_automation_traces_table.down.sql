@@ -0,0 +1 @@
+DROP TABLE automation_traces;
@@ -0,0 +1,15 @@
+CREATE TABLE automation_traces (
+    id BIGSERIAL PRIMARY KEY,
+    automation_id BIGINT NOT NULL REFERENCES automations(id) ON DELETE CASCADE,
+    household_id BIGINT NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    trigger JSONB NOT NULL,
+    event JSONB NOT NULL DEFAULT 'null', -- The event that matched, null for time triggers
+    conditions JSONB NOT NULL DEFAULT '[]',
+    actions JSONB NOT NULL DEFAULT '[]',
+    passed BOOLEAN NOT NULL,             -- Every condition passed
+    failed BOOLEAN NOT NULL,             -- An action failed
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_automation_traces_automation_started_at ON automation_traces(automation_id, started_at DESC);
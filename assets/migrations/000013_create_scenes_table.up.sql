@@ -0,0 +1,12 @@
+CREATE TABLE scenes (
+    id BIGSERIAL PRIMARY KEY,
+    household_id BIGINT NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    room_id BIGINT REFERENCES rooms(id) ON DELETE SET NULL,
+    name TEXT NOT NULL,
+    targets JSONB NOT NULL DEFAULT '[]', -- [{"device_id": 1, "state": {"on": true, "brightness": 30}}]
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_scenes_household_id ON scenes(household_id);
+CREATE INDEX idx_scenes_room_id ON scenes(room_id);
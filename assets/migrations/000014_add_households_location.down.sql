@@ -0,0 +1,3 @@
+ALTER TABLE households DROP COLUMN longitude;
+ALTER TABLE households DROP COLUMN latitude;
+ALTER TABLE households DROP COLUMN timezone;
@@ -0,0 +1,4 @@
+-- Used to schedule time triggers in local time and to compute sunrise and sunset
+ALTER TABLE households ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC';
+ALTER TABLE households ADD COLUMN latitude DOUBLE PRECISION;
+ALTER TABLE households ADD COLUMN longitude DOUBLE PRECISION;
@@ -0,0 +1,9 @@
+-- The next time each scheduled trigger fires, so schedules survive restarts.
+-- spec is the trigger as it was scheduled; a changed trigger is rescheduled.
+CREATE TABLE schedule_runs (
+    automation_id BIGINT NOT NULL REFERENCES automations(id) ON DELETE CASCADE,
+    trigger_index INTEGER NOT NULL,
+    spec TEXT NOT NULL,
+    next_run_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (automation_id, trigger_index)
+);
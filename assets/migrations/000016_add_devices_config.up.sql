@@ -0,0 +1,2 @@
+-- Protocol specific settings, such as the MQTT topics and payload mapping of a device
+ALTER TABLE devices ADD COLUMN config JSONB NOT NULL DEFAULT '{}';
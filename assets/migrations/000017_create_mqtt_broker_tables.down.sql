@@ -0,0 +1,4 @@
+DROP TABLE mqtt_retained_messages;
+DROP TABLE mqtt_inflight_messages;
+DROP TABLE mqtt_subscriptions;
+DROP TABLE mqtt_sessions;
@@ -0,0 +1,30 @@
+-- State of the embedded MQTT broker, so that persistent sessions and retained
+-- messages survive restarts. data holds the broker's own encoding of each
+-- record. household_id is the household whose token the client connected
+-- with, NULL for the server's own client.
+CREATE TABLE mqtt_sessions (
+    client_id TEXT PRIMARY KEY,
+    household_id BIGINT REFERENCES households(id) ON DELETE CASCADE,
+    data JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE mqtt_subscriptions (
+    client_id TEXT NOT NULL,
+    filter TEXT NOT NULL,
+    data JSONB NOT NULL,
+    PRIMARY KEY (client_id, filter)
+);
+
+CREATE TABLE mqtt_inflight_messages (
+    client_id TEXT NOT NULL,
+    packet_id INTEGER NOT NULL,
+    data JSONB NOT NULL,
+    PRIMARY KEY (client_id, packet_id)
+);
+
+CREATE TABLE mqtt_retained_messages (
+    topic TEXT PRIMARY KEY,
+    data JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
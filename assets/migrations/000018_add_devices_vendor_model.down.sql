@@ -0,0 +1,2 @@
+ALTER TABLE devices DROP COLUMN model;
+ALTER TABLE devices DROP COLUMN vendor;
@@ -0,0 +1,3 @@
+-- Reported by integrations that know the hardware, such as Zigbee2MQTT
+ALTER TABLE devices ADD COLUMN vendor TEXT NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN model TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+DROP TABLE hue_bridges;
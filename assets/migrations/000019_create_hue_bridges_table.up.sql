@@ -0,0 +1,13 @@
+-- Philips Hue bridges paired with a household. bridge_id is the bridge's own
+-- id, such as 001788fffe123456, and application_key the key it issued when
+-- paired, encrypted with the server's SECRET_KEY.
+CREATE TABLE hue_bridges (
+    id BIGSERIAL PRIMARY KEY,
+    household_id BIGINT NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    bridge_id TEXT NOT NULL,
+    address TEXT NOT NULL,
+    application_key BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (household_id, bridge_id)
+);
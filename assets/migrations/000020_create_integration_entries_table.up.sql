@@ -0,0 +1,18 @@
+-- The integrations a household has added, with their settings. Devices of an
+-- integration are only followed and commanded while its entry is enabled.
+CREATE TABLE integration_entries (
+    id BIGSERIAL PRIMARY KEY,
+    household_id BIGINT NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    integration TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    config JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (household_id, integration)
+);
+
+-- Households keep the integrations they were already using
+INSERT INTO integration_entries (household_id, integration)
+SELECT DISTINCT household_id, protocol FROM devices WHERE protocol IN ('shelly', 'hue', 'wled')
+UNION
+SELECT DISTINCT household_id, 'hue' FROM hue_bridges;
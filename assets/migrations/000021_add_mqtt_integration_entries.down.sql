@@ -0,0 +1 @@
+DELETE FROM integration_entries WHERE integration IN ('mqtt', 'zigbee2mqtt');
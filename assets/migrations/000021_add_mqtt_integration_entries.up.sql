@@ -0,0 +1,7 @@
+-- MQTT and Zigbee2MQTT are integrations too, so households keep following
+-- the devices they were already using them for
+INSERT INTO integration_entries (household_id, integration)
+SELECT DISTINCT household_id, 'mqtt' FROM devices WHERE protocol = 'mqtt'
+UNION
+SELECT DISTINCT household_id, 'zigbee2mqtt' FROM devices WHERE protocol = 'mqtt' AND config->'metadata' ? 'ieee_address'
+ON CONFLICT (household_id, integration) DO NOTHING;
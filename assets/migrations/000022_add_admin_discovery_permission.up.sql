@@ -0,0 +1,3 @@
+INSERT INTO role_permissions (role, permission) VALUES
+    ('owner', 'admin:discovery'),
+    ('admin', 'admin:discovery');
@@ -0,0 +1,21 @@
+// Show only the inputs that apply to the type chosen for each trigger,
+// condition and action in the automation editor. Without JavaScript every
+// input is shown and the ones that do not apply are ignored when saving.
+(function () {
+    "use strict";
+
+    function update(rule) {
+        const type = rule.querySelector("[data-rule-type]").value;
+
+        rule.querySelectorAll("[data-rule-for]").forEach(function (el) {
+            el.hidden = !el.dataset.ruleFor.split(" ").includes(type);
+        });
+    }
+
+    document.querySelectorAll("[data-rule]").forEach(function (rule) {
+        rule.querySelector("[data-rule-type]").addEventListener("change", function () {
+            update(rule);
+        });
+        update(rule);
+    });
+})();
@@ -0,0 +1,60 @@
+// Live device state. Listens to the /api/v1/events stream and patches any
+// element marked with data-device-id when that device's state changes:
+//   [data-state-list]    rebuilt from the full state (a <dl> or inline spans)
+//   [data-state-key]     form inputs set to the new value, unless focused
+//   [data-state-empty]   hidden once there is state
+//   [data-state-updated] replaced with "Last updated just now."
+(function () {
+    "use strict";
+
+    if (!window.EventSource || !document.querySelector("[data-device-id]")) {
+        return;
+    }
+
+    function renderList(list, state) {
+        const keys = Object.keys(state).sort();
+
+        list.replaceChildren();
+        keys.forEach(function (key) {
+            const value = String(state[key]);
+            if (list.tagName === "DL") {
+                const dt = document.createElement("dt");
+                const dd = document.createElement("dd");
+                dt.textContent = key;
+                dd.textContent = value;
+                list.append(dt, dd);
+            } else {
+                const span = document.createElement("span");
+                span.className = "state";
+                span.textContent = key + ": " + value;
+                list.append(span, " ");
+            }
+        });
+    }
+
+    function update(message) {
+        document.querySelectorAll('[data-device-id="' + message.device_id + '"]').forEach(function (el) {
+            el.querySelectorAll("[data-state-list]").forEach(function (list) {
+                renderList(list, message.state);
+            });
+            el.querySelectorAll("[data-state-key]").forEach(function (input) {
+                const value = message.state[input.dataset.stateKey];
+                if (value !== undefined && input !== document.activeElement) {
+                    input.value = value;
+                }
+            });
+            el.querySelectorAll("[data-state-empty]").forEach(function (empty) {
+                empty.hidden = true;
+            });
+            el.querySelectorAll("[data-state-updated]").forEach(function (updated) {
+                updated.textContent = "Last updated just now.";
+            });
+        });
+    }
+
+    // EventSource reconnects by itself using the retry interval sent by the server
+    const source = new EventSource("/api/v1/events");
+    source.addEventListener("state_changed", function (event) {
+        update(JSON.parse(event.data));
+    });
+})();
@@ -0,0 +1,50 @@
+// Drag and drop devices between rooms on the rooms overview page. Each move is
+// saved with a POST to /devices/{id}/room before the element is moved.
+(function () {
+    "use strict";
+
+    let dragged = null;
+
+    document.querySelectorAll(".device[draggable]").forEach(function (el) {
+        el.addEventListener("dragstart", function (event) {
+            dragged = el;
+            event.dataTransfer.effectAllowed = "move";
+            event.dataTransfer.setData("text/plain", el.dataset.deviceId);
+        });
+        el.addEventListener("dragend", function () {
+            dragged = null;
+        });
+    });
+
+    document.querySelectorAll(".dropzone").forEach(function (zone) {
+        zone.addEventListener("dragover", function (event) {
+            event.preventDefault();
+            zone.classList.add("dragover");
+        });
+        zone.addEventListener("dragleave", function () {
+            zone.classList.remove("dragover");
+        });
+        zone.addEventListener("drop", function (event) {
+            event.preventDefault();
+            zone.classList.remove("dragover");
+
+            const el = dragged;
+            if (!el || el.closest(".dropzone") === zone) {
+                return;
+            }
+
+            const body = new URLSearchParams({ RoomID: zone.dataset.roomId });
+            fetch("/devices/" + el.dataset.deviceId + "/room", { method: "POST", body: body })
+                .then(function (response) {
+                    if (!response.ok) {
+                        throw new Error("move failed with status " + response.status);
+                    }
+                    zone.querySelector("ul").appendChild(el);
+                })
+                .catch(function (err) {
+                    console.error(err);
+                    alert("The device could not be moved.");
+                });
+        });
+    });
+})();
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/automation"
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+	"github.com/wumbabum/home_assist/internal/request"
+	"github.com/wumbabum/home_assist/internal/response"
+	"github.com/wumbabum/home_assist/internal/validator"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	defaultHistoryRange = 24 * time.Hour
+	defaultHistoryLimit = 1000
+	maxHistoryLimit     = 10_000
+
+	defaultTraceLimit = 20
+)
+
+type pageQuery struct {
+	Page     int `form:"page"`
+	PageSize int `form:"page_size"`
+}
+
+// historyQuery holds the query string of GET /api/v1/devices/{id}/history.
+// Times are RFC 3339 and default to the last 24 hours.
+type historyQuery struct {
+	From      string `form:"from"`
+	To        string `form:"to"`
+	Attribute string `form:"attribute"`
+	Limit     int    `form:"limit"`
+}
+
+// automationInput is the body of POST /api/v1/automations and
+// PUT /api/v1/automations/{id}. Automations are enabled unless stated.
+type automationInput struct {
+	Name       string              `json:"name"`
+	Enabled    *bool               `json:"enabled"`
+	Triggers   database.Triggers   `json:"triggers"`
+	Conditions database.Conditions `json:"conditions"`
+	Actions    database.Actions    `json:"actions"`
+}
+
+func (in automationInput) apply(a *database.Automation) {
+	a.Name = in.Name
+	a.Enabled = in.Enabled == nil || *in.Enabled
+	a.Triggers = in.Triggers
+	a.Conditions = in.Conditions
+	a.Actions = in.Actions
+}
+
+type traceQuery struct {
+	Limit int `form:"limit"`
+}
+
+// sceneInput is the body of POST /api/v1/scenes. When targets are left out
+// the scene captures the current state of the devices in room_id.
+type sceneInput struct {
+	Name    string                `json:"name"`
+	RoomID  *int64                `json:"room_id"`
+	Targets database.SceneTargets `json:"targets"`
+}
+
+// deviceStateResponse is the state of a single device, as listed by
+// GET /api/v1/states.
+type deviceStateResponse struct {
+	DeviceID  int64                `json:"device_id"`
+	State     database.DeviceState `json:"state"`
+	UpdatedAt *time.Time           `json:"updated_at"`
+}
+
+func (app *application) apiListDevices(w http.ResponseWriter, r *http.Request) {
+	page, ok := app.readPage(w, r)
+	if !ok {
+		return
+	}
+
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	devices, metadata, err := app.db.ListDevicesPaged(r.Context(), householdID, page)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"devices": devices, "metadata": metadata})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiShowDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.apiLoadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	err := response.JSON(w, http.StatusOK, map[string]any{"device": device})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiShowDeviceState(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.apiLoadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	state := deviceStateResponse{DeviceID: device.ID, State: device.State, UpdatedAt: device.StateUpdatedAt}
+
+	err := response.JSON(w, http.StatusOK, map[string]any{"state": state})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiListStates(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	devices, err := app.db.ListDevices(r.Context(), householdID)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	states := make([]deviceStateResponse, 0, len(devices))
+	for _, device := range devices {
+		states = append(states, deviceStateResponse{DeviceID: device.ID, State: device.State, UpdatedAt: device.StateUpdatedAt})
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"states": states})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiSendCommand(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.apiLoadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	var cmd deviceCommand
+
+	err := request.DecodeJSONStrict(w, r, &cmd)
+	if err != nil {
+		app.apiBadRequest(w, r, err)
+		return
+	}
+
+	device, err = app.executeCommand(r.Context(), device, cmd)
+	if err != nil {
+		var cmdErr *commandError
+		if errors.As(err, &cmdErr) {
+			var v validator.Validator
+			v.AddFieldError("command", cmdErr.Error())
+			app.apiFailedValidation(w, r, v)
+			return
+		}
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"device": device})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiListDeviceHistory(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.apiLoadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	query := historyQuery{Limit: defaultHistoryLimit}
+
+	err := request.DecodeQueryString(r, &query)
+	if err != nil {
+		app.apiBadRequest(w, r, errors.New("limit must be an integer"))
+		return
+	}
+
+	filter := database.StateHistoryFilter{
+		DeviceID:  device.ID,
+		To:        time.Now(),
+		Attribute: query.Attribute,
+		Limit:     query.Limit,
+	}
+
+	var v validator.Validator
+	if query.To != "" {
+		filter.To, err = time.Parse(time.RFC3339, query.To)
+		v.CheckField(err == nil, "to", "must be an RFC 3339 time")
+	}
+	filter.From = filter.To.Add(-defaultHistoryRange)
+	if query.From != "" {
+		filter.From, err = time.Parse(time.RFC3339, query.From)
+		v.CheckField(err == nil, "from", "must be an RFC 3339 time")
+	}
+	v.CheckField(filter.From.Before(filter.To), "from", "must be before to")
+	v.CheckField(validator.Between(query.Limit, 1, maxHistoryLimit), "limit", "must be between 1 and 10000")
+	if v.HasErrors() {
+		app.apiFailedValidation(w, r, v)
+		return
+	}
+
+	entries, err := app.db.ListStateHistory(r.Context(), device.HouseholdID, filter)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"history": entries, "from": filter.From, "to": filter.To})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiListRooms(w http.ResponseWriter, r *http.Request) {
+	page, ok := app.readPage(w, r)
+	if !ok {
+		return
+	}
+
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	rooms, metadata, err := app.db.ListRoomsPaged(r.Context(), householdID, page)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"rooms": rooms, "metadata": metadata})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiShowRoom(w http.ResponseWriter, r *http.Request) {
+	id, err := readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w, r)
+		return
+	}
+
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	room, err := app.db.GetRoom(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.apiNotFound(w, r)
+		return
+	case err != nil:
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	devices, err := app.db.ListDevicesInRoom(r.Context(), householdID, room.ID)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"room": room, "devices": devices})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiListAutomations(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	automations, err := app.db.ListAutomations(r.Context(), householdID)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"automations": automations})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiShowAutomation(w http.ResponseWriter, r *http.Request) {
+	a, ok := app.apiLoadAutomation(w, r)
+	if !ok {
+		return
+	}
+
+	err := response.JSON(w, http.StatusOK, map[string]any{"automation": a})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+// apiListAutomationTraces returns the most recent runs of an automation,
+// newest first. Only the last 50 runs of each automation are kept.
+func (app *application) apiListAutomationTraces(w http.ResponseWriter, r *http.Request) {
+	a, ok := app.apiLoadAutomation(w, r)
+	if !ok {
+		return
+	}
+
+	query := traceQuery{Limit: defaultTraceLimit}
+
+	err := request.DecodeQueryString(r, &query)
+	if err != nil {
+		app.apiBadRequest(w, r, errors.New("limit must be an integer"))
+		return
+	}
+
+	var v validator.Validator
+	v.CheckField(validator.Between(query.Limit, 1, 50), "limit", "must be between 1 and 50")
+	if v.HasErrors() {
+		app.apiFailedValidation(w, r, v)
+		return
+	}
+
+	traces, err := app.db.ListAutomationTraces(r.Context(), a.HouseholdID, a.ID, query.Limit)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"traces": traces})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiCreateAutomation(w http.ResponseWriter, r *http.Request) {
+	var input automationInput
+
+	err := request.DecodeJSONStrict(w, r, &input)
+	if err != nil {
+		app.apiBadRequest(w, r, err)
+		return
+	}
+
+	a := &database.Automation{HouseholdID: contextGetHouseholdMember(r).HouseholdID}
+	input.apply(a)
+
+	var v validator.Validator
+	automation.Validate(&v, a)
+	err = app.validateSunTriggers(r.Context(), &v, a)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+	err = app.validateWebhookTriggers(r.Context(), &v, a)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+	if v.HasErrors() {
+		app.apiFailedValidation(w, r, v)
+		return
+	}
+
+	err = app.db.CreateAutomation(r.Context(), a)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	app.logger.Info("automation created", "automation_id", a.ID, "household_id", a.HouseholdID)
+	app.automationsChanged(a.HouseholdID)
+
+	err = response.JSON(w, http.StatusCreated, map[string]any{"automation": a})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiUpdateAutomation(w http.ResponseWriter, r *http.Request) {
+	a, ok := app.apiLoadAutomation(w, r)
+	if !ok {
+		return
+	}
+
+	var input automationInput
+
+	err := request.DecodeJSONStrict(w, r, &input)
+	if err != nil {
+		app.apiBadRequest(w, r, err)
+		return
+	}
+
+	input.apply(a)
+
+	var v validator.Validator
+	automation.Validate(&v, a)
+	err = app.validateSunTriggers(r.Context(), &v, a)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+	err = app.validateWebhookTriggers(r.Context(), &v, a)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+	if v.HasErrors() {
+		app.apiFailedValidation(w, r, v)
+		return
+	}
+
+	err = app.db.UpdateAutomation(r.Context(), a)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.apiNotFound(w, r)
+		return
+	case err != nil:
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	app.automationsChanged(a.HouseholdID)
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"automation": a})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiDeleteAutomation(w http.ResponseWriter, r *http.Request) {
+	id, err := readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w, r)
+		return
+	}
+
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	err = app.db.DeleteAutomation(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.apiNotFound(w, r)
+		return
+	case err != nil:
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	app.automationsChanged(householdID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiReceiveWebhook fires the automations with a webhook trigger for the
+// {webhookID} URL parameter. The ID is the only credential, so unknown IDs
+// and disabled automations get the same 404. A JSON object body, if any, is
+// passed on as the event data.
+func (app *application) apiReceiveWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookID := chi.URLParam(r, "webhookID")
+
+	a, err := app.db.GetAutomationByWebhook(r.Context(), webhookID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.apiNotFound(w, r)
+		return
+	case err != nil:
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	// Chunked requests have no length, so an empty body is only known once
+	// it has been read
+	var data map[string]any
+	err = request.DecodeJSON(w, r, &data)
+	if err != nil && !errors.Is(err, request.ErrEmpty) {
+		app.apiBadRequest(w, r, err)
+		return
+	}
+
+	app.events.Publish(events.NewWebhookReceived(a.HouseholdID, events.WebhookReceived{
+		WebhookID: webhookID,
+		Data:      data,
+	}))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (app *application) apiListScenes(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	scenes, err := app.db.ListScenes(r.Context(), householdID)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"scenes": scenes})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiShowScene(w http.ResponseWriter, r *http.Request) {
+	scene, ok := app.apiLoadScene(w, r)
+	if !ok {
+		return
+	}
+
+	err := response.JSON(w, http.StatusOK, map[string]any{"scene": scene})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiCreateScene(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	var input sceneInput
+
+	err := request.DecodeJSONStrict(w, r, &input)
+	if err != nil {
+		app.apiBadRequest(w, r, err)
+		return
+	}
+
+	var v validator.Validator
+	v.CheckField(validator.NotBlank(input.Name), "name", "must be provided")
+	v.CheckField(validator.MaxRunes(input.Name, 100), "name", "must not be more than 100 characters")
+
+	var room *database.Room
+	if input.RoomID != nil {
+		room, err = app.db.GetRoom(r.Context(), householdID, *input.RoomID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			v.AddFieldError("room_id", "room does not exist")
+		case err != nil:
+			app.apiServerError(w, r, err)
+			return
+		}
+	}
+	v.CheckField(room != nil || input.Targets != nil, "targets", "must be provided unless room_id is")
+	if v.HasErrors() {
+		app.apiFailedValidation(w, r, v)
+		return
+	}
+
+	scene := &database.Scene{HouseholdID: householdID, RoomID: input.RoomID, Name: input.Name, Targets: input.Targets}
+	if input.Targets == nil {
+		scene, err = app.snapshotRoom(r.Context(), room, input.Name)
+		if err != nil {
+			app.apiServerError(w, r, err)
+			return
+		}
+	}
+
+	err = app.validateSceneTargets(r.Context(), &v, householdID, scene.Targets)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+	if v.HasErrors() {
+		app.apiFailedValidation(w, r, v)
+		return
+	}
+
+	err = app.db.CreateScene(r.Context(), scene)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	app.logger.Info("scene created", "scene_id", scene.ID, "household_id", householdID, "devices", len(scene.Targets))
+
+	err = response.JSON(w, http.StatusCreated, map[string]any{"scene": scene})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiDeleteScene(w http.ResponseWriter, r *http.Request) {
+	id, err := readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w, r)
+		return
+	}
+
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	err = app.db.DeleteScene(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.apiNotFound(w, r)
+		return
+	case err != nil:
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiActivateScene applies a scene and reports whether each device reached
+// its target. A scene with an invalid target is rejected with 409 Conflict
+// and changes nothing.
+func (app *application) apiActivateScene(w http.ResponseWriter, r *http.Request) {
+	scene, ok := app.apiLoadScene(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := app.applyScene(r.Context(), scene)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	if !report.Activated {
+		status = http.StatusConflict
+	}
+
+	err = response.JSON(w, status, map[string]any{"report": report})
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+// readPage parses the page and page_size query string parameters. If they are
+// invalid an error response is written and ok is false.
+func (app *application) readPage(w http.ResponseWriter, r *http.Request) (page database.Page, ok bool) {
+	query := pageQuery{Page: 1, PageSize: defaultPageSize}
+
+	err := request.DecodeQueryString(r, &query)
+	if err != nil {
+		app.apiBadRequest(w, r, errors.New("page and page_size must be integers"))
+		return database.Page{}, false
+	}
+
+	var v validator.Validator
+	v.CheckField(validator.Between(query.Page, 1, 10_000), "page", "must be between 1 and 10000")
+	v.CheckField(validator.Between(query.PageSize, 1, maxPageSize), "page_size", "must be between 1 and 100")
+	if v.HasErrors() {
+		app.apiFailedValidation(w, r, v)
+		return database.Page{}, false
+	}
+
+	return database.Page{Number: query.Page, Size: query.PageSize}, true
+}
+
+// apiLoadAutomation fetches the automation identified by the {id} URL
+// parameter. If it cannot be loaded an error response is written and ok is
+// false.
+func (app *application) apiLoadAutomation(w http.ResponseWriter, r *http.Request) (a *database.Automation, ok bool) {
+	id, err := readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w, r)
+		return nil, false
+	}
+
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	a, err = app.db.GetAutomation(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.apiNotFound(w, r)
+		return nil, false
+	case err != nil:
+		app.apiServerError(w, r, err)
+		return nil, false
+	}
+
+	return a, true
+}
+
+// apiLoadScene fetches the scene identified by the {id} URL parameter. If it
+// cannot be loaded an error response is written and ok is false.
+func (app *application) apiLoadScene(w http.ResponseWriter, r *http.Request) (scene *database.Scene, ok bool) {
+	id, err := readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w, r)
+		return nil, false
+	}
+
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	scene, err = app.db.GetScene(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.apiNotFound(w, r)
+		return nil, false
+	case err != nil:
+		app.apiServerError(w, r, err)
+		return nil, false
+	}
+
+	return scene, true
+}
+
+// apiLoadDevice fetches the device identified by the {id} URL parameter. If it
+// cannot be loaded an error response is written and ok is false.
+func (app *application) apiLoadDevice(w http.ResponseWriter, r *http.Request) (device *database.Device, ok bool) {
+	id, err := readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w, r)
+		return nil, false
+	}
+
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	device, err = app.db.GetDevice(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.apiNotFound(w, r)
+		return nil, false
+	case err != nil:
+		app.apiServerError(w, r, err)
+		return nil, false
+	}
+
+	return device, true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticateAPI_NoSession(t *testing.T) {
+	app := newTestApplicationWithSession(t)
+
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be called when not authenticated")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/devices", nil)
+	w := httptest.NewRecorder()
+
+	handler := app.sessionManager.LoadAndSave(app.authenticateAPI(testHandler))
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Status != http.StatusUnauthorized || body.Error.Message == "" {
+		t.Errorf("unexpected error envelope %+v", body.Error)
+	}
+}
+
+func TestReadPage(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		query    string
+		ok       bool
+		number   int
+		size     int
+		status   int
+		errField string
+	}{
+		{"", true, 1, defaultPageSize, 0, ""},
+		{"?page=3&page_size=50", true, 3, 50, 0, ""},
+		{"?page=0", false, 0, 0, http.StatusUnprocessableEntity, "page"},
+		{"?page_size=500", false, 0, 0, http.StatusUnprocessableEntity, "page_size"},
+		{"?page=two", false, 0, 0, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/devices"+tt.query, nil)
+			w := httptest.NewRecorder()
+
+			page, ok := app.readPage(w, req)
+			if ok != tt.ok {
+				t.Fatalf("expected ok=%t, got %t", tt.ok, ok)
+			}
+
+			if tt.ok {
+				if page.Number != tt.number || page.Size != tt.size {
+					t.Errorf("expected page %d/%d, got %d/%d", tt.number, tt.size, page.Number, page.Size)
+				}
+				return
+			}
+
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, w.Code)
+			}
+
+			var body struct {
+				Error apiError `json:"error"`
+			}
+			err := json.NewDecoder(w.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.errField != "" && body.Error.Fields[tt.errField] == "" {
+				t.Errorf("expected field error for %s, got %v", tt.errField, body.Error.Fields)
+			}
+		})
+	}
+}
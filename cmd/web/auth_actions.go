@@ -65,6 +65,19 @@ func (app *application) callback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Household invitations are addressed by email, so only honour them once
+	// Auth0 has confirmed the user owns the address.
+	if profile.EmailVerified {
+		joined, err := app.db.AcceptHouseholdInvitations(r.Context(), user.ID, user.Email)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if joined > 0 {
+			app.logger.Info("household invitations accepted", "user_id", user.ID, "households", joined)
+		}
+	}
+
 	app.sessionManager.Put(r.Context(), "access_token", token.AccessToken)
 	app.sessionManager.Put(r.Context(), "profile", profile)
 	app.sessionManager.Put(r.Context(), "user_id", user.ID)
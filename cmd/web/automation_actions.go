@@ -0,0 +1,525 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/automation"
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+	"github.com/wumbabum/home_assist/internal/request"
+	"github.com/wumbabum/home_assist/internal/response"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+// automationTraceLimit is how many runs are shown on an automation's page.
+const automationTraceLimit = 20
+
+// automationEventTypes are the events an event trigger can be chosen to
+// match in the editor.
+var automationEventTypes = []string{
+	string(events.TypeStateChanged),
+	string(events.TypeDeviceAdded),
+	string(events.TypeAutomationTriggered),
+	string(events.TypeWebhookReceived),
+	string(events.TypeNotification),
+}
+
+// automationForm is the automation editor. Each trigger, condition and action
+// is a row of inputs named like Triggers[0].Type; rows left without a type are
+// ignored, which is how the blank row at the end of each list adds a new one.
+// Field errors use the keys of automation.Validate, such as "triggers.0.at".
+type automationForm struct {
+	ID         int64               `form:"ID"`
+	Name       string              `form:"Name"`
+	Enabled    bool                `form:"Enabled"`
+	Triggers   []triggerForm       `form:"Triggers"`
+	Conditions []conditionForm     `form:"Conditions"`
+	Actions    []actionForm        `form:"Actions"`
+	Validator  validator.Validator `form:"-"`
+}
+
+type triggerForm struct {
+	Type      string `form:"Type"`
+	DeviceID  int64  `form:"DeviceID"`
+	Attribute string `form:"Attribute"`
+	To        string `form:"To"`
+	At        string `form:"At"`
+	Cron      string `form:"Cron"`
+	Sun       string `form:"Sun"`
+	Offset    int    `form:"Offset"`
+	EventType string `form:"EventType"`
+	WebhookID string `form:"WebhookID"`
+}
+
+type conditionForm struct {
+	Type      string   `form:"Type"`
+	DeviceID  int64    `form:"DeviceID"`
+	Attribute string   `form:"Attribute"`
+	Value     string   `form:"Value"`
+	Above     string   `form:"Above"`
+	Below     string   `form:"Below"`
+	After     string   `form:"After"`
+	Before    string   `form:"Before"`
+	Weekdays  []string `form:"Weekdays"`
+	Present   string   `form:"Present"` // "true", "false" or empty
+}
+
+type actionForm struct {
+	Type     string `form:"Type"`
+	DeviceID int64  `form:"DeviceID"`
+	Command  string `form:"Command"`
+	Params   string `form:"Params"` // A JSON object
+	SceneID  int64  `form:"SceneID"`
+	Title    string `form:"Title"`
+	Message  string `form:"Message"`
+	Seconds  int    `form:"Seconds"`
+}
+
+func newAutomationForm(a *database.Automation) automationForm {
+	form := automationForm{ID: a.ID, Name: a.Name, Enabled: a.Enabled}
+
+	for _, t := range a.Triggers {
+		form.Triggers = append(form.Triggers, triggerForm{
+			Type:      t.Type,
+			DeviceID:  t.DeviceID,
+			Attribute: t.Attribute,
+			To:        formatFormValue(t.To),
+			At:        t.At,
+			Cron:      t.Cron,
+			Sun:       t.Sun,
+			Offset:    t.Offset,
+			EventType: t.EventType,
+			WebhookID: t.WebhookID,
+		})
+	}
+
+	for _, c := range a.Conditions {
+		row := conditionForm{
+			Type:      c.Type,
+			DeviceID:  c.DeviceID,
+			Attribute: c.Attribute,
+			Value:     formatFormValue(c.Value),
+			After:     c.After,
+			Before:    c.Before,
+			Weekdays:  c.Weekdays,
+		}
+		if c.Above != nil {
+			row.Above = strconv.FormatFloat(*c.Above, 'f', -1, 64)
+		}
+		if c.Below != nil {
+			row.Below = strconv.FormatFloat(*c.Below, 'f', -1, 64)
+		}
+		if c.Present != nil {
+			row.Present = strconv.FormatBool(*c.Present)
+		}
+		form.Conditions = append(form.Conditions, row)
+	}
+
+	for _, act := range a.Actions {
+		row := actionForm{
+			Type:     act.Type,
+			DeviceID: act.DeviceID,
+			Command:  act.Command,
+			SceneID:  act.SceneID,
+			Title:    act.Title,
+			Message:  act.Message,
+			Seconds:  act.Seconds,
+		}
+		if len(act.Params) > 0 {
+			params, _ := json.Marshal(act.Params)
+			row.Params = string(params)
+		}
+		form.Actions = append(form.Actions, row)
+	}
+
+	return form
+}
+
+// FieldError returns the error for a field of a row, e.g.
+// FieldError "triggers" 0 "at".
+func (f automationForm) FieldError(list string, i int, field string) string {
+	return f.Validator.FieldErrors[fmt.Sprintf("%s.%d.%s", list, i, field)]
+}
+
+// automation drops blank rows, then converts and validates the form. The
+// rows are compacted first so that row indexes match the field errors.
+func (f *automationForm) automation(householdID int64) *database.Automation {
+	f.Triggers = removeBlankRows(f.Triggers, func(t triggerForm) string { return t.Type })
+	f.Conditions = removeBlankRows(f.Conditions, func(c conditionForm) string { return c.Type })
+	f.Actions = removeBlankRows(f.Actions, func(a actionForm) string { return a.Type })
+
+	a := &database.Automation{
+		ID:          f.ID,
+		HouseholdID: householdID,
+		Name:        f.Name,
+		Enabled:     f.Enabled,
+		Triggers:    database.Triggers{},
+		Conditions:  database.Conditions{},
+		Actions:     database.Actions{},
+	}
+
+	for _, t := range f.Triggers {
+		a.Triggers = append(a.Triggers, database.Trigger{
+			Type:      t.Type,
+			DeviceID:  t.DeviceID,
+			Attribute: strings.TrimSpace(t.Attribute),
+			To:        parseFormValue(t.To),
+			At:        strings.TrimSpace(t.At),
+			Cron:      strings.TrimSpace(t.Cron),
+			Sun:       t.Sun,
+			Offset:    t.Offset,
+			EventType: t.EventType,
+			WebhookID: strings.TrimSpace(t.WebhookID),
+		})
+	}
+
+	for i, c := range f.Conditions {
+		condition := database.Condition{
+			Type:      c.Type,
+			DeviceID:  c.DeviceID,
+			Attribute: strings.TrimSpace(c.Attribute),
+			Value:     parseFormValue(c.Value),
+			After:     strings.TrimSpace(c.After),
+			Before:    strings.TrimSpace(c.Before),
+			Weekdays:  c.Weekdays,
+		}
+		condition.Above = f.parseNumber(c.Above, fmt.Sprintf("conditions.%d.above", i))
+		condition.Below = f.parseNumber(c.Below, fmt.Sprintf("conditions.%d.below", i))
+		if c.Present != "" {
+			present := c.Present == "true"
+			condition.Present = &present
+		}
+		a.Conditions = append(a.Conditions, condition)
+	}
+
+	for i, act := range f.Actions {
+		action := database.Action{
+			Type:     act.Type,
+			DeviceID: act.DeviceID,
+			Command:  strings.TrimSpace(act.Command),
+			SceneID:  act.SceneID,
+			Title:    act.Title,
+			Message:  act.Message,
+			Seconds:  act.Seconds,
+		}
+		if strings.TrimSpace(act.Params) != "" {
+			err := json.Unmarshal([]byte(act.Params), &action.Params)
+			f.Validator.CheckField(err == nil, fmt.Sprintf("actions.%d.params", i), `must be a JSON object such as {"brightness": 40}`)
+		}
+		a.Actions = append(a.Actions, action)
+	}
+
+	automation.Validate(&f.Validator, a)
+	return a
+}
+
+func (f *automationForm) parseNumber(s, key string) *float64 {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		f.Validator.AddFieldError(key, "must be a number")
+		return nil
+	}
+	return &n
+}
+
+func removeBlankRows[T any](rows []T, rowType func(T) string) []T {
+	var kept []T
+	for _, row := range rows {
+		if rowType(row) != "" {
+			kept = append(kept, row)
+		}
+	}
+	return kept
+}
+
+// parseFormValue converts a state value typed into the editor to the JSON
+// type devices report: booleans and numbers are recognised, anything else is
+// a string and an empty input means any value.
+func parseFormValue(s string) any {
+	s = strings.TrimSpace(s)
+
+	switch s {
+	case "":
+		return nil
+	case "true", "false":
+		return s == "true"
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err == nil {
+		return n
+	}
+	return s
+}
+
+func formatFormValue(v any) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func (app *application) listAutomations(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	automations, err := app.db.ListAutomations(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data["Automations"] = automations
+
+	err = response.Page(w, http.StatusOK, data, "pages/automations.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) showAutomation(w http.ResponseWriter, r *http.Request) {
+	a, ok := app.loadAutomation(w, r)
+	if !ok {
+		return
+	}
+
+	traces, err := app.db.ListAutomationTraces(r.Context(), a.HouseholdID, a.ID, automationTraceLimit)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data["Automation"] = a
+	data["Traces"] = traces
+
+	err = response.Page(w, http.StatusOK, data, "pages/automation.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) newAutomation(w http.ResponseWriter, r *http.Request) {
+	form := automationForm{Enabled: true}
+	app.renderAutomationForm(w, r, http.StatusOK, form, nil)
+}
+
+func (app *application) createAutomation(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	var form automationForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	form.ID = 0
+
+	a := form.automation(householdID)
+	err = app.validateSunTriggers(r.Context(), &form.Validator, a)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.validateWebhookTriggers(r.Context(), &form.Validator, a)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if form.Validator.HasErrors() {
+		app.renderAutomationForm(w, r, http.StatusUnprocessableEntity, form, nil)
+		return
+	}
+
+	err = app.db.CreateAutomation(r.Context(), a)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("automation created", "automation_id", a.ID, "household_id", a.HouseholdID)
+	app.automationsChanged(a.HouseholdID)
+
+	http.Redirect(w, r, "/automations/"+strconv.FormatInt(a.ID, 10), http.StatusSeeOther)
+}
+
+func (app *application) editAutomation(w http.ResponseWriter, r *http.Request) {
+	a, ok := app.loadAutomation(w, r)
+	if !ok {
+		return
+	}
+
+	app.renderAutomationForm(w, r, http.StatusOK, newAutomationForm(a), nil)
+}
+
+func (app *application) updateAutomation(w http.ResponseWriter, r *http.Request) {
+	existing, ok := app.loadAutomation(w, r)
+	if !ok {
+		return
+	}
+
+	var form automationForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	form.ID = existing.ID
+
+	a := form.automation(existing.HouseholdID)
+	err = app.validateSunTriggers(r.Context(), &form.Validator, a)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.validateWebhookTriggers(r.Context(), &form.Validator, a)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if form.Validator.HasErrors() {
+		app.renderAutomationForm(w, r, http.StatusUnprocessableEntity, form, nil)
+		return
+	}
+
+	err = app.db.UpdateAutomation(r.Context(), a)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.notFound(w, r)
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.automationsChanged(a.HouseholdID)
+
+	http.Redirect(w, r, "/automations/"+strconv.FormatInt(a.ID, 10), http.StatusSeeOther)
+}
+
+func (app *application) deleteAutomation(w http.ResponseWriter, r *http.Request) {
+	a, ok := app.loadAutomation(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.db.DeleteAutomation(r.Context(), a.HouseholdID, a.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("automation deleted", "automation_id", a.ID, "name", a.Name)
+	app.automationsChanged(a.HouseholdID)
+
+	http.Redirect(w, r, "/automations", http.StatusSeeOther)
+}
+
+// dryRunAutomation evaluates the automation in the editor, saved or not,
+// against the current state of its devices. Conditions are checked as if a
+// trigger had just fired, and the editor is shown again with the result so
+// that changes can be tried before saving.
+func (app *application) dryRunAutomation(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	var form automationForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	a := form.automation(householdID)
+	if form.Validator.HasErrors() {
+		app.renderAutomationForm(w, r, http.StatusUnprocessableEntity, form, nil)
+		return
+	}
+
+	run := app.automations.Execute(r.Context(), a, automation.Cause{Time: time.Now()}, true)
+
+	app.renderAutomationForm(w, r, http.StatusOK, form, run)
+}
+
+func (app *application) renderAutomationForm(w http.ResponseWriter, r *http.Request, status int, form automationForm, run *automation.Run) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	devices, err := app.db.ListDevices(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	scenes, err := app.db.ListScenes(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	action := "/automations/new"
+	if form.ID != 0 {
+		action = "/automations/" + strconv.FormatInt(form.ID, 10) + "/edit"
+	}
+
+	// A blank row at the end of each list adds a new trigger, condition or
+	// action when saved
+	form.Triggers = append(form.Triggers, triggerForm{})
+	form.Conditions = append(form.Conditions, conditionForm{})
+	form.Actions = append(form.Actions, actionForm{})
+
+	data := app.newTemplateData(r)
+	data["Form"] = form
+	data["Action"] = action
+	data["Devices"] = devices
+	data["Scenes"] = scenes
+	data["TriggerTypes"] = database.TriggerTypes
+	data["SunEvents"] = []string{database.Sunrise, database.Sunset}
+	data["ConditionTypes"] = database.ConditionTypes
+	data["ActionTypes"] = database.ActionTypes
+	data["EventTypes"] = automationEventTypes
+	data["Weekdays"] = automation.Weekdays
+	data["DryRun"] = run
+
+	err = response.Page(w, status, data, "pages/automation_form.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// loadAutomation fetches the automation identified by the {id} URL parameter.
+// If it cannot be loaded an error response is written and ok is false.
+func (app *application) loadAutomation(w http.ResponseWriter, r *http.Request) (a *database.Automation, ok bool) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	id, err := readIDParam(r)
+	if err != nil {
+		app.notFound(w, r)
+		return nil, false
+	}
+
+	a, err = app.db.GetAutomation(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.notFound(w, r)
+		return nil, false
+	case err != nil:
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	return a, true
+}
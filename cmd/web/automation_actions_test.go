@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/request"
+)
+
+func decodeAutomationForm(t *testing.T, values url.Values) automationForm {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/automations/new", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var form automationForm
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form
+}
+
+func TestAutomationForm(t *testing.T) {
+	form := decodeAutomationForm(t, url.Values{
+		"Name":                    {"Evening lights"},
+		"Enabled":                 {"true"},
+		"Triggers[0].Type":        {""},
+		"Triggers[1].Type":        {"state"},
+		"Triggers[1].DeviceID":    {"3"},
+		"Triggers[1].Attribute":   {"motion"},
+		"Triggers[1].To":          {"true"},
+		"Triggers[2].Type":        {"sun"},
+		"Triggers[2].Sun":         {"sunset"},
+		"Triggers[2].Offset":      {"-15"},
+		"Conditions[0].Type":      {"numeric"},
+		"Conditions[0].DeviceID":  {"4"},
+		"Conditions[0].Attribute": {"illuminance"},
+		"Conditions[0].Below":     {"30.5"},
+		"Conditions[1].Type":      {"time"},
+		"Conditions[1].After":     {"18:00"},
+		"Conditions[1].Weekdays":  {"fri", "sat"},
+		"Actions[0].Type":         {"device_command"},
+		"Actions[0].DeviceID":     {"5"},
+		"Actions[0].Command":      {"set_brightness"},
+		"Actions[0].Params":       {`{"brightness": 60}`},
+		"Actions[1].Type":         {""},
+	})
+
+	a := form.automation(1)
+	if form.Validator.HasErrors() {
+		t.Fatalf("unexpected errors %v", form.Validator.FieldErrors)
+	}
+
+	if !a.Enabled || a.HouseholdID != 1 || a.Name != "Evening lights" {
+		t.Errorf("unexpected automation %+v", a)
+	}
+	if len(a.Triggers) != 2 || a.Triggers[0].To != true || a.Triggers[0].DeviceID != 3 || a.Triggers[1].Offset != -15 {
+		t.Errorf("unexpected triggers %+v", a.Triggers)
+	}
+	if len(a.Conditions) != 2 || a.Conditions[0].Below == nil || *a.Conditions[0].Below != 30.5 || a.Conditions[0].Above != nil {
+		t.Errorf("unexpected conditions %+v", a.Conditions)
+	}
+	if len(a.Conditions[1].Weekdays) != 2 {
+		t.Errorf("expected 2 weekdays, got %v", a.Conditions[1].Weekdays)
+	}
+	if len(a.Actions) != 1 || a.Actions[0].Params["brightness"] != 60.0 {
+		t.Errorf("unexpected actions %+v", a.Actions)
+	}
+
+	// Saved automations fill the editor with the same values
+	again := newAutomationForm(a)
+	if again.Triggers[0].To != "true" || again.Conditions[0].Below != "30.5" || again.Actions[0].Params != `{"brightness":60}` {
+		t.Errorf("unexpected form %+v", again)
+	}
+}
+
+func TestAutomationFormErrors(t *testing.T) {
+	form := decodeAutomationForm(t, url.Values{
+		"Name":                    {""},
+		"Triggers[0].Type":        {""},
+		"Triggers[1].Type":        {"time"},
+		"Triggers[1].At":          {"noon"},
+		"Conditions[0].Type":      {"numeric"},
+		"Conditions[0].DeviceID":  {"4"},
+		"Conditions[0].Attribute": {"temperature"},
+		"Conditions[0].Above":     {"warm"},
+		"Actions[0].Type":         {"device_command"},
+		"Actions[0].DeviceID":     {"5"},
+		"Actions[0].Command":      {"turn_on"},
+		"Actions[0].Params":       {"brightness=60"},
+	})
+
+	form.automation(1)
+
+	// Blank rows are dropped before validation, so the time trigger is the
+	// first row when the editor is shown again
+	for _, key := range []string{"name", "triggers.0.at", "conditions.0.above", "actions.0.params"} {
+		if form.Validator.FieldErrors[key] == "" {
+			t.Errorf("expected an error for %s", key)
+		}
+	}
+	if form.FieldError("triggers", 0, "at") == "" {
+		t.Error("expected FieldError to find the trigger error")
+	}
+	if len(form.Triggers) != 1 || form.Triggers[0].At != "noon" {
+		t.Errorf("expected the time trigger to be kept, got %+v", form.Triggers)
+	}
+}
+
+func TestParseFormValue(t *testing.T) {
+	tests := []struct {
+		input string
+		want  any
+	}{
+		{"", nil},
+		{" true ", true},
+		{"false", false},
+		{"21.5", 21.5},
+		{"heat", "heat"},
+	}
+
+	for _, tt := range tests {
+		got := parseFormValue(tt.input)
+		if got != tt.want {
+			t.Errorf("parseFormValue(%q) = %v, expected %v", tt.input, got, tt.want)
+		}
+		if tt.want != nil && parseFormValue(formatFormValue(got)) != got {
+			t.Errorf("%v did not survive a round trip", got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/wumbabum/home_assist/internal/automation"
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+	"github.com/wumbabum/home_assist/internal/scheduler"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+// automationActuator carries out automation actions on behalf of the engine
+// using the same code paths as requests from users.
+type automationActuator struct {
+	app *application
+}
+
+func (a automationActuator) SendCommand(ctx context.Context, device *database.Device, command string, params map[string]any) error {
+	_, err := a.app.executeCommand(ctx, device, deviceCommand{Command: command, Params: params})
+	return err
+}
+
+func (a automationActuator) ActivateScene(ctx context.Context, householdID, sceneID int64) error {
+	scene, err := a.app.db.GetScene(ctx, householdID, sceneID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("scene %d does not exist", sceneID)
+	}
+	if err != nil {
+		return err
+	}
+
+	report, err := a.app.applyScene(ctx, scene)
+	if err != nil {
+		return err
+	}
+	if len(report.Failed()) > 0 {
+		return errors.New(report.Summary(scene.Name))
+	}
+	return nil
+}
+
+func (a automationActuator) Notify(ctx context.Context, automation *database.Automation, title, message string) error {
+	a.app.logger.Info("automation notification", "automation_id", automation.ID, "title", title, "message", message)
+
+	ev := events.NewNotification(automation.HouseholdID, events.Notification{
+		AutomationID: automation.ID,
+		Title:        title,
+		Message:      message,
+	})
+	ev.Origin = events.OriginFrom(ctx)
+	a.app.events.Publish(ev)
+	return nil
+}
+
+// runAutomations starts the automation engine. It stops when the server
+// starts shutting down, cutting short any delay actions in progress.
+func (app *application) runAutomations() {
+	app.automations = automation.NewEngine(app.db, automationActuator{app: app}, app.events, app.logger)
+
+	app.backgroundTask("automation engine", func() error {
+		ctx, cancel := app.shutdownContext()
+		defer cancel()
+
+		return app.automations.Run(ctx)
+	})
+}
+
+// runScheduler starts the scheduler that fires time, cron and sun triggers.
+// It starts after runAutomations so that the engine sees the first trigger.
+func (app *application) runScheduler() {
+	app.schedules = scheduler.New(app.db, app.events, app.logger)
+
+	app.backgroundTask("scheduler", func() error {
+		ctx, cancel := app.shutdownContext()
+		defer cancel()
+
+		return app.schedules.Run(ctx)
+	})
+}
+
+// automationsChanged makes the engine and the scheduler read the automations
+// of a household again, after one has been saved or deleted.
+func (app *application) automationsChanged(householdID int64) {
+	app.automations.Reload(householdID)
+	app.schedules.Reload()
+}
+
+// validateSunTriggers checks that the household of an automation with sun
+// triggers has the latitude and longitude needed to compute them.
+func (app *application) validateSunTriggers(ctx context.Context, v *validator.Validator, a *database.Automation) error {
+	var household *database.Household
+
+	for i, t := range a.Triggers {
+		if t.Type != database.TriggerSun {
+			continue
+		}
+
+		if household == nil {
+			var err error
+			household, err = app.db.GetHousehold(ctx, a.HouseholdID)
+			if err != nil {
+				return err
+			}
+		}
+
+		hasLocation := household.Latitude != nil && household.Longitude != nil
+		v.CheckField(hasLocation, fmt.Sprintf("triggers.%d.sun", i), "needs the latitude and longitude of the household")
+	}
+
+	return nil
+}
+
+// validateWebhookTriggers checks that no other automation, in any household,
+// uses the webhook IDs of an automation. The ID alone picks the automation a
+// webhook fires, so a shared one would let a household take over another's.
+func (app *application) validateWebhookTriggers(ctx context.Context, v *validator.Validator, a *database.Automation) error {
+	for i, t := range a.Triggers {
+		if t.Type != database.TriggerWebhook || t.WebhookID == "" {
+			continue
+		}
+
+		inUse, err := app.db.WebhookIDInUse(ctx, t.WebhookID, a.ID)
+		if err != nil {
+			return err
+		}
+		v.CheckField(!inUse, fmt.Sprintf("triggers.%d.webhook_id", i), "is already used by another automation")
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/broker"
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+// brokerAuthenticator lets clients of the embedded MQTT broker sign in with
+// an API token as their password, with the same checks as the JSON API.
+type brokerAuthenticator struct {
+	app *application
+}
+
+func (a brokerAuthenticator) AuthenticateMQTT(ctx context.Context, password string) (*database.HouseholdMember, error) {
+	if !strings.HasPrefix(password, apiTokenPrefix) {
+		return nil, broker.ErrInvalidCredentials
+	}
+
+	token, err := a.app.db.AuthenticateAPIToken(ctx, hashAPIToken(password))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, broker.ErrInvalidCredentials
+	case err != nil:
+		return nil, err
+	}
+
+	// The owner may have left the household since the token was created
+	member, err := a.app.db.GetHouseholdMember(ctx, token.HouseholdID, token.UserID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, broker.ErrInvalidCredentials
+	case err != nil:
+		return nil, err
+	}
+
+	return scopeMember(member, token.Scopes), nil
+}
+
+// startBroker starts the embedded MQTT broker when it is enabled. Unless
+// another broker is configured, the MQTT client connects to it.
+func (app *application) startBroker() error {
+	if !app.config.broker.enabled {
+		return nil
+	}
+
+	b, err := broker.New(broker.Config{Address: app.config.broker.address}, brokerAuthenticator{app: app}, app.db, app.logger)
+	if err != nil {
+		return err
+	}
+
+	err = b.Start()
+	if err != nil {
+		return err
+	}
+	app.broker = b
+
+	app.logger.Info("started MQTT broker", "addr", b.Addr())
+
+	if app.config.mqtt.broker == "" {
+		app.config.mqtt.broker = b.LocalURL()
+		app.config.mqtt.username = broker.SystemUsername
+		app.config.mqtt.password = b.SystemPassword()
+		app.config.mqtt.embedded = true
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+	"github.com/wumbabum/home_assist/internal/integrations"
+)
+
+// deviceCommand asks a device to change state, e.g.
+// {"command": "set_brightness", "params": {"brightness": 40}}.
+type deviceCommand struct {
+	Command string         `json:"command"`
+	Params  map[string]any `json:"params,omitempty"`
+}
+
+// commandForm is the HTML form flavour of deviceCommand, where the single
+// Value field is mapped to the parameter the command expects.
+type commandForm struct {
+	Command string `form:"Command"`
+	Value   string `form:"Value"`
+}
+
+var commandStringParams = map[string]string{
+	"set_color":   "color",
+	"set_effect":  "effect",
+	"set_palette": "palette",
+}
+
+var commandValueParams = map[string]string{
+	"set_brightness":         "brightness",
+	"set_color_temperature":  "kelvin",
+	"set_position":           "position",
+	"set_preset":             "preset",
+	"set_target_temperature": "temperature",
+}
+
+func (f commandForm) deviceCommand() (deviceCommand, error) {
+	cmd := deviceCommand{Command: f.Command}
+
+	if param, ok := commandStringParams[f.Command]; ok {
+		cmd.Params = map[string]any{param: f.Value}
+		return cmd, nil
+	}
+
+	if param, ok := commandValueParams[f.Command]; ok {
+		value, err := strconv.ParseFloat(f.Value, 64)
+		if err != nil {
+			return cmd, newCommandError("%s must be a number", param)
+		}
+		cmd.Params = map[string]any{param: value}
+	}
+
+	return cmd, nil
+}
+
+// commandError reports a command that is malformed or not supported by the
+// device it was sent to.
+type commandError struct {
+	message string
+}
+
+func (e *commandError) Error() string {
+	return e.message
+}
+
+func newCommandError(format string, args ...any) error {
+	return &commandError{message: fmt.Sprintf(format, args...)}
+}
+
+var rgxHexColor = regexp.MustCompile("^#[0-9a-fA-F]{6}$")
+
+// stateForCommand translates a command into the state change it requests,
+// checking it against the capabilities of the device.
+func stateForCommand(device *database.Device, cmd deviceCommand) (database.DeviceState, error) {
+	require := func(capability string) error {
+		if !device.HasCapability(capability) {
+			return newCommandError("device does not support %s", capability)
+		}
+		return nil
+	}
+
+	switch cmd.Command {
+	case "turn_on", "turn_off":
+		if err := require("on_off"); err != nil {
+			return nil, err
+		}
+		return database.DeviceState{"on": cmd.Command == "turn_on"}, nil
+
+	case "toggle":
+		if err := require("on_off"); err != nil {
+			return nil, err
+		}
+		on, _ := device.State["on"].(bool)
+		return database.DeviceState{"on": !on}, nil
+
+	case "set_brightness":
+		if err := require("brightness"); err != nil {
+			return nil, err
+		}
+		brightness, err := numberParam(cmd.Params, "brightness", 0, 100)
+		if err != nil {
+			return nil, err
+		}
+		return database.DeviceState{"brightness": brightness, "on": brightness > 0}, nil
+
+	case "set_color":
+		if err := require("color"); err != nil {
+			return nil, err
+		}
+		color, _ := cmd.Params["color"].(string)
+		if !rgxHexColor.MatchString(color) {
+			return nil, newCommandError("params.color must be a hex color such as #ff8800")
+		}
+		return database.DeviceState{"color": color, "on": true}, nil
+
+	case "set_color_temperature":
+		if err := require("color_temperature"); err != nil {
+			return nil, err
+		}
+		kelvin, err := numberParam(cmd.Params, "kelvin", 1500, 9000)
+		if err != nil {
+			return nil, err
+		}
+		return database.DeviceState{"color_temperature": kelvin, "on": true}, nil
+
+	case "set_effect", "set_palette":
+		if err := require("effect"); err != nil {
+			return nil, err
+		}
+		attr := strings.TrimPrefix(cmd.Command, "set_")
+		name, _ := cmd.Params[attr].(string)
+		if strings.TrimSpace(name) == "" {
+			return nil, newCommandError("params.%s must be the name of the %s", attr, attr)
+		}
+		return database.DeviceState{attr: name, "on": true}, nil
+
+	case "set_preset":
+		if err := require("preset"); err != nil {
+			return nil, err
+		}
+		preset, err := numberParam(cmd.Params, "preset", 1, 250)
+		if err != nil {
+			return nil, err
+		}
+		if preset != math.Trunc(preset) {
+			return nil, newCommandError("params.preset must be a whole number")
+		}
+		return database.DeviceState{"preset": preset}, nil
+
+	case "set_position":
+		if err := require("position"); err != nil {
+			return nil, err
+		}
+		position, err := numberParam(cmd.Params, "position", 0, 100)
+		if err != nil {
+			return nil, err
+		}
+		return database.DeviceState{"position": position}, nil
+
+	case "set_target_temperature":
+		if device.Kind != "thermostat" {
+			return nil, newCommandError("device is not a thermostat")
+		}
+		temperature, err := numberParam(cmd.Params, "temperature", 5, 35)
+		if err != nil {
+			return nil, err
+		}
+		return database.DeviceState{"target_temperature": temperature}, nil
+
+	case "lock", "unlock":
+		if err := require("lock"); err != nil {
+			return nil, err
+		}
+		return database.DeviceState{"locked": cmd.Command == "lock"}, nil
+
+	case "":
+		return nil, newCommandError("command must be provided")
+
+	default:
+		return nil, newCommandError("unknown command %q", cmd.Command)
+	}
+}
+
+func numberParam(params map[string]any, key string, min, max float64) (float64, error) {
+	value, ok := params[key].(float64)
+	if !ok {
+		return 0, newCommandError("params.%s must be a number", key)
+	}
+	if value < min || value > max {
+		return 0, newCommandError("params.%s must be between %g and %g", key, min, max)
+	}
+	return value, nil
+}
+
+// executeCommand applies a command to a device and returns the device with
+// its updated state. Errors of type *commandError mean the command was
+// rejected. Devices of an integration are sent the command through it, and
+// their state is updated optimistically until they report it.
+func (app *application) executeCommand(ctx context.Context, device *database.Device, cmd deviceCommand) (*database.Device, error) {
+	state, err := stateForCommand(device, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if integration, ok := integrations.Default.Get(device.Protocol); ok {
+		err = app.handleCommand(ctx, integration, device, state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	updated, err := app.db.UpdateDeviceState(ctx, device.HouseholdID, device.ID, state)
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger.Info("device command executed", "device_id", device.ID, "command", cmd.Command)
+
+	// Commands sent by an automation carry its run, so automations cannot
+	// keep firing each other
+	ev := events.NewStateChanged(updated.HouseholdID, events.StateChanged{
+		DeviceID: updated.ID,
+		State:    updated.State,
+		Changes:  state,
+	})
+	ev.Origin = events.OriginFrom(ctx)
+	app.events.Publish(ev)
+
+	return updated, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+func TestStateForCommand(t *testing.T) {
+	light := &database.Device{
+		Kind:         "light",
+		Capabilities: []string{"on_off", "brightness", "color", "effect"},
+		State:        database.DeviceState{"on": true},
+	}
+
+	tests := []struct {
+		name     string
+		cmd      deviceCommand
+		expected database.DeviceState
+		wantErr  bool
+	}{
+		{"turn off", deviceCommand{Command: "turn_off"}, database.DeviceState{"on": false}, false},
+		{"toggle", deviceCommand{Command: "toggle"}, database.DeviceState{"on": false}, false},
+		{"brightness", deviceCommand{Command: "set_brightness", Params: map[string]any{"brightness": 40.0}}, database.DeviceState{"on": true, "brightness": 40.0}, false},
+		{"brightness zero turns off", deviceCommand{Command: "set_brightness", Params: map[string]any{"brightness": 0.0}}, database.DeviceState{"on": false, "brightness": 0.0}, false},
+		{"brightness out of range", deviceCommand{Command: "set_brightness", Params: map[string]any{"brightness": 140.0}}, nil, true},
+		{"brightness not a number", deviceCommand{Command: "set_brightness", Params: map[string]any{"brightness": "high"}}, nil, true},
+		{"color", deviceCommand{Command: "set_color", Params: map[string]any{"color": "#ff8800"}}, database.DeviceState{"on": true, "color": "#ff8800"}, false},
+		{"bad color", deviceCommand{Command: "set_color", Params: map[string]any{"color": "orange"}}, nil, true},
+		{"effect", deviceCommand{Command: "set_effect", Params: map[string]any{"effect": "Rainbow"}}, database.DeviceState{"on": true, "effect": "Rainbow"}, false},
+		{"palette", deviceCommand{Command: "set_palette", Params: map[string]any{"palette": "Party"}}, database.DeviceState{"on": true, "palette": "Party"}, false},
+		{"missing effect", deviceCommand{Command: "set_effect"}, nil, true},
+		{"unsupported capability", deviceCommand{Command: "lock"}, nil, true},
+		{"presets unsupported", deviceCommand{Command: "set_preset", Params: map[string]any{"preset": 2.0}}, nil, true},
+		{"not a thermostat", deviceCommand{Command: "set_target_temperature", Params: map[string]any{"temperature": 21.0}}, nil, true},
+		{"unknown", deviceCommand{Command: "explode"}, nil, true},
+		{"missing", deviceCommand{}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := stateForCommand(light, tt.cmd)
+
+			if tt.wantErr {
+				var cmdErr *commandError
+				if !errors.As(err, &cmdErr) {
+					t.Fatalf("expected *commandError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(state) != len(tt.expected) {
+				t.Fatalf("expected state %v, got %v", tt.expected, state)
+			}
+			for key, value := range tt.expected {
+				if state[key] != value {
+					t.Errorf("expected %s=%v, got %v", key, value, state[key])
+				}
+			}
+		})
+	}
+}
+
+func TestCommandFormDeviceCommand(t *testing.T) {
+	cmd, err := commandForm{Command: "set_brightness", Value: "55"}.deviceCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Params["brightness"] != 55.0 {
+		t.Errorf("expected brightness param 55, got %v", cmd.Params["brightness"])
+	}
+
+	_, err = commandForm{Command: "set_position", Value: "half"}.deviceCommand()
+	if err == nil {
+		t.Error("expected error for non-numeric value")
+	}
+
+	cmd, err = commandForm{Command: "turn_on"}.deviceCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Params != nil {
+		t.Errorf("expected no params, got %v", cmd.Params)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+type contextKey string
+
+const householdMemberContextKey = contextKey("householdMember")
+
+func contextSetHouseholdMember(r *http.Request, member *database.HouseholdMember) *http.Request {
+	ctx := context.WithValue(r.Context(), householdMemberContextKey, member)
+	return r.WithContext(ctx)
+}
+
+// contextGetHouseholdMember returns the active household membership of the
+// current user, or nil outside of routes wrapped by loadHousehold.
+func contextGetHouseholdMember(r *http.Request) *database.HouseholdMember {
+	member, ok := r.Context().Value(householdMemberContextKey).(*database.HouseholdMember)
+	if !ok {
+		return nil
+	}
+	return member
+}
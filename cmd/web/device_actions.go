@@ -0,0 +1,456 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+	"github.com/wumbabum/home_assist/internal/integrations"
+	"github.com/wumbabum/home_assist/internal/integrations/hue"
+	"github.com/wumbabum/home_assist/internal/integrations/mqtt"
+	"github.com/wumbabum/home_assist/internal/integrations/shelly"
+	"github.com/wumbabum/home_assist/internal/integrations/wled"
+	"github.com/wumbabum/home_assist/internal/integrations/zigbee2mqtt"
+	"github.com/wumbabum/home_assist/internal/request"
+	"github.com/wumbabum/home_assist/internal/response"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+type deviceForm struct {
+	Name         string              `form:"Name"`
+	RoomID       int64               `form:"RoomID"`
+	Kind         string              `form:"Kind"`
+	Protocol     string              `form:"Protocol"`
+	Address      string              `form:"Address"`
+	Capabilities []string            `form:"Capabilities"`
+	Config       string              `form:"Config"` // A JSON object of protocol specific settings
+	Validator    validator.Validator `form:"-"`
+}
+
+// config decodes the Config field, which may be left blank.
+func (f *deviceForm) config() (database.DeviceConfig, error) {
+	config := database.DeviceConfig{}
+	if strings.TrimSpace(f.Config) == "" {
+		return config, nil
+	}
+
+	err := json.Unmarshal([]byte(f.Config), &config)
+	if err != nil || config == nil {
+		return nil, errors.New("config must be a JSON object")
+	}
+	return config, nil
+}
+
+// validate checks the form for a device of householdID, which must have
+// enabled the integration of the device's protocol in its entries. On the
+// embedded broker, where householdTopics is set, MQTT devices must use the
+// topics of their household.
+func (f *deviceForm) validate(rooms []database.Room, entries []database.IntegrationEntry, householdID int64, householdTopics bool) {
+	f.Validator.CheckField(validator.NotBlank(f.Name), "Name", "Name is required")
+	f.Validator.CheckField(validator.MaxRunes(f.Name, database.MaxDeviceNameRunes), "Name", "Name must not be more than "+strconv.Itoa(database.MaxDeviceNameRunes)+" characters")
+	f.Validator.CheckField(validator.In(f.Kind, database.DeviceKinds...), "Kind", "Kind is not supported")
+	f.Validator.CheckField(validator.In(f.Protocol, database.DeviceProtocols...), "Protocol", "Protocol is not supported")
+	f.Validator.CheckField(validator.MaxRunes(f.Address, 255), "Address", "Address must not be more than 255 characters")
+	f.Validator.CheckField(validator.AllIn(f.Capabilities, database.DeviceCapabilities...), "Capabilities", "Capabilities contain an unsupported value")
+	f.Validator.CheckField(validator.NoDuplicates(f.Capabilities), "Capabilities", "Capabilities must not contain duplicates")
+
+	roomIDs := []int64{0}
+	for _, room := range rooms {
+		roomIDs = append(roomIDs, room.ID)
+	}
+	f.Validator.CheckField(validator.In(f.RoomID, roomIDs...), "RoomID", "Room does not exist")
+
+	// Integrations only follow and control the devices of households that
+	// enabled them
+	if integration, ok := integrations.Default.Get(f.Protocol); ok {
+		enabled := slices.ContainsFunc(entries, func(entry database.IntegrationEntry) bool {
+			return entry.Integration == integration.Name() && entry.Enabled
+		})
+		f.Validator.CheckField(enabled, "Protocol", "Add and enable the "+integration.Title()+" integration first")
+	}
+
+	config, err := f.config()
+	if err != nil {
+		f.Validator.AddFieldError("Config", "Config must be a JSON object")
+		return
+	}
+
+	// MQTT devices without a topic are saved but not subscribed to
+	if f.Protocol == mqtt.Protocol && (f.Address != "" || len(config) > 0) {
+		device := database.Device{Kind: f.Kind, Address: f.Address, Capabilities: f.Capabilities, Config: config}
+		cfg, err := mqtt.ParseDeviceConfig(&device)
+		if err != nil {
+			f.Validator.AddFieldError("Config", err.Error())
+			return
+		}
+
+		if householdTopics {
+			var topicErr *mqtt.TopicError
+			err := mqtt.CheckHouseholdTopics(householdID, cfg, f.Address)
+			switch {
+			case errors.As(err, &topicErr) && topicErr.Topic == f.Address:
+				f.Validator.AddFieldError("Address", "Address must be a topic below "+topicErr.HouseholdTopic)
+			case errors.As(err, &topicErr):
+				f.Validator.AddFieldError("Config", "Topic "+topicErr.Topic+" must be below "+topicErr.HouseholdTopic)
+			}
+		}
+	}
+
+	if f.Protocol == shelly.Protocol {
+		if integrations.CheckAddress(f.Address) != nil {
+			f.Validator.AddFieldError("Address", "Address must be the relay's host name or IP address, optionally followed by a port")
+			return
+		}
+
+		device := database.Device{Address: f.Address, Config: config}
+		_, err := shelly.ParseDeviceConfig(&device)
+		if err != nil {
+			f.Validator.AddFieldError("Config", err.Error())
+		}
+	}
+
+	if f.Protocol == wled.Protocol {
+		if integrations.CheckAddress(f.Address) != nil {
+			f.Validator.AddFieldError("Address", "Address must be the controller's host name or IP address, optionally followed by a port")
+			return
+		}
+
+		device := database.Device{Address: f.Address, Config: config}
+		_, err := wled.ParseDeviceConfig(&device)
+		if err != nil {
+			f.Validator.AddFieldError("Config", err.Error())
+		}
+	}
+
+	// Hue lights are normally imported from their bridge
+	if f.Protocol == hue.Protocol {
+		device := database.Device{Address: f.Address, Config: config}
+		_, err := hue.ParseDeviceConfig(&device)
+		if err != nil {
+			f.Validator.AddFieldError("Config", err.Error())
+		}
+	}
+}
+
+func (f *deviceForm) apply(device *database.Device) {
+	device.Name = f.Name
+	device.RoomID = optionalID(f.RoomID)
+	device.Kind = f.Kind
+	device.Protocol = f.Protocol
+	device.Address = f.Address
+	device.Capabilities = f.Capabilities
+	device.Config, _ = f.config()
+}
+
+func (app *application) listDevices(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	devices, err := app.db.ListDevices(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data["Devices"] = devices
+
+	if bridges, ok := app.zigbeeBridges(); ok {
+		if bridge, ok := bridges.Bridge(householdID); ok {
+			data["Zigbee"] = bridge
+		}
+	}
+
+	err = response.Page(w, http.StatusOK, data, "pages/devices.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) showDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.loadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data["Device"] = device
+
+	if device.RoomID != nil {
+		room, err := app.db.GetRoom(r.Context(), device.HouseholdID, *device.RoomID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		data["Room"] = room
+	}
+
+	// The effects and palettes are known once the controller has been
+	// connected to
+	if lister, ok := app.integrations[device.Protocol].(integrations.EffectLister); ok && device.HasCapability("effect") {
+		data["Effects"] = lister.Effects(device)
+	}
+
+	err := response.Page(w, http.StatusOK, data, "pages/device.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) newDevice(w http.ResponseWriter, r *http.Request) {
+	form := deviceForm{Kind: "light", Protocol: "mqtt"}
+	app.renderDeviceForm(w, r, http.StatusOK, "/devices/new", form)
+}
+
+func (app *application) createDevice(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	var form deviceForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	rooms, err := app.db.ListRooms(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	entries, err := app.db.ListIntegrationEntries(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	form.validate(rooms, entries, householdID, app.config.mqtt.embedded)
+	if form.Validator.HasErrors() {
+		app.renderDeviceForm(w, r, http.StatusUnprocessableEntity, "/devices/new", form)
+		return
+	}
+
+	device := database.Device{HouseholdID: householdID}
+	form.apply(&device)
+
+	err = app.db.CreateDevice(r.Context(), &device)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("device created", "device_id", device.ID, "name", device.Name)
+	app.reloadDevices()
+
+	app.events.Publish(events.NewDeviceAdded(device.HouseholdID, events.DeviceAdded{
+		DeviceID: device.ID,
+		Name:     device.Name,
+		Kind:     device.Kind,
+		Protocol: device.Protocol,
+	}))
+
+	http.Redirect(w, r, "/devices/"+strconv.FormatInt(device.ID, 10), http.StatusSeeOther)
+}
+
+func (app *application) editDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.loadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	form := deviceForm{
+		Name:         device.Name,
+		Kind:         device.Kind,
+		Protocol:     device.Protocol,
+		Address:      device.Address,
+		Capabilities: device.Capabilities,
+	}
+	if len(device.Config) > 0 {
+		config, err := json.MarshalIndent(device.Config, "", "  ")
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		form.Config = string(config)
+	}
+	if device.RoomID != nil {
+		form.RoomID = *device.RoomID
+	}
+	app.renderDeviceForm(w, r, http.StatusOK, deviceEditPath(device), form)
+}
+
+func (app *application) updateDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.loadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	var form deviceForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	rooms, err := app.db.ListRooms(r.Context(), device.HouseholdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	entries, err := app.db.ListIntegrationEntries(r.Context(), device.HouseholdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	form.validate(rooms, entries, device.HouseholdID, app.config.mqtt.embedded)
+	if form.Validator.HasErrors() {
+		app.renderDeviceForm(w, r, http.StatusUnprocessableEntity, deviceEditPath(device), form)
+		return
+	}
+
+	// A Zigbee2MQTT device's name is also its name on the bridge, which
+	// updates the device's topics once it has renamed it
+	bridges, ok := app.zigbeeBridges()
+	rename := ok && form.Name != device.Name && zigbee2mqtt.IEEEAddress(device) != ""
+	if rename {
+		err := zigbee2mqtt.CheckName(form.Name)
+		if err != nil {
+			form.Validator.AddFieldError("Name", "Name "+err.Error())
+			app.renderDeviceForm(w, r, http.StatusUnprocessableEntity, deviceEditPath(device), form)
+			return
+		}
+	}
+
+	before := *device
+	form.apply(device)
+
+	err = app.db.UpdateDevice(r.Context(), device)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.reloadDevices()
+
+	// The bridge is only asked once the new name is saved, as it renames
+	// the device straight away
+	if rename {
+		err := bridges.Rename(r.Context(), &before, form.Name)
+		if err != nil {
+			app.logger.Warn("failed to rename device on Zigbee2MQTT bridge", "device_id", device.ID, "error", err)
+			app.sessionManager.Put(r.Context(), "flash", "The device was saved, but could not be renamed on the Zigbee2MQTT bridge.")
+		}
+	}
+
+	http.Redirect(w, r, "/devices/"+strconv.FormatInt(device.ID, 10), http.StatusSeeOther)
+}
+
+func (app *application) deleteDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.loadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.db.DeleteDevice(r.Context(), device.HouseholdID, device.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("device deleted", "device_id", device.ID, "name", device.Name)
+	app.reloadDevices()
+
+	http.Redirect(w, r, "/devices", http.StatusSeeOther)
+}
+
+func (app *application) controlDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.loadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	var form commandForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	cmd, err := form.deviceCommand()
+	if err == nil {
+		_, err = app.executeCommand(r.Context(), device, cmd)
+	}
+
+	var cmdErr *commandError
+	switch {
+	case errors.As(err, &cmdErr):
+		app.badRequest(w, r, err)
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/devices/"+strconv.FormatInt(device.ID, 10), http.StatusSeeOther)
+}
+
+func (app *application) renderDeviceForm(w http.ResponseWriter, r *http.Request, status int, action string, form deviceForm) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	rooms, err := app.db.ListRooms(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data["Form"] = form
+	data["Action"] = action
+	data["Kinds"] = database.DeviceKinds
+	data["Protocols"] = database.DeviceProtocols
+	data["Capabilities"] = database.DeviceCapabilities
+	data["Rooms"] = rooms
+
+	err = response.Page(w, status, data, "pages/device_form.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// loadDevice fetches the device identified by the {id} URL parameter. If it
+// cannot be loaded an error response is written and ok is false.
+func (app *application) loadDevice(w http.ResponseWriter, r *http.Request) (device *database.Device, ok bool) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	id, err := readIDParam(r)
+	if err != nil {
+		app.notFound(w, r)
+		return nil, false
+	}
+
+	device, err = app.db.GetDevice(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.notFound(w, r)
+		return nil, false
+	case err != nil:
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	return device, true
+}
+
+func deviceEditPath(device *database.Device) string {
+	return "/devices/" + strconv.FormatInt(device.ID, 10) + "/edit"
+}
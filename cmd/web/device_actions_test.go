@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+// enabledEntries enables the integrations of the protocols tested.
+var enabledEntries = []database.IntegrationEntry{
+	{Integration: "mqtt", Enabled: true},
+	{Integration: "shelly", Enabled: true},
+	{Integration: "wled", Enabled: true},
+	{Integration: "hue", Enabled: true},
+}
+
+func TestDeviceFormValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		form       deviceForm
+		errorField string
+	}{
+		{"valid", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Capabilities: []string{"on_off"}}, ""},
+		{"blank name", deviceForm{Name: " ", Kind: "light", Protocol: "mqtt"}, "Name"},
+		{"unknown kind", deviceForm{Name: "Lamp", Kind: "toaster", Protocol: "mqtt"}, "Kind"},
+		{"unknown protocol", deviceForm{Name: "Lamp", Kind: "light", Protocol: "carrier-pigeon"}, "Protocol"},
+		{"unknown capability", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Capabilities: []string{"teleport"}}, "Capabilities"},
+		{"unknown room", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", RoomID: 99}, "RoomID"},
+		{"duplicate capability", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Capabilities: []string{"on_off", "on_off"}}, "Capabilities"},
+		{"mqtt config", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Address: "zigbee2mqtt/lamp", Config: `{"brightness_scale": 254}`}, ""},
+		{"config not an object", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Config: `["zigbee2mqtt/lamp"]`}, "Config"},
+		{"invalid mqtt config", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Address: "zigbee2mqtt/#"}, "Config"},
+		{"shelly relay", deviceForm{Name: "Heater", Kind: "switch", Protocol: "shelly", Address: "192.168.1.20", Config: `{"channel": 1}`}, ""},
+		{"shelly without address", deviceForm{Name: "Heater", Kind: "switch", Protocol: "shelly"}, "Address"},
+		{"invalid shelly config", deviceForm{Name: "Heater", Kind: "switch", Protocol: "shelly", Address: "192.168.1.20", Config: `{"channel": -1}`}, "Config"},
+		{"wled strip", deviceForm{Name: "Desk strip", Kind: "light", Protocol: "wled", Address: "wled-desk.local", Capabilities: []string{"on_off", "effect"}}, ""},
+		{"invalid wled address", deviceForm{Name: "Desk strip", Kind: "light", Protocol: "wled", Address: "http://wled-desk.local/"}, "Address"},
+		{"hue light", deviceForm{Name: "Lamp", Kind: "light", Protocol: "hue", Address: "3f1b2d9e-6a1c-4f55-9c3e-8d2b7a1e0f42", Config: `{"bridge_id": "001788fffe123456"}`}, ""},
+		{"hue light without bridge", deviceForm{Name: "Lamp", Kind: "light", Protocol: "hue", Address: "3f1b2d9e-6a1c-4f55-9c3e-8d2b7a1e0f42"}, "Config"},
+		{"unknown mqtt setting", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Address: "lamp", Config: `{"topic": "lamp"}`}, "Config"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.validate([]database.Room{{ID: 1, Name: "Kitchen"}}, enabledEntries, 1, false)
+
+			if tt.errorField == "" {
+				if tt.form.Validator.HasErrors() {
+					t.Errorf("expected no errors, got %v", tt.form.Validator.FieldErrors)
+				}
+				return
+			}
+
+			if _, ok := tt.form.Validator.FieldErrors[tt.errorField]; !ok {
+				t.Errorf("expected error for field %s, got %v", tt.errorField, tt.form.Validator.FieldErrors)
+			}
+		})
+	}
+}
+
+func TestDeviceFormValidateHouseholdTopics(t *testing.T) {
+	tests := []struct {
+		name       string
+		form       deviceForm
+		errorField string
+	}{
+		{"own household", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Address: "households/1/lamp", Config: `{"command_topic": "households/1/lamp/set"}`}, ""},
+		{"no topic", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt"}, ""},
+		{"address of another household", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Address: "households/2/lamp"}, "Address"},
+		{"address outside households", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Address: "zigbee2mqtt/lamp"}, "Address"},
+		{"prefix of another household", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Address: "households/10/lamp"}, "Address"},
+		{"state topic of another household", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Address: "households/1/lamp", Config: `{"state_topic": "households/2/lamp"}`}, "Config"},
+		{"command topic of another household", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Address: "households/1/lamp", Config: `{"command_topic": "households/2/lamp/set"}`}, "Config"},
+		{"attribute topic of another household", deviceForm{Name: "Plug", Kind: "outlet", Protocol: "mqtt", Address: "households/1/plug", Config: `{"attributes": {"power": {"path": "$", "state_topic": "households/2/plug/power"}}}`}, "Config"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.validate(nil, enabledEntries, 1, true)
+
+			if tt.errorField == "" {
+				if tt.form.Validator.HasErrors() {
+					t.Errorf("expected no errors, got %v", tt.form.Validator.FieldErrors)
+				}
+				return
+			}
+
+			if _, ok := tt.form.Validator.FieldErrors[tt.errorField]; !ok {
+				t.Errorf("expected error for field %s, got %v", tt.errorField, tt.form.Validator.FieldErrors)
+			}
+		})
+	}
+}
+
+func TestDeviceFormValidateIntegration(t *testing.T) {
+	entries := []database.IntegrationEntry{
+		{Integration: "shelly", Enabled: true},
+		{Integration: "wled", Enabled: false},
+	}
+
+	tests := []struct {
+		name       string
+		form       deviceForm
+		errorField string
+	}{
+		{"enabled", deviceForm{Name: "Heater", Kind: "switch", Protocol: "shelly", Address: "192.168.1.20"}, ""},
+		{"disabled", deviceForm{Name: "Desk strip", Kind: "light", Protocol: "wled", Address: "wled-desk.local"}, "Protocol"},
+		{"not added", deviceForm{Name: "Lamp", Kind: "light", Protocol: "mqtt", Address: "lamp"}, "Protocol"},
+		{"without integration", deviceForm{Name: "Lamp", Kind: "light", Protocol: "virtual"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.validate(nil, entries, 1, false)
+
+			if tt.errorField == "" {
+				if tt.form.Validator.HasErrors() {
+					t.Errorf("expected no errors, got %v", tt.form.Validator.FieldErrors)
+				}
+				return
+			}
+
+			if _, ok := tt.form.Validator.FieldErrors[tt.errorField]; !ok {
+				t.Errorf("expected error for field %s, got %v", tt.errorField, tt.form.Validator.FieldErrors)
+			}
+		})
+	}
+}
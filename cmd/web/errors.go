@@ -1,9 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"log/slog"
 	"net/http"
 	"runtime/debug"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/response"
+	"github.com/wumbabum/home_assist/internal/validator"
 )
 
 func (app *application) reportServerError(r *http.Request, err error) {
@@ -18,6 +23,11 @@ func (app *application) reportServerError(r *http.Request, err error) {
 	app.logger.Error(message, requestAttrs, "trace", trace)
 }
 
+func (app *application) reportBackgroundError(task string, err error) {
+	trace := string(debug.Stack())
+	app.logger.Error(err.Error(), "task", task, "trace", trace)
+}
+
 func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
 	app.reportServerError(r, err)
 
@@ -29,3 +39,77 @@ func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
 	message := "The requested resource could not be found"
 	http.Error(w, message, http.StatusNotFound)
 }
+
+func (app *application) forbidden(w http.ResponseWriter, r *http.Request) {
+	message := "You do not have permission to perform this action"
+	http.Error(w, message, http.StatusForbidden)
+}
+
+func (app *application) badRequest(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// apiError is the envelope for every error returned by the JSON API:
+// {"error": {"status": 404, "message": "...", "fields": {...}}}.
+type apiError struct {
+	Status  int               `json:"status"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+func (app *application) apiErrorResponse(w http.ResponseWriter, r *http.Request, status int, message string, fields map[string]string) {
+	data := map[string]apiError{
+		"error": {Status: status, Message: message, Fields: fields},
+	}
+
+	err := response.JSON(w, status, data)
+	if err != nil {
+		app.reportServerError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (app *application) apiServerError(w http.ResponseWriter, r *http.Request, err error) {
+	app.reportServerError(r, err)
+
+	message := "The server encountered a problem and could not process your request"
+	app.apiErrorResponse(w, r, http.StatusInternalServerError, message, nil)
+}
+
+func (app *application) apiNotFound(w http.ResponseWriter, r *http.Request) {
+	message := "The requested resource could not be found"
+	app.apiErrorResponse(w, r, http.StatusNotFound, message, nil)
+}
+
+func (app *application) apiMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("The %s method is not supported for this resource", r.Method)
+	app.apiErrorResponse(w, r, http.StatusMethodNotAllowed, message, nil)
+}
+
+func (app *application) apiBadRequest(w http.ResponseWriter, r *http.Request, err error) {
+	app.apiErrorResponse(w, r, http.StatusBadRequest, err.Error(), nil)
+}
+
+func (app *application) apiFailedValidation(w http.ResponseWriter, r *http.Request, v validator.Validator) {
+	message := "The request failed validation"
+	if len(v.Errors) > 0 {
+		message = strings.Join(v.Errors, "; ")
+	}
+	app.apiErrorResponse(w, r, http.StatusUnprocessableEntity, message, v.FieldErrors)
+}
+
+func (app *application) apiUnauthorized(w http.ResponseWriter, r *http.Request) {
+	message := "You must be authenticated to access this resource"
+	app.apiErrorResponse(w, r, http.StatusUnauthorized, message, nil)
+}
+
+func (app *application) apiInvalidToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	message := "Invalid, expired or revoked API token"
+	app.apiErrorResponse(w, r, http.StatusUnauthorized, message, nil)
+}
+
+func (app *application) apiForbidden(w http.ResponseWriter, r *http.Request) {
+	message := "You do not have permission to perform this action"
+	app.apiErrorResponse(w, r, http.StatusForbidden, message, nil)
+}
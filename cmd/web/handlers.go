@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 
+	"github.com/wumbabum/home_assist/internal/database"
 	"github.com/wumbabum/home_assist/internal/response"
 )
 
@@ -22,14 +23,43 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) userProfile(w http.ResponseWriter, r *http.Request) {
+	app.renderProfile(w, r, http.StatusOK, apiTokenForm{Scopes: []string{database.PermissionDevicesView}})
+}
+
+func (app *application) renderProfile(w http.ResponseWriter, r *http.Request, status int, tokenForm apiTokenForm) {
 	profileData := app.sessionManager.Get(r.Context(), "profile")
 	profile, _ := profileData.(UserProfile)
 	app.logger.Info("profile data", "profile", profile)
 
+	member := contextGetHouseholdMember(r)
+
+	tokens, err := app.db.ListAPITokens(r.Context(), member.UserID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	households, err := app.db.ListUserHouseholds(r.Context(), member.UserID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	householdNames := make(map[int64]string, len(households))
+	for _, h := range households {
+		householdNames[h.HouseholdID] = h.HouseholdName
+	}
+
 	data := app.newTemplateData(r)
 	data["Profile"] = profile
+	data["Tokens"] = tokens
+	data["HouseholdNames"] = householdNames
+	data["NewToken"] = app.sessionManager.PopString(r.Context(), "new_api_token")
+	data["Scopes"] = database.Permissions
+	data["ExpiryDays"] = apiTokenExpiryDays
+	data["TokenForm"] = tokenForm
 
-	err := response.Page(w, http.StatusOK, data, "pages/user.tmpl")
+	err = response.Page(w, status, data, "pages/user.tmpl")
 	if err != nil {
 		app.serverError(w, r, err)
 	}
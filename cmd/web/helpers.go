@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
 	"github.com/wumbabum/home_assist/internal/version"
+
+	"github.com/go-chi/chi/v5"
 )
 
 func (app *application) newTemplateData(r *http.Request) map[string]any {
@@ -13,27 +22,134 @@ func (app *application) newTemplateData(r *http.Request) map[string]any {
 		"Version":         version.Get(),
 		"IsAuthenticated": profile != nil,
 		"Profile":         profile,
+		"Household":       contextGetHouseholdMember(r),
+		"Flash":           app.sessionManager.PopString(r.Context(), "flash"),
 	}
 
 	return data
 }
 
-// func (app *application) backgroundTask(r *http.Request, fn func() error) {
-// 	app.wg.Add(1)
+// activeHouseholdMember returns the user's membership of the household selected
+// in the session. When none is selected, or the user has since left it, the
+// oldest membership is selected instead, and a new household is created for
+// users who do not belong to any.
+func (app *application) activeHouseholdMember(ctx context.Context, userID int64) (*database.HouseholdMember, error) {
+	householdID := app.sessionManager.GetInt64(ctx, "household_id")
+	if householdID != 0 {
+		member, err := app.db.GetHouseholdMember(ctx, householdID, userID)
+		if err == nil {
+			return member, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	members, err := app.db.ListUserHouseholds(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(members) == 0 {
+		household, err := app.db.CreateHousehold(ctx, "Home", userID)
+		if err != nil {
+			return nil, err
+		}
+		app.logger.Info("household created", "household_id", household.ID, "user_id", userID)
+
+		members, err = app.db.ListUserHouseholds(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(members) == 0 {
+			return nil, errors.New("household membership missing after creation")
+		}
+	}
+
+	app.sessionManager.Put(ctx, "household_id", members[0].HouseholdID)
+	return &members[0], nil
+}
+
+// readIDParam parses the positive integer {id} URL parameter of the current route.
+func readIDParam(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid id parameter")
+	}
+	return id, nil
+}
+
+// optionalID maps the zero value used by HTML select inputs for "none" to nil.
+func optionalID(id int64) *int64 {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
 
-// 	go func() {
-// 		defer app.wg.Done()
+// subscribe starts a consumer for events matching opts. fn is called for each
+// event in turn until the bus is closed during shutdown.
+func (app *application) subscribe(opts events.SubscribeOptions, fn func(events.Event)) {
+	sub := app.events.Subscribe(opts)
 
-// 		defer func() {
-// 			pv := recover()
-// 			if pv != nil {
-// 				app.reportServerError(r, fmt.Errorf("%v", pv))
-// 			}
-// 		}()
+	app.wg.Add(1)
 
-// 		err := fn()
-// 		if err != nil {
-// 			app.reportServerError(r, err)
-// 		}
-// 	}()
-// }
+	go func() {
+		defer app.wg.Done()
+
+		for e := range sub.Events() {
+			app.handleEvent(opts.Name, e, fn)
+		}
+	}()
+}
+
+// handleEvent runs fn, recovering from panics so that one bad event does not
+// stop the consumer.
+func (app *application) handleEvent(name string, e events.Event, fn func(events.Event)) {
+	defer func() {
+		pv := recover()
+		if pv != nil {
+			app.logger.Error("event consumer panicked", "subscriber", name, "type", e.Type, "error", fmt.Sprintf("%v", pv))
+		}
+	}()
+
+	fn(e)
+}
+
+// shutdownContext returns a context cancelled once the server starts shutting
+// down, for background tasks that run until then.
+func (app *application) shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-app.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// backgroundTask runs fn in a goroutine that shutdown waits for, reporting
+// any error or panic.
+func (app *application) backgroundTask(name string, fn func() error) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			pv := recover()
+			if pv != nil {
+				app.reportBackgroundError(name, fmt.Errorf("%v", pv))
+			}
+		}()
+
+		err := fn()
+		if err != nil {
+			app.reportBackgroundError(name, err)
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+)
+
+const (
+	historyWriteTimeout  = 5 * time.Second
+	historyPruneInterval = time.Hour
+	historyPruneTimeout  = 5 * time.Minute
+)
+
+// recordStateChange stores a state_changed event in the state history.
+func (app *application) recordStateChange(e events.Event) {
+	payload, ok := e.Payload.(events.StateChanged)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), historyWriteTimeout)
+	defer cancel()
+
+	entry := &database.StateHistoryEntry{
+		HouseholdID: e.HouseholdID,
+		DeviceID:    payload.DeviceID,
+		State:       payload.State,
+		Changes:     payload.Changes,
+		RecordedAt:  e.Time,
+	}
+
+	err := app.db.RecordStateChange(ctx, entry)
+	if err != nil {
+		app.logger.Error("failed to record state change", "device_id", payload.DeviceID, "error", err)
+	}
+}
+
+// pruneStateHistory deletes history older than the configured retention once
+// an hour until the server shuts down. A retention of 0 keeps history forever.
+func (app *application) pruneStateHistory() {
+	if app.config.history.retentionDays <= 0 {
+		return
+	}
+
+	app.backgroundTask("prune state history", func() error {
+		ticker := time.NewTicker(historyPruneInterval)
+		defer ticker.Stop()
+
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), historyPruneTimeout)
+			before := time.Now().AddDate(0, 0, -app.config.history.retentionDays)
+
+			deleted, err := app.db.PruneStateHistory(ctx, before)
+			cancel()
+			if err != nil {
+				app.reportBackgroundError("prune state history", err)
+			} else if deleted > 0 {
+				app.logger.Info("state history pruned", "deleted", deleted, "before", before)
+			}
+
+			select {
+			case <-app.shutdown:
+				return nil
+			case <-ticker.C:
+			}
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/funcs"
+	"github.com/wumbabum/home_assist/internal/response"
+)
+
+// historyRange is a period shown on the history pages, along with the bucket
+// size its values are downsampled to.
+type historyRange struct {
+	Name   string
+	Length time.Duration
+	Bucket time.Duration
+}
+
+var historyRanges = []historyRange{
+	{Name: "day", Length: 24 * time.Hour, Bucket: 15 * time.Minute},
+	{Name: "week", Length: 7 * 24 * time.Hour, Bucket: 2 * time.Hour},
+	{Name: "month", Length: 30 * 24 * time.Hour, Bucket: 6 * time.Hour},
+}
+
+// historyGroup holds the charts of a single device.
+type historyGroup struct {
+	Device database.Device
+	Charts []funcs.Chart
+}
+
+func (app *application) deviceHistory(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.loadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	rng, err := readHistoryRange(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	group, err := app.historyGroup(r.Context(), *device, rng)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data["Title"] = device.Name
+	data["Path"] = r.URL.Path
+	data["BackPath"] = "/devices/" + strconv.FormatInt(device.ID, 10)
+	data["Range"] = rng
+	data["Ranges"] = historyRanges
+	data["Groups"] = []historyGroup{group}
+
+	err = response.Page(w, http.StatusOK, data, "pages/history.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) roomHistory(w http.ResponseWriter, r *http.Request) {
+	room, ok := app.loadRoom(w, r)
+	if !ok {
+		return
+	}
+
+	rng, err := readHistoryRange(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	devices, err := app.db.ListDevicesInRoom(r.Context(), room.HouseholdID, room.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	groups := []historyGroup{}
+	for _, device := range devices {
+		group, err := app.historyGroup(r.Context(), device, rng)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if len(group.Charts) > 0 {
+			groups = append(groups, group)
+		}
+	}
+
+	data := app.newTemplateData(r)
+	data["Title"] = room.Name
+	data["Path"] = r.URL.Path
+	data["BackPath"] = "/rooms/" + strconv.FormatInt(room.ID, 10)
+	data["Range"] = rng
+	data["Ranges"] = historyRanges
+	data["Groups"] = groups
+
+	err = response.Page(w, http.StatusOK, data, "pages/history.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// historyGroup builds a chart for every attribute of the device that can be
+// plotted, ending now.
+func (app *application) historyGroup(ctx context.Context, device database.Device, rng historyRange) (historyGroup, error) {
+	group := historyGroup{Device: device}
+
+	to := time.Now()
+	from := to.Add(-rng.Length)
+
+	for _, attribute := range chartAttributes(device.State) {
+		filter := database.StateHistoryFilter{DeviceID: device.ID, From: from, To: to, Attribute: attribute}
+
+		buckets, err := app.db.AggregateStateHistory(ctx, device.HouseholdID, filter, rng.Bucket)
+		if err != nil {
+			return group, err
+		}
+
+		_, step := device.State[attribute].(bool)
+		chart := funcs.Chart{Title: attribute, From: from, To: to, Step: step}
+		for _, bucket := range buckets {
+			chart.Points = append(chart.Points, funcs.ChartPoint{Time: bucket.Start, Min: bucket.Min, Max: bucket.Max, Avg: bucket.Avg})
+		}
+		group.Charts = append(group.Charts, chart)
+	}
+
+	return group, nil
+}
+
+// chartAttributes returns the numeric and boolean attributes of a state in
+// alphabetical order.
+func chartAttributes(state database.DeviceState) []string {
+	attributes := []string{}
+	for key, value := range state {
+		switch value.(type) {
+		case float64, bool:
+			attributes = append(attributes, key)
+		}
+	}
+	slices.Sort(attributes)
+	return attributes
+}
+
+// readHistoryRange parses the ?range query string parameter, defaulting to a day.
+func readHistoryRange(r *http.Request) (historyRange, error) {
+	name := r.URL.Query().Get("range")
+	if name == "" {
+		return historyRanges[0], nil
+	}
+
+	for _, rng := range historyRanges {
+		if rng.Name == name {
+			return rng, nil
+		}
+	}
+	return historyRange{}, errors.New("range must be day, week or month")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+func TestChartAttributes(t *testing.T) {
+	state := database.DeviceState{
+		"temperature":        21.5,
+		"target_temperature": 20.0,
+		"on":                 true,
+		"color":              "#ff8800",
+		"mode":               nil,
+	}
+
+	got := chartAttributes(state)
+	want := []string{"on", "target_temperature", "temperature"}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestReadHistoryRange(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		err   bool
+	}{
+		{"", "day", false},
+		{"?range=week", "week", false},
+		{"?range=month", "month", false},
+		{"?range=year", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/devices/1/history"+tt.query, nil)
+
+			rng, err := readHistoryRange(req)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %t, got %v", tt.err, err)
+			}
+			if rng.Name != tt.want {
+				t.Errorf("expected range %q, got %q", tt.want, rng.Name)
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/request"
+	"github.com/wumbabum/home_assist/internal/response"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+type invitationForm struct {
+	Email     string              `form:"Email"`
+	Role      string              `form:"Role"`
+	Validator validator.Validator `form:"-"`
+}
+
+type memberRoleForm struct {
+	Role string `form:"Role"`
+}
+
+type householdForm struct {
+	Name      string              `form:"Name"`
+	Validator validator.Validator `form:"-"`
+}
+
+// householdLocationForm sets where a household is, for scheduling automations.
+// Coordinates are strings so that they can be left blank.
+type householdLocationForm struct {
+	Timezone  string              `form:"Timezone"`
+	Latitude  string              `form:"Latitude"`
+	Longitude string              `form:"Longitude"`
+	Validator validator.Validator `form:"-"`
+}
+
+func newHouseholdLocationForm(household *database.Household) householdLocationForm {
+	form := householdLocationForm{Timezone: household.Timezone}
+	if household.Latitude != nil && household.Longitude != nil {
+		form.Latitude = strconv.FormatFloat(*household.Latitude, 'f', -1, 64)
+		form.Longitude = strconv.FormatFloat(*household.Longitude, 'f', -1, 64)
+	}
+	return form
+}
+
+// household validates the form and returns the household with its location
+// updated.
+func (f *householdLocationForm) household(household *database.Household) *database.Household {
+	f.Timezone = strings.TrimSpace(f.Timezone)
+	_, err := time.LoadLocation(f.Timezone)
+	f.Validator.CheckField(validator.NotBlank(f.Timezone), "Timezone", "Timezone is required")
+	f.Validator.CheckField(err == nil && f.Timezone != "Local", "Timezone", "Timezone must be a name such as Europe/London")
+
+	updated := *household
+	updated.Timezone = f.Timezone
+	updated.Latitude = parseCoordinate(&f.Validator, f.Latitude, "Latitude", 90)
+	updated.Longitude = parseCoordinate(&f.Validator, f.Longitude, "Longitude", 180)
+
+	if (updated.Latitude == nil) != (updated.Longitude == nil) {
+		f.Validator.AddFieldError("Longitude", "Latitude and longitude must be given together")
+	}
+
+	return &updated
+}
+
+func parseCoordinate(v *validator.Validator, s, field string, limit float64) *float64 {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < -limit || n > limit {
+		v.AddFieldError(field, fmt.Sprintf("%s must be a number between -%g and %g", field, limit, limit))
+		return nil
+	}
+	return &n
+}
+
+type switchHouseholdForm struct {
+	HouseholdID int64 `form:"HouseholdID"`
+}
+
+func (app *application) showHousehold(w http.ResponseWriter, r *http.Request) {
+	app.renderHousehold(w, r, http.StatusOK, invitationForm{Role: database.RoleMember}, householdForm{}, nil)
+}
+
+func (app *application) createInvitation(w http.ResponseWriter, r *http.Request) {
+	member := contextGetHouseholdMember(r)
+
+	var form invitationForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	form.Validator.CheckField(validator.NotBlank(form.Email), "Email", "Email is required")
+	form.Validator.CheckField(validator.IsEmail(form.Email), "Email", "Email must be a valid email address")
+	form.Validator.CheckField(validator.In(form.Role, database.InvitableRoles...), "Role", "Role is not supported")
+	if form.Validator.HasErrors() {
+		app.renderHousehold(w, r, http.StatusUnprocessableEntity, form, householdForm{}, nil)
+		return
+	}
+
+	invitation, err := app.db.CreateHouseholdInvitation(r.Context(), member.HouseholdID, form.Email, form.Role, member.UserID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("household invitation created", "household_id", member.HouseholdID, "invitation_id", invitation.ID, "role", invitation.Role)
+
+	http.Redirect(w, r, "/household", http.StatusSeeOther)
+}
+
+func (app *application) deleteInvitation(w http.ResponseWriter, r *http.Request) {
+	member := contextGetHouseholdMember(r)
+
+	id, err := readIDParam(r)
+	if err != nil {
+		app.notFound(w, r)
+		return
+	}
+
+	err = app.db.DeleteHouseholdInvitation(r.Context(), member.HouseholdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.notFound(w, r)
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/household", http.StatusSeeOther)
+}
+
+func (app *application) updateMemberRole(w http.ResponseWriter, r *http.Request) {
+	member := contextGetHouseholdMember(r)
+
+	target, members, ok := app.loadHouseholdMember(w, r, member.HouseholdID)
+	if !ok {
+		return
+	}
+
+	var form memberRoleForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if !validator.In(form.Role, database.HouseholdRoles...) {
+		app.badRequest(w, r, errors.New("role is not supported"))
+		return
+	}
+
+	// Only owners can hand out or take away ownership
+	if (form.Role == database.RoleOwner || target.Role == database.RoleOwner) && member.Role != database.RoleOwner {
+		app.forbidden(w, r)
+		return
+	}
+
+	if target.Role == database.RoleOwner && form.Role != database.RoleOwner && countOwners(members) == 1 {
+		app.badRequest(w, r, errors.New("a household must keep at least one owner"))
+		return
+	}
+
+	err = app.db.UpdateHouseholdMemberRole(r.Context(), member.HouseholdID, target.UserID, form.Role)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("household member role changed", "household_id", member.HouseholdID, "user_id", target.UserID, "role", form.Role)
+
+	http.Redirect(w, r, "/household", http.StatusSeeOther)
+}
+
+func (app *application) removeMember(w http.ResponseWriter, r *http.Request) {
+	member := contextGetHouseholdMember(r)
+
+	target, members, ok := app.loadHouseholdMember(w, r, member.HouseholdID)
+	if !ok {
+		return
+	}
+
+	// Anyone may leave, but removing somebody else needs management rights and
+	// only owners may remove other owners.
+	leaving := target.UserID == member.UserID
+	if !leaving && (!member.Can(database.PermissionAdminUsers) || (target.Role == database.RoleOwner && member.Role != database.RoleOwner)) {
+		app.forbidden(w, r)
+		return
+	}
+
+	if target.Role == database.RoleOwner && countOwners(members) == 1 {
+		app.badRequest(w, r, errors.New("a household must keep at least one owner"))
+		return
+	}
+
+	err := app.db.RemoveHouseholdMember(r.Context(), member.HouseholdID, target.UserID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("household member removed", "household_id", member.HouseholdID, "user_id", target.UserID)
+
+	if leaving {
+		app.sessionManager.Remove(r.Context(), "household_id")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/household", http.StatusSeeOther)
+}
+
+func (app *application) createHousehold(w http.ResponseWriter, r *http.Request) {
+	member := contextGetHouseholdMember(r)
+
+	var form householdForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	form.Validator.CheckField(validator.NotBlank(form.Name), "Name", "Name is required")
+	form.Validator.CheckField(validator.MaxRunes(form.Name, 100), "Name", "Name must not be more than 100 characters")
+	if form.Validator.HasErrors() {
+		app.renderHousehold(w, r, http.StatusUnprocessableEntity, invitationForm{Role: database.RoleMember}, form, nil)
+		return
+	}
+
+	household, err := app.db.CreateHousehold(r.Context(), form.Name, member.UserID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("household created", "household_id", household.ID, "user_id", member.UserID)
+
+	app.sessionManager.Put(r.Context(), "household_id", household.ID)
+	http.Redirect(w, r, "/household", http.StatusSeeOther)
+}
+
+// updateHouseholdLocation sets the timezone and coordinates that time, cron
+// and sun triggers are scheduled with.
+func (app *application) updateHouseholdLocation(w http.ResponseWriter, r *http.Request) {
+	member := contextGetHouseholdMember(r)
+
+	household, err := app.db.GetHousehold(r.Context(), member.HouseholdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	var form householdLocationForm
+
+	err = request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	household = form.household(household)
+	if form.Validator.HasErrors() {
+		app.renderHousehold(w, r, http.StatusUnprocessableEntity, invitationForm{Role: database.RoleMember}, householdForm{}, &form)
+		return
+	}
+
+	err = app.db.UpdateHouseholdLocation(r.Context(), household)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("household location changed", "household_id", household.ID, "timezone", household.Timezone)
+	app.schedules.Reload()
+
+	app.sessionManager.Put(r.Context(), "flash", "Location saved.")
+	http.Redirect(w, r, "/household", http.StatusSeeOther)
+}
+
+func (app *application) switchHousehold(w http.ResponseWriter, r *http.Request) {
+	member := contextGetHouseholdMember(r)
+
+	var form switchHouseholdForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	_, err = app.db.GetHouseholdMember(r.Context(), form.HouseholdID, member.UserID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.forbidden(w, r)
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "household_id", form.HouseholdID)
+	http.Redirect(w, r, "/household", http.StatusSeeOther)
+}
+
+// renderHousehold shows the household page. A nil locationForm shows the
+// household's saved location.
+func (app *application) renderHousehold(w http.ResponseWriter, r *http.Request, status int, inviteForm invitationForm, createForm householdForm, locationForm *householdLocationForm) {
+	member := contextGetHouseholdMember(r)
+
+	if locationForm == nil {
+		household, err := app.db.GetHousehold(r.Context(), member.HouseholdID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		form := newHouseholdLocationForm(household)
+		locationForm = &form
+	}
+
+	members, err := app.db.ListHouseholdMembers(r.Context(), member.HouseholdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	invitations, err := app.db.ListHouseholdInvitations(r.Context(), member.HouseholdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	households, err := app.db.ListUserHouseholds(r.Context(), member.UserID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	rolePermissions, err := app.db.ListRolePermissions(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data["Members"] = members
+	data["Invitations"] = invitations
+	data["Households"] = households
+	data["RolePermissions"] = rolePermissions
+	data["Roles"] = database.HouseholdRoles
+	data["InvitableRoles"] = database.InvitableRoles
+	data["Form"] = inviteForm
+	data["HouseholdForm"] = createForm
+	data["LocationForm"] = locationForm
+
+	err = response.Page(w, status, data, "pages/household.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// loadHouseholdMember finds the member identified by the {id} URL parameter
+// (a user ID) and also returns the full member list for ownership checks. If
+// it cannot be loaded an error response is written and ok is false.
+func (app *application) loadHouseholdMember(w http.ResponseWriter, r *http.Request, householdID int64) (target *database.HouseholdMember, members []database.HouseholdMember, ok bool) {
+	userID, err := readIDParam(r)
+	if err != nil {
+		app.notFound(w, r)
+		return nil, nil, false
+	}
+
+	members, err = app.db.ListHouseholdMembers(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, nil, false
+	}
+
+	for i := range members {
+		if members[i].UserID == userID {
+			return &members[i], members, true
+		}
+	}
+
+	app.notFound(w, r)
+	return nil, nil, false
+}
+
+func countOwners(members []database.HouseholdMember) int {
+	count := 0
+	for _, m := range members {
+		if m.Role == database.RoleOwner {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+func TestHouseholdLocationForm(t *testing.T) {
+	existing := &database.Household{ID: 1, Name: "Home", Timezone: "UTC"}
+
+	form := householdLocationForm{Timezone: " Europe/London ", Latitude: "51.5074", Longitude: "-0.1278"}
+	household := form.household(existing)
+	if form.Validator.HasErrors() {
+		t.Fatalf("unexpected errors %v", form.Validator.FieldErrors)
+	}
+	if household.Timezone != "Europe/London" || *household.Latitude != 51.5074 || *household.Longitude != -0.1278 {
+		t.Errorf("unexpected household %+v", household)
+	}
+	if existing.Timezone != "UTC" {
+		t.Error("expected the existing household to be left unchanged")
+	}
+	if again := newHouseholdLocationForm(household); again.Latitude != "51.5074" || again.Longitude != "-0.1278" {
+		t.Errorf("unexpected form %+v", again)
+	}
+
+	tests := []struct {
+		name  string
+		form  householdLocationForm
+		field string
+	}{
+		{"Unknown timezone", householdLocationForm{Timezone: "Mars/Olympus_Mons"}, "Timezone"},
+		{"Local timezone", householdLocationForm{Timezone: "Local"}, "Timezone"},
+		{"Latitude out of range", householdLocationForm{Timezone: "UTC", Latitude: "91", Longitude: "0"}, "Latitude"},
+		{"Longitude not a number", householdLocationForm{Timezone: "UTC", Latitude: "0", Longitude: "west"}, "Longitude"},
+		{"Latitude without longitude", householdLocationForm{Timezone: "UTC", Latitude: "51.5"}, "Longitude"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.household(existing)
+			if tt.form.Validator.FieldErrors[tt.field] == "" {
+				t.Errorf("expected an error for %s, got %v", tt.field, tt.form.Validator.FieldErrors)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+	"github.com/wumbabum/home_assist/internal/integrations/hue"
+	"github.com/wumbabum/home_assist/internal/request"
+	"github.com/wumbabum/home_assist/internal/response"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+// hueBridges is implemented by the Hue integration, which pairs and imports
+// the bridges listed on their own page.
+type hueBridges interface {
+	Pair(ctx context.Context, address string) (*hue.Pairing, error)
+	Import(ctx context.Context, bridge *database.HueBridge, opts hue.ImportOptions) (*hue.ImportResult, error)
+}
+
+// hueBridges returns the Hue integration, unless the server is not
+// configured for it.
+func (app *application) hueBridges() (hueBridges, bool) {
+	bridges, ok := app.integrations[hue.Protocol].(hueBridges)
+	return bridges, ok
+}
+
+type hueBridgeForm struct {
+	Address   string              `form:"Address"`
+	Validator validator.Validator `form:"-"`
+}
+
+func (f *hueBridgeForm) validate() {
+	f.Validator.CheckField(validator.NotBlank(f.Address), "Address", "Address is required")
+	f.Validator.CheckField(validator.MaxRunes(f.Address, 255), "Address", "Address must not be more than 255 characters")
+}
+
+func (app *application) listHueBridges(w http.ResponseWriter, r *http.Request) {
+	// Bridges found on the local network link here with their address
+	form := hueBridgeForm{Address: r.URL.Query().Get("address")}
+	app.renderHueBridges(w, r, http.StatusOK, form)
+}
+
+// pairHueBridge pairs the household with the bridge at an address, once its
+// link button has been pressed, and imports its lights, rooms and scenes.
+func (app *application) pairHueBridge(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	var form hueBridgeForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	bridges, entry, ok := app.loadHueEntry(w, r)
+	if !ok {
+		return
+	}
+
+	form.validate()
+	if form.Validator.HasErrors() {
+		app.renderHueBridges(w, r, http.StatusUnprocessableEntity, form)
+		return
+	}
+
+	pairing, err := bridges.Pair(r.Context(), form.Address)
+	switch {
+	case errors.Is(err, hue.ErrLinkButton):
+		form.Validator.AddFieldError("Address", "Press the link button on the bridge, then pair it within 30 seconds")
+	case err != nil:
+		app.logger.Warn("failed to pair Hue bridge", "address", form.Address, "error", err)
+		form.Validator.AddFieldError("Address", "No Hue bridge could be reached at this address")
+	}
+	if form.Validator.HasErrors() {
+		app.renderHueBridges(w, r, http.StatusUnprocessableEntity, form)
+		return
+	}
+
+	key, err := app.secrets.Encrypt([]byte(pairing.ApplicationKey))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	bridge := database.HueBridge{HouseholdID: householdID, BridgeID: pairing.BridgeID, Address: form.Address, ApplicationKey: key}
+
+	err = app.db.SaveHueBridge(r.Context(), &bridge)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("Hue bridge paired", "household_id", householdID, "bridge_id", bridge.BridgeID)
+
+	app.importHueBridge(w, r, bridges, entry, &bridge)
+}
+
+func (app *application) reimportHueBridge(w http.ResponseWriter, r *http.Request) {
+	bridge, ok := app.loadHueBridge(w, r)
+	if !ok {
+		return
+	}
+
+	bridges, entry, ok := app.loadHueEntry(w, r)
+	if !ok {
+		return
+	}
+
+	app.importHueBridge(w, r, bridges, entry, bridge)
+}
+
+// importHueBridge imports a bridge's lights and, as the household's settings
+// say, its rooms and scenes, then redirects to the list of bridges with a
+// summary of what changed.
+func (app *application) importHueBridge(w http.ResponseWriter, r *http.Request, bridges hueBridges, entry *database.IntegrationEntry, bridge *database.HueBridge) {
+	result, err := bridges.Import(r.Context(), bridge, hue.ImportOptionsFor(entry))
+	if err != nil {
+		app.logger.Warn("failed to import Hue bridge", "bridge_id", bridge.BridgeID, "error", err)
+		app.sessionManager.Put(r.Context(), "flash", "The Hue bridge could not be imported, check that it is reachable and try again.")
+		http.Redirect(w, r, "/hue", http.StatusSeeOther)
+		return
+	}
+
+	for _, device := range result.Added {
+		app.events.Publish(events.NewDeviceAdded(device.HouseholdID, events.DeviceAdded{
+			DeviceID: device.ID,
+			Name:     device.Name,
+			Kind:     device.Kind,
+			Protocol: device.Protocol,
+		}))
+	}
+	if len(result.Added) > 0 || result.Updated > 0 {
+		app.reloadDevices()
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", result.Summary())
+	http.Redirect(w, r, "/hue", http.StatusSeeOther)
+}
+
+// deleteHueBridge unpairs a bridge. Its lights are kept, but cannot be
+// controlled until it is paired again.
+func (app *application) deleteHueBridge(w http.ResponseWriter, r *http.Request) {
+	bridge, ok := app.loadHueBridge(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.db.DeleteHueBridge(r.Context(), bridge.HouseholdID, bridge.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("Hue bridge removed", "household_id", bridge.HouseholdID, "bridge_id", bridge.BridgeID)
+	app.reloadDevices()
+
+	http.Redirect(w, r, "/hue", http.StatusSeeOther)
+}
+
+func (app *application) renderHueBridges(w http.ResponseWriter, r *http.Request, status int, form hueBridgeForm) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	bridges, err := app.db.ListHouseholdHueBridges(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	enabled, err := app.integrationEnabled(r.Context(), householdID, hue.Protocol)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	_, available := app.hueBridges()
+
+	data := app.newTemplateData(r)
+	data["Bridges"] = bridges
+	data["Form"] = form
+	data["Available"] = available
+	data["Enabled"] = enabled
+
+	err = response.Page(w, status, data, "pages/hue.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// loadHueEntry returns the Hue integration and the household's entry of it,
+// which must be available and enabled to pair and import bridges. If they
+// cannot be loaded an error response is written and ok is false.
+func (app *application) loadHueEntry(w http.ResponseWriter, r *http.Request) (bridges hueBridges, entry *database.IntegrationEntry, ok bool) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	bridges, ok = app.hueBridges()
+	if !ok {
+		app.notFound(w, r)
+		return nil, nil, false
+	}
+
+	entry, err := app.db.GetIntegrationEntry(r.Context(), householdID, hue.Protocol)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) || (err == nil && !entry.Enabled):
+		app.notFound(w, r)
+		return nil, nil, false
+	case err != nil:
+		app.serverError(w, r, err)
+		return nil, nil, false
+	}
+
+	return bridges, entry, true
+}
+
+// loadHueBridge fetches the bridge identified by the {id} URL parameter, when
+// Hue is available. If it cannot be loaded an error response is written and ok
+// is false.
+func (app *application) loadHueBridge(w http.ResponseWriter, r *http.Request) (bridge *database.HueBridge, ok bool) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	_, available := app.hueBridges()
+
+	id, err := readIDParam(r)
+	if err != nil || !available {
+		app.notFound(w, r)
+		return nil, false
+	}
+
+	bridge, err = app.db.GetHueBridge(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.notFound(w, r)
+		return nil, false
+	case err != nil:
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	return bridge, true
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/discovery"
+	"github.com/wumbabum/home_assist/internal/events"
+	"github.com/wumbabum/home_assist/internal/integrations"
+	"github.com/wumbabum/home_assist/internal/integrations/hue"
+	"github.com/wumbabum/home_assist/internal/request"
+	"github.com/wumbabum/home_assist/internal/response"
+	"github.com/wumbabum/home_assist/internal/validator"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// integrationRow is an integration as listed for a household.
+type integrationRow struct {
+	Integration integrations.Integration
+	Entry       *database.IntegrationEntry // nil until added
+	Available   bool                       // Whether the server is configured for it
+}
+
+// discoveredRow is a device heard on the local network, as listed for a
+// household.
+type discoveredRow struct {
+	Found     discovery.Found
+	Available bool      // Whether the server is configured for the device's integration
+	Enabled   bool      // Whether the household has enabled the device's integration
+	Added     bool      // Whether any household has added the device, or paired the bridge
+	Adoption  *adoption // nil unless the device can be adopted
+}
+
+type integrationForm struct {
+	Config    map[string]string   `form:"Config"` // Keyed by the names of the schema's fields
+	Validator validator.Validator `form:"-"`
+}
+
+// adoptForm adds a discovered device. The fields are those of the device
+// form, which validates them, with the vendor and model the device reported.
+type adoptForm struct {
+	deviceForm
+	Vendor string `form:"Vendor"`
+	Model  string `form:"Model"`
+}
+
+func (f *adoptForm) validate(rooms []database.Room, entries []database.IntegrationEntry, householdID int64, householdTopics bool) {
+	f.deviceForm.validate(rooms, entries, householdID, householdTopics)
+	f.Validator.CheckField(validator.MaxRunes(f.Vendor, 100), "Vendor", "Vendor must not be more than 100 characters")
+	f.Validator.CheckField(validator.MaxRunes(f.Model, 100), "Model", "Model must not be more than 100 characters")
+}
+
+// adoption is a form adopting a discovered device, with the rooms it can be
+// put in and the path it is posted to.
+type adoption struct {
+	Form   adoptForm
+	Rooms  []database.Room
+	Action string
+}
+
+func (app *application) listIntegrations(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	entries, err := app.db.ListIntegrationEntries(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	byName := map[string]*database.IntegrationEntry{}
+	for i := range entries {
+		byName[entries[i].Integration] = &entries[i]
+	}
+
+	rows := []integrationRow{}
+	for _, integration := range integrations.Default.All() {
+		_, available := app.integrations[integration.Name()]
+		rows = append(rows, integrationRow{
+			Integration: integration,
+			Entry:       byName[integration.Name()],
+			Available:   available,
+		})
+	}
+
+	data := app.newTemplateData(r)
+	data["Integrations"] = rows
+
+	err = response.Page(w, http.StatusOK, data, "pages/integrations.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) showIntegration(w http.ResponseWriter, r *http.Request) {
+	integration, entry, ok := app.loadIntegration(w, r)
+	if !ok {
+		return
+	}
+
+	form := integrationForm{Config: integration.ConfigSchema().Values(nil)}
+	if entry != nil {
+		form.Config = integration.ConfigSchema().Values(entry.Config)
+	}
+
+	app.renderIntegration(w, r, http.StatusOK, integration, entry, form)
+}
+
+// saveIntegration adds an integration to the household, enabled, or updates
+// the settings of its entry.
+func (app *application) saveIntegration(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	integration, entry, ok := app.loadIntegration(w, r)
+	if !ok {
+		return
+	}
+
+	var form integrationForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	config := integration.ConfigSchema().Parse(form.Config, &form.Validator)
+	if form.Validator.HasErrors() {
+		app.renderIntegration(w, r, http.StatusUnprocessableEntity, integration, entry, form)
+		return
+	}
+
+	added := entry == nil
+	if added {
+		entry = &database.IntegrationEntry{HouseholdID: householdID, Integration: integration.Name(), Enabled: true}
+	}
+	entry.Config = config
+
+	err = app.db.SaveIntegrationEntry(r.Context(), entry)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("integration entry saved", "household_id", householdID, "integration", integration.Name())
+	app.reloadDevices()
+
+	if added {
+		app.sessionManager.Put(r.Context(), "flash", integration.Title()+" added.")
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", integration.Title()+" settings saved.")
+	}
+	http.Redirect(w, r, integrationPath(integration), http.StatusSeeOther)
+}
+
+func (app *application) enableIntegration(w http.ResponseWriter, r *http.Request) {
+	app.setIntegrationEnabled(w, r, true)
+}
+
+func (app *application) disableIntegration(w http.ResponseWriter, r *http.Request) {
+	app.setIntegrationEnabled(w, r, false)
+}
+
+func (app *application) setIntegrationEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	integration, entry, ok := app.loadIntegration(w, r)
+	if !ok {
+		return
+	}
+	if entry == nil {
+		app.notFound(w, r)
+		return
+	}
+
+	err := app.db.SetIntegrationEntryEnabled(r.Context(), householdID, integration.Name(), enabled)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("integration entry updated", "household_id", householdID, "integration", integration.Name(), "enabled", enabled)
+	app.reloadDevices()
+
+	if enabled {
+		app.sessionManager.Put(r.Context(), "flash", integration.Title()+" enabled.")
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", integration.Title()+" disabled, its devices are no longer followed or controlled.")
+	}
+	http.Redirect(w, r, "/integrations", http.StatusSeeOther)
+}
+
+// deleteIntegration removes an integration from the household. Its devices
+// are kept, but are not followed until it is added again.
+func (app *application) deleteIntegration(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	integration, _, ok := app.loadIntegration(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.db.DeleteIntegrationEntry(r.Context(), householdID, integration.Name())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("integration entry deleted", "household_id", householdID, "integration", integration.Name())
+	app.reloadDevices()
+
+	app.sessionManager.Put(r.Context(), "flash", integration.Title()+" removed.")
+	http.Redirect(w, r, "/integrations", http.StatusSeeOther)
+}
+
+// discoverIntegration lists the devices the integration found that the
+// household has not added, each with a form to adopt it.
+func (app *application) discoverIntegration(w http.ResponseWriter, r *http.Request) {
+	integration, entry, ok := app.loadIntegration(w, r)
+	if !ok {
+		return
+	}
+
+	_, available := app.integrations[integration.Name()]
+	if entry == nil || !entry.Enabled || !available {
+		app.notFound(w, r)
+		return
+	}
+
+	discoveries, err := integration.Discover(r.Context(), entry)
+	if err != nil {
+		app.logger.Warn("integration discovery failed", "integration", integration.Name(), "error", err)
+		app.sessionManager.Put(r.Context(), "flash", "Devices could not be discovered, check that they are reachable and try again.")
+		http.Redirect(w, r, integrationPath(integration), http.StatusSeeOther)
+		return
+	}
+
+	forms := []adoptForm{}
+	for _, d := range discoveries {
+		forms = append(forms, adoptFormFor(integration, d))
+	}
+
+	app.renderDiscoveries(w, r, http.StatusOK, integration, integrationPath(integration)+"/adopt", forms)
+}
+
+// adoptDevice adds a discovered device to the household.
+func (app *application) adoptDevice(w http.ResponseWriter, r *http.Request) {
+	integration, entry, ok := app.loadIntegration(w, r)
+	if !ok {
+		return
+	}
+	if entry == nil || !entry.Enabled {
+		app.notFound(w, r)
+		return
+	}
+
+	var form adoptForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.adopt(w, r, integration, integrationPath(integration)+"/adopt", form)
+}
+
+// adoptDiscovered adopts a device listed on the page of devices discovered
+// on the local network, while it is still announcing itself.
+func (app *application) adoptDiscovered(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	if !app.discoversFor(householdID) {
+		app.notFound(w, r)
+		return
+	}
+
+	var form adoptForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	integration, ok := integrations.Default.Get(form.Protocol)
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+
+	found := false
+	for _, f := range app.discovery.List() {
+		if f.Integration != nil && f.Integration.Name() == form.Protocol && f.Discovery.Address == form.Address {
+			found = true
+		}
+	}
+	form.Validator.CheckField(found, "Address", "This device is no longer announced on the local network")
+
+	app.adopt(w, r, integration, "/discovered/adopt", form)
+}
+
+// adopt validates a form adopting a device of integration and creates the
+// device, or renders the form again, posting to action, with its errors.
+func (app *application) adopt(w http.ResponseWriter, r *http.Request, integration integrations.Integration, action string, form adoptForm) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	rooms, err := app.db.ListRooms(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	entries, err := app.db.ListIntegrationEntries(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	form.validate(rooms, entries, householdID, app.config.mqtt.embedded)
+	form.Validator.CheckField(form.Protocol == integration.Name(), "Protocol", "Protocol must be that of the integration")
+
+	added, err := app.addedDevices(r.Context(), form.Protocol)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	form.Validator.CheckField(!added[form.Protocol+" "+form.Address], "Address", "This device has already been added")
+	if form.Validator.HasErrors() {
+		app.renderDiscoveries(w, r, http.StatusUnprocessableEntity, integration, action, []adoptForm{form})
+		return
+	}
+
+	device := database.Device{HouseholdID: householdID, Vendor: form.Vendor, Model: form.Model}
+	form.apply(&device)
+
+	err = app.db.CreateDevice(r.Context(), &device)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("device adopted", "device_id", device.ID, "name", device.Name, "integration", integration.Name())
+	app.reloadDevices()
+
+	app.events.Publish(events.NewDeviceAdded(device.HouseholdID, events.DeviceAdded{
+		DeviceID: device.ID,
+		Name:     device.Name,
+		Kind:     device.Kind,
+		Protocol: device.Protocol,
+	}))
+
+	http.Redirect(w, r, "/devices/"+strconv.FormatInt(device.ID, 10), http.StatusSeeOther)
+}
+
+// listDiscovered lists the devices heard on the local network. Those an
+// enabled integration handles can be adopted, or set up on the integration's
+// own page, unless the household has added them already.
+func (app *application) listDiscovered(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	data := app.newTemplateData(r)
+	if !app.discoversFor(householdID) {
+		err := response.Page(w, http.StatusOK, data, "pages/discovered.tmpl")
+		if err != nil {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	discovered := app.discovery.List()
+
+	var protocols []string
+	for _, f := range discovered {
+		if f.Integration != nil {
+			protocols = append(protocols, f.Integration.Name())
+		}
+	}
+	added, err := app.addedDevices(r.Context(), protocols...)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	entries, err := app.db.ListIntegrationEntries(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	rooms, err := app.db.ListRooms(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	enabled := map[string]bool{}
+	for _, entry := range entries {
+		enabled[entry.Integration] = entry.Enabled
+	}
+
+	var found, other []discoveredRow
+	for _, f := range discovered {
+		if f.Integration == nil {
+			other = append(other, discoveredRow{Found: f})
+			continue
+		}
+
+		name := f.Integration.Name()
+		_, available := app.integrations[name]
+		row := discoveredRow{
+			Found:     f,
+			Available: available,
+			Enabled:   enabled[name],
+			Added:     added[name+" "+f.Discovery.Address],
+		}
+		if row.Available && row.Enabled && !row.Added && f.Discovery.SetupPath == "" {
+			row.Adoption = &adoption{Form: adoptFormFor(f.Integration, f.Discovery), Rooms: rooms, Action: "/discovered/adopt"}
+		}
+		found = append(found, row)
+	}
+
+	data["Discovery"] = true
+	data["Found"] = found
+	data["Other"] = other
+
+	err = response.Page(w, http.StatusOK, data, "pages/discovered.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) renderIntegration(w http.ResponseWriter, r *http.Request, status int, integration integrations.Integration, entry *database.IntegrationEntry, form integrationForm) {
+	_, available := app.integrations[integration.Name()]
+
+	data := app.newTemplateData(r)
+	data["Integration"] = integration
+	data["Schema"] = integration.ConfigSchema()
+	data["Entry"] = entry
+	data["Available"] = available
+	data["Form"] = form
+
+	err := response.Page(w, status, data, "pages/integration.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) renderDiscoveries(w http.ResponseWriter, r *http.Request, status int, integration integrations.Integration, action string, forms []adoptForm) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	rooms, err := app.db.ListRooms(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	adoptions := []adoption{}
+	for _, form := range forms {
+		adoptions = append(adoptions, adoption{Form: form, Rooms: rooms, Action: action})
+	}
+
+	data := app.newTemplateData(r)
+	data["Integration"] = integration
+	data["Adoptions"] = adoptions
+
+	err = response.Page(w, status, data, "pages/discoveries.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// loadIntegration fetches the registered integration named by the {name} URL
+// parameter, and the household's entry of it if it has been added. If it
+// cannot be loaded an error response is written and ok is false.
+func (app *application) loadIntegration(w http.ResponseWriter, r *http.Request) (integration integrations.Integration, entry *database.IntegrationEntry, ok bool) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	integration, ok = integrations.Default.Get(chi.URLParam(r, "name"))
+	if !ok {
+		app.notFound(w, r)
+		return nil, nil, false
+	}
+
+	entry, err := app.db.GetIntegrationEntry(r.Context(), householdID, integration.Name())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return integration, nil, true
+	case err != nil:
+		app.serverError(w, r, err)
+		return nil, nil, false
+	}
+
+	return integration, entry, true
+}
+
+// adoptFormFor fills the form adopting a discovered device.
+func adoptFormFor(integration integrations.Integration, d integrations.Discovery) adoptForm {
+	form := adoptForm{
+		deviceForm: deviceForm{
+			Name:         d.Name,
+			Kind:         d.Kind,
+			Protocol:     integration.Name(),
+			Address:      d.Address,
+			Capabilities: d.Capabilities,
+		},
+		Vendor: d.Vendor,
+		Model:  d.Model,
+	}
+	if len(d.Config) > 0 {
+		js, _ := json.Marshal(d.Config)
+		form.Config = string(js)
+	}
+	return form
+}
+
+func integrationPath(integration integrations.Integration) string {
+	return "/integrations/" + integration.Name()
+}
+
+// addedDevices returns the devices of every household using the protocols,
+// and the Hue bridges paired by any of them, keyed by protocol and address.
+// A device on the local network must only be followed once, so one added by
+// a household cannot be adopted by another.
+func (app *application) addedDevices(ctx context.Context, protocols ...string) (map[string]bool, error) {
+	added := map[string]bool{}
+	for _, protocol := range slices.Compact(slices.Sorted(slices.Values(protocols))) {
+
+		devices, err := app.db.ListDevicesByProtocol(ctx, protocol)
+		if err != nil {
+			return nil, err
+		}
+		for _, device := range devices {
+			added[device.Protocol+" "+device.Address] = true
+		}
+
+		if protocol != hue.Protocol {
+			continue
+		}
+		bridges, err := app.db.ListHueBridges(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, bridge := range bridges {
+			added[hue.Protocol+" "+bridge.Address] = true
+		}
+	}
+	return added, nil
+}
+
+// discoversFor reports whether the devices discovered on the local network
+// are shown to a household. The server's network is that of a single
+// household, configured with DISCOVERY_HOUSEHOLD_ID.
+func (app *application) discoversFor(householdID int64) bool {
+	return app.discovery != nil && householdID == app.config.discovery.householdID
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/discovery"
+	"github.com/wumbabum/home_assist/internal/events"
+	"github.com/wumbabum/home_assist/internal/integrations"
+	"github.com/wumbabum/home_assist/internal/integrations/mqtt"
+	"github.com/wumbabum/home_assist/internal/integrations/shelly"
+	"github.com/wumbabum/home_assist/internal/integrations/wled"
+	"github.com/wumbabum/home_assist/internal/integrations/zigbee2mqtt"
+)
+
+// runIntegrations sets up every registered integration, which follows the
+// devices of the households that enabled it. Integrations the server is not
+// configured for are left out, and shut down with the server.
+func (app *application) runIntegrations() {
+	app.integrations = map[string]integrations.Integration{}
+
+	host := integrations.Host{
+		DB:       app.db,
+		Secrets:  app.secrets,
+		OnState:  app.reportDeviceState,
+		OnChange: app.devicesChanged,
+		Logger:   app.logger,
+		Config: map[string]any{
+			mqtt.Protocol: mqtt.IntegrationConfig{
+				Config: mqtt.Config{
+					Broker:     app.config.mqtt.broker,
+					ClientID:   app.config.mqtt.clientID,
+					Username:   app.config.mqtt.username,
+					Password:   app.config.mqtt.password,
+					QoS:        byte(app.config.mqtt.qos),
+					MaxBackoff: app.config.mqtt.reconnectMax,
+				},
+				HouseholdTopics: app.config.mqtt.embedded,
+				HouseholdID:     app.config.mqtt.householdID,
+				DiscoveryPrefix: app.config.mqtt.discoveryPrefix,
+			},
+			zigbee2mqtt.Name: zigbee2mqtt.Config{
+				BaseTopic:       app.config.mqtt.zigbee2mqttBaseTopic,
+				HouseholdTopics: app.config.mqtt.embedded,
+				HouseholdID:     app.config.mqtt.householdID,
+			},
+			shelly.Protocol: shelly.Config{PollInterval: app.config.shelly.pollInterval},
+			wled.Protocol:   wled.Config{PollInterval: app.config.wled.pollInterval},
+		},
+		Integrations: app.integrations,
+	}
+
+	// Integrations that run on another are set up once it is
+	var dependents []integrations.Integration
+	for _, integration := range integrations.Default.All() {
+		if _, ok := integration.(integrations.Dependent); ok {
+			dependents = append(dependents, integration)
+			continue
+		}
+		app.setupIntegration(host, integration)
+	}
+	for _, integration := range dependents {
+		dependsOn := integration.(integrations.Dependent).DependsOn()
+		if _, ok := app.integrations[dependsOn]; !ok {
+			app.logger.Info("integration unavailable, the integration it runs on is not set up", "integration", integration.Name(), "depends_on", dependsOn)
+			continue
+		}
+		app.setupIntegration(host, integration)
+	}
+
+	app.backgroundTask("integrations", func() error {
+		<-app.shutdown
+
+		ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownPeriod)
+		defer cancel()
+
+		var errs []error
+		for _, integration := range app.integrations {
+			err := integration.Shutdown(ctx)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	})
+}
+
+// setupIntegration sets up an integration, adding it to those set up unless
+// it failed or the server is not configured for it.
+func (app *application) setupIntegration(host integrations.Host, integration integrations.Integration) {
+	err := integration.Setup(context.Background(), host)
+	switch {
+	case errors.Is(err, integrations.ErrUnavailable):
+		app.logger.Info("integration unavailable, the server is not configured for it", "integration", integration.Name())
+	case err != nil:
+		app.logger.Error("failed to set up integration", "integration", integration.Name(), "error", err)
+	default:
+		app.integrations[integration.Name()] = integration
+	}
+}
+
+// runDiscovery listens for devices announcing themselves on the local
+// network, unless disabled, for the household on that network to adopt those
+// an integration handles.
+func (app *application) runDiscovery() {
+	if !app.config.discovery.enabled {
+		app.logger.Info("local network discovery disabled")
+		return
+	}
+	if app.config.discovery.householdID == 0 {
+		app.logger.Info("local network discovery disabled, no household configured for the network")
+		return
+	}
+
+	app.discovery = discovery.New(discovery.Config{
+		MDNSAddress: app.config.discovery.mdnsAddress,
+		SSDPAddress: app.config.discovery.ssdpAddress,
+	}, integrations.Default, app.logger)
+
+	app.backgroundTask("discovery", func() error {
+		ctx, cancel := app.shutdownContext()
+		defer cancel()
+
+		return app.discovery.Run(ctx)
+	})
+}
+
+// reloadDevices updates the integrations following devices after devices or
+// integration entries have been saved or deleted.
+func (app *application) reloadDevices() {
+	for _, integration := range app.integrations {
+		integration.Reload()
+	}
+}
+
+// devicesChanged reloads the integrations after one created, updated or
+// deleted devices by itself, publishing a device_added event for each device
+// it created.
+func (app *application) devicesChanged(ctx context.Context, householdID int64, added []database.Device) {
+	app.reloadDevices()
+
+	for _, device := range added {
+		app.events.Publish(events.NewDeviceAdded(householdID, events.DeviceAdded{
+			DeviceID: device.ID,
+			Name:     device.Name,
+			Kind:     device.Kind,
+			Protocol: device.Protocol,
+		}))
+	}
+}
+
+func (app *application) reportDeviceState(ctx context.Context, device database.Device, state database.DeviceState) {
+	_, err := app.updateDeviceState(ctx, &device, state)
+	// The device may have been deleted before the integration was reloaded
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.logger.Error("failed to save reported device state", "device_id", device.ID, "error", err)
+	}
+}
+
+// updateDeviceState saves state reported by a device, publishing a
+// state_changed event with the attributes that changed. Devices repeat their
+// state often, so nothing is saved when the state is unchanged.
+func (app *application) updateDeviceState(ctx context.Context, device *database.Device, state database.DeviceState) (*database.Device, error) {
+	current, err := app.db.GetDevice(ctx, device.HouseholdID, device.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := database.DeviceState{}
+	for attr, value := range state {
+		if !reflect.DeepEqual(current.State[attr], value) {
+			changes[attr] = value
+		}
+	}
+	if len(changes) == 0 {
+		return current, nil
+	}
+
+	updated, err := app.db.UpdateDeviceState(ctx, device.HouseholdID, device.ID, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	app.events.Publish(events.NewStateChanged(updated.HouseholdID, events.StateChanged{
+		DeviceID: updated.ID,
+		State:    updated.State,
+		Changes:  changes,
+	}))
+
+	return updated, nil
+}
+
+// integrationEnabled reports whether a household has added and enabled an
+// integration.
+func (app *application) integrationEnabled(ctx context.Context, householdID int64, name string) (bool, error) {
+	entry, err := app.db.GetIntegrationEntry(ctx, householdID, name)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return entry.Enabled, nil
+}
+
+// handleCommand sends a state change to a device through the integration of
+// its protocol, which the household must have enabled and the server be
+// configured for.
+func (app *application) handleCommand(ctx context.Context, integration integrations.Integration, device *database.Device, state database.DeviceState) error {
+	enabled, err := app.integrationEnabled(ctx, device.HouseholdID, integration.Name())
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return newCommandError("the %s integration is not enabled", integration.Title())
+	}
+
+	if _, ok := app.integrations[integration.Name()]; !ok {
+		return newCommandError("the %s integration is unavailable", integration.Title())
+	}
+
+	err = integration.HandleCommand(ctx, device, state)
+	if err != nil {
+		return newCommandError("device could not be reached: %v", err)
+	}
+	return nil
+}
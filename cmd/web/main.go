@@ -9,10 +9,20 @@ import (
 	"runtime/debug"
 	"sync"
 	"time"
+	_ "time/tzdata" // Household timezones must load on hosts without a zoneinfo database
 
 	"github.com/wumbabum/home_assist/internal/authenticator"
+	"github.com/wumbabum/home_assist/internal/automation"
+	"github.com/wumbabum/home_assist/internal/broker"
 	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/discovery"
 	"github.com/wumbabum/home_assist/internal/env"
+	"github.com/wumbabum/home_assist/internal/events"
+	"github.com/wumbabum/home_assist/internal/integrations"
+	"github.com/wumbabum/home_assist/internal/integrations/mqtt"
+	"github.com/wumbabum/home_assist/internal/integrations/zigbee2mqtt"
+	"github.com/wumbabum/home_assist/internal/scheduler"
+	"github.com/wumbabum/home_assist/internal/secrets"
 	"github.com/wumbabum/home_assist/internal/version"
 
 	"github.com/alexedwards/scs/postgresstore"
@@ -47,14 +57,55 @@ type config struct {
 	session struct {
 		cookieName string
 	}
+	history struct {
+		retentionDays int
+	}
+	mqtt struct {
+		broker       string
+		clientID     string
+		username     string
+		password     string
+		qos          int
+		reconnectMax time.Duration
+		embedded     bool  // Connected to the embedded broker, where topics are per household
+		householdID  int64 // The household of devices found on another broker
+
+		discoveryPrefix      string
+		zigbee2mqttBaseTopic string
+	}
+	broker struct {
+		enabled bool
+		address string
+	}
+	shelly struct {
+		pollInterval time.Duration
+	}
+	wled struct {
+		pollInterval time.Duration
+	}
+	discovery struct {
+		enabled     bool
+		householdID int64 // The household whose network the server is on
+		mdnsAddress string
+		ssdpAddress string
+	}
+	secretKey string // Encrypts the credentials stored in the database, such as Hue application keys
 }
 
 type application struct {
 	auth0          *authenticator.Authenticator
+	automations    *automation.Engine
+	broker         *broker.Broker // nil unless the embedded broker is enabled
 	config         config
 	db             *database.DB
+	discovery      *discovery.Discoverer // nil when discovery is disabled
+	events         *events.Bus
+	integrations   map[string]integrations.Integration // Those set up, by name
 	logger         *slog.Logger
+	schedules      *scheduler.Scheduler
+	secrets        *secrets.Cipher // nil when no secret key is configured
 	sessionManager *scs.SessionManager
+	shutdown       chan struct{} // Closed when the server starts shutting down
 	wg             sync.WaitGroup
 }
 
@@ -71,9 +122,29 @@ func run(logger *slog.Logger) error {
 	cfg.auth0.callbackURL = env.GetString("AUTH0_CALLBACK_URL", "http://localhost:5749/callback")
 	cfg.baseURL = env.GetString("BASE_URL", "http://localhost:5749")
 	cfg.httpPort = env.GetInt("HTTP_PORT", 5749)
+	cfg.secretKey = env.GetString("SECRET_KEY", "")
 	cfg.db.dsn = env.GetString("DB_DSN", "user:pass@localhost:5432/db")
 	cfg.db.automigrate = env.GetBool("DB_AUTOMIGRATE", true)
 	cfg.session.cookieName = env.GetString("SESSION_COOKIE_NAME", "session_ux762yqp")
+	cfg.history.retentionDays = env.GetInt("HISTORY_RETENTION_DAYS", 30)
+	cfg.mqtt.broker = env.GetString("MQTT_BROKER", "")
+	cfg.mqtt.clientID = env.GetString("MQTT_CLIENT_ID", mqtt.DefaultClientID)
+	cfg.mqtt.username = env.GetString("MQTT_USERNAME", "")
+	cfg.mqtt.password = env.GetString("MQTT_PASSWORD", "")
+	cfg.mqtt.qos = env.GetInt("MQTT_QOS", 1)
+	cfg.mqtt.reconnectMax = time.Duration(env.GetInt("MQTT_RECONNECT_MAX_SECONDS", 60)) * time.Second
+	// MQTT_DISCOVERY_HOUSEHOLD_ID is the name from before Zigbee2MQTT used it too
+	cfg.mqtt.householdID = int64(env.GetInt("MQTT_HOUSEHOLD_ID", env.GetInt("MQTT_DISCOVERY_HOUSEHOLD_ID", 0)))
+	cfg.mqtt.discoveryPrefix = env.GetString("MQTT_DISCOVERY_PREFIX", mqtt.DefaultDiscoveryPrefix)
+	cfg.mqtt.zigbee2mqttBaseTopic = env.GetString("ZIGBEE2MQTT_BASE_TOPIC", zigbee2mqtt.DefaultBaseTopic)
+	cfg.broker.enabled = env.GetBool("MQTT_BROKER_ENABLED", false)
+	cfg.broker.address = env.GetString("MQTT_BROKER_ADDR", ":1883")
+	cfg.shelly.pollInterval = time.Duration(env.GetInt("SHELLY_POLL_SECONDS", 30)) * time.Second
+	cfg.wled.pollInterval = time.Duration(env.GetInt("WLED_POLL_SECONDS", 30)) * time.Second
+	cfg.discovery.enabled = env.GetBool("DISCOVERY_ENABLED", false)
+	cfg.discovery.householdID = int64(env.GetInt("DISCOVERY_HOUSEHOLD_ID", 0))
+	cfg.discovery.mdnsAddress = env.GetString("DISCOVERY_MDNS_ADDR", discovery.DefaultMDNSAddress)
+	cfg.discovery.ssdpAddress = env.GetString("DISCOVERY_SSDP_ADDR", discovery.DefaultSSDPAddress)
 
 	showVersion := flag.Bool("version", false, "display version and exit")
 
@@ -84,6 +155,22 @@ func run(logger *slog.Logger) error {
 		return nil
 	}
 
+	if cfg.mqtt.qos < 0 || cfg.mqtt.qos > 2 {
+		return fmt.Errorf("MQTT_QOS must be 0, 1 or 2, got %d", cfg.mqtt.qos)
+	}
+
+	var cipher *secrets.Cipher
+	if cfg.secretKey != "" {
+		key, err := secrets.ParseKey(cfg.secretKey)
+		if err != nil {
+			return fmt.Errorf("SECRET_KEY is invalid: %w", err)
+		}
+		cipher, err = secrets.NewCipher(key)
+		if err != nil {
+			return err
+		}
+	}
+
 	db, err := database.New(cfg.db.dsn)
 	if err != nil {
 		return err
@@ -116,9 +203,33 @@ func run(logger *slog.Logger) error {
 		auth0:          auth0,
 		config:         cfg,
 		db:             db,
+		events:         events.NewBus(logger),
 		logger:         logger,
+		secrets:        cipher,
 		sessionManager: sessionManager,
+		shutdown:       make(chan struct{}),
+	}
+
+	app.subscribe(events.SubscribeOptions{Name: "log", Policy: events.DropNewest}, func(e events.Event) {
+		app.logger.Debug("event published", "type", e.Type, "household_id", e.HouseholdID, "payload", e.Payload)
+	})
+	app.subscribe(events.SubscribeOptions{
+		Name:   "history",
+		Filter: events.Filter{Types: []events.Type{events.TypeStateChanged}},
+		Buffer: 256,
+		Policy: events.Block,
+	}, app.recordStateChange)
+
+	app.pruneStateHistory()
+	app.runAutomations()
+	app.runScheduler()
+
+	err = app.startBroker()
+	if err != nil {
+		return err
 	}
+	app.runIntegrations()
+	app.runDiscovery()
 
 	return app.serveHTTP()
 }
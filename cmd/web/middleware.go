@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 
+	"github.com/wumbabum/home_assist/internal/database"
 	"github.com/wumbabum/home_assist/internal/response"
 
 	"github.com/tomasen/realip"
@@ -23,6 +27,132 @@ func (app *application) requireAuth(next http.Handler) http.Handler {
 	})
 }
 
+// loadHousehold stores the membership of the user's active household in the
+// request context. It must be used after requireAuth.
+func (app *application) loadHousehold(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := app.sessionManager.GetInt64(r.Context(), "user_id")
+		if userID == 0 {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		member, err := app.activeHouseholdMember(r.Context(), userID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, contextSetHouseholdMember(r, member))
+	})
+}
+
+// authenticateAPI resolves the caller of a JSON API request from either a
+// personal API token in the Authorization header or, for requests from the
+// browser, the session cookie. Their active household membership is stored
+// in the request context, and 401 is returned when nobody is signed in.
+func (app *application) authenticateAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+
+		plaintext, present, ok := bearerToken(r)
+		if !ok {
+			app.apiInvalidToken(w, r)
+			return
+		}
+
+		if present {
+			member, err := app.apiTokenMember(r.Context(), plaintext)
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				app.apiInvalidToken(w, r)
+				return
+			case err != nil:
+				app.apiServerError(w, r, err)
+				return
+			}
+
+			next.ServeHTTP(w, contextSetHouseholdMember(r, member))
+			return
+		}
+
+		userID := app.sessionManager.GetInt64(r.Context(), "user_id")
+		if userID == 0 {
+			app.apiUnauthorized(w, r)
+			return
+		}
+
+		member, err := app.activeHouseholdMember(r.Context(), userID)
+		if err != nil {
+			app.apiServerError(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, contextSetHouseholdMember(r, member))
+	})
+}
+
+// apiTokenMember returns the household membership a personal API token acts
+// as, limited to the token's scopes. It returns sql.ErrNoRows if the token is
+// invalid, expired or revoked, or its owner has left the household.
+func (app *application) apiTokenMember(ctx context.Context, plaintext string) (*database.HouseholdMember, error) {
+	token, err := app.db.AuthenticateAPIToken(ctx, hashAPIToken(plaintext))
+	if err != nil {
+		return nil, err
+	}
+
+	// The owner may have left the household since the token was created
+	member, err := app.db.GetHouseholdMember(ctx, token.HouseholdID, token.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return scopeMember(member, token.Scopes), nil
+}
+
+// requirePermission only lets requests through when the role of the user in
+// their active household grants every listed permission. It must be used after
+// loadHousehold.
+func (app *application) requirePermission(permissions ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasPermissions(contextGetHouseholdMember(r), permissions) {
+				app.forbidden(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireAPIPermission is requirePermission for JSON API routes.
+func (app *application) requireAPIPermission(permissions ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasPermissions(contextGetHouseholdMember(r), permissions) {
+				app.apiForbidden(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func hasPermissions(member *database.HouseholdMember, permissions []string) bool {
+	if member == nil {
+		return false
+	}
+
+	for _, permission := range permissions {
+		if !member.Can(permission) {
+			return false
+		}
+	}
+	return true
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
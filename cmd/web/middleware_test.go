@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
 )
 
 func TestRequireAuth_NoSession(t *testing.T) {
@@ -92,3 +94,67 @@ func TestLogAccess(t *testing.T) {
 		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
 	}
 }
+
+func TestLoadHousehold_NoUserID(t *testing.T) {
+	// Sessions created before users were persisted carry a profile but no user_id
+	app := newTestApplicationWithSession(t)
+
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be called without a user_id in the session")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	w := httptest.NewRecorder()
+
+	handler := app.sessionManager.LoadAndSave(app.loadHousehold(testHandler))
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("expected status %d, got %d", http.StatusSeeOther, w.Code)
+	}
+
+	if location := w.Header().Get("Location"); location != "/login" {
+		t.Errorf("expected redirect to /login, got %s", location)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	app := newTestApplication(t)
+
+	guest := &database.HouseholdMember{
+		Role:        database.RoleGuest,
+		Permissions: []string{database.PermissionDevicesView, database.PermissionDevicesControl},
+	}
+
+	tests := []struct {
+		name        string
+		member      *database.HouseholdMember
+		permissions []string
+		expected    int
+	}{
+		{"granted", guest, []string{database.PermissionDevicesControl}, http.StatusOK},
+		{"all granted", guest, []string{database.PermissionDevicesView, database.PermissionDevicesControl}, http.StatusOK},
+		{"one missing", guest, []string{database.PermissionDevicesControl, database.PermissionAutomationsEdit}, http.StatusForbidden},
+		{"no household", nil, []string{database.PermissionDevicesView}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.member != nil {
+				req = contextSetHouseholdMember(req, tt.member)
+			}
+			w := httptest.NewRecorder()
+
+			app.requirePermission(tt.permissions...)(testHandler).ServeHTTP(w, req)
+
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, w.Code)
+			}
+		})
+	}
+}
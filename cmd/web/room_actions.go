@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/request"
+	"github.com/wumbabum/home_assist/internal/response"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+type roomForm struct {
+	Name      string              `form:"Name"`
+	FloorID   int64               `form:"FloorID"`
+	Validator validator.Validator `form:"-"`
+}
+
+func (f *roomForm) validate(floors []database.Floor) {
+	f.Validator.CheckField(validator.NotBlank(f.Name), "Name", "Name is required")
+	f.Validator.CheckField(validator.MaxRunes(f.Name, 100), "Name", "Name must not be more than 100 characters")
+
+	floorIDs := []int64{0}
+	for _, floor := range floors {
+		floorIDs = append(floorIDs, floor.ID)
+	}
+	f.Validator.CheckField(validator.In(f.FloorID, floorIDs...), "FloorID", "Floor does not exist")
+}
+
+type floorForm struct {
+	Name      string              `form:"Name"`
+	Level     int                 `form:"Level"`
+	Validator validator.Validator `form:"-"`
+}
+
+type moveDeviceForm struct {
+	RoomID int64 `form:"RoomID"`
+}
+
+// roomGroup is a room together with the devices assigned to it.
+type roomGroup struct {
+	Room    database.Room
+	Devices []database.Device
+}
+
+// floorGroup is a floor together with its rooms. Floor is nil for the group of
+// rooms that are not on any floor.
+type floorGroup struct {
+	Floor *database.Floor
+	Rooms []roomGroup
+}
+
+func (app *application) listRooms(w http.ResponseWriter, r *http.Request) {
+	app.renderRooms(w, r, http.StatusOK, floorForm{})
+}
+
+func (app *application) showRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := app.loadRoom(w, r)
+	if !ok {
+		return
+	}
+
+	app.renderRoom(w, r, http.StatusOK, room, sceneForm{})
+}
+
+func (app *application) newRoom(w http.ResponseWriter, r *http.Request) {
+	app.renderRoomForm(w, r, http.StatusOK, "/rooms/new", roomForm{})
+}
+
+func (app *application) createRoom(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	var form roomForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	floors, err := app.db.ListFloors(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	form.validate(floors)
+	if form.Validator.HasErrors() {
+		app.renderRoomForm(w, r, http.StatusUnprocessableEntity, "/rooms/new", form)
+		return
+	}
+
+	room := database.Room{HouseholdID: householdID, Name: form.Name, FloorID: optionalID(form.FloorID)}
+
+	err = app.db.CreateRoom(r.Context(), &room)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/rooms/"+strconv.FormatInt(room.ID, 10), http.StatusSeeOther)
+}
+
+func (app *application) editRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := app.loadRoom(w, r)
+	if !ok {
+		return
+	}
+
+	form := roomForm{Name: room.Name}
+	if room.FloorID != nil {
+		form.FloorID = *room.FloorID
+	}
+
+	app.renderRoomForm(w, r, http.StatusOK, roomEditPath(room), form)
+}
+
+func (app *application) updateRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := app.loadRoom(w, r)
+	if !ok {
+		return
+	}
+
+	var form roomForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	floors, err := app.db.ListFloors(r.Context(), room.HouseholdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	form.validate(floors)
+	if form.Validator.HasErrors() {
+		app.renderRoomForm(w, r, http.StatusUnprocessableEntity, roomEditPath(room), form)
+		return
+	}
+
+	room.Name = form.Name
+	room.FloorID = optionalID(form.FloorID)
+
+	err = app.db.UpdateRoom(r.Context(), room)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/rooms/"+strconv.FormatInt(room.ID, 10), http.StatusSeeOther)
+}
+
+func (app *application) deleteRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := app.loadRoom(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.db.DeleteRoom(r.Context(), room.HouseholdID, room.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/rooms", http.StatusSeeOther)
+}
+
+func (app *application) createFloor(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	var form floorForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	form.Validator.CheckField(validator.NotBlank(form.Name), "Name", "Name is required")
+	form.Validator.CheckField(validator.MaxRunes(form.Name, 100), "Name", "Name must not be more than 100 characters")
+	form.Validator.CheckField(validator.Between(form.Level, -10, 200), "Level", "Level must be between -10 and 200")
+	if form.Validator.HasErrors() {
+		app.renderRooms(w, r, http.StatusUnprocessableEntity, form)
+		return
+	}
+
+	_, err = app.db.CreateFloor(r.Context(), householdID, form.Name, form.Level)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/rooms", http.StatusSeeOther)
+}
+
+func (app *application) deleteFloor(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	id, err := readIDParam(r)
+	if err != nil {
+		app.notFound(w, r)
+		return
+	}
+
+	err = app.db.DeleteFloor(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.notFound(w, r)
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/rooms", http.StatusSeeOther)
+}
+
+// moveDevice assigns a device to the room given in the form, or unassigns it
+// when RoomID is 0. It backs the drag and drop on the rooms page.
+func (app *application) moveDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.loadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	var form moveDeviceForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if form.RoomID != 0 {
+		_, err := app.db.GetRoom(r.Context(), device.HouseholdID, form.RoomID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			app.badRequest(w, r, errors.New("room does not exist"))
+			return
+		case err != nil:
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	err = app.db.SetDeviceRoom(r.Context(), device.HouseholdID, device.ID, optionalID(form.RoomID))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/rooms", http.StatusSeeOther)
+}
+
+// renderRooms renders the rooms overview, which also hosts the add floor form.
+func (app *application) renderRooms(w http.ResponseWriter, r *http.Request, status int, form floorForm) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	floors, err := app.db.ListFloors(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	rooms, err := app.db.ListRooms(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	devices, err := app.db.ListDevices(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	scenes, err := app.db.ListScenes(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Scenes captured in a room are listed on the room's page
+	scenes = slices.DeleteFunc(scenes, func(scene database.Scene) bool { return scene.RoomID != nil })
+
+	groups, unassigned := groupRooms(floors, rooms, devices)
+
+	data := app.newTemplateData(r)
+	data["Form"] = form
+	data["Groups"] = groups
+	data["Unassigned"] = unassigned
+	data["Scenes"] = scenes
+
+	err = response.Page(w, status, data, "pages/rooms.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) renderRoom(w http.ResponseWriter, r *http.Request, status int, room *database.Room, form sceneForm) {
+	devices, err := app.db.ListDevicesInRoom(r.Context(), room.HouseholdID, room.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	scenes, err := app.db.ListScenesInRoom(r.Context(), room.HouseholdID, room.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data["Room"] = room
+	data["Devices"] = devices
+	data["Scenes"] = scenes
+	data["SceneForm"] = form
+
+	if room.FloorID != nil {
+		floors, err := app.db.ListFloors(r.Context(), room.HouseholdID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		for _, floor := range floors {
+			if floor.ID == *room.FloorID {
+				data["Floor"] = floor
+			}
+		}
+	}
+
+	err = response.Page(w, status, data, "pages/room.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) renderRoomForm(w http.ResponseWriter, r *http.Request, status int, action string, form roomForm) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	floors, err := app.db.ListFloors(r.Context(), householdID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data["Form"] = form
+	data["Action"] = action
+	data["Floors"] = floors
+
+	err = response.Page(w, status, data, "pages/room_form.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// loadRoom fetches the room identified by the {id} URL parameter. If it cannot
+// be loaded an error response is written and ok is false.
+func (app *application) loadRoom(w http.ResponseWriter, r *http.Request) (room *database.Room, ok bool) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	id, err := readIDParam(r)
+	if err != nil {
+		app.notFound(w, r)
+		return nil, false
+	}
+
+	room, err = app.db.GetRoom(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.notFound(w, r)
+		return nil, false
+	case err != nil:
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	return room, true
+}
+
+func roomEditPath(room *database.Room) string {
+	return "/rooms/" + strconv.FormatInt(room.ID, 10) + "/edit"
+}
+
+// groupRooms arranges rooms under their floors and devices under their rooms.
+// Rooms without a floor are collected in a final group with a nil Floor, and
+// devices without a room are returned separately.
+func groupRooms(floors []database.Floor, rooms []database.Room, devices []database.Device) (groups []floorGroup, unassigned []database.Device) {
+	devicesByRoom := map[int64][]database.Device{}
+	for _, device := range devices {
+		if device.RoomID == nil {
+			unassigned = append(unassigned, device)
+			continue
+		}
+		devicesByRoom[*device.RoomID] = append(devicesByRoom[*device.RoomID], device)
+	}
+
+	roomsByFloor := map[int64][]roomGroup{}
+	var floorless []roomGroup
+	for _, room := range rooms {
+		group := roomGroup{Room: room, Devices: devicesByRoom[room.ID]}
+		if room.FloorID == nil {
+			floorless = append(floorless, group)
+			continue
+		}
+		roomsByFloor[*room.FloorID] = append(roomsByFloor[*room.FloorID], group)
+	}
+
+	for i := range floors {
+		groups = append(groups, floorGroup{Floor: &floors[i], Rooms: roomsByFloor[floors[i].ID]})
+	}
+	if len(floorless) > 0 {
+		groups = append(groups, floorGroup{Rooms: floorless})
+	}
+
+	return groups, unassigned
+}
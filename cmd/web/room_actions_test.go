@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+func TestGroupRooms(t *testing.T) {
+	ground, upstairs := int64(1), int64(2)
+	kitchen, garden := int64(10), int64(20)
+
+	floors := []database.Floor{{ID: ground, Name: "Ground"}, {ID: upstairs, Name: "Upstairs"}}
+	rooms := []database.Room{
+		{ID: kitchen, Name: "Kitchen", FloorID: &ground},
+		{ID: garden, Name: "Garden"},
+	}
+	devices := []database.Device{
+		{ID: 100, Name: "Kettle", RoomID: &kitchen},
+		{ID: 101, Name: "Sprinkler", RoomID: &garden},
+		{ID: 102, Name: "Spare plug"},
+	}
+
+	groups, unassigned := groupRooms(floors, rooms, devices)
+
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 groups, got %d", len(groups))
+	}
+
+	if groups[0].Floor.ID != ground || len(groups[0].Rooms) != 1 || groups[0].Rooms[0].Devices[0].ID != 100 {
+		t.Errorf("unexpected ground floor group: %+v", groups[0])
+	}
+	if groups[1].Floor.ID != upstairs || len(groups[1].Rooms) != 0 {
+		t.Errorf("unexpected upstairs group: %+v", groups[1])
+	}
+	if groups[2].Floor != nil || len(groups[2].Rooms) != 1 || groups[2].Rooms[0].Room.ID != garden {
+		t.Errorf("unexpected floorless group: %+v", groups[2])
+	}
+
+	if len(unassigned) != 1 || unassigned[0].ID != 102 {
+		t.Errorf("expected device 102 to be unassigned, got %v", unassigned)
+	}
+}
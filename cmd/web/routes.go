@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/wumbabum/home_assist/assets"
+	"github.com/wumbabum/home_assist/internal/database"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -29,7 +30,148 @@ func (app *application) routes() http.Handler {
 	// Protected routes
 	mux.Group(func(mux chi.Router) {
 		mux.Use(app.requireAuth)
+		mux.Use(app.loadHousehold)
 		mux.Get("/profile", app.userProfile)
+		mux.Post("/profile/tokens", app.createAPIToken)
+		mux.Post("/profile/tokens/{id}/revoke", app.revokeAPIToken)
+
+		mux.Get("/household", app.showHousehold)
+		mux.Post("/household/members/{id}/delete", app.removeMember)
+		mux.Post("/households", app.createHousehold)
+		mux.Post("/households/switch", app.switchHousehold)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionAdminUsers))
+			mux.Post("/household/invitations", app.createInvitation)
+			mux.Post("/household/invitations/{id}/delete", app.deleteInvitation)
+			mux.Post("/household/members/{id}/role", app.updateMemberRole)
+			mux.Post("/household/location", app.updateHouseholdLocation)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionDevicesView))
+			mux.Get("/devices", app.listDevices)
+			mux.Get("/devices/{id}", app.showDevice)
+			mux.Get("/devices/{id}/history", app.deviceHistory)
+			mux.Get("/rooms", app.listRooms)
+			mux.Get("/rooms/{id}", app.showRoom)
+			mux.Get("/rooms/{id}/history", app.roomHistory)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionDevicesControl))
+			mux.Post("/devices/{id}/command", app.controlDevice)
+			mux.Post("/scenes/{id}/activate", app.activateScene)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionDevicesEdit))
+			mux.Get("/devices/new", app.newDevice)
+			mux.Post("/devices/new", app.createDevice)
+			mux.Get("/devices/{id}/edit", app.editDevice)
+			mux.Post("/devices/{id}/edit", app.updateDevice)
+			mux.Post("/devices/{id}/delete", app.deleteDevice)
+			mux.Post("/devices/{id}/room", app.moveDevice)
+			mux.Post("/zigbee/permit-join", app.permitJoin)
+			mux.Get("/hue", app.listHueBridges)
+			mux.Post("/hue/pair", app.pairHueBridge)
+			mux.Post("/hue/{id}/import", app.reimportHueBridge)
+			mux.Post("/hue/{id}/delete", app.deleteHueBridge)
+			mux.Get("/integrations", app.listIntegrations)
+			mux.Get("/integrations/{name}", app.showIntegration)
+			mux.Post("/integrations/{name}", app.saveIntegration)
+			mux.Post("/integrations/{name}/enable", app.enableIntegration)
+			mux.Post("/integrations/{name}/disable", app.disableIntegration)
+			mux.Post("/integrations/{name}/delete", app.deleteIntegration)
+			mux.Get("/integrations/{name}/discover", app.discoverIntegration)
+			mux.Post("/integrations/{name}/adopt", app.adoptDevice)
+
+			mux.Get("/rooms/new", app.newRoom)
+			mux.Post("/rooms/new", app.createRoom)
+			mux.Get("/rooms/{id}/edit", app.editRoom)
+			mux.Post("/rooms/{id}/edit", app.updateRoom)
+			mux.Post("/rooms/{id}/delete", app.deleteRoom)
+			mux.Post("/rooms/{id}/scenes", app.captureRoomScene)
+			mux.Post("/scenes/{id}/delete", app.deleteScene)
+
+			mux.Post("/floors", app.createFloor)
+			mux.Post("/floors/{id}/delete", app.deleteFloor)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionDevicesEdit, database.PermissionAdminDiscovery))
+			mux.Get("/discovered", app.listDiscovered)
+			mux.Post("/discovered/adopt", app.adoptDiscovered)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionAutomationsView))
+			mux.Get("/automations", app.listAutomations)
+			mux.Get("/automations/{id}", app.showAutomation)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionAutomationsEdit))
+			mux.Get("/automations/new", app.newAutomation)
+			mux.Post("/automations/new", app.createAutomation)
+			mux.Post("/automations/dry-run", app.dryRunAutomation)
+			mux.Get("/automations/{id}/edit", app.editAutomation)
+			mux.Post("/automations/{id}/edit", app.updateAutomation)
+			mux.Post("/automations/{id}/delete", app.deleteAutomation)
+		})
+	})
+
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.NotFound(app.apiNotFound)
+		mux.MethodNotAllowed(app.apiMethodNotAllowed)
+
+		// Webhook IDs are secret and authenticate the request themselves
+		mux.Post("/webhooks/{webhookID}", app.apiReceiveWebhook)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.authenticateAPI)
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(app.requireAPIPermission(database.PermissionDevicesView))
+				mux.Get("/devices", app.apiListDevices)
+				mux.Get("/devices/{id}", app.apiShowDevice)
+				mux.Get("/devices/{id}/state", app.apiShowDeviceState)
+				mux.Get("/devices/{id}/history", app.apiListDeviceHistory)
+				mux.Get("/states", app.apiListStates)
+				mux.Get("/rooms", app.apiListRooms)
+				mux.Get("/rooms/{id}", app.apiShowRoom)
+				mux.Get("/scenes", app.apiListScenes)
+				mux.Get("/scenes/{id}", app.apiShowScene)
+				mux.Get("/events", app.streamEvents)
+				mux.Get("/ws", app.serveWebSocket)
+			})
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(app.requireAPIPermission(database.PermissionDevicesControl))
+				mux.Post("/devices/{id}/commands", app.apiSendCommand)
+				mux.Post("/scenes/{id}/activate", app.apiActivateScene)
+			})
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(app.requireAPIPermission(database.PermissionDevicesEdit))
+				mux.Post("/scenes", app.apiCreateScene)
+				mux.Delete("/scenes/{id}", app.apiDeleteScene)
+			})
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(app.requireAPIPermission(database.PermissionAutomationsView))
+				mux.Get("/automations", app.apiListAutomations)
+				mux.Get("/automations/{id}", app.apiShowAutomation)
+				mux.Get("/automations/{id}/traces", app.apiListAutomationTraces)
+			})
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(app.requireAPIPermission(database.PermissionAutomationsEdit))
+				mux.Post("/automations", app.apiCreateAutomation)
+				mux.Put("/automations/{id}", app.apiUpdateAutomation)
+				mux.Delete("/automations/{id}", app.apiDeleteAutomation)
+			})
+		})
 	})
 
 	return mux
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/request"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+type sceneForm struct {
+	Name      string              `form:"Name"`
+	Validator validator.Validator `form:"-"`
+}
+
+// captureRoomScene creates a scene from the current state of the devices in
+// the room identified by the {id} URL parameter.
+func (app *application) captureRoomScene(w http.ResponseWriter, r *http.Request) {
+	room, ok := app.loadRoom(w, r)
+	if !ok {
+		return
+	}
+
+	var form sceneForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	form.Validator.CheckField(validator.NotBlank(form.Name), "Name", "Name is required")
+	form.Validator.CheckField(validator.MaxRunes(form.Name, 100), "Name", "Name must not be more than 100 characters")
+	if form.Validator.HasErrors() {
+		app.renderRoom(w, r, http.StatusUnprocessableEntity, room, form)
+		return
+	}
+
+	scene, err := app.snapshotRoom(r.Context(), room, form.Name)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if len(scene.Targets) == 0 {
+		form.Validator.AddFieldError("Name", "None of the devices in this room have reported a state that a scene can restore")
+		app.renderRoom(w, r, http.StatusUnprocessableEntity, room, form)
+		return
+	}
+
+	err = app.db.CreateScene(r.Context(), scene)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("scene created", "scene_id", scene.ID, "room_id", room.ID, "devices", len(scene.Targets))
+
+	http.Redirect(w, r, "/rooms/"+strconv.FormatInt(room.ID, 10), http.StatusSeeOther)
+}
+
+func (app *application) activateScene(w http.ResponseWriter, r *http.Request) {
+	scene, ok := app.loadScene(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := app.applyScene(r.Context(), scene)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", report.Summary(scene.Name))
+
+	http.Redirect(w, r, scenePath(scene), http.StatusSeeOther)
+}
+
+func (app *application) deleteScene(w http.ResponseWriter, r *http.Request) {
+	scene, ok := app.loadScene(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.db.DeleteScene(r.Context(), scene.HouseholdID, scene.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("scene deleted", "scene_id", scene.ID, "name", scene.Name)
+
+	http.Redirect(w, r, scenePath(scene), http.StatusSeeOther)
+}
+
+// snapshotRoom returns an unsaved scene that restores the devices in a room
+// to their current state.
+func (app *application) snapshotRoom(ctx context.Context, room *database.Room, name string) (*database.Scene, error) {
+	devices, err := app.db.ListDevicesInRoom(ctx, room.HouseholdID, room.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	scene := &database.Scene{
+		HouseholdID: room.HouseholdID,
+		RoomID:      &room.ID,
+		Name:        name,
+		Targets:     database.SceneTargets{},
+	}
+
+	for _, device := range devices {
+		state := snapshotState(&device)
+		if len(state) > 0 {
+			scene.Targets = append(scene.Targets, database.SceneTarget{DeviceID: device.ID, State: state})
+		}
+	}
+
+	return scene, nil
+}
+
+// validateSceneTargets checks that every target names a different device of
+// the household and a state the device can be brought to.
+func (app *application) validateSceneTargets(ctx context.Context, v *validator.Validator, householdID int64, targets database.SceneTargets) error {
+	v.CheckField(len(targets) > 0, "targets", "must contain at least one device")
+
+	seen := map[int64]bool{}
+	for i, target := range targets {
+		field := func(name string) string { return fmt.Sprintf("targets.%d.%s", i, name) }
+
+		if seen[target.DeviceID] {
+			v.AddFieldError(field("device_id"), "must not be repeated")
+			continue
+		}
+		seen[target.DeviceID] = true
+
+		device, err := app.db.GetDevice(ctx, householdID, target.DeviceID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			v.AddFieldError(field("device_id"), "device does not exist")
+			continue
+		case err != nil:
+			return err
+		}
+
+		v.CheckField(len(target.State) > 0, field("state"), "must be provided")
+
+		_, err = commandsForState(device, target.State)
+		if err != nil {
+			v.AddFieldError(field("state"), err.Error())
+		}
+	}
+
+	return nil
+}
+
+// loadScene fetches the scene identified by the {id} URL parameter. If it
+// cannot be loaded an error response is written and ok is false.
+func (app *application) loadScene(w http.ResponseWriter, r *http.Request) (scene *database.Scene, ok bool) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	id, err := readIDParam(r)
+	if err != nil {
+		app.notFound(w, r)
+		return nil, false
+	}
+
+	scene, err = app.db.GetScene(r.Context(), householdID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.notFound(w, r)
+		return nil, false
+	case err != nil:
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	return scene, true
+}
+
+// scenePath is the page that lists a scene: its room, or the rooms overview
+// for scenes that do not belong to one.
+func scenePath(scene *database.Scene) string {
+	if scene.RoomID == nil {
+		return "/rooms"
+	}
+	return "/rooms/" + strconv.FormatInt(*scene.RoomID, 10)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+// sceneAttributes are the state attributes a scene captures and restores, in
+// the order they are applied. "on" comes last so that turning a light off is
+// not undone by setting its brightness.
+var sceneAttributes = []string{"locked", "position", "target_temperature", "color", "color_temperature", "brightness", "on"}
+
+// sceneDeviceResult reports whether a device reached its target state.
+type sceneDeviceResult struct {
+	DeviceID int64  `json:"device_id"`
+	Name     string `json:"name,omitempty"`
+	Reached  bool   `json:"reached"`
+	Error    string `json:"error,omitempty"`
+}
+
+// sceneReport is the outcome of activating a scene. Activated is false when a
+// target was invalid, in which case no device was changed.
+type sceneReport struct {
+	SceneID   int64               `json:"scene_id"`
+	Activated bool                `json:"activated"`
+	Devices   []sceneDeviceResult `json:"devices"`
+}
+
+// Failed returns the devices that did not reach their target state.
+func (r sceneReport) Failed() []sceneDeviceResult {
+	var failed []sceneDeviceResult
+	for _, d := range r.Devices {
+		if !d.Reached {
+			failed = append(failed, d)
+		}
+	}
+	return failed
+}
+
+// Summary describes the outcome in a sentence for a flash message or error.
+func (r sceneReport) Summary(name string) string {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return fmt.Sprintf("%s activated.", name)
+	}
+
+	var problems []string
+	for _, d := range failed {
+		if d.Error == "" {
+			continue
+		}
+		label := d.Name
+		if label == "" {
+			label = fmt.Sprintf("device %d", d.DeviceID)
+		}
+		problems = append(problems, fmt.Sprintf("%s (%s)", label, d.Error))
+	}
+
+	if !r.Activated {
+		return fmt.Sprintf("%s was not activated: %s.", name, strings.Join(problems, ", "))
+	}
+	return fmt.Sprintf("%s activated, but %d of %d devices did not reach their target: %s.", name, len(failed), len(r.Devices), strings.Join(problems, ", "))
+}
+
+// snapshotState returns the part of a device's current state that a scene
+// can restore.
+func snapshotState(device *database.Device) database.DeviceState {
+	state := database.DeviceState{}
+	for _, attribute := range sceneAttributes {
+		value, ok := device.State[attribute]
+		if !ok {
+			continue
+		}
+		state[attribute] = value
+		if _, err := commandsForState(device, state); err != nil {
+			delete(state, attribute)
+		}
+	}
+	return state
+}
+
+// commandsForState returns the commands that bring a device to the given
+// state, checking each against the device's capabilities.
+func commandsForState(device *database.Device, state database.DeviceState) ([]deviceCommand, error) {
+	for attribute := range state {
+		if !slices.Contains(sceneAttributes, attribute) {
+			return nil, newCommandError("%s cannot be set by a scene", attribute)
+		}
+	}
+
+	var cmds []deviceCommand
+	for _, attribute := range sceneAttributes {
+		value, ok := state[attribute]
+		if !ok {
+			continue
+		}
+
+		var cmd deviceCommand
+		switch attribute {
+		case "on":
+			on, ok := value.(bool)
+			if !ok {
+				return nil, newCommandError("on must be true or false")
+			}
+			cmd.Command = "turn_off"
+			if on {
+				cmd.Command = "turn_on"
+			}
+		case "locked":
+			locked, ok := value.(bool)
+			if !ok {
+				return nil, newCommandError("locked must be true or false")
+			}
+			cmd.Command = "unlock"
+			if locked {
+				cmd.Command = "lock"
+			}
+		case "position":
+			cmd = deviceCommand{Command: "set_position", Params: map[string]any{"position": value}}
+		case "target_temperature":
+			cmd = deviceCommand{Command: "set_target_temperature", Params: map[string]any{"temperature": value}}
+		case "color":
+			cmd = deviceCommand{Command: "set_color", Params: map[string]any{"color": value}}
+		case "color_temperature":
+			cmd = deviceCommand{Command: "set_color_temperature", Params: map[string]any{"kelvin": value}}
+		case "brightness":
+			cmd = deviceCommand{Command: "set_brightness", Params: map[string]any{"brightness": value}}
+		}
+
+		_, err := stateForCommand(device, cmd)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	return cmds, nil
+}
+
+// applyScene brings every device of a scene to its target state. All
+// targets are checked before any device is changed, so a scene naming a
+// device that has been removed or a state it no longer supports changes
+// nothing. Devices are then commanded in parallel and any that fail, or end
+// up in a different state, are listed in the report.
+func (app *application) applyScene(ctx context.Context, scene *database.Scene) (sceneReport, error) {
+	report := sceneReport{SceneID: scene.ID, Devices: make([]sceneDeviceResult, len(scene.Targets))}
+
+	devices := make([]*database.Device, len(scene.Targets))
+	plans := make([][]deviceCommand, len(scene.Targets))
+	valid := true
+
+	for i, target := range scene.Targets {
+		report.Devices[i].DeviceID = target.DeviceID
+
+		device, err := app.db.GetDevice(ctx, scene.HouseholdID, target.DeviceID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			report.Devices[i].Error = "device no longer exists"
+			valid = false
+			continue
+		case err != nil:
+			return report, err
+		}
+		devices[i] = device
+		report.Devices[i].Name = device.Name
+
+		plans[i], err = commandsForState(device, target.State)
+		if err != nil {
+			report.Devices[i].Error = err.Error()
+			valid = false
+		}
+	}
+
+	if !valid {
+		return report, nil
+	}
+	report.Activated = true
+
+	var wg sync.WaitGroup
+	for i, target := range scene.Targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Devices[i].Reached, report.Devices[i].Error = app.applyState(ctx, devices[i], plans[i], target.State)
+		}()
+	}
+	wg.Wait()
+
+	app.logger.Info("scene activated", "scene_id", scene.ID, "devices", len(scene.Targets), "failed", len(report.Failed()))
+	return report, nil
+}
+
+// applyState runs the commands planned for a device and reports whether it
+// reached the target state.
+func (app *application) applyState(ctx context.Context, device *database.Device, cmds []deviceCommand, target database.DeviceState) (bool, string) {
+	for _, cmd := range cmds {
+		updated, err := app.executeCommand(ctx, device, cmd)
+		if err != nil {
+			return false, err.Error()
+		}
+		device = updated
+	}
+
+	for attribute, value := range target {
+		if !reflect.DeepEqual(device.State[attribute], value) {
+			return false, fmt.Sprintf("%s is %v instead of %v", attribute, device.State[attribute], value)
+		}
+	}
+	return true, ""
+}
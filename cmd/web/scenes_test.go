@@ -0,0 +1,89 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+func TestCommandsForState(t *testing.T) {
+	light := &database.Device{
+		Kind:         "light",
+		Capabilities: []string{"on_off", "brightness", "color"},
+	}
+
+	tests := []struct {
+		name     string
+		state    database.DeviceState
+		expected []string
+		wantErr  bool
+	}{
+		{"dimmed", database.DeviceState{"on": true, "brightness": 30.0}, []string{"set_brightness", "turn_on"}, false},
+		{"off keeps brightness", database.DeviceState{"on": false, "brightness": 30.0, "color": "#ff8800"}, []string{"set_color", "set_brightness", "turn_off"}, false},
+		{"unsupported capability", database.DeviceState{"locked": true}, nil, true},
+		{"not settable", database.DeviceState{"temperature": 21.0}, nil, true},
+		{"wrong type", database.DeviceState{"on": "yes"}, nil, true},
+		{"out of range", database.DeviceState{"brightness": 300.0}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds, err := commandsForState(light, tt.state)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, cmd := range cmds {
+				names = append(names, cmd.Command)
+			}
+			if !slices.Equal(names, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, names)
+			}
+		})
+	}
+}
+
+func TestSnapshotState(t *testing.T) {
+	light := &database.Device{
+		Kind:         "light",
+		Capabilities: []string{"on_off", "brightness"},
+		State:        database.DeviceState{"on": true, "brightness": 55.0, "color": "#ffffff", "power": 7.5},
+	}
+
+	state := snapshotState(light)
+
+	// Read-only attributes and ones the device cannot be commanded to change
+	// are left out
+	if len(state) != 2 || state["on"] != true || state["brightness"] != 55.0 {
+		t.Errorf("unexpected snapshot %v", state)
+	}
+}
+
+func TestSceneReportSummary(t *testing.T) {
+	report := sceneReport{
+		Activated: true,
+		Devices: []sceneDeviceResult{
+			{DeviceID: 1, Name: "Lamp", Reached: true},
+			{DeviceID: 2, Name: "Blinds", Error: "device did not respond"},
+		},
+	}
+
+	summary := report.Summary("Movie night")
+	if !strings.Contains(summary, "1 of 2 devices") || !strings.Contains(summary, "Blinds (device did not respond)") {
+		t.Errorf("unexpected summary %q", summary)
+	}
+
+	report.Devices[1] = sceneDeviceResult{DeviceID: 2, Reached: true}
+	if summary := report.Summary("Movie night"); summary != "Movie night activated." {
+		t.Errorf("unexpected summary %q", summary)
+	}
+}
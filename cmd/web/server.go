@@ -29,6 +29,12 @@ func (app *application) serveHTTP() error {
 		WriteTimeout: defaultWriteTimeout,
 	}
 
+	// Long-lived connections such as event streams never become idle, so
+	// tell them to finish or Shutdown would wait for the full period.
+	srv.RegisterOnShutdown(func() {
+		close(app.shutdown)
+	})
+
 	shutdownErrorChan := make(chan error)
 
 	go func() {
@@ -39,7 +45,16 @@ func (app *application) serveHTTP() error {
 		ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownPeriod)
 		defer cancel()
 
-		shutdownErrorChan <- srv.Shutdown(ctx)
+		err := srv.Shutdown(ctx)
+
+		// Drain the MQTT broker too, even if the server did not stop in
+		// time, so clients are told it is going away and persistent
+		// sessions are saved before the database closes
+		if app.broker != nil {
+			err = errors.Join(err, app.broker.Shutdown(ctx))
+		}
+
+		shutdownErrorChan <- err
 	}()
 
 	app.logger.Info("starting server", slog.Group("server", "addr", srv.Addr))
@@ -56,6 +71,10 @@ func (app *application) serveHTTP() error {
 
 	app.logger.Info("stopped server", slog.Group("server", "addr", srv.Addr))
 
+	// Closing the bus closes every subscriber channel, letting consumers
+	// started with app.subscribe finish before we wait for them.
+	app.events.Close()
+
 	app.wg.Wait()
 	return nil
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/events"
+)
+
+const (
+	streamHeartbeat  = 25 * time.Second
+	streamRetry      = 3 * time.Second
+	streamBufferSize = 32
+)
+
+// stateChangedMessage is the data of a state_changed server-sent event.
+type stateChangedMessage struct {
+	DeviceID int64          `json:"device_id"`
+	State    map[string]any `json:"state"`
+	Changes  map[string]any `json:"changes"`
+	Time     time.Time      `json:"time"`
+}
+
+// streamEvents sends device state changes in the user's household as
+// Server-Sent Events until the client goes away or the server shuts down.
+func (app *application) streamEvents(w http.ResponseWriter, r *http.Request) {
+	member := contextGetHouseholdMember(r)
+	rc := http.NewResponseController(w)
+
+	sub := app.events.Subscribe(events.SubscribeOptions{
+		Name:   "stream",
+		Filter: events.Filter{Types: []events.Type{events.TypeStateChanged}, HouseholdID: member.HouseholdID},
+		Buffer: streamBufferSize,
+		// Only the latest state matters to a dashboard
+		Policy: events.DropOldest,
+	})
+	defer sub.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// The server's WriteTimeout would otherwise end the stream after 10
+	// seconds, so the deadline is pushed back before every write instead.
+	write := func(fn func(io.Writer) error) bool {
+		err := rc.SetWriteDeadline(time.Now().Add(defaultWriteTimeout))
+		if err == nil {
+			err = fn(w)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			app.logger.Debug("event stream closed", "error", err)
+			return false
+		}
+		return true
+	}
+
+	ok := write(func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+		return err
+	})
+	if !ok {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-app.shutdown:
+			return
+
+		case <-heartbeat.C:
+			ok = write(func(w io.Writer) error {
+				_, err := io.WriteString(w, ": heartbeat\n\n")
+				return err
+			})
+
+		case e, open := <-sub.Events():
+			if !open {
+				return
+			}
+
+			payload, _ := e.Payload.(events.StateChanged)
+			msg := stateChangedMessage{DeviceID: payload.DeviceID, State: payload.State, Changes: payload.Changes, Time: e.Time}
+
+			ok = write(func(w io.Writer) error {
+				return writeServerSentEvent(w, string(e.Type), msg)
+			})
+		}
+
+		if !ok {
+			return
+		}
+	}
+}
+
+// writeServerSentEvent writes a single named event with JSON data.
+func writeServerSentEvent(w io.Writer, event string, data any) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, js)
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+)
+
+func TestStreamEvents(t *testing.T) {
+	app := newTestApplication(t)
+	app.shutdown = make(chan struct{})
+
+	member := &database.HouseholdMember{HouseholdID: 1, UserID: 1}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.streamEvents(w, contextSetHouseholdMember(r, member))
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	next := func() string {
+		t.Helper()
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("stream ended")
+			}
+			return line
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for stream")
+		}
+		return ""
+	}
+
+	if line := next(); !strings.HasPrefix(line, "retry: ") {
+		t.Fatalf("expected retry line, got %q", line)
+	}
+	next()
+
+	// Events for other households must not be streamed
+	app.events.Publish(events.NewStateChanged(2, events.StateChanged{DeviceID: 99}))
+	app.events.Publish(events.NewStateChanged(1, events.StateChanged{DeviceID: 7, State: map[string]any{"on": true}}))
+
+	if line := next(); line != "event: state_changed" {
+		t.Fatalf("expected state_changed event, got %q", line)
+	}
+
+	var msg stateChangedMessage
+	err = json.Unmarshal([]byte(strings.TrimPrefix(next(), "data: ")), &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.DeviceID != 7 || msg.State["on"] != true {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	// Shutting down ends the stream
+	close(app.shutdown)
+	for {
+		select {
+		case _, ok := <-lines:
+			if !ok {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("stream still open after shutdown")
+		}
+	}
+}
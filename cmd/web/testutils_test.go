@@ -5,6 +5,8 @@ import (
 	"os"
 	"testing"
 
+	"github.com/wumbabum/home_assist/internal/events"
+
 	"github.com/alexedwards/scs/v2"
 )
 
@@ -17,6 +19,7 @@ func newTestApplication(t *testing.T) *application {
 	}))
 
 	return &application{
+		events: events.NewBus(logger),
 		logger: logger,
 	}
 }
@@ -33,6 +36,7 @@ func newTestApplicationWithSession(t *testing.T) *application {
 	sessionManager := scs.New()
 
 	return &application{
+		events:         events.NewBus(logger),
 		logger:         logger,
 		sessionManager: sessionManager,
 	}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/request"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+// apiTokenPrefix makes tokens easy to recognise, e.g. in secret scanners.
+const apiTokenPrefix = "ha_"
+
+var apiTokenExpiryDays = []int{0, 30, 90, 365}
+
+type apiTokenForm struct {
+	Name       string              `form:"Name"`
+	Scopes     []string            `form:"Scopes"`
+	ExpiryDays int                 `form:"ExpiryDays"`
+	Validator  validator.Validator `form:"-"`
+}
+
+func (app *application) createAPIToken(w http.ResponseWriter, r *http.Request) {
+	member := contextGetHouseholdMember(r)
+
+	var form apiTokenForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	form.Validator.CheckField(validator.NotBlank(form.Name), "Name", "Name is required")
+	form.Validator.CheckField(validator.MaxRunes(form.Name, 100), "Name", "Name must not be more than 100 characters")
+	form.Validator.CheckField(len(form.Scopes) > 0, "Scopes", "Select at least one scope")
+	form.Validator.CheckField(validator.In(form.ExpiryDays, apiTokenExpiryDays...), "ExpiryDays", "Expiry is not supported")
+	for _, scope := range form.Scopes {
+		if !member.Can(scope) {
+			form.Validator.AddFieldError("Scopes", "You cannot grant a scope you do not have")
+			break
+		}
+	}
+	if form.Validator.HasErrors() {
+		app.renderProfile(w, r, http.StatusUnprocessableEntity, form)
+		return
+	}
+
+	plaintext, hash, err := generateAPIToken()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	token := &database.APIToken{
+		UserID:      member.UserID,
+		HouseholdID: member.HouseholdID,
+		Name:        form.Name,
+		Scopes:      form.Scopes,
+	}
+	if form.ExpiryDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, form.ExpiryDays)
+		token.ExpiresAt = &expiresAt
+	}
+
+	err = app.db.CreateAPIToken(r.Context(), token, hash)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("api token created", "token_id", token.ID, "user_id", member.UserID, "scopes", token.Scopes)
+
+	// The plaintext is only ever shown once, on the next page load
+	app.sessionManager.Put(r.Context(), "new_api_token", plaintext)
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func (app *application) revokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	member := contextGetHouseholdMember(r)
+
+	id, err := readIDParam(r)
+	if err != nil {
+		app.notFound(w, r)
+		return
+	}
+
+	err = app.db.RevokeAPIToken(r.Context(), member.UserID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.notFound(w, r)
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("api token revoked", "token_id", id, "user_id", member.UserID)
+
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+// generateAPIToken returns a new random token and the hash to store for it.
+func generateAPIToken() (plaintext string, hash []byte, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", nil, err
+	}
+
+	plaintext = apiTokenPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	return plaintext, hashAPIToken(plaintext), nil
+}
+
+// hashAPIToken hashes a token for storage and lookup. Tokens carry 256 bits of
+// randomness so a plain SHA-256 is enough, no salt or slow hash is needed.
+func hashAPIToken(plaintext string) []byte {
+	sum := sha256.Sum256([]byte(plaintext))
+	return sum[:]
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>"
+// header. ok is false if the header is present but malformed.
+func bearerToken(r *http.Request) (token string, present bool, ok bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", false, true
+	}
+
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || !strings.HasPrefix(token, apiTokenPrefix) {
+		return "", true, false
+	}
+
+	return token, true, true
+}
+
+// scopeMember limits a member's permissions to the scopes granted to a token,
+// so a token can never do more than its owner's current role allows.
+func scopeMember(member *database.HouseholdMember, scopes []string) *database.HouseholdMember {
+	scoped := *member
+	scoped.Permissions = nil
+	for _, permission := range member.Permissions {
+		if slices.Contains(scopes, permission) {
+			scoped.Permissions = append(scoped.Permissions, permission)
+		}
+	}
+	return &scoped
+}
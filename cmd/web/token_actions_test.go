@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+func TestGenerateAPIToken(t *testing.T) {
+	plaintext, hash, err := generateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(plaintext, apiTokenPrefix) {
+		t.Errorf("expected token to start with %q, got %q", apiTokenPrefix, plaintext)
+	}
+	if !bytes.Equal(hash, hashAPIToken(plaintext)) {
+		t.Error("expected hash to match the token")
+	}
+
+	other, _, err := generateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == plaintext {
+		t.Error("expected tokens to be unique")
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header  string
+		token   string
+		present bool
+		ok      bool
+	}{
+		{"", "", false, true},
+		{"Bearer ha_abc", "ha_abc", true, true},
+		{"bearer ha_abc", "ha_abc", true, true},
+		{"Basic dXNlcjpwYXNz", "", true, false},
+		{"Bearer", "", true, false},
+		{"Bearer abc", "", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/devices", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			token, present, ok := bearerToken(req)
+			if token != tt.token || present != tt.present || ok != tt.ok {
+				t.Errorf("expected (%q, %t, %t), got (%q, %t, %t)", tt.token, tt.present, tt.ok, token, present, ok)
+			}
+		})
+	}
+}
+
+func TestScopeMember(t *testing.T) {
+	member := &database.HouseholdMember{
+		Role:        database.RoleGuest,
+		Permissions: []string{database.PermissionDevicesView, database.PermissionDevicesControl},
+	}
+
+	scoped := scopeMember(member, []string{database.PermissionDevicesView, database.PermissionDevicesEdit})
+
+	if !scoped.Can(database.PermissionDevicesView) {
+		t.Error("expected scoped member to keep devices:view")
+	}
+	if scoped.Can(database.PermissionDevicesControl) {
+		t.Error("expected devices:control to be removed as it is not in the token scopes")
+	}
+	if scoped.Can(database.PermissionDevicesEdit) {
+		t.Error("expected devices:edit to be denied as the role does not grant it")
+	}
+	if !slices.Contains(member.Permissions, database.PermissionDevicesControl) {
+		t.Error("expected the original member to be unchanged")
+	}
+}
+
+func TestAuthenticateAPI_MalformedBearer(t *testing.T) {
+	app := newTestApplicationWithSession(t)
+
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be called with a malformed token")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/devices", nil)
+	req.Header.Set("Authorization", "Token something")
+	w := httptest.NewRecorder()
+
+	handler := app.sessionManager.LoadAndSave(app.authenticateAPI(testHandler))
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+		t.Errorf("expected WWW-Authenticate challenge, got %q", w.Header().Get("WWW-Authenticate"))
+	}
+}
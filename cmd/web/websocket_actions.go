@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+	"github.com/wumbabum/home_assist/internal/request"
+	"github.com/wumbabum/home_assist/internal/validator"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	wsPingInterval = 30 * time.Second
+	wsAuthInterval = time.Minute
+	wsWriteTimeout = 10 * time.Second
+	wsBufferSize   = 64
+)
+
+// errWSAccessRevoked ends a socket whose token or membership is no longer
+// valid.
+var errWSAccessRevoked = errors.New("websocket access revoked")
+
+// wsEventTypes are the events a WebSocket client may subscribe to.
+var wsEventTypes = []events.Type{events.TypeStateChanged, events.TypeDeviceAdded, events.TypeNotification}
+
+// wsRequest is a message sent by the client. Every request is answered with a
+// wsAck carrying the same ID, e.g.
+//
+//	{"id": 1, "type": "subscribe", "filter": {"device_ids": [3], "types": ["state_changed"]}}
+//	{"id": 2, "type": "command", "device_id": 3, "command": "turn_on"}
+//	{"id": 3, "type": "unsubscribe"}
+type wsRequest struct {
+	ID       int64          `json:"id"`
+	Type     string         `json:"type"`
+	Filter   wsFilter       `json:"filter"`
+	DeviceID int64          `json:"device_id"`
+	Command  string         `json:"command"`
+	Params   map[string]any `json:"params"`
+}
+
+// wsFilter selects the events sent to a client. Empty fields match everything.
+type wsFilter struct {
+	DeviceIDs []int64       `json:"device_ids"`
+	Types     []events.Type `json:"types"`
+}
+
+func (f wsFilter) matches(e events.Event) bool {
+	if len(f.Types) > 0 && !slices.Contains(f.Types, e.Type) {
+		return false
+	}
+	if len(f.DeviceIDs) == 0 {
+		return true
+	}
+
+	switch payload := e.Payload.(type) {
+	case events.StateChanged:
+		return slices.Contains(f.DeviceIDs, payload.DeviceID)
+	case events.DeviceAdded:
+		return slices.Contains(f.DeviceIDs, payload.DeviceID)
+	}
+	return false
+}
+
+// wsAck acknowledges a request. Errors use the same format as the JSON API.
+type wsAck struct {
+	ID      int64     `json:"id"`
+	Type    string    `json:"type"`
+	Success bool      `json:"success"`
+	Result  any       `json:"result,omitempty"`
+	Error   *apiError `json:"error,omitempty"`
+}
+
+type wsEvent struct {
+	Type  string      `json:"type"`
+	Event events.Type `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  any         `json:"data"`
+}
+
+// wsClient is a single WebSocket connection.
+type wsClient struct {
+	app   *application
+	conn  *websocket.Conn
+	token string // The API token the socket was opened with, empty for the session
+
+	mu     sync.Mutex
+	member *database.HouseholdMember // As of the last authorization
+	filter *wsFilter                 // nil until the client subscribes
+}
+
+// serveWebSocket upgrades the request to a WebSocket on which the client can
+// subscribe to events and send device commands.
+func (app *application) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	member := contextGetHouseholdMember(r)
+	token, _, _ := bearerToken(r)
+
+	// Hijacked connections are not tracked by http.Server.Shutdown, so the
+	// socket is added to the wait group while the request still is
+	select {
+	case <-app.shutdown:
+		app.apiErrorResponse(w, r, http.StatusServiceUnavailable, "The server is shutting down", nil)
+		return
+	default:
+	}
+	app.wg.Add(1)
+	defer app.wg.Done()
+
+	// The socket outlives the server's read and write timeouts, which would
+	// otherwise still apply to the hijacked connection.
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		// Accept has already written an error response
+		app.logger.Debug("websocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.CloseNow()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	sub := app.events.Subscribe(events.SubscribeOptions{
+		Name:   "websocket",
+		Filter: events.Filter{Types: wsEventTypes, HouseholdID: member.HouseholdID},
+		Buffer: wsBufferSize,
+		Policy: events.DropOldest,
+	})
+	defer sub.Unsubscribe()
+
+	client := &wsClient{app: app, conn: conn, token: token, member: member}
+
+	go func() {
+		select {
+		case <-app.shutdown:
+			conn.Close(websocket.StatusGoingAway, "server shutting down")
+		case <-ctx.Done():
+		}
+	}()
+	go client.forwardEvents(ctx, sub)
+	go client.keepAlive(ctx)
+	go client.keepAuthorized(ctx)
+
+	err = client.readRequests(ctx)
+	switch websocket.CloseStatus(err) {
+	case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+		conn.Close(websocket.StatusNormalClosure, "")
+	default:
+		app.logger.Debug("websocket closed", "error", err)
+	}
+}
+
+func (c *wsClient) readRequests(ctx context.Context) error {
+	for {
+		typ, data, err := c.conn.Read(ctx)
+		if err != nil {
+			return err
+		}
+
+		if typ != websocket.MessageText {
+			err = c.writeError(ctx, 0, http.StatusBadRequest, "message must be JSON text", nil)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var req wsRequest
+
+		err = request.DecodeJSONMessage(data, &req)
+		if err != nil {
+			err = c.writeError(ctx, 0, http.StatusBadRequest, err.Error(), nil)
+		} else {
+			err = c.handleRequest(ctx, req)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleRequest answers a single request. Only errors writing to the socket
+// are returned, anything wrong with the request is reported to the client.
+func (c *wsClient) handleRequest(ctx context.Context, req wsRequest) error {
+	switch req.Type {
+	case "subscribe":
+		var v validator.Validator
+		for _, t := range req.Filter.Types {
+			v.CheckField(validator.In(t, wsEventTypes...), "filter.types", "must only contain state_changed, device_added or notification")
+		}
+		if v.HasErrors() {
+			return c.writeFailedValidation(ctx, req.ID, v)
+		}
+
+		c.mu.Lock()
+		c.filter = &req.Filter
+		c.mu.Unlock()
+
+		return c.writeAck(ctx, req.ID, map[string]any{"filter": req.Filter})
+
+	case "unsubscribe":
+		c.mu.Lock()
+		c.filter = nil
+		c.mu.Unlock()
+
+		return c.writeAck(ctx, req.ID, nil)
+
+	case "command":
+		if !c.currentMember().Can(database.PermissionDevicesControl) {
+			return c.writeError(ctx, req.ID, http.StatusForbidden, "You do not have permission to perform this action", nil)
+		}
+
+		// The token may have been revoked, or the member removed, since the
+		// socket was opened
+		member, err := c.authorize(ctx)
+		switch {
+		case errors.Is(err, errWSAccessRevoked):
+			return err
+		case err != nil:
+			return c.writeServerError(ctx, req.ID, err)
+		case !member.Can(database.PermissionDevicesControl):
+			return c.writeError(ctx, req.ID, http.StatusForbidden, "You do not have permission to perform this action", nil)
+		}
+
+		device, err := c.app.db.GetDevice(ctx, member.HouseholdID, req.DeviceID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return c.writeError(ctx, req.ID, http.StatusNotFound, "The requested resource could not be found", nil)
+		case err != nil:
+			return c.writeServerError(ctx, req.ID, err)
+		}
+
+		device, err = c.app.executeCommand(ctx, device, deviceCommand{Command: req.Command, Params: req.Params})
+		if err != nil {
+			var cmdErr *commandError
+			if errors.As(err, &cmdErr) {
+				var v validator.Validator
+				v.AddFieldError("command", cmdErr.Error())
+				return c.writeFailedValidation(ctx, req.ID, v)
+			}
+			return c.writeServerError(ctx, req.ID, err)
+		}
+
+		return c.writeAck(ctx, req.ID, map[string]any{"device": device})
+
+	default:
+		return c.writeError(ctx, req.ID, http.StatusBadRequest, "type must be subscribe, unsubscribe or command", nil)
+	}
+}
+
+// forwardEvents sends bus events matching the client's filter until the
+// connection ends or the bus is closed.
+func (c *wsClient) forwardEvents(ctx context.Context, sub *events.Subscriber) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case e, open := <-sub.Events():
+			if !open {
+				return
+			}
+
+			c.mu.Lock()
+			filter := c.filter
+			c.mu.Unlock()
+
+			if filter == nil || !filter.matches(e) {
+				continue
+			}
+
+			err := c.write(ctx, wsEvent{Type: "event", Event: e.Type, Time: e.Time, Data: e.Payload})
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// keepAlive pings the client so that connections from devices which dropped
+// off the network without closing are noticed.
+func (c *wsClient) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, wsWriteTimeout)
+			err := c.conn.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				c.conn.Close(websocket.StatusPolicyViolation, "ping timeout")
+				return
+			}
+		}
+	}
+}
+
+// keepAuthorized authorizes the client again periodically, so that events
+// stop once its access is revoked even if it sends no commands.
+func (c *wsClient) keepAuthorized(ctx context.Context) {
+	ticker := time.NewTicker(wsAuthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := c.authorize(ctx)
+			switch {
+			case errors.Is(err, errWSAccessRevoked):
+				return
+			case err != nil && ctx.Err() == nil:
+				c.app.logger.Warn("failed to authorize websocket", "error", err, "user_id", c.currentMember().UserID)
+			}
+		}
+	}
+}
+
+// authorize loads the client's membership again, through its API token if it
+// has one. When the token is no longer valid, or the user is no longer a
+// member allowed to view devices, the socket is closed and
+// errWSAccessRevoked is returned.
+func (c *wsClient) authorize(ctx context.Context) (*database.HouseholdMember, error) {
+	member := c.currentMember()
+
+	var err error
+	if c.token != "" {
+		member, err = c.app.apiTokenMember(ctx, c.token)
+	} else {
+		member, err = c.app.db.GetHouseholdMember(ctx, member.HouseholdID, member.UserID)
+	}
+	switch {
+	case errors.Is(err, sql.ErrNoRows) || (err == nil && !member.Can(database.PermissionDevicesView)):
+		c.conn.Close(websocket.StatusPolicyViolation, "access revoked")
+		return nil, errWSAccessRevoked
+	case err != nil:
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.member = member
+	c.mu.Unlock()
+
+	return member, nil
+}
+
+func (c *wsClient) currentMember() *database.HouseholdMember {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.member
+}
+
+func (c *wsClient) write(ctx context.Context, msg any) error {
+	js, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, wsWriteTimeout)
+	defer cancel()
+
+	return c.conn.Write(ctx, websocket.MessageText, js)
+}
+
+func (c *wsClient) writeAck(ctx context.Context, id int64, result any) error {
+	return c.write(ctx, wsAck{ID: id, Type: "ack", Success: true, Result: result})
+}
+
+func (c *wsClient) writeError(ctx context.Context, id int64, status int, message string, fields map[string]string) error {
+	return c.write(ctx, wsAck{ID: id, Type: "ack", Error: &apiError{Status: status, Message: message, Fields: fields}})
+}
+
+func (c *wsClient) writeFailedValidation(ctx context.Context, id int64, v validator.Validator) error {
+	return c.writeError(ctx, id, http.StatusUnprocessableEntity, "The request failed validation", v.FieldErrors)
+}
+
+func (c *wsClient) writeServerError(ctx context.Context, id int64, err error) error {
+	c.app.logger.Error("websocket request failed", "error", err, "user_id", c.currentMember().UserID)
+	return c.writeError(ctx, id, http.StatusInternalServerError, "The server encountered a problem and could not process your request", nil)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+
+	"github.com/coder/websocket"
+)
+
+func dialTestWebSocket(t *testing.T, app *application, member *database.HouseholdMember) (context.Context, *websocket.Conn) {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.serveWebSocket(w, contextSetHouseholdMember(r, member))
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	conn, _, err := websocket.Dial(ctx, strings.Replace(srv.URL, "http", "ws", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+
+	return ctx, conn
+}
+
+func wsRoundTrip(t *testing.T, ctx context.Context, conn *websocket.Conn, msg string) map[string]any {
+	t.Helper()
+
+	err := conn.Write(ctx, websocket.MessageText, []byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wsReadMessage(t, ctx, conn)
+}
+
+func wsReadMessage(t *testing.T, ctx context.Context, conn *websocket.Conn) map[string]any {
+	t.Helper()
+
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply map[string]any
+	err = json.Unmarshal(data, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestWebSocketRequests(t *testing.T) {
+	app := newTestApplication(t)
+	app.shutdown = make(chan struct{})
+
+	guest := &database.HouseholdMember{HouseholdID: 1, UserID: 1, Permissions: []string{database.PermissionDevicesView}}
+	ctx, conn := dialTestWebSocket(t, app, guest)
+
+	tests := []struct {
+		name    string
+		msg     string
+		id      float64
+		success bool
+		status  float64
+		field   string
+	}{
+		{"subscribe", `{"id": 1, "type": "subscribe", "filter": {"device_ids": [7]}}`, 1, true, 0, ""},
+		{"invalid filter", `{"id": 2, "type": "subscribe", "filter": {"types": ["nope"]}}`, 2, false, 422, "filter.types"},
+		{"bad json", `{"id": 3,`, 0, false, 400, ""},
+		{"unknown key", `{"id": 4, "type": "subscribe", "colour": "red"}`, 0, false, 400, ""},
+		{"unknown type", `{"id": 5, "type": "reboot"}`, 5, false, 400, ""},
+		{"forbidden command", `{"id": 6, "type": "command", "device_id": 7, "command": "turn_on"}`, 6, false, 403, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := wsRoundTrip(t, ctx, conn, tt.msg)
+
+			if reply["type"] != "ack" || reply["id"] != tt.id || reply["success"] != tt.success {
+				t.Fatalf("unexpected ack %v", reply)
+			}
+			if tt.success {
+				return
+			}
+
+			apiErr, _ := reply["error"].(map[string]any)
+			if apiErr["status"] != tt.status {
+				t.Errorf("expected status %g, got %v", tt.status, apiErr["status"])
+			}
+			if tt.field != "" {
+				fields, _ := apiErr["fields"].(map[string]any)
+				if fields[tt.field] == nil {
+					t.Errorf("expected field error for %s, got %v", tt.field, apiErr["fields"])
+				}
+			}
+		})
+	}
+}
+
+func TestWebSocketEventsAndShutdown(t *testing.T) {
+	app := newTestApplication(t)
+	app.shutdown = make(chan struct{})
+
+	member := &database.HouseholdMember{HouseholdID: 1, UserID: 1}
+	ctx, conn := dialTestWebSocket(t, app, member)
+
+	reply := wsRoundTrip(t, ctx, conn, `{"id": 1, "type": "subscribe", "filter": {"device_ids": [7], "types": ["state_changed"]}}`)
+	if reply["success"] != true {
+		t.Fatalf("subscribe failed: %v", reply)
+	}
+
+	// Only the last event matches the filter
+	app.events.Publish(events.NewStateChanged(1, events.StateChanged{DeviceID: 8}))
+	app.events.Publish(events.NewDeviceAdded(1, events.DeviceAdded{DeviceID: 7}))
+	app.events.Publish(events.NewStateChanged(2, events.StateChanged{DeviceID: 7}))
+	app.events.Publish(events.NewStateChanged(1, events.StateChanged{DeviceID: 7, State: map[string]any{"on": true}}))
+
+	msg := wsReadMessage(t, ctx, conn)
+	data, _ := msg["data"].(map[string]any)
+	if msg["type"] != "event" || msg["event"] != "state_changed" || data["device_id"] != 7.0 {
+		t.Fatalf("unexpected event %v", msg)
+	}
+
+	close(app.shutdown)
+
+	_, _, err := conn.Read(ctx)
+	if status := websocket.CloseStatus(err); status != websocket.StatusGoingAway {
+		t.Errorf("expected going away close, got %v (%v)", status, err)
+	}
+
+	app.wg.Wait()
+}
+
+func TestWebSocketRejectedDuringShutdown(t *testing.T) {
+	app := newTestApplication(t)
+	app.shutdown = make(chan struct{})
+	close(app.shutdown)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.serveWebSocket(w, contextSetHouseholdMember(r, &database.HouseholdMember{HouseholdID: 1, UserID: 1}))
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	_, resp, err := websocket.Dial(ctx, strings.Replace(srv.URL, "http", "ws", 1), nil)
+	if err == nil {
+		t.Fatal("expected the upgrade to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %v", http.StatusServiceUnavailable, resp)
+	}
+
+	app.wg.Wait()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations/mqtt"
+	"github.com/wumbabum/home_assist/internal/integrations/zigbee2mqtt"
+	"github.com/wumbabum/home_assist/internal/request"
+)
+
+// zigbeeBridges is implemented by the Zigbee2MQTT integration, whose bridges
+// are shown and renamed with the household's devices.
+type zigbeeBridges interface {
+	Bridge(householdID int64) (zigbee2mqtt.Bridge, bool)
+	PermitJoin(ctx context.Context, householdID int64, d time.Duration) error
+	Rename(ctx context.Context, device *database.Device, name string) error
+}
+
+// zigbeeBridges returns the Zigbee2MQTT integration, unless the server is not
+// configured for it.
+func (app *application) zigbeeBridges() (zigbeeBridges, bool) {
+	bridges, ok := app.integrations[zigbee2mqtt.Name].(zigbeeBridges)
+	return bridges, ok
+}
+
+type permitJoinForm struct {
+	Enable bool `form:"Enable"`
+}
+
+// permitJoin lets new Zigbee devices join the household's network for as
+// long as the bridge allows, or stops them from joining. They are imported
+// once the bridge has interviewed them.
+func (app *application) permitJoin(w http.ResponseWriter, r *http.Request) {
+	householdID := contextGetHouseholdMember(r).HouseholdID
+
+	var form permitJoinForm
+
+	err := request.DecodePostForm(r, &form)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	bridges, ok := app.zigbeeBridges()
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+
+	d := zigbee2mqtt.MaxPermitJoin
+	if !form.Enable {
+		d = 0
+	}
+
+	err = bridges.PermitJoin(r.Context(), householdID, d)
+	switch {
+	case errors.Is(err, zigbee2mqtt.ErrNoBridge):
+		app.notFound(w, r)
+		return
+	case errors.Is(err, mqtt.ErrNotConnected):
+		app.sessionManager.Put(r.Context(), "flash", "The Zigbee2MQTT bridge cannot be reached, try again later.")
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	case form.Enable:
+		app.sessionManager.Put(r.Context(), "flash", "New Zigbee devices can join for the next few minutes.")
+	default:
+		app.sessionManager.Put(r.Context(), "flash", "New Zigbee devices can no longer join.")
+	}
+
+	http.Redirect(w, r, "/devices", http.StatusSeeOther)
+}
@@ -0,0 +1,49 @@
+package automation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+const maxDelay = time.Hour
+
+func (e *Engine) runAction(ctx context.Context, a *database.Automation, action database.Action) error {
+	switch action.Type {
+	case database.ActionDeviceCommand:
+		device, err := e.store.GetDevice(ctx, a.HouseholdID, action.DeviceID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("device %d does not exist", action.DeviceID)
+		}
+		if err != nil {
+			return err
+		}
+		return e.actuator.SendCommand(ctx, device, action.Command, action.Params)
+
+	case database.ActionScene:
+		return e.actuator.ActivateScene(ctx, a.HouseholdID, action.SceneID)
+
+	case database.ActionNotification:
+		return e.actuator.Notify(ctx, a, action.Title, action.Message)
+
+	case database.ActionDelay:
+		delay := min(time.Duration(action.Seconds)*time.Second, maxDelay)
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("delay interrupted: %w", ctx.Err())
+		}
+
+	default:
+		return fmt.Errorf("unknown action type %q", action.Type)
+	}
+}
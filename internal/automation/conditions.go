@@ -0,0 +1,176 @@
+package automation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+const timeOfDayLayout = "15:04"
+
+var Weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// presenceAttributes are the state attributes read by presence conditions, in
+// order of preference: trackers report "present", sensors "occupancy" or
+// "motion".
+var presenceAttributes = []string{"present", "occupancy", "motion"}
+
+func (e *Engine) checkCondition(ctx context.Context, householdID int64, c database.Condition) ConditionResult {
+	result := ConditionResult{Condition: c}
+
+	switch c.Type {
+	case database.ConditionState:
+		device, err := e.conditionDevice(ctx, householdID, c.DeviceID)
+		if err != nil {
+			result.Detail = err.Error()
+			return result
+		}
+		value := device.State[c.Attribute]
+		result.Passed = sameValue(value, c.Value)
+		result.Detail = fmt.Sprintf("%s of %s is %v", c.Attribute, device.Name, value)
+
+	case database.ConditionNumeric:
+		device, err := e.conditionDevice(ctx, householdID, c.DeviceID)
+		if err != nil {
+			result.Detail = err.Error()
+			return result
+		}
+		value, ok := toFloat(device.State[c.Attribute])
+		if !ok {
+			result.Detail = fmt.Sprintf("%s of %s is not a number", c.Attribute, device.Name)
+			return result
+		}
+		result.Passed = (c.Above == nil || value > *c.Above) && (c.Below == nil || value < *c.Below)
+		result.Detail = fmt.Sprintf("%s of %s is %g", c.Attribute, device.Name, value)
+
+	case database.ConditionTime:
+		loc, err := e.householdLocation(ctx, householdID)
+		if err != nil {
+			result.Detail = err.Error()
+			return result
+		}
+		now := e.now().In(loc)
+		result.Passed = inTimeWindow(now, c.After, c.Before, c.Weekdays)
+		result.Detail = "it is " + strings.ToLower(now.Format("Mon 15:04"))
+
+	case database.ConditionPresence:
+		device, err := e.conditionDevice(ctx, householdID, c.DeviceID)
+		if err != nil {
+			result.Detail = err.Error()
+			return result
+		}
+		present, attribute := false, ""
+		for _, attribute = range presenceAttributes {
+			if v, ok := device.State[attribute].(bool); ok {
+				present = v
+				break
+			}
+		}
+		result.Passed = c.Present != nil && present == *c.Present
+		if present {
+			result.Detail = fmt.Sprintf("%s reports presence (%s)", device.Name, attribute)
+		} else {
+			result.Detail = fmt.Sprintf("%s reports nobody present", device.Name)
+		}
+
+	default:
+		result.Detail = fmt.Sprintf("unknown condition type %q", c.Type)
+	}
+
+	return result
+}
+
+func (e *Engine) conditionDevice(ctx context.Context, householdID, id int64) (*database.Device, error) {
+	device, err := e.store.GetDevice(ctx, householdID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("device %d does not exist", id)
+	}
+	return device, err
+}
+
+// householdLocation returns the timezone of a household, which time
+// conditions are checked in like the scheduler fires time triggers.
+func (e *Engine) householdLocation(ctx context.Context, householdID int64) (*time.Location, error) {
+	household, err := e.store.GetHousehold(ctx, householdID)
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation(household.Timezone)
+	if err != nil {
+		e.logger.Warn("unknown household timezone, using UTC", "household_id", householdID, "timezone", household.Timezone)
+		return time.UTC, nil
+	}
+	return loc, nil
+}
+
+// inTimeWindow reports whether now falls between after and before, either of
+// which may be empty. A window such as 22:00 to 06:00 spans midnight, in
+// which case the weekday is that of the evening it started.
+func inTimeWindow(now time.Time, after, before string, weekdays []string) bool {
+	minutes := now.Hour()*60 + now.Minute()
+	start, hasStart := parseTimeOfDay(after)
+	end, hasEnd := parseTimeOfDay(before)
+
+	day := now
+	inside := true
+	switch {
+	case hasStart && hasEnd && start > end:
+		inside = minutes >= start || minutes < end
+		if minutes < end {
+			day = now.AddDate(0, 0, -1)
+		}
+	case hasStart && hasEnd:
+		inside = minutes >= start && minutes < end
+	case hasStart:
+		inside = minutes >= start
+	case hasEnd:
+		inside = minutes < end
+	}
+
+	if len(weekdays) > 0 && !slices.Contains(weekdays, Weekdays[day.Weekday()]) {
+		return false
+	}
+	return inside
+}
+
+// parseTimeOfDay returns the minutes since midnight of a "15:04" time.
+func parseTimeOfDay(s string) (int, bool) {
+	t, err := time.Parse(timeOfDayLayout, s)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// sameValue compares state values, treating all numeric types alike as
+// values may come from JSON or from Go code.
+func sameValue(a, b any) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,271 @@
+// Package automation runs the automations stored in the database. It matches
+// triggers against published events, including the schedule_fired events of
+// the scheduler, checks conditions against the current state of devices and
+// carries out the actions in order.
+package automation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+)
+
+const traceWriteTimeout = 5 * time.Second
+
+// Store is the data the engine needs, implemented by *database.DB.
+type Store interface {
+	ListEnabledAutomations(ctx context.Context, householdID int64) ([]database.Automation, error)
+	GetDevice(ctx context.Context, householdID, id int64) (*database.Device, error)
+	GetHousehold(ctx context.Context, id int64) (*database.Household, error)
+	MarkAutomationTriggered(ctx context.Context, id int64, at time.Time) error
+	RecordAutomationTrace(ctx context.Context, trace *database.AutomationTrace) error
+}
+
+// Actuator carries out the actions that reach outside the engine.
+type Actuator interface {
+	SendCommand(ctx context.Context, device *database.Device, command string, params map[string]any) error
+	ActivateScene(ctx context.Context, householdID, sceneID int64) error
+	Notify(ctx context.Context, automation *database.Automation, title, message string) error
+}
+
+type Engine struct {
+	store    Store
+	actuator Actuator
+	bus      *events.Bus
+	sub      *events.Subscriber
+	logger   *slog.Logger
+	now      func() time.Time
+
+	mu          sync.Mutex
+	running     map[int64]bool                  // Automations are never run twice at the same time
+	automations map[int64][]database.Automation // Enabled automations by household, until reloaded
+	generation  int                             // Incremented by every reload
+	wg          sync.WaitGroup
+}
+
+// NewEngine subscribes to the bus straight away, so that no trigger published
+// before Run starts is missed. Run must be called to consume the events.
+func NewEngine(store Store, actuator Actuator, bus *events.Bus, logger *slog.Logger) *Engine {
+	return &Engine{
+		store:    store,
+		actuator: actuator,
+		bus:      bus,
+		sub: bus.Subscribe(events.SubscribeOptions{
+			Name:   "automations",
+			Buffer: 256,
+			Policy: events.Block,
+		}),
+		logger:      logger,
+		now:         time.Now,
+		running:     make(map[int64]bool),
+		automations: make(map[int64][]database.Automation),
+	}
+}
+
+// Reload makes the engine read the automations of a household again, after
+// one has been saved or deleted. It does not block.
+func (e *Engine) Reload(householdID int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.automations, householdID)
+	e.generation++
+}
+
+// Run listens for triggers until ctx is cancelled or the bus is closed, then
+// waits for automations that are still running. Cancelling ctx also cuts
+// short any delay actions.
+func (e *Engine) Run(ctx context.Context) error {
+	defer e.wg.Wait()
+	defer e.sub.Unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case ev, open := <-e.sub.Events():
+			if !open {
+				return nil
+			}
+			e.handleEvent(ctx, ev)
+		}
+	}
+}
+
+func (e *Engine) handleEvent(ctx context.Context, ev events.Event) {
+	automations, err := e.enabledAutomations(ctx, ev.HouseholdID)
+	if err != nil {
+		e.logger.Error("failed to load automations", "household_id", ev.HouseholdID, "error", err)
+		return
+	}
+
+	for _, a := range automations {
+		for i, trigger := range a.Triggers {
+			if matchEvent(a.ID, i, trigger, ev) {
+				e.start(ctx, a, Cause{Trigger: trigger, Event: &ev, Time: ev.Time})
+				break
+			}
+		}
+	}
+}
+
+// enabledAutomations returns the enabled automations of a household, which
+// are only loaded from the store the first time after a reload.
+func (e *Engine) enabledAutomations(ctx context.Context, householdID int64) ([]database.Automation, error) {
+	e.mu.Lock()
+	automations, cached := e.automations[householdID]
+	generation := e.generation
+	e.mu.Unlock()
+
+	if cached {
+		return automations, nil
+	}
+
+	automations, err := e.store.ListEnabledAutomations(ctx, householdID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Automations reloaded while loading may have been loaded before saving
+	e.mu.Lock()
+	if e.generation == generation {
+		e.automations[householdID] = automations
+	}
+	e.mu.Unlock()
+
+	return automations, nil
+}
+
+// start runs an automation in the background unless it is already running.
+func (e *Engine) start(ctx context.Context, a database.Automation, cause Cause) {
+	e.mu.Lock()
+	if e.running[a.ID] {
+		e.mu.Unlock()
+		e.logger.Warn("automation already running, trigger ignored", "automation_id", a.ID, "trigger", cause.Trigger.Type)
+		return
+	}
+	e.running[a.ID] = true
+	e.mu.Unlock()
+
+	e.wg.Add(1)
+
+	go func() {
+		defer e.wg.Done()
+
+		defer func() {
+			e.mu.Lock()
+			delete(e.running, a.ID)
+			e.mu.Unlock()
+		}()
+
+		defer func() {
+			pv := recover()
+			if pv != nil {
+				e.logger.Error("automation panicked", "automation_id", a.ID, "error", fmt.Sprintf("%v", pv))
+			}
+		}()
+
+		run := e.Execute(ctx, &a, cause, false)
+
+		e.logger.Info("automation run",
+			"automation_id", a.ID, "trigger", cause.Trigger.Type,
+			"passed", run.Passed(), "failed", run.Failed(), "duration", run.FinishedAt.Sub(run.StartedAt))
+
+		e.recordTrace(run)
+	}()
+}
+
+// Execute checks the conditions of an automation and, if they all pass, runs
+// its actions in order, stopping at the first one that fails. In a dry run
+// conditions are checked but no action is carried out.
+func (e *Engine) Execute(ctx context.Context, a *database.Automation, cause Cause, dryRun bool) *Run {
+	run := &Run{
+		AutomationID: a.ID,
+		HouseholdID:  a.HouseholdID,
+		Cause:        cause,
+		DryRun:       dryRun,
+		StartedAt:    e.now(),
+	}
+
+	for _, condition := range a.Conditions {
+		run.Conditions = append(run.Conditions, e.checkCondition(ctx, a.HouseholdID, condition))
+	}
+
+	if !run.Passed() {
+		for _, action := range a.Actions {
+			run.Actions = append(run.Actions, ActionResult{Action: action, Status: ActionSkipped})
+		}
+		run.FinishedAt = e.now()
+		return run
+	}
+
+	if !dryRun {
+		err := e.store.MarkAutomationTriggered(ctx, a.ID, run.StartedAt)
+		if err != nil {
+			e.logger.Error("failed to mark automation triggered", "automation_id", a.ID, "error", err)
+		}
+
+		// Events published by the actions carry the run as their origin
+		origin := events.Origin{AutomationID: a.ID, Depth: 1}
+		if cause.Event != nil && cause.Event.Origin != nil {
+			origin.Depth = cause.Event.Origin.Depth + 1
+		}
+		ctx = events.WithOrigin(ctx, origin)
+
+		ev := events.NewAutomationTriggered(a.HouseholdID, events.AutomationTriggered{
+			AutomationID: a.ID,
+			Name:         a.Name,
+			Trigger:      cause.Trigger.Type,
+		})
+		ev.Origin = &origin
+		e.bus.Publish(ev)
+	}
+
+	failed := false
+	for _, action := range a.Actions {
+		result := ActionResult{Action: action, StartedAt: e.now()}
+
+		switch {
+		case failed:
+			result.Status = ActionSkipped
+		case dryRun:
+			result.Status = ActionDryRun
+		default:
+			err := e.runAction(ctx, a, action)
+			if err != nil {
+				result.Status = ActionFailed
+				result.Error = err.Error()
+				failed = true
+			} else {
+				result.Status = ActionOK
+			}
+		}
+
+		result.Duration = e.now().Sub(result.StartedAt)
+		run.Actions = append(run.Actions, result)
+	}
+
+	run.FinishedAt = e.now()
+	return run
+}
+
+// recordTrace stores the trace of a run. The trace is written even when the
+// engine is stopping, since the run it records has already happened.
+func (e *Engine) recordTrace(run *Run) {
+	trace, err := run.Trace()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), traceWriteTimeout)
+		defer cancel()
+
+		err = e.store.RecordAutomationTrace(ctx, trace)
+	}
+	if err != nil {
+		e.logger.Error("failed to record automation trace", "automation_id", run.AutomationID, "error", err)
+	}
+}
@@ -0,0 +1,439 @@
+package automation
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+type fakeStore struct {
+	mu          sync.Mutex
+	automations []database.Automation
+	devices     map[int64]*database.Device
+	timezone    string // Of every household, UTC if empty
+	triggered   []int64
+	traces      []*database.AutomationTrace
+	loads       int // Of the automations of a household
+}
+
+func (s *fakeStore) ListEnabledAutomations(ctx context.Context, householdID int64) ([]database.Automation, error) {
+	s.loads++
+
+	var list []database.Automation
+	for _, a := range s.automations {
+		if a.HouseholdID == householdID && a.Enabled {
+			list = append(list, a)
+		}
+	}
+	return list, nil
+}
+
+func (s *fakeStore) GetDevice(ctx context.Context, householdID, id int64) (*database.Device, error) {
+	device, ok := s.devices[id]
+	if !ok || device.HouseholdID != householdID {
+		return nil, sql.ErrNoRows
+	}
+	return device, nil
+}
+
+func (s *fakeStore) GetHousehold(ctx context.Context, id int64) (*database.Household, error) {
+	timezone := s.timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	return &database.Household{ID: id, Timezone: timezone}, nil
+}
+
+func (s *fakeStore) MarkAutomationTriggered(ctx context.Context, id int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.triggered = append(s.triggered, id)
+	return nil
+}
+
+func (s *fakeStore) RecordAutomationTrace(ctx context.Context, trace *database.AutomationTrace) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.traces = append(s.traces, trace)
+	return nil
+}
+
+type fakeActuator struct {
+	commands chan string
+}
+
+func (f *fakeActuator) SendCommand(ctx context.Context, device *database.Device, command string, params map[string]any) error {
+	f.commands <- device.Name + ":" + command
+	return nil
+}
+
+func (f *fakeActuator) ActivateScene(ctx context.Context, householdID, sceneID int64) error {
+	f.commands <- "scene"
+	return nil
+}
+
+func (f *fakeActuator) Notify(ctx context.Context, automation *database.Automation, title, message string) error {
+	f.commands <- "notify:" + message
+	return nil
+}
+
+func newTestEngine(store *fakeStore) (*Engine, *fakeActuator, *events.Bus) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	bus := events.NewBus(logger)
+	actuator := &fakeActuator{commands: make(chan string, 10)}
+	return NewEngine(store, actuator, bus, logger), actuator, bus
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestEngineStateTrigger(t *testing.T) {
+	store := &fakeStore{
+		devices: map[int64]*database.Device{
+			1: {ID: 1, HouseholdID: 1, Name: "door", State: database.DeviceState{"contact": false}},
+			2: {ID: 2, HouseholdID: 1, Name: "hall", State: database.DeviceState{"on": false}},
+			3: {ID: 3, HouseholdID: 1, Name: "lux", State: database.DeviceState{"illuminance": 12.0}},
+		},
+		automations: []database.Automation{{
+			ID:          1,
+			HouseholdID: 1,
+			Name:        "Hall light when the door opens in the dark",
+			Enabled:     true,
+			Triggers:    database.Triggers{{Type: database.TriggerState, DeviceID: 1, Attribute: "contact", To: false}},
+			Conditions:  database.Conditions{{Type: database.ConditionNumeric, DeviceID: 3, Attribute: "illuminance", Below: ptr(50.0)}},
+			Actions:     database.Actions{{Type: database.ActionDeviceCommand, DeviceID: 2, Command: "turn_on"}},
+		}},
+	}
+	engine, actuator, bus := newTestEngine(store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		engine.Run(ctx)
+		close(done)
+	}()
+
+	// Changes of other attributes or to other values do not fire
+	bus.Publish(events.NewStateChanged(1, events.StateChanged{DeviceID: 1, State: map[string]any{"contact": true}, Changes: map[string]any{"contact": true}}))
+	bus.Publish(events.NewStateChanged(1, events.StateChanged{DeviceID: 1, State: map[string]any{"battery": 90.0}, Changes: map[string]any{"battery": 90.0}}))
+	bus.Publish(events.NewStateChanged(1, events.StateChanged{DeviceID: 1, State: map[string]any{"contact": false}, Changes: map[string]any{"contact": false}}))
+
+	select {
+	case cmd := <-actuator.commands:
+		if cmd != "hall:turn_on" {
+			t.Errorf("unexpected command %q", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("automation did not run")
+	}
+
+	cancel()
+	<-done
+
+	if len(actuator.commands) != 0 {
+		t.Errorf("expected a single command, got %d more", len(actuator.commands))
+	}
+	if len(store.triggered) != 1 {
+		t.Errorf("expected automation to be marked triggered once, got %v", store.triggered)
+	}
+
+	if len(store.traces) != 1 {
+		t.Fatalf("expected 1 trace, got %d", len(store.traces))
+	}
+	trace := store.traces[0]
+	if !trace.Passed || trace.Failed || trace.Trigger.Type != database.TriggerState {
+		t.Errorf("unexpected trace %+v", trace)
+	}
+	if !strings.Contains(string(trace.Event), `"state_changed"`) {
+		t.Errorf("expected the triggering event in the trace, got %s", trace.Event)
+	}
+	if len(trace.Conditions) != 1 || trace.Conditions[0].Detail == "" {
+		t.Errorf("expected the condition result in the trace, got %+v", trace.Conditions)
+	}
+	if len(trace.Actions) != 1 || trace.Actions[0].Status != ActionOK {
+		t.Errorf("expected the action outcome in the trace, got %+v", trace.Actions)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	store := &fakeStore{
+		devices: map[int64]*database.Device{
+			1: {ID: 1, HouseholdID: 1, Name: "phone", State: database.DeviceState{"present": true}},
+			2: {ID: 2, HouseholdID: 1, Name: "heater", State: database.DeviceState{"on": false}},
+		},
+	}
+	engine, actuator, _ := newTestEngine(store)
+
+	a := &database.Automation{
+		ID:          1,
+		HouseholdID: 1,
+		Conditions:  database.Conditions{{Type: database.ConditionPresence, DeviceID: 1, Present: ptr(true)}},
+		Actions: database.Actions{
+			{Type: database.ActionNotification, Message: "Welcome home"},
+			{Type: database.ActionDeviceCommand, DeviceID: 99, Command: "turn_on"},
+			{Type: database.ActionDeviceCommand, DeviceID: 2, Command: "turn_on"},
+		},
+	}
+
+	// A dry run checks conditions but carries out nothing
+	run := engine.Execute(context.Background(), a, Cause{}, true)
+	if !run.Passed() || run.Actions[0].Status != ActionDryRun {
+		t.Errorf("unexpected dry run %+v", run)
+	}
+	if len(actuator.commands) != 0 || len(store.triggered) != 0 {
+		t.Fatal("dry run carried out actions")
+	}
+
+	// Actions after a failure are skipped
+	run = engine.Execute(context.Background(), a, Cause{}, false)
+	statuses := []string{run.Actions[0].Status, run.Actions[1].Status, run.Actions[2].Status}
+	if statuses[0] != ActionOK || statuses[1] != ActionFailed || statuses[2] != ActionSkipped {
+		t.Errorf("unexpected action statuses %v", statuses)
+	}
+	if run.Actions[1].Error == "" || !run.Failed() {
+		t.Error("expected the missing device to be reported")
+	}
+	if cmd := <-actuator.commands; cmd != "notify:Welcome home" {
+		t.Errorf("unexpected command %q", cmd)
+	}
+
+	// Failing conditions skip every action
+	store.devices[1].State["present"] = false
+	run = engine.Execute(context.Background(), a, Cause{}, false)
+	if run.Passed() || run.Actions[0].Status != ActionSkipped {
+		t.Errorf("expected actions to be skipped, got %+v", run.Actions)
+	}
+}
+
+func TestTimeConditionTimezone(t *testing.T) {
+	// 23:30 on Sunday 7 January 2024 in UTC is 12:30 on Monday in Auckland
+	store := &fakeStore{timezone: "Pacific/Auckland"}
+	engine, _, _ := newTestEngine(store)
+	engine.now = func() time.Time { return time.Date(2024, 1, 7, 23, 30, 0, 0, time.UTC) }
+
+	a := &database.Automation{
+		ID:          1,
+		HouseholdID: 1,
+		Conditions:  database.Conditions{{Type: database.ConditionTime, After: "12:00", Before: "13:00", Weekdays: []string{"mon"}}},
+		Actions:     database.Actions{{Type: database.ActionDelay, Seconds: 1}},
+	}
+
+	run := engine.Execute(context.Background(), a, Cause{}, true)
+	if !run.Passed() {
+		t.Errorf("expected the condition to pass in the household's timezone, got %q", run.Conditions[0].Detail)
+	}
+	if detail := run.Conditions[0].Detail; detail != "it is mon 12:30" {
+		t.Errorf("unexpected detail %q", detail)
+	}
+
+	store.timezone = "UTC"
+	run = engine.Execute(context.Background(), a, Cause{}, true)
+	if run.Passed() {
+		t.Errorf("expected the condition to fail in UTC, got %q", run.Conditions[0].Detail)
+	}
+}
+
+func TestInTimeWindow(t *testing.T) {
+	// 7 January 2024 is a Sunday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		after    string
+		before   string
+		weekdays []string
+		want     bool
+	}{
+		{"inside", at(8, 12, 0), "09:00", "17:00", nil, true},
+		{"end is exclusive", at(8, 17, 0), "09:00", "17:00", nil, false},
+		{"overnight evening", at(8, 23, 0), "22:00", "06:00", nil, true},
+		{"overnight morning", at(9, 5, 59), "22:00", "06:00", nil, true},
+		{"overnight outside", at(9, 12, 0), "22:00", "06:00", nil, false},
+		{"only after", at(8, 23, 0), "22:00", "", nil, true},
+		{"weekday", at(8, 12, 0), "", "", []string{"mon"}, true},
+		{"other weekday", at(7, 12, 0), "", "", []string{"mon"}, false},
+		{"overnight counts from the evening", at(9, 1, 0), "22:00", "06:00", []string{"mon"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := inTimeWindow(tt.now, tt.after, tt.before, tt.weekdays)
+			if got != tt.want {
+				t.Errorf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMatchEvent(t *testing.T) {
+	webhook := database.Trigger{Type: database.TriggerWebhook, WebhookID: "abcdefghijklmnop"}
+	if !matchEvent(1, 0, webhook, events.NewWebhookReceived(1, events.WebhookReceived{WebhookID: "abcdefghijklmnop"})) {
+		t.Error("expected webhook to match")
+	}
+	if matchEvent(1, 0, webhook, events.NewWebhookReceived(1, events.WebhookReceived{WebhookID: "other"})) {
+		t.Error("expected other webhook not to match")
+	}
+
+	chained := database.Trigger{Type: database.TriggerEvent, EventType: string(events.TypeAutomationTriggered)}
+	if !matchEvent(1, 0, chained, events.NewAutomationTriggered(1, events.AutomationTriggered{AutomationID: 2})) {
+		t.Error("expected another automation to trigger")
+	}
+	if matchEvent(1, 0, chained, events.NewAutomationTriggered(1, events.AutomationTriggered{AutomationID: 1})) {
+		t.Error("expected an automation not to trigger itself")
+	}
+
+	scheduled := database.Trigger{Type: database.TriggerCron, Cron: "0 7 * * *"}
+	if !matchEvent(1, 2, scheduled, events.NewScheduleFired(1, events.ScheduleFired{AutomationID: 1, Trigger: 2})) {
+		t.Error("expected scheduled trigger to match")
+	}
+	if matchEvent(1, 1, scheduled, events.NewScheduleFired(1, events.ScheduleFired{AutomationID: 1, Trigger: 2})) {
+		t.Error("expected another trigger of the automation not to match")
+	}
+	if matchEvent(1, 2, scheduled, events.NewScheduleFired(1, events.ScheduleFired{AutomationID: 2, Trigger: 2})) {
+		t.Error("expected another automation's trigger not to match")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	a := &database.Automation{
+		Name: "Morning",
+		Triggers: database.Triggers{
+			{Type: database.TriggerTime, At: "7:30am"},
+			{Type: database.TriggerWebhook, WebhookID: "short"},
+			{Type: database.TriggerCron, Cron: "every day"},
+			{Type: database.TriggerSun, Sun: "noon", Offset: 24 * 60},
+			{Type: database.TriggerWebhook, WebhookID: "doorbell-0123456789"},
+			{Type: database.TriggerWebhook, WebhookID: "doorbell-0123456789"},
+		},
+		Conditions: database.Conditions{{Type: database.ConditionNumeric, DeviceID: 1, Attribute: "temperature", Above: ptr(20.0), Below: ptr(10.0)}},
+		Actions:    database.Actions{{Type: database.ActionDelay, Seconds: 7200}, {Type: "reboot"}},
+	}
+
+	var v validator.Validator
+	Validate(&v, a)
+
+	for _, field := range []string{"triggers.0.at", "triggers.1.webhook_id", "triggers.2.cron", "triggers.3.sun", "triggers.3.offset", "triggers.5.webhook_id", "conditions.0.below", "actions.0.seconds", "actions.1.type"} {
+		if v.FieldErrors[field] == "" {
+			t.Errorf("expected an error for %s", field)
+		}
+	}
+	for _, field := range []string{"name", "triggers.4.webhook_id"} {
+		if v.FieldErrors[field] != "" {
+			t.Errorf("unexpected %s error %q", field, v.FieldErrors[field])
+		}
+	}
+}
+
+// chainActuator publishes the state_changed event of a command, with the
+// origin of the run sending it, as the server does. The event is published
+// once the run has finished, so that the automation it fires is not ignored
+// for still running.
+type chainActuator struct {
+	fakeActuator
+	bus *events.Bus
+}
+
+func (c *chainActuator) SendCommand(ctx context.Context, device *database.Device, command string, params map[string]any) error {
+	ev := events.NewStateChanged(device.HouseholdID, events.StateChanged{
+		DeviceID: device.ID,
+		State:    map[string]any{"on": true},
+		Changes:  map[string]any{"on": true},
+	})
+	ev.Origin = events.OriginFrom(ctx)
+	time.AfterFunc(20*time.Millisecond, func() { c.bus.Publish(ev) })
+
+	return c.fakeActuator.SendCommand(ctx, device, command, params)
+}
+
+func TestEngineChainDepth(t *testing.T) {
+	store := &fakeStore{
+		devices: map[int64]*database.Device{
+			1: {ID: 1, HouseholdID: 1, Name: "hall"},
+			2: {ID: 2, HouseholdID: 1, Name: "porch"},
+		},
+		// Each turns on the light the other is triggered by
+		automations: []database.Automation{
+			{
+				ID:          1,
+				HouseholdID: 1,
+				Enabled:     true,
+				Triggers:    database.Triggers{{Type: database.TriggerState, DeviceID: 1}},
+				Actions:     database.Actions{{Type: database.ActionDeviceCommand, DeviceID: 2, Command: "turn_on"}},
+			},
+			{
+				ID:          2,
+				HouseholdID: 1,
+				Enabled:     true,
+				Triggers:    database.Triggers{{Type: database.TriggerState, DeviceID: 2}},
+				Actions:     database.Actions{{Type: database.ActionDeviceCommand, DeviceID: 1, Command: "turn_on"}},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	bus := events.NewBus(logger)
+	actuator := &chainActuator{fakeActuator: fakeActuator{commands: make(chan string, 10)}, bus: bus}
+	engine := NewEngine(store, actuator, bus, logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		engine.Run(ctx)
+		close(done)
+	}()
+
+	bus.Publish(events.NewStateChanged(1, events.StateChanged{DeviceID: 1, State: map[string]any{"on": true}, Changes: map[string]any{"on": true}}))
+
+	var commands []string
+	for quiet := false; !quiet; {
+		select {
+		case cmd := <-actuator.commands:
+			commands = append(commands, cmd)
+		case <-time.After(500 * time.Millisecond):
+			quiet = true
+		}
+	}
+
+	cancel()
+	<-done
+
+	want := []string{"porch:turn_on", "hall:turn_on", "porch:turn_on", "hall:turn_on", "porch:turn_on"}
+	if !slices.Equal(commands, want) {
+		t.Errorf("expected the chain to stop after %d runs with %v, got %v", maxChainDepth, want, commands)
+	}
+}
+
+func TestEngineReload(t *testing.T) {
+	store := &fakeStore{}
+	engine, _, _ := newTestEngine(store)
+	ctx := context.Background()
+
+	// Automations are loaded once for every household, until reloaded
+	engine.handleEvent(ctx, events.NewStateChanged(1, events.StateChanged{DeviceID: 1}))
+	engine.handleEvent(ctx, events.NewStateChanged(1, events.StateChanged{DeviceID: 2}))
+	engine.handleEvent(ctx, events.NewStateChanged(2, events.StateChanged{DeviceID: 3}))
+	if store.loads != 2 {
+		t.Fatalf("expected 2 loads, got %d", store.loads)
+	}
+
+	engine.Reload(1)
+	engine.handleEvent(ctx, events.NewStateChanged(1, events.StateChanged{DeviceID: 1}))
+	engine.handleEvent(ctx, events.NewStateChanged(2, events.StateChanged{DeviceID: 3}))
+	if store.loads != 3 {
+		t.Errorf("expected the reloaded household to load again, got %d loads", store.loads)
+	}
+}
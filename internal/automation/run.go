@@ -0,0 +1,113 @@
+package automation
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+)
+
+const (
+	ActionOK      = "ok"
+	ActionFailed  = "failed"
+	ActionSkipped = "skipped" // A condition did not pass or an earlier action failed
+	ActionDryRun  = "dry_run" // Would have run
+)
+
+// Cause is what started a run: the trigger that matched and, unless it was a
+// time trigger, the event it matched.
+type Cause struct {
+	Trigger database.Trigger `json:"trigger"`
+	Event   *events.Event    `json:"event,omitempty"`
+	Time    time.Time        `json:"time"`
+}
+
+// Run records how an automation was evaluated.
+type Run struct {
+	AutomationID int64             `json:"automation_id"`
+	HouseholdID  int64             `json:"household_id"`
+	Cause        Cause             `json:"cause"`
+	DryRun       bool              `json:"dry_run"`
+	Conditions   []ConditionResult `json:"conditions"`
+	Actions      []ActionResult    `json:"actions"`
+	StartedAt    time.Time         `json:"started_at"`
+	FinishedAt   time.Time         `json:"finished_at"`
+}
+
+type ConditionResult struct {
+	Condition database.Condition `json:"condition"`
+	Passed    bool               `json:"passed"`
+	Detail    string             `json:"detail"` // Why it passed or not, e.g. "temperature is 21.5"
+}
+
+type ActionResult struct {
+	Action    database.Action `json:"action"`
+	Status    string          `json:"status"`
+	Error     string          `json:"error,omitempty"`
+	StartedAt time.Time       `json:"started_at"`
+	Duration  time.Duration   `json:"duration"`
+}
+
+// Passed reports whether every condition passed.
+func (r *Run) Passed() bool {
+	for _, c := range r.Conditions {
+		if !c.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed reports whether an action failed.
+func (r *Run) Failed() bool {
+	for _, a := range r.Actions {
+		if a.Status == ActionFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// Trace converts the run to the trace stored for it.
+func (r *Run) Trace() (*database.AutomationTrace, error) {
+	trace := &database.AutomationTrace{
+		AutomationID: r.AutomationID,
+		HouseholdID:  r.HouseholdID,
+		Trigger:      r.Cause.Trigger,
+		Conditions:   database.TraceConditions{},
+		Actions:      database.TraceActions{},
+		Passed:       r.Passed(),
+		Failed:       r.Failed(),
+		StartedAt:    r.StartedAt,
+		FinishedAt:   r.FinishedAt,
+	}
+
+	if r.Cause.Event != nil {
+		event, err := json.Marshal(r.Cause.Event)
+		if err != nil {
+			return nil, err
+		}
+		trace.Event = event
+	}
+
+	for _, c := range r.Conditions {
+		trace.Conditions = append(trace.Conditions, database.TraceCondition{
+			Condition: c.Condition,
+			Passed:    c.Passed,
+			Detail:    c.Detail,
+		})
+	}
+
+	for _, a := range r.Actions {
+		trace.Actions = append(trace.Actions, database.TraceAction{
+			Action:     a.Action,
+			Status:     a.Status,
+			Error:      a.Error,
+			StartedAt:  a.StartedAt,
+			DurationMS: a.Duration.Milliseconds(),
+		})
+	}
+
+	return trace, nil
+}
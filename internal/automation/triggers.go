@@ -0,0 +1,52 @@
+package automation
+
+import (
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+)
+
+// maxChainDepth is the number of automation runs after which the events
+// they publish fire no more automations.
+const maxChainDepth = 5
+
+// matchEvent reports whether an event fires the trigger at index of the
+// automation with the given ID. Automations never fire on the events of their
+// own runs, and chains of automations firing each other are cut short after
+// maxChainDepth runs, as either would loop forever.
+func matchEvent(automationID int64, index int, trigger database.Trigger, ev events.Event) bool {
+	if ev.Origin != nil && (ev.Origin.AutomationID == automationID || ev.Origin.Depth >= maxChainDepth) {
+		return false
+	}
+
+	switch trigger.Type {
+	case database.TriggerState:
+		payload, ok := ev.Payload.(events.StateChanged)
+		if !ok || payload.DeviceID != trigger.DeviceID {
+			return false
+		}
+		if trigger.Attribute == "" {
+			return true
+		}
+		if _, changed := payload.Changes[trigger.Attribute]; !changed {
+			return false
+		}
+		return trigger.To == nil || sameValue(payload.State[trigger.Attribute], trigger.To)
+
+	case database.TriggerEvent:
+		if string(ev.Type) != trigger.EventType {
+			return false
+		}
+		payload, ok := ev.Payload.(events.AutomationTriggered)
+		return !ok || payload.AutomationID != automationID
+
+	case database.TriggerWebhook:
+		payload, ok := ev.Payload.(events.WebhookReceived)
+		return ok && payload.WebhookID == trigger.WebhookID
+
+	case database.TriggerTime, database.TriggerCron, database.TriggerSun:
+		payload, ok := ev.Payload.(events.ScheduleFired)
+		return ok && payload.AutomationID == automationID && payload.Trigger == index
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+package automation
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/scheduler"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+var rgxWebhookID = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+// maxSunOffset is the furthest in minutes a sun trigger can be moved from
+// sunrise or sunset.
+const maxSunOffset = 12 * 60
+
+// Validate checks an automation before it is saved. Problems are recorded as
+// field errors keyed by their path, such as "triggers.0.at".
+func Validate(v *validator.Validator, a *database.Automation) {
+	v.CheckField(validator.NotBlank(a.Name), "name", "must be provided")
+	v.CheckField(validator.MaxRunes(a.Name, 100), "name", "must not be more than 100 characters")
+	v.CheckField(len(a.Triggers) > 0, "triggers", "must contain at least one trigger")
+	v.CheckField(len(a.Actions) > 0, "actions", "must contain at least one action")
+
+	webhookIDs := map[string]bool{}
+	for i, t := range a.Triggers {
+		field := func(name string) string { return fmt.Sprintf("triggers.%d.%s", i, name) }
+
+		switch t.Type {
+		case database.TriggerState:
+			v.CheckField(t.DeviceID > 0, field("device_id"), "must be provided")
+		case database.TriggerTime:
+			_, ok := parseTimeOfDay(t.At)
+			v.CheckField(ok, field("at"), "must be a time such as 07:30")
+		case database.TriggerCron:
+			_, err := scheduler.ParseCron(t.Cron)
+			v.CheckField(err == nil, field("cron"), "must be a cron expression such as 30 7 * * 1-5")
+		case database.TriggerSun:
+			v.CheckField(validator.In(t.Sun, database.Sunrise, database.Sunset), field("sun"), "must be sunrise or sunset")
+			v.CheckField(validator.Between(t.Offset, -maxSunOffset, maxSunOffset), field("offset"), "must be between -720 and 720 minutes")
+		case database.TriggerEvent:
+			v.CheckField(validator.NotBlank(t.EventType), field("event_type"), "must be provided")
+		case database.TriggerWebhook:
+			v.CheckField(rgxWebhookID.MatchString(t.WebhookID), field("webhook_id"), "must be 16 to 64 letters, digits, - or _")
+			v.CheckField(!webhookIDs[t.WebhookID], field("webhook_id"), "is already used by another trigger")
+			webhookIDs[t.WebhookID] = true
+		default:
+			v.AddFieldError(field("type"), "must be one of state, time, cron, sun, event or webhook")
+		}
+	}
+
+	for i, c := range a.Conditions {
+		field := func(name string) string { return fmt.Sprintf("conditions.%d.%s", i, name) }
+
+		switch c.Type {
+		case database.ConditionState:
+			v.CheckField(c.DeviceID > 0, field("device_id"), "must be provided")
+			v.CheckField(validator.NotBlank(c.Attribute), field("attribute"), "must be provided")
+		case database.ConditionNumeric:
+			v.CheckField(c.DeviceID > 0, field("device_id"), "must be provided")
+			v.CheckField(validator.NotBlank(c.Attribute), field("attribute"), "must be provided")
+			v.CheckField(c.Above != nil || c.Below != nil, field("above"), "above or below must be provided")
+			if c.Above != nil && c.Below != nil {
+				v.CheckField(*c.Above < *c.Below, field("below"), "must be greater than above")
+			}
+		case database.ConditionTime:
+			_, hasAfter := parseTimeOfDay(c.After)
+			_, hasBefore := parseTimeOfDay(c.Before)
+			v.CheckField(c.After == "" || hasAfter, field("after"), "must be a time such as 22:00")
+			v.CheckField(c.Before == "" || hasBefore, field("before"), "must be a time such as 06:00")
+			v.CheckField(hasAfter || hasBefore || len(c.Weekdays) > 0, field("after"), "after, before or weekdays must be provided")
+			for _, day := range c.Weekdays {
+				v.CheckField(slices.Contains(Weekdays, day), field("weekdays"), "must only contain sun, mon, tue, wed, thu, fri or sat")
+			}
+		case database.ConditionPresence:
+			v.CheckField(c.DeviceID > 0, field("device_id"), "must be provided")
+			v.CheckField(c.Present != nil, field("present"), "must be provided")
+		default:
+			v.AddFieldError(field("type"), "must be one of state, numeric, time or presence")
+		}
+	}
+
+	for i, act := range a.Actions {
+		field := func(name string) string { return fmt.Sprintf("actions.%d.%s", i, name) }
+
+		switch act.Type {
+		case database.ActionDeviceCommand:
+			v.CheckField(act.DeviceID > 0, field("device_id"), "must be provided")
+			v.CheckField(validator.NotBlank(act.Command), field("command"), "must be provided")
+		case database.ActionScene:
+			v.CheckField(act.SceneID > 0, field("scene_id"), "must be provided")
+		case database.ActionNotification:
+			v.CheckField(validator.NotBlank(act.Message), field("message"), "must be provided")
+			v.CheckField(validator.MaxRunes(act.Message, 500), field("message"), "must not be more than 500 characters")
+		case database.ActionDelay:
+			v.CheckField(validator.Between(act.Seconds, 1, int(maxDelay.Seconds())), field("seconds"), "must be between 1 and 3600")
+		default:
+			v.AddFieldError(field("type"), "must be one of device_command, scene, notification or delay")
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// storeTimeout bounds the database calls made while handling a client.
+const storeTimeout = 5 * time.Second
+
+// hook authenticates clients, checks their access to topics and persists the
+// broker's state.
+type hook struct {
+	mochi.HookBase
+	auth           Authenticator
+	store          Store
+	systemPassword string
+	logger         *slog.Logger
+
+	mu sync.Mutex
+	// The household member each client acts as, nil for the server's own
+	// client. Persistent sessions are kept after a client disconnects, so
+	// that another household cannot take them over.
+	clients map[string]*database.HouseholdMember
+}
+
+func newHook(auth Authenticator, store Store, systemPassword string, logger *slog.Logger) *hook {
+	return &hook{
+		auth:           auth,
+		store:          store,
+		systemPassword: systemPassword,
+		logger:         logger,
+		clients:        map[string]*database.HouseholdMember{},
+	}
+}
+
+func (h *hook) ID() string {
+	return "home_assist"
+}
+
+func (h *hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mochi.OnConnectAuthenticate,
+		mochi.OnACLCheck,
+		mochi.OnSessionEstablished,
+		mochi.OnDisconnect,
+		mochi.OnSubscribed,
+		mochi.OnUnsubscribed,
+		mochi.OnRetainMessage,
+		mochi.OnQosPublish,
+		mochi.OnQosComplete,
+		mochi.OnQosDropped,
+		mochi.OnWillSent,
+		mochi.OnClientExpired,
+		mochi.OnRetainedExpired,
+		mochi.StoredClients,
+		mochi.StoredSubscriptions,
+		mochi.StoredInflightMessages,
+		mochi.StoredRetainedMessages,
+	}, []byte{b})
+}
+
+func (h *hook) OnConnectAuthenticate(cl *mochi.Client, pk packets.Packet) bool {
+	username := string(pk.Connect.Username)
+	password := string(pk.Connect.Password)
+
+	if username == SystemUsername {
+		if subtle.ConstantTimeCompare([]byte(password), []byte(h.systemPassword)) != 1 {
+			h.logger.Warn("MQTT client rejected, invalid system password", "client_id", cl.ID, "remote", cl.Net.Remote)
+			return false
+		}
+		h.setClient(cl.ID, nil)
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	member, err := h.auth.AuthenticateMQTT(ctx, password)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidCredentials) {
+			h.logger.Error("failed to authenticate MQTT client", "client_id", cl.ID, "error", err)
+		} else {
+			h.logger.Warn("MQTT client rejected, invalid token", "client_id", cl.ID, "remote", cl.Net.Remote)
+		}
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if owner, ok := h.clients[cl.ID]; ok && (owner == nil || owner.HouseholdID != member.HouseholdID) {
+		h.logger.Warn("MQTT client rejected, client ID used by another household", "client_id", cl.ID, "household_id", member.HouseholdID)
+		return false
+	}
+
+	// A will is published by the broker, so check the client may publish it
+	if cl.Properties.Will.TopicName != "" && !allowed(member, cl.Properties.Will.TopicName, true) {
+		h.logger.Warn("MQTT client rejected, will topic not allowed", "client_id", cl.ID, "topic", cl.Properties.Will.TopicName)
+		return false
+	}
+
+	h.clients[cl.ID] = member
+	return true
+}
+
+func (h *hook) OnACLCheck(cl *mochi.Client, topic string, write bool) bool {
+	h.mu.Lock()
+	member, ok := h.clients[cl.ID]
+	h.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	return allowed(member, topic, write)
+}
+
+func (h *hook) setClient(clientID string, member *database.HouseholdMember) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[clientID] = member
+}
+
+func (h *hook) forgetClient(clientID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, clientID)
+}
+
+func (h *hook) client(clientID string) *database.HouseholdMember {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.clients[clientID]
+}
+
+// allowed reports whether a member may publish to a topic, or subscribe to a
+// filter when write is false. A nil member is the server's own client.
+// Filters are only allowed when every topic they match is in the household.
+func allowed(member *database.HouseholdMember, topic string, write bool) bool {
+	if member == nil {
+		return true
+	}
+
+	permission := database.PermissionDevicesView
+	if write {
+		permission = database.PermissionDevicesControl
+	}
+	if !member.Can(permission) {
+		return false
+	}
+
+	prefix := HouseholdTopic(member.HouseholdID)
+	return topic == prefix || strings.HasPrefix(topic, prefix+"/")
+}
@@ -0,0 +1,132 @@
+// Package broker runs an embedded MQTT 3.1.1 and 5 broker, for homes without
+// one of their own. Clients sign in with an API token as their password and
+// may only use the topics of their household. Persistent sessions and
+// retained messages are stored in Postgres, so they survive restarts.
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/wumbabum/home_assist/internal/database"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// SystemUsername is the username of the server's own client, which may use
+// the topics of every household. Its password is generated at startup.
+const SystemUsername = "home_assist"
+
+// ErrInvalidCredentials is returned by an Authenticator for passwords that
+// are not an active API token.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// HouseholdTopic returns the topic that the topics of a household's clients
+// must be in, for example households/1. A client of that household may use
+// households/1/zigbee2mqtt/lamp but not households/2/# or $SYS/#.
+func HouseholdTopic(householdID int64) string {
+	return fmt.Sprintf("households/%d", householdID)
+}
+
+// Authenticator checks the password a client connects with, returning the
+// household member it acts as, with the permissions of the API token.
+type Authenticator interface {
+	AuthenticateMQTT(ctx context.Context, password string) (*database.HouseholdMember, error)
+}
+
+// Store is the data the broker persists, implemented by *database.DB.
+type Store interface {
+	ListMQTTSessions(ctx context.Context) ([]database.MQTTSession, error)
+	SaveMQTTSession(ctx context.Context, session *database.MQTTSession) error
+	DeleteMQTTSession(ctx context.Context, clientID string) error
+	ListMQTTSubscriptions(ctx context.Context) ([][]byte, error)
+	SaveMQTTSubscription(ctx context.Context, clientID, filter string, data []byte) error
+	DeleteMQTTSubscription(ctx context.Context, clientID, filter string) error
+	ListMQTTInflightMessages(ctx context.Context) ([][]byte, error)
+	SaveMQTTInflightMessage(ctx context.Context, clientID string, packetID uint16, data []byte) error
+	DeleteMQTTInflightMessage(ctx context.Context, clientID string, packetID uint16) error
+	ListMQTTRetainedMessages(ctx context.Context) ([][]byte, error)
+	SaveMQTTRetainedMessage(ctx context.Context, topic string, data []byte) error
+	DeleteMQTTRetainedMessage(ctx context.Context, topic string) error
+}
+
+type Config struct {
+	Address string // Address to listen on, such as :1883
+}
+
+type Broker struct {
+	server   *mochi.Server
+	listener *listeners.TCP
+	hook     *hook
+}
+
+func New(cfg Config, auth Authenticator, store Store, logger *slog.Logger) (*Broker, error) {
+	password := make([]byte, 32)
+	_, err := rand.Read(password)
+	if err != nil {
+		return nil, err
+	}
+
+	server := mochi.New(&mochi.Options{Logger: logger})
+
+	h := newHook(auth, store, hex.EncodeToString(password), logger)
+	err = server.AddHook(h, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	listener := listeners.NewTCP(listeners.Config{ID: "tcp", Address: cfg.Address})
+	err = server.AddListener(listener)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Broker{server: server, listener: listener, hook: h}, nil
+}
+
+// Start restores the stored sessions and retained messages and starts
+// accepting clients. It does not block.
+func (b *Broker) Start() error {
+	return b.server.Serve()
+}
+
+// Shutdown stops accepting clients and disconnects those connected, waiting
+// until they are gone or ctx is done.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- b.server.Close()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Addr returns the address the broker listens on.
+func (b *Broker) Addr() string {
+	return b.listener.Address()
+}
+
+// LocalURL returns the URL the server's own client connects to.
+func (b *Broker) LocalURL() string {
+	_, port, err := net.SplitHostPort(b.Addr())
+	if err != nil {
+		return "tcp://" + b.Addr()
+	}
+	return "tcp://" + net.JoinHostPort("127.0.0.1", port)
+}
+
+// SystemPassword returns the password of the server's own client.
+func (b *Broker) SystemPassword() string {
+	return b.hook.systemPassword
+}
@@ -0,0 +1,356 @@
+package broker
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+type fakeAuthenticator map[string]*database.HouseholdMember
+
+func (a fakeAuthenticator) AuthenticateMQTT(ctx context.Context, password string) (*database.HouseholdMember, error) {
+	member, ok := a[password]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return member, nil
+}
+
+type fakeStore struct {
+	mu            sync.Mutex
+	sessions      map[string]database.MQTTSession
+	subscriptions map[[2]string][]byte
+	retained      map[string][]byte
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		sessions:      map[string]database.MQTTSession{},
+		subscriptions: map[[2]string][]byte{},
+		retained:      map[string][]byte{},
+	}
+}
+
+func (s *fakeStore) ListMQTTSessions(ctx context.Context) ([]database.MQTTSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sessions []database.MQTTSession
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (s *fakeStore) SaveMQTTSession(ctx context.Context, session *database.MQTTSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ClientID] = *session
+	return nil
+}
+
+func (s *fakeStore) DeleteMQTTSession(ctx context.Context, clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, clientID)
+	for key := range s.subscriptions {
+		if key[0] == clientID {
+			delete(s.subscriptions, key)
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) ListMQTTSubscriptions(ctx context.Context) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rows [][]byte
+	for _, data := range s.subscriptions {
+		rows = append(rows, data)
+	}
+	return rows, nil
+}
+
+func (s *fakeStore) SaveMQTTSubscription(ctx context.Context, clientID, filter string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[[2]string{clientID, filter}] = data
+	return nil
+}
+
+func (s *fakeStore) DeleteMQTTSubscription(ctx context.Context, clientID, filter string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscriptions, [2]string{clientID, filter})
+	return nil
+}
+
+func (s *fakeStore) ListMQTTInflightMessages(ctx context.Context) ([][]byte, error) {
+	return nil, nil
+}
+
+func (s *fakeStore) SaveMQTTInflightMessage(ctx context.Context, clientID string, packetID uint16, data []byte) error {
+	return nil
+}
+
+func (s *fakeStore) DeleteMQTTInflightMessage(ctx context.Context, clientID string, packetID uint16) error {
+	return nil
+}
+
+func (s *fakeStore) ListMQTTRetainedMessages(ctx context.Context) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rows [][]byte
+	for _, data := range s.retained {
+		rows = append(rows, data)
+	}
+	return rows, nil
+}
+
+func (s *fakeStore) SaveMQTTRetainedMessage(ctx context.Context, topic string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retained[topic] = data
+	return nil
+}
+
+func (s *fakeStore) DeleteMQTTRetainedMessage(ctx context.Context, topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.retained, topic)
+	return nil
+}
+
+var (
+	controller = &database.HouseholdMember{HouseholdID: 1, Permissions: []string{database.PermissionDevicesView, database.PermissionDevicesControl}}
+	viewer     = &database.HouseholdMember{HouseholdID: 1, Permissions: []string{database.PermissionDevicesView}}
+	neighbour  = &database.HouseholdMember{HouseholdID: 2, Permissions: []string{database.PermissionDevicesView, database.PermissionDevicesControl}}
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		member *database.HouseholdMember
+		topic  string
+		write  bool
+		want   bool
+	}{
+		{"Own topic", controller, "households/1/zigbee2mqtt/lamp", true, true},
+		{"Own wildcard", viewer, "households/1/#", false, true},
+		{"Other household", controller, "households/2/zigbee2mqtt/lamp", true, false},
+		{"Similar prefix", controller, "households/12/lamp", false, false},
+		{"Wildcard across households", controller, "households/+/lamp", false, false},
+		{"Outside households", controller, "zigbee2mqtt/lamp", false, false},
+		{"System topics", controller, "$SYS/broker/uptime", false, false},
+		{"Publish without control", viewer, "households/1/lamp/set", true, false},
+		{"Server", nil, "#", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowed(tt.member, tt.topic, tt.write); got != tt.want {
+				t.Errorf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func startBroker(t *testing.T, store Store, address string) *Broker {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	auth := fakeAuthenticator{"controller": controller, "viewer": viewer, "neighbour": neighbour}
+
+	b, err := New(Config{Address: address}, auth, store, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func connect(t *testing.T, b *Broker, clientID, username, password string, clean bool) (paho.Client, error) {
+	t.Helper()
+
+	opts := paho.NewClientOptions().
+		AddBroker(b.LocalURL()).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword(password).
+		SetCleanSession(clean).
+		SetAutoReconnect(false)
+
+	client := paho.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(3 * time.Second) {
+		t.Fatal("timed out connecting")
+	}
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return client, nil
+}
+
+func mustConnect(t *testing.T, b *Broker, clientID, password string, clean bool) paho.Client {
+	t.Helper()
+
+	client, err := connect(t, b, clientID, "token", password, clean)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func subscribe(t *testing.T, client paho.Client, filter string) (<-chan string, byte) {
+	t.Helper()
+
+	messages := make(chan string, 10)
+	token := client.Subscribe(filter, 1, func(_ paho.Client, msg paho.Message) {
+		messages <- msg.Topic() + " " + string(msg.Payload())
+	})
+	if !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatalf("failed to subscribe to %s: %v", filter, token.Error())
+	}
+	return messages, token.(*paho.SubscribeToken).Result()[filter]
+}
+
+func receive(t *testing.T, messages <-chan string) string {
+	t.Helper()
+
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return ""
+	}
+}
+
+func TestBrokerAuthentication(t *testing.T) {
+	b := startBroker(t, newFakeStore(), "127.0.0.1:0")
+	defer b.Shutdown(context.Background())
+
+	_, err := connect(t, b, "stranger", "token", "not-a-token", true)
+	if err == nil {
+		t.Error("expected an unknown token to be rejected")
+	}
+	_, err = connect(t, b, "impostor", SystemUsername, "guess", true)
+	if err == nil {
+		t.Error("expected a wrong system password to be rejected")
+	}
+
+	// Household clients only see their own household's topics
+	server, err := connect(t, b, "server", SystemUsername, b.SystemPassword(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, _ := subscribe(t, mustConnect(t, b, "viewer", "viewer", true), "households/1/#")
+	other, _ := subscribe(t, mustConnect(t, b, "neighbour", "neighbour", true), "households/2/#")
+
+	_, code := subscribe(t, mustConnect(t, b, "snoop", "neighbour", true), "households/1/#")
+	if code != 0x80 {
+		t.Errorf("expected the subscription to another household to fail, got %#x", code)
+	}
+
+	token := server.Publish("households/1/lamp", 1, false, "ON")
+	token.Wait()
+	if msg := receive(t, own); msg != "households/1/lamp ON" {
+		t.Errorf("unexpected message %q", msg)
+	}
+	select {
+	case msg := <-other:
+		t.Errorf("expected no message for the other household, got %q", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A client ID belongs to the household that first used it
+	_, err = connect(t, b, "viewer", "token", "neighbour", true)
+	if err == nil {
+		t.Error("expected a client ID in use by another household to be rejected")
+	}
+}
+
+func TestBrokerPersistence(t *testing.T) {
+	store := newFakeStore()
+	b := startBroker(t, store, "127.0.0.1:0")
+	address := b.Addr()
+
+	controllerClient := mustConnect(t, b, "lamp", "controller", false)
+	subscribe(t, controllerClient, "households/1/lamp/set")
+
+	token := controllerClient.Publish("households/1/lamp", 1, true, `{"state": "ON"}`)
+	if !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatal("failed to publish")
+	}
+	controllerClient.Disconnect(250)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := b.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The retained message and the persistent session survive a restart
+	b = startBroker(t, store, address)
+	defer b.Shutdown(context.Background())
+
+	retained, _ := subscribe(t, mustConnect(t, b, "viewer", "viewer", true), "households/1/lamp")
+	if msg := receive(t, retained); msg != `households/1/lamp {"state": "ON"}` {
+		t.Errorf("unexpected retained message %q", msg)
+	}
+
+	opts := paho.NewClientOptions().AddBroker(b.LocalURL()).SetClientID("lamp").SetUsername("token").SetPassword("controller").SetCleanSession(false)
+	commands := make(chan string, 10)
+	opts.SetDefaultPublishHandler(func(_ paho.Client, msg paho.Message) {
+		commands <- string(msg.Payload())
+	})
+	lamp := paho.NewClient(opts)
+	connectToken := lamp.Connect()
+	if !connectToken.WaitTimeout(3*time.Second) || connectToken.Error() != nil {
+		t.Fatal("failed to reconnect")
+	}
+	defer lamp.Disconnect(0)
+	if !connectToken.(*paho.ConnectToken).SessionPresent() {
+		t.Error("expected the session to be restored")
+	}
+
+	server, err := connect(t, b, "server", SystemUsername, b.SystemPassword(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Publish("households/1/lamp/set", 1, false, "OFF").Wait()
+
+	select {
+	case cmd := <-commands:
+		if cmd != "OFF" {
+			t.Errorf("unexpected command %q", cmd)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the restored subscription to receive the command")
+	}
+
+	// Clearing the retained message deletes it from the store
+	server.Publish("households/1/lamp", 1, true, "").Wait()
+	time.Sleep(50 * time.Millisecond)
+	store.mu.Lock()
+	_, ok := store.retained["households/1/lamp"]
+	store.mu.Unlock()
+	if ok {
+		t.Error("expected the cleared retained message to be deleted")
+	}
+}
@@ -0,0 +1,328 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/wumbabum/home_assist/internal/database"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Only sessions that outlive their connection are stored. Clients with a
+// clean session, like the server's own, cost no writes beyond their retained
+// messages.
+func persistent(cl *mochi.Client) bool {
+	if cl.Properties.ProtocolVersion == 5 {
+		return cl.Properties.Props.SessionExpiryInterval > 0
+	}
+	return !cl.Properties.Clean
+}
+
+func (h *hook) OnSessionEstablished(cl *mochi.Client, pk packets.Packet) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	// A clean start discards any session the client had before
+	if cl.Properties.Clean {
+		err := h.store.DeleteMQTTSession(ctx, cl.ID)
+		if err != nil {
+			h.logger.Error("failed to delete MQTT session", "client_id", cl.ID, "error", err)
+		}
+	}
+
+	h.saveSession(ctx, cl)
+}
+
+func (h *hook) OnWillSent(cl *mochi.Client, pk packets.Packet) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	h.saveSession(ctx, cl)
+}
+
+func (h *hook) saveSession(ctx context.Context, cl *mochi.Client) {
+	if !persistent(cl) {
+		return
+	}
+
+	props := cl.Properties.Props.Copy(false)
+	data, err := json.Marshal(storage.Client{
+		ID:              cl.ID,
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval:     props.SessionExpiryInterval,
+			SessionExpiryIntervalFlag: props.SessionExpiryIntervalFlag,
+			AuthenticationMethod:      props.AuthenticationMethod,
+			AuthenticationData:        props.AuthenticationData,
+			RequestProblemInfo:        props.RequestProblemInfo,
+			RequestProblemInfoFlag:    props.RequestProblemInfoFlag,
+			RequestResponseInfo:       props.RequestResponseInfo,
+			ReceiveMaximum:            props.ReceiveMaximum,
+			TopicAliasMaximum:         props.TopicAliasMaximum,
+			User:                      props.User,
+			MaximumPacketSize:         props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	})
+	if err != nil {
+		h.logger.Error("failed to encode MQTT session", "client_id", cl.ID, "error", err)
+		return
+	}
+
+	session := &database.MQTTSession{ClientID: cl.ID, Data: data}
+	if member := h.client(cl.ID); member != nil {
+		session.HouseholdID = &member.HouseholdID
+	}
+
+	err = h.store.SaveMQTTSession(ctx, session)
+	if err != nil {
+		h.logger.Error("failed to save MQTT session", "client_id", cl.ID, "error", err)
+	}
+}
+
+func (h *hook) OnDisconnect(cl *mochi.Client, err error, expire bool) {
+	if !expire || cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	h.deleteSession(cl)
+}
+
+func (h *hook) OnClientExpired(cl *mochi.Client) {
+	h.deleteSession(cl)
+}
+
+func (h *hook) deleteSession(cl *mochi.Client) {
+	h.forgetClient(cl.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	err := h.store.DeleteMQTTSession(ctx, cl.ID)
+	if err != nil {
+		h.logger.Error("failed to delete MQTT session", "client_id", cl.ID, "error", err)
+	}
+}
+
+func (h *hook) OnSubscribed(cl *mochi.Client, pk packets.Packet, reasonCodes []byte) {
+	if !persistent(cl) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	for i, filter := range pk.Filters {
+		// Reason codes from 0x80 are failures, the rest the granted QoS
+		if reasonCodes[i] >= packets.ErrUnspecifiedError.Code {
+			continue
+		}
+
+		data, err := json.Marshal(storage.Subscription{
+			ID:                cl.ID + ":" + filter.Filter,
+			T:                 storage.SubscriptionKey,
+			Client:            cl.ID,
+			Filter:            filter.Filter,
+			Qos:               reasonCodes[i],
+			Identifier:        filter.Identifier,
+			NoLocal:           filter.NoLocal,
+			RetainHandling:    filter.RetainHandling,
+			RetainAsPublished: filter.RetainAsPublished,
+		})
+		if err == nil {
+			err = h.store.SaveMQTTSubscription(ctx, cl.ID, filter.Filter, data)
+		}
+		if err != nil {
+			h.logger.Error("failed to save MQTT subscription", "client_id", cl.ID, "filter", filter.Filter, "error", err)
+		}
+	}
+}
+
+func (h *hook) OnUnsubscribed(cl *mochi.Client, pk packets.Packet) {
+	if !persistent(cl) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	for _, filter := range pk.Filters {
+		err := h.store.DeleteMQTTSubscription(ctx, cl.ID, filter.Filter)
+		if err != nil {
+			h.logger.Error("failed to delete MQTT subscription", "client_id", cl.ID, "filter", filter.Filter, "error", err)
+		}
+	}
+}
+
+// OnRetainMessage stores or, when r is -1 for an empty payload, deletes the
+// retained message of a topic.
+func (h *hook) OnRetainMessage(cl *mochi.Client, pk packets.Packet, r int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	if r == -1 {
+		h.deleteRetained(ctx, pk.TopicName)
+		return
+	}
+
+	data, err := json.Marshal(message(cl, pk, storage.RetainedKey))
+	if err == nil {
+		err = h.store.SaveMQTTRetainedMessage(ctx, pk.TopicName, data)
+	}
+	if err != nil {
+		h.logger.Error("failed to save MQTT retained message", "topic", pk.TopicName, "error", err)
+	}
+}
+
+func (h *hook) OnRetainedExpired(topic string) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	h.deleteRetained(ctx, topic)
+}
+
+func (h *hook) deleteRetained(ctx context.Context, topic string) {
+	err := h.store.DeleteMQTTRetainedMessage(ctx, topic)
+	if err != nil {
+		h.logger.Error("failed to delete MQTT retained message", "topic", topic, "error", err)
+	}
+}
+
+// OnQosPublish stores a message sent to a client until it is acknowledged.
+func (h *hook) OnQosPublish(cl *mochi.Client, pk packets.Packet, sent int64, resends int) {
+	if !persistent(cl) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	msg := message(cl, pk, storage.InflightKey)
+	msg.Sent = sent
+	msg.PacketID = pk.PacketID
+
+	data, err := json.Marshal(msg)
+	if err == nil {
+		err = h.store.SaveMQTTInflightMessage(ctx, cl.ID, pk.PacketID, data)
+	}
+	if err != nil {
+		h.logger.Error("failed to save MQTT inflight message", "client_id", cl.ID, "error", err)
+	}
+}
+
+func (h *hook) OnQosComplete(cl *mochi.Client, pk packets.Packet) {
+	if !persistent(cl) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	err := h.store.DeleteMQTTInflightMessage(ctx, cl.ID, pk.PacketID)
+	if err != nil {
+		h.logger.Error("failed to delete MQTT inflight message", "client_id", cl.ID, "error", err)
+	}
+}
+
+func (h *hook) OnQosDropped(cl *mochi.Client, pk packets.Packet) {
+	h.OnQosComplete(cl, pk)
+}
+
+func message(cl *mochi.Client, pk packets.Packet, kind string) storage.Message {
+	props := pk.Properties.Copy(false)
+	return storage.Message{
+		ID:          pk.TopicName,
+		T:           kind,
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+}
+
+// StoredClients restores the persistent sessions, remembering the household
+// of each so that their client IDs stay reserved.
+func (h *hook) StoredClients() ([]storage.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	sessions, err := h.store.ListMQTTSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []storage.Client
+	for _, session := range sessions {
+		var cl storage.Client
+		err := json.Unmarshal(session.Data, &cl)
+		if err != nil {
+			h.logger.Error("failed to decode MQTT session", "client_id", session.ClientID, "error", err)
+			continue
+		}
+
+		var member *database.HouseholdMember
+		if session.HouseholdID != nil {
+			// Permissions are checked again when the client reconnects
+			member = &database.HouseholdMember{HouseholdID: *session.HouseholdID}
+		}
+		h.setClient(session.ClientID, member)
+
+		clients = append(clients, cl)
+	}
+	return clients, nil
+}
+
+func (h *hook) StoredSubscriptions() ([]storage.Subscription, error) {
+	return decodeStored[storage.Subscription](h, "subscription", h.store.ListMQTTSubscriptions)
+}
+
+func (h *hook) StoredInflightMessages() ([]storage.Message, error) {
+	return decodeStored[storage.Message](h, "inflight message", h.store.ListMQTTInflightMessages)
+}
+
+func (h *hook) StoredRetainedMessages() ([]storage.Message, error) {
+	return decodeStored[storage.Message](h, "retained message", h.store.ListMQTTRetainedMessages)
+}
+
+func decodeStored[T any](h *hook, kind string, list func(context.Context) ([][]byte, error)) ([]T, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	rows, err := list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []T
+	for _, data := range rows {
+		var v T
+		err := json.Unmarshal(data, &v)
+		if err != nil {
+			h.logger.Error("failed to decode stored MQTT "+kind, "error", err)
+			continue
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
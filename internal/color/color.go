@@ -0,0 +1,75 @@
+// Package color converts between the hex colors stored in device state, such
+// as "#ff8800", and the CIE xy chromaticities used by Zigbee and Hue lights.
+package color
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// White is the chromaticity of the sRGB white point, D65.
+var White = XY{X: 0.3127, Y: 0.3290}
+
+// XY is a CIE 1931 chromaticity.
+type XY struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// XYToHex converts a chromaticity to the sRGB color of full brightness.
+func XYToHex(xy XY) string {
+	X, Z := xy.X/xy.Y, (1-xy.X-xy.Y)/xy.Y
+	rgb := []float64{
+		3.2406*X - 1.5372 - 0.4986*Z,
+		-0.9689*X + 1.8758 + 0.0415*Z,
+		0.0557*X - 0.2040 + 1.0570*Z,
+	}
+
+	peak := max(rgb[0], rgb[1], rgb[2])
+	if peak <= 0 {
+		return "#000000"
+	}
+	var hex strings.Builder
+	hex.WriteByte('#')
+	for _, c := range rgb {
+		c = max(c, 0) / peak
+		if c <= 0.0031308 {
+			c *= 12.92
+		} else {
+			c = 1.055*math.Pow(c, 1/2.4) - 0.055
+		}
+		fmt.Fprintf(&hex, "%02x", int(math.Round(min(c, 1)*255)))
+	}
+	return hex.String()
+}
+
+// HexToXY converts a hex color such as "#ff8800" to its chromaticity. Black,
+// which has none, is converted to White.
+func HexToXY(hex string) (XY, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(hex, "#"), 16, 32)
+	if err != nil || len(hex) != 7 || hex[0] != '#' {
+		return XY{}, fmt.Errorf("invalid hex color %q", hex)
+	}
+
+	var rgb [3]float64
+	for i := range rgb {
+		c := float64(n>>(16-8*i)&0xff) / 255
+		if c <= 0.04045 {
+			c /= 12.92
+		} else {
+			c = math.Pow((c+0.055)/1.055, 2.4)
+		}
+		rgb[i] = c
+	}
+
+	X := 0.4124*rgb[0] + 0.3576*rgb[1] + 0.1805*rgb[2]
+	Y := 0.2126*rgb[0] + 0.7152*rgb[1] + 0.0722*rgb[2]
+	Z := 0.0193*rgb[0] + 0.1192*rgb[1] + 0.9505*rgb[2]
+	if X+Y+Z == 0 {
+		return White, nil
+	}
+
+	return XY{X: X / (X + Y + Z), Y: Y / (X + Y + Z)}, nil
+}
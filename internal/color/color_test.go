@@ -0,0 +1,50 @@
+package color
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHexToXY(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want XY
+	}{
+		{"#ffffff", XY{X: 0.3127, Y: 0.329}},
+		{"#ff0000", XY{X: 0.64, Y: 0.33}},
+		{"#00ff00", XY{X: 0.3, Y: 0.6}},
+		{"#0000ff", XY{X: 0.15, Y: 0.06}},
+		{"#000000", White},
+	}
+
+	for _, tt := range tests {
+		got, err := HexToXY(tt.hex)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.hex, err)
+			continue
+		}
+		if math.Abs(got.X-tt.want.X) > 0.0005 || math.Abs(got.Y-tt.want.Y) > 0.0005 {
+			t.Errorf("%s: expected %+v, got %+v", tt.hex, tt.want, got)
+		}
+	}
+
+	for _, invalid := range []string{"", "ff8800", "#ff88", "#gg8800", "#ff88001"} {
+		_, err := HexToXY(invalid)
+		if err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestXYToHex(t *testing.T) {
+	// Colors of full brightness convert back to themselves
+	for _, hex := range []string{"#ffffff", "#ff0000", "#ff8800", "#00ffff", "#8000ff"} {
+		xy, err := HexToXY(hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := XYToHex(xy); got != hex {
+			t.Errorf("%s: converted back to %s", hex, got)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type APIToken struct {
+	ID          int64          `db:"id"`
+	UserID      int64          `db:"user_id"`
+	HouseholdID int64          `db:"household_id"`
+	Name        string         `db:"name"`
+	Scopes      pq.StringArray `db:"scopes"` // Permissions the token may use, capped by the user's role
+	LastUsedAt  *time.Time     `db:"last_used_at"`
+	ExpiresAt   *time.Time     `db:"expires_at"`
+	RevokedAt   *time.Time     `db:"revoked_at"`
+	CreatedAt   time.Time      `db:"created_at"`
+}
+
+const apiTokenColumns = `id, user_id, household_id, name, scopes, last_used_at, expires_at, revoked_at, created_at`
+
+// CreateAPIToken stores a new token. Only the hash of the token is persisted.
+func (db *DB) CreateAPIToken(ctx context.Context, token *APIToken, tokenHash []byte) error {
+	query := `
+		INSERT INTO api_tokens (user_id, household_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING ` + apiTokenColumns
+
+	return db.conn.GetContext(ctx, token, query,
+		token.UserID, token.HouseholdID, token.Name, tokenHash, token.Scopes, token.ExpiresAt)
+}
+
+func (db *DB) ListAPITokens(ctx context.Context, userID int64) ([]APIToken, error) {
+	query := `SELECT ` + apiTokenColumns + ` FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC`
+	tokens := []APIToken{}
+	err := db.conn.SelectContext(ctx, &tokens, query, userID)
+	return tokens, err
+}
+
+// AuthenticateAPIToken looks up an active token by hash and records that it
+// was used. It returns sql.ErrNoRows for unknown, expired or revoked tokens.
+func (db *DB) AuthenticateAPIToken(ctx context.Context, tokenHash []byte) (*APIToken, error) {
+	query := `
+		UPDATE api_tokens
+		SET last_used_at = NOW()
+		WHERE token_hash = $1
+			AND revoked_at IS NULL
+			AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING ` + apiTokenColumns
+
+	var token APIToken
+	err := db.conn.GetContext(ctx, &token, query, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RevokeAPIToken revokes one of a user's tokens. It returns sql.ErrNoRows if
+// the token does not exist or is already revoked.
+func (db *DB) RevokeAPIToken(ctx context.Context, userID, id int64) error {
+	query := `UPDATE api_tokens SET revoked_at = NOW() WHERE user_id = $1 AND id = $2 AND revoked_at IS NULL`
+	result, err := db.conn.ExecContext(ctx, query, userID, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
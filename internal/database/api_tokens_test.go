@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAPITokenLifecycle(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	members, err := db.ListHouseholdMembers(ctx, household.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := members[0]
+
+	hash := []byte("0123456789abcdef0123456789abcdef")
+	token := &APIToken{UserID: owner.UserID, HouseholdID: household.ID, Name: "cron", Scopes: []string{PermissionDevicesView}}
+	err = db.CreateAPIToken(ctx, token, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.ID == 0 {
+		t.Error("expected ID to be set")
+	}
+
+	// Authenticating records when the token was used
+	authenticated, err := db.AuthenticateAPIToken(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authenticated.ID != token.ID {
+		t.Errorf("expected token %d, got %d", token.ID, authenticated.ID)
+	}
+	if authenticated.LastUsedAt == nil {
+		t.Error("expected LastUsedAt to be set")
+	}
+
+	_, err = db.AuthenticateAPIToken(ctx, []byte("unknown"))
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for unknown token, got %v", err)
+	}
+
+	// Revoked tokens are kept for the list but no longer authenticate
+	err = db.RevokeAPIToken(ctx, owner.UserID, token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AuthenticateAPIToken(ctx, hash)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for revoked token, got %v", err)
+	}
+	err = db.RevokeAPIToken(ctx, owner.UserID, token.ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows on second revoke, got %v", err)
+	}
+
+	tokens, err := db.ListAPITokens(ctx, owner.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].RevokedAt == nil {
+		t.Errorf("expected one revoked token, got %v", tokens)
+	}
+
+	// Expired tokens do not authenticate
+	expiredHash := []byte("fedcba9876543210fedcba9876543210")
+	expiresAt := time.Now().Add(-time.Hour)
+	expired := &APIToken{UserID: owner.UserID, HouseholdID: household.ID, Name: "old", Scopes: []string{PermissionDevicesView}, ExpiresAt: &expiresAt}
+	err = db.CreateAPIToken(ctx, expired, expiredHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AuthenticateAPIToken(ctx, expiredHash)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for expired token, got %v", err)
+	}
+}
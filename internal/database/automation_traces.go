@@ -0,0 +1,111 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+)
+
+// maxTracesPerAutomation is how many traces are kept for each automation.
+// Older ones are deleted as new runs are recorded.
+const maxTracesPerAutomation = 50
+
+// AutomationTrace records a single run of an automation: what triggered it,
+// how each condition was evaluated and what happened to each action.
+type AutomationTrace struct {
+	ID           int64           `db:"id" json:"id"`
+	AutomationID int64           `db:"automation_id" json:"automation_id"`
+	HouseholdID  int64           `db:"household_id" json:"household_id"`
+	Trigger      Trigger         `db:"trigger" json:"trigger"`
+	Event        json.RawMessage `db:"event" json:"event"`
+	Conditions   TraceConditions `db:"conditions" json:"conditions"`
+	Actions      TraceActions    `db:"actions" json:"actions"`
+	Passed       bool            `db:"passed" json:"passed"`
+	Failed       bool            `db:"failed" json:"failed"`
+	StartedAt    time.Time       `db:"started_at" json:"started_at"`
+	FinishedAt   time.Time       `db:"finished_at" json:"finished_at"`
+}
+
+type TraceCondition struct {
+	Condition Condition `json:"condition"`
+	Passed    bool      `json:"passed"`
+	Detail    string    `json:"detail"`
+}
+
+type TraceAction struct {
+	Action     Action    `json:"action"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+type (
+	TraceConditions []TraceCondition
+	TraceActions    []TraceAction
+)
+
+func (t Trigger) Value() (driver.Value, error) {
+	js, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(js), nil
+}
+
+func (t *Trigger) Scan(src any) error                  { return scanJSON(src, t) }
+func (c TraceConditions) Value() (driver.Value, error) { return jsonValue(c) }
+func (c *TraceConditions) Scan(src any) error          { return scanJSON(src, c) }
+func (a TraceActions) Value() (driver.Value, error)    { return jsonValue(a) }
+func (a *TraceActions) Scan(src any) error             { return scanJSON(src, a) }
+
+const automationTraceColumns = `id, automation_id, household_id, trigger, event, conditions, actions, passed, failed, started_at, finished_at`
+
+// RecordAutomationTrace stores a trace and deletes the oldest traces of the
+// automation beyond the most recent maxTracesPerAutomation.
+func (db *DB) RecordAutomationTrace(ctx context.Context, trace *AutomationTrace) error {
+	event := "null"
+	if len(trace.Event) > 0 {
+		event = string(trace.Event)
+	}
+
+	query := `
+		INSERT INTO automation_traces (automation_id, household_id, trigger, event, conditions, actions, passed, failed, started_at, finished_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING ` + automationTraceColumns
+
+	err := db.conn.GetContext(ctx, trace, query,
+		trace.AutomationID, trace.HouseholdID, trace.Trigger, event, trace.Conditions, trace.Actions,
+		trace.Passed, trace.Failed, trace.StartedAt, trace.FinishedAt)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		DELETE FROM automation_traces
+		WHERE automation_id = $1 AND id NOT IN (
+			SELECT id FROM automation_traces
+			WHERE automation_id = $1
+			ORDER BY started_at DESC, id DESC
+			LIMIT $2
+		)`
+
+	_, err = db.conn.ExecContext(ctx, query, trace.AutomationID, maxTracesPerAutomation)
+	return err
+}
+
+// ListAutomationTraces returns the most recent traces of an automation,
+// newest first.
+func (db *DB) ListAutomationTraces(ctx context.Context, householdID, automationID int64, limit int) ([]AutomationTrace, error) {
+	query := `
+		SELECT ` + automationTraceColumns + `
+		FROM automation_traces
+		WHERE household_id = $1 AND automation_id = $2
+		ORDER BY started_at DESC, id DESC
+		LIMIT $3`
+
+	traces := []AutomationTrace{}
+	err := db.conn.SelectContext(ctx, &traces, query, householdID, automationID, limit)
+	return traces, err
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAutomationTraces(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	automation := &Automation{
+		HouseholdID: household.ID,
+		Name:        "Porch light at sunset",
+		Enabled:     true,
+		Triggers:    Triggers{{Type: TriggerTime, At: "19:00"}},
+		Actions:     Actions{{Type: ActionDeviceCommand, DeviceID: 1, Command: "turn_on"}},
+	}
+	err := db.CreateAutomation(ctx, automation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := range maxTracesPerAutomation + 5 {
+		trace := &AutomationTrace{
+			AutomationID: automation.ID,
+			HouseholdID:  household.ID,
+			Trigger:      automation.Triggers[0],
+			Actions: TraceActions{{
+				Action:     automation.Actions[0],
+				Status:     "failed",
+				Error:      "device 1 does not exist",
+				DurationMS: 3,
+			}},
+			Passed:     true,
+			Failed:     true,
+			StartedAt:  start.Add(time.Duration(i) * time.Second),
+			FinishedAt: start.Add(time.Duration(i) * time.Second),
+		}
+		if i == 0 {
+			trace.Event = json.RawMessage(`{"type": "webhook_received"}`)
+		}
+
+		err = db.RecordAutomationTrace(ctx, trace)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	traces, err := db.ListAutomationTraces(ctx, household.ID, automation.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != maxTracesPerAutomation {
+		t.Fatalf("expected %d traces to be kept, got %d", maxTracesPerAutomation, len(traces))
+	}
+
+	latest := traces[0]
+	if !latest.StartedAt.Equal(start.Add(time.Duration(maxTracesPerAutomation+4) * time.Second)) {
+		t.Errorf("expected newest trace first, got %v", latest.StartedAt)
+	}
+	if latest.Trigger.At != "19:00" || string(latest.Event) != "null" {
+		t.Errorf("unexpected trace %+v", latest)
+	}
+	if len(latest.Actions) != 1 || latest.Actions[0].Error != "device 1 does not exist" {
+		t.Errorf("unexpected actions %+v", latest.Actions)
+	}
+}
@@ -0,0 +1,237 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	TriggerState   = "state"   // A device attribute changed, optionally to a given value
+	TriggerTime    = "time"    // Every day at a time of day
+	TriggerCron    = "cron"    // At the times matched by a cron expression
+	TriggerSun     = "sun"     // At sunrise or sunset, optionally offset
+	TriggerEvent   = "event"   // An event of a given type was published
+	TriggerWebhook = "webhook" // A POST to /api/v1/webhooks/{webhook_id}
+
+	ConditionState    = "state"    // A device attribute equals a value
+	ConditionNumeric  = "numeric"  // A device attribute is within a range
+	ConditionTime     = "time"     // The current time is within a window
+	ConditionPresence = "presence" // A presence sensor reports someone home, or not
+
+	ActionDeviceCommand = "device_command"
+	ActionScene         = "scene"
+	ActionNotification  = "notification"
+	ActionDelay         = "delay"
+
+	Sunrise = "sunrise"
+	Sunset  = "sunset"
+)
+
+var (
+	TriggerTypes   = []string{TriggerState, TriggerTime, TriggerCron, TriggerSun, TriggerEvent, TriggerWebhook}
+	ConditionTypes = []string{ConditionState, ConditionNumeric, ConditionTime, ConditionPresence}
+	ActionTypes    = []string{ActionDeviceCommand, ActionScene, ActionNotification, ActionDelay}
+
+	// ScheduledTriggerTypes are fired by the scheduler rather than by events.
+	ScheduledTriggerTypes = []string{TriggerTime, TriggerCron, TriggerSun}
+)
+
+type Automation struct {
+	ID              int64      `db:"id" json:"id"`
+	HouseholdID     int64      `db:"household_id" json:"household_id"`
+	Name            string     `db:"name" json:"name"`
+	Enabled         bool       `db:"enabled" json:"enabled"`
+	Triggers        Triggers   `db:"triggers" json:"triggers"`     // Any trigger starts the automation
+	Conditions      Conditions `db:"conditions" json:"conditions"` // All conditions must pass
+	Actions         Actions    `db:"actions" json:"actions"`       // Run in order
+	LastTriggeredAt *time.Time `db:"last_triggered_at" json:"last_triggered_at"`
+	CreatedAt       time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt       time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// Trigger starts an automation. Which fields apply depends on Type.
+type Trigger struct {
+	Type      string `json:"type"`
+	DeviceID  int64  `json:"device_id,omitempty"`  // state
+	Attribute string `json:"attribute,omitempty"`  // state, any attribute if empty
+	To        any    `json:"to,omitempty"`         // state, any value if nil
+	At        string `json:"at,omitempty"`         // time, as "15:04" in the household's timezone
+	Cron      string `json:"cron,omitempty"`       // cron, such as "30 7 * * 1-5" in the household's timezone
+	Sun       string `json:"sun,omitempty"`        // sun, sunrise or sunset
+	Offset    int    `json:"offset,omitempty"`     // sun, in minutes, negative for before
+	EventType string `json:"event_type,omitempty"` // event
+	WebhookID string `json:"webhook_id,omitempty"` // webhook
+}
+
+// Condition must hold for an automation to run its actions. Which fields
+// apply depends on Type.
+type Condition struct {
+	Type      string   `json:"type"`
+	DeviceID  int64    `json:"device_id,omitempty"` // state, numeric, presence
+	Attribute string   `json:"attribute,omitempty"` // state, numeric
+	Value     any      `json:"value,omitempty"`     // state
+	Above     *float64 `json:"above,omitempty"`     // numeric, exclusive
+	Below     *float64 `json:"below,omitempty"`     // numeric, exclusive
+	After     string   `json:"after,omitempty"`     // time, as "15:04"
+	Before    string   `json:"before,omitempty"`    // time, as "15:04", may be earlier than After to span midnight
+	Weekdays  []string `json:"weekdays,omitempty"`  // time, e.g. ["mon", "tue"], every day if empty
+	Present   *bool    `json:"present,omitempty"`   // presence
+}
+
+// Action is a step of an automation. Which fields apply depends on Type.
+type Action struct {
+	Type     string         `json:"type"`
+	DeviceID int64          `json:"device_id,omitempty"` // device_command
+	Command  string         `json:"command,omitempty"`   // device_command
+	Params   map[string]any `json:"params,omitempty"`    // device_command
+	SceneID  int64          `json:"scene_id,omitempty"`  // scene
+	Title    string         `json:"title,omitempty"`     // notification
+	Message  string         `json:"message,omitempty"`   // notification
+	Seconds  int            `json:"seconds,omitempty"`   // delay
+}
+
+type (
+	Triggers   []Trigger
+	Conditions []Condition
+	Actions    []Action
+)
+
+func (t Triggers) Value() (driver.Value, error)   { return jsonValue(t) }
+func (t *Triggers) Scan(src any) error            { return scanJSON(src, t) }
+func (c Conditions) Value() (driver.Value, error) { return jsonValue(c) }
+func (c *Conditions) Scan(src any) error          { return scanJSON(src, c) }
+func (a Actions) Value() (driver.Value, error)    { return jsonValue(a) }
+func (a *Actions) Scan(src any) error             { return scanJSON(src, a) }
+
+// jsonValue stores a slice as a JSONB array, using [] rather than null for nil.
+func jsonValue[T any](s []T) (driver.Value, error) {
+	if s == nil {
+		return "[]", nil
+	}
+
+	js, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return string(js), nil
+}
+
+func scanJSON(src any, dst any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, dst)
+	case string:
+		return json.Unmarshal([]byte(v), dst)
+	case nil:
+		return nil
+	default:
+		return fmt.Errorf("unable to scan type %T into %T", src, dst)
+	}
+}
+
+const automationColumns = `id, household_id, name, enabled, triggers, conditions, actions, last_triggered_at, created_at, updated_at`
+
+func (db *DB) CreateAutomation(ctx context.Context, automation *Automation) error {
+	query := `
+		INSERT INTO automations (household_id, name, enabled, triggers, conditions, actions)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING ` + automationColumns
+
+	return db.conn.GetContext(ctx, automation, query,
+		automation.HouseholdID, automation.Name, automation.Enabled,
+		automation.Triggers, automation.Conditions, automation.Actions)
+}
+
+func (db *DB) GetAutomation(ctx context.Context, householdID, id int64) (*Automation, error) {
+	query := `SELECT ` + automationColumns + ` FROM automations WHERE household_id = $1 AND id = $2`
+
+	var automation Automation
+	err := db.conn.GetContext(ctx, &automation, query, householdID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &automation, nil
+}
+
+func (db *DB) ListAutomations(ctx context.Context, householdID int64) ([]Automation, error) {
+	query := `SELECT ` + automationColumns + ` FROM automations WHERE household_id = $1 ORDER BY name, id`
+	automations := []Automation{}
+	err := db.conn.SelectContext(ctx, &automations, query, householdID)
+	return automations, err
+}
+
+// ListEnabledAutomations returns the enabled automations of a household.
+func (db *DB) ListEnabledAutomations(ctx context.Context, householdID int64) ([]Automation, error) {
+	query := `SELECT ` + automationColumns + ` FROM automations WHERE household_id = $1 AND enabled ORDER BY id`
+	automations := []Automation{}
+	err := db.conn.SelectContext(ctx, &automations, query, householdID)
+	return automations, err
+}
+
+// GetAutomationByWebhook finds the enabled automation with a webhook trigger
+// for webhookID. It returns sql.ErrNoRows if there is none. Webhook IDs are
+// unique since they were validated with WebhookIDInUse, so should one have
+// been saved twice before, the automation that claimed it first keeps it.
+func (db *DB) GetAutomationByWebhook(ctx context.Context, webhookID string) (*Automation, error) {
+	query := `
+		SELECT ` + automationColumns + `
+		FROM automations
+		WHERE enabled AND triggers @> jsonb_build_array(jsonb_build_object('type', 'webhook', 'webhook_id', $1::text))
+		ORDER BY id
+		LIMIT 1`
+
+	var automation Automation
+	err := db.conn.GetContext(ctx, &automation, query, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	return &automation, nil
+}
+
+// WebhookIDInUse reports whether an automation other than automationID, in
+// any household and enabled or not, has a webhook trigger for webhookID.
+// Pass 0 as automationID for an automation that has not been created.
+func (db *DB) WebhookIDInUse(ctx context.Context, webhookID string, automationID int64) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM automations
+			WHERE id <> $2 AND triggers @> jsonb_build_array(jsonb_build_object('type', 'webhook', 'webhook_id', $1::text))
+		)`
+
+	var inUse bool
+	err := db.conn.GetContext(ctx, &inUse, query, webhookID, automationID)
+	return inUse, err
+}
+
+// UpdateAutomation saves the name, enabled flag, triggers, conditions and
+// actions. It returns sql.ErrNoRows if the automation does not exist.
+func (db *DB) UpdateAutomation(ctx context.Context, automation *Automation) error {
+	query := `
+		UPDATE automations
+		SET name = $3, enabled = $4, triggers = $5, conditions = $6, actions = $7, updated_at = NOW()
+		WHERE household_id = $1 AND id = $2
+		RETURNING ` + automationColumns
+
+	return db.conn.GetContext(ctx, automation, query,
+		automation.HouseholdID, automation.ID, automation.Name, automation.Enabled,
+		automation.Triggers, automation.Conditions, automation.Actions)
+}
+
+func (db *DB) MarkAutomationTriggered(ctx context.Context, id int64, at time.Time) error {
+	_, err := db.conn.ExecContext(ctx, `UPDATE automations SET last_triggered_at = $2 WHERE id = $1`, id, at)
+	return err
+}
+
+// DeleteAutomation removes an automation. It returns sql.ErrNoRows if the
+// automation does not exist.
+func (db *DB) DeleteAutomation(ctx context.Context, householdID, id int64) error {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM automations WHERE household_id = $1 AND id = $2`, householdID, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
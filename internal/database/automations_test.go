@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAutomations(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	morning := &Automation{
+		HouseholdID: household.ID,
+		Name:        "Morning",
+		Enabled:     true,
+		Triggers:    Triggers{{Type: TriggerTime, At: "07:00"}},
+		Actions:     Actions{{Type: ActionNotification, Message: "Good morning"}},
+	}
+	webhook := &Automation{
+		HouseholdID: household.ID,
+		Name:        "Doorbell",
+		Enabled:     true,
+		Triggers:    Triggers{{Type: TriggerWebhook, WebhookID: "doorbell-0123456789"}},
+		Conditions:  Conditions{{Type: ConditionTime, After: "22:00", Before: "06:00"}},
+		Actions:     Actions{{Type: ActionDelay, Seconds: 5}},
+	}
+	for _, a := range []*Automation{morning, webhook} {
+		err := db.CreateAutomation(ctx, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := db.GetAutomation(ctx, household.ID, webhook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Conditions) != 1 || got.Conditions[0].Before != "06:00" {
+		t.Errorf("unexpected conditions %+v", got.Conditions)
+	}
+	if got.Triggers[0].WebhookID != "doorbell-0123456789" {
+		t.Errorf("unexpected triggers %+v", got.Triggers)
+	}
+
+	scheduled, err := db.ListScheduledAutomations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timed []ScheduledAutomation
+	for _, a := range scheduled {
+		if a.HouseholdID == household.ID {
+			timed = append(timed, a)
+		}
+	}
+	if len(timed) != 1 || timed[0].ID != morning.ID || timed[0].Timezone != "UTC" {
+		t.Errorf("expected only the morning automation in UTC, got %+v", timed)
+	}
+
+	found, err := db.GetAutomationByWebhook(ctx, "doorbell-0123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != webhook.ID {
+		t.Errorf("expected automation %d, got %d", webhook.ID, found.ID)
+	}
+
+	// The ID is taken for every automation but the one using it
+	for _, tc := range []struct {
+		automationID int64
+		want         bool
+	}{{0, true}, {morning.ID, true}, {webhook.ID, false}} {
+		inUse, err := db.WebhookIDInUse(ctx, "doorbell-0123456789", tc.automationID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inUse != tc.want {
+			t.Errorf("automation %d: expected in use %v, got %v", tc.automationID, tc.want, inUse)
+		}
+	}
+
+	// Disabled automations no longer fire
+	webhook.Enabled = false
+	err = db.UpdateAutomation(ctx, webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetAutomationByWebhook(ctx, "doorbell-0123456789")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+
+	enabled, err := db.ListEnabledAutomations(ctx, household.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enabled) != 1 {
+		t.Errorf("expected 1 enabled automation, got %d", len(enabled))
+	}
+
+	now := time.Now().Truncate(time.Second)
+	err = db.MarkAutomationTriggered(ctx, morning.ID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = db.GetAutomation(ctx, household.ID, morning.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LastTriggeredAt == nil || !got.LastTriggeredAt.Equal(now) {
+		t.Errorf("expected last triggered at %v, got %v", now, got.LastTriggeredAt)
+	}
+
+	err = db.DeleteAutomation(ctx, household.ID, morning.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteAutomation(ctx, household.ID, morning.ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
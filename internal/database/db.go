@@ -2,6 +2,7 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"strings"
@@ -24,6 +25,8 @@ type DB struct {
 	conn interface {
 		sqlx.ExtContext
 		Get(dest interface{}, query string, args ...interface{}) error
+		GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+		SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
 	}
 	db *sqlx.DB // Keep reference for Close() and other DB-specific methods
 }
@@ -80,6 +83,18 @@ func (db *DB) MigrateUp() error {
 	}
 }
 
+// requireRowsAffected converts a write that matched nothing into sql.ErrNoRows.
+func requireRowsAffected(result sql.Result) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 func (db *DB) Close() error {
 	if db.db != nil {
 		return db.db.Close()
@@ -0,0 +1,243 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+var (
+	DeviceKinds = []string{
+		"light", "switch", "outlet", "sensor", "thermostat", "lock", "cover", "fan", "camera", "other",
+	}
+	DeviceProtocols = []string{
+		"mqtt", "zigbee", "zwave", "wifi", "http", "virtual", "shelly", "hue", "wled",
+	}
+	DeviceCapabilities = []string{
+		"on_off", "brightness", "color", "color_temperature", "temperature", "humidity",
+		"motion", "contact", "presence", "position", "lock", "power", "battery", "effect", "preset",
+	}
+)
+
+// MaxDeviceNameRunes is the longest name a device may have.
+const MaxDeviceNameRunes = 100
+
+// TruncateName shortens a name to MaxDeviceNameRunes, for the names devices
+// are given by an integration rather than in the device form.
+func TruncateName(name string) string {
+	for utf8.RuneCountInString(name) > MaxDeviceNameRunes {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+type Device struct {
+	ID             int64          `db:"id" json:"id"`
+	HouseholdID    int64          `db:"household_id" json:"household_id"`
+	RoomID         *int64         `db:"room_id" json:"room_id"` // nil when the device is not assigned to a room
+	Name           string         `db:"name" json:"name"`
+	Kind           string         `db:"kind" json:"kind"`
+	Protocol       string         `db:"protocol" json:"protocol"`
+	Address        string         `db:"address" json:"address"` // Protocol specific, e.g. an MQTT topic or IP address
+	Capabilities   pq.StringArray `db:"capabilities" json:"capabilities"`
+	Config         DeviceConfig   `db:"config" json:"config"` // Protocol specific settings
+	Vendor         string         `db:"vendor" json:"vendor"` // Empty unless reported by the integration
+	Model          string         `db:"model" json:"model"`
+	State          DeviceState    `db:"state" json:"state"`
+	StateUpdatedAt *time.Time     `db:"state_updated_at" json:"state_updated_at"`
+	CreatedAt      time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// DeviceState holds the last known attributes of a device, for example
+// {"on": true, "brightness": 80}.
+type DeviceState map[string]any
+
+func (s DeviceState) Value() (driver.Value, error) {
+	if s == nil {
+		return "{}", nil
+	}
+
+	js, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return string(js), nil
+}
+
+func (s *DeviceState) Scan(src any) error {
+	var js []byte
+
+	switch v := src.(type) {
+	case []byte:
+		js = v
+	case string:
+		js = []byte(v)
+	case nil:
+		*s = DeviceState{}
+		return nil
+	default:
+		return fmt.Errorf("unable to scan type %T into DeviceState", src)
+	}
+
+	return json.Unmarshal(js, s)
+}
+
+// DeviceConfig holds the protocol specific settings of a device, such as the
+// topics of an MQTT device. Each integration decodes its own settings.
+type DeviceConfig map[string]any
+
+func (c DeviceConfig) Value() (driver.Value, error) { return DeviceState(c).Value() }
+
+func (c *DeviceConfig) Scan(src any) error {
+	var state DeviceState
+	err := state.Scan(src)
+	*c = DeviceConfig(state)
+	return err
+}
+
+// HasCapability reports whether the device advertises the given capability.
+func (d Device) HasCapability(capability string) bool {
+	for _, c := range d.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+const deviceColumns = `id, household_id, room_id, name, kind, protocol, address, capabilities, config, vendor, model, state, state_updated_at, created_at, updated_at`
+
+func (db *DB) CreateDevice(ctx context.Context, device *Device) error {
+	query := `
+		INSERT INTO devices (household_id, room_id, name, kind, protocol, address, capabilities, config, vendor, model)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING ` + deviceColumns
+
+	return db.conn.GetContext(ctx, device, query,
+		device.HouseholdID, device.RoomID, device.Name, device.Kind, device.Protocol, device.Address, device.Capabilities, device.Config, device.Vendor, device.Model)
+}
+
+func (db *DB) GetDevice(ctx context.Context, householdID, id int64) (*Device, error) {
+	query := `SELECT ` + deviceColumns + ` FROM devices WHERE household_id = $1 AND id = $2`
+	var device Device
+	err := db.conn.GetContext(ctx, &device, query, householdID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (db *DB) ListDevices(ctx context.Context, householdID int64) ([]Device, error) {
+	query := `SELECT ` + deviceColumns + ` FROM devices WHERE household_id = $1 ORDER BY name, id`
+	devices := []Device{}
+	err := db.conn.SelectContext(ctx, &devices, query, householdID)
+	return devices, err
+}
+
+// ListDevicesPaged returns one page of a household's devices along with the
+// pagination metadata.
+func (db *DB) ListDevicesPaged(ctx context.Context, householdID int64, page Page) ([]Device, PageMetadata, error) {
+	query := `
+		SELECT COUNT(*) OVER() AS total_records, ` + deviceColumns + `
+		FROM devices
+		WHERE household_id = $1
+		ORDER BY name, id
+		LIMIT $2 OFFSET $3
+	`
+	var rows []struct {
+		TotalRecords int `db:"total_records"`
+		Device
+	}
+	err := db.conn.SelectContext(ctx, &rows, query, householdID, page.limit(), page.offset())
+	if err != nil {
+		return nil, PageMetadata{}, err
+	}
+
+	devices := make([]Device, 0, len(rows))
+	totalRecords := 0
+	for _, row := range rows {
+		totalRecords = row.TotalRecords
+		devices = append(devices, row.Device)
+	}
+
+	return devices, calculatePageMetadata(totalRecords, page), nil
+}
+
+func (db *DB) ListDevicesInRoom(ctx context.Context, householdID, roomID int64) ([]Device, error) {
+	query := `SELECT ` + deviceColumns + ` FROM devices WHERE household_id = $1 AND room_id = $2 ORDER BY name, id`
+	devices := []Device{}
+	err := db.conn.SelectContext(ctx, &devices, query, householdID, roomID)
+	return devices, err
+}
+
+// ListDevicesByProtocol returns the devices of every household that use a
+// protocol, for the integration that talks to them.
+func (db *DB) ListDevicesByProtocol(ctx context.Context, protocol string) ([]Device, error) {
+	query := `SELECT ` + deviceColumns + ` FROM devices WHERE protocol = $1 ORDER BY id`
+	devices := []Device{}
+	err := db.conn.SelectContext(ctx, &devices, query, protocol)
+	return devices, err
+}
+
+// UpdateDevice saves the editable fields of device. It returns sql.ErrNoRows
+// if the device does not exist.
+func (db *DB) UpdateDevice(ctx context.Context, device *Device) error {
+	query := `
+		UPDATE devices
+		SET room_id = $2, name = $3, kind = $4, protocol = $5, address = $6, capabilities = $7, config = $8,
+			vendor = $9, model = $10, updated_at = NOW()
+		WHERE id = $1 AND household_id = $11
+		RETURNING ` + deviceColumns
+
+	return db.conn.GetContext(ctx, device, query,
+		device.ID, device.RoomID, device.Name, device.Kind, device.Protocol, device.Address, device.Capabilities, device.Config,
+		device.Vendor, device.Model, device.HouseholdID)
+}
+
+// UpdateDeviceState merges state into the stored state of a device, so that
+// attributes that are not mentioned keep their previous value. It returns
+// sql.ErrNoRows if the device does not exist.
+func (db *DB) UpdateDeviceState(ctx context.Context, householdID, id int64, state DeviceState) (*Device, error) {
+	query := `
+		UPDATE devices
+		SET state = state || $3::jsonb, state_updated_at = NOW()
+		WHERE household_id = $1 AND id = $2
+		RETURNING ` + deviceColumns
+
+	var device Device
+	err := db.conn.GetContext(ctx, &device, query, householdID, id, state)
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// SetDeviceRoom moves a device into a room, or out of any room when roomID is
+// nil. It returns sql.ErrNoRows if the device does not exist.
+func (db *DB) SetDeviceRoom(ctx context.Context, householdID, deviceID int64, roomID *int64) error {
+	query := `UPDATE devices SET room_id = $3, updated_at = NOW() WHERE household_id = $1 AND id = $2`
+	result, err := db.conn.ExecContext(ctx, query, householdID, deviceID, roomID)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
+
+// DeleteDevice removes a device. It returns sql.ErrNoRows if the device does
+// not exist.
+func (db *DB) DeleteDevice(ctx context.Context, householdID, id int64) error {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM devices WHERE household_id = $1 AND id = $2`, householdID, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestDeviceCRUD(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	// Create device
+	device := &Device{
+		HouseholdID:  household.ID,
+		Name:         "Kitchen light",
+		Kind:         "light",
+		Protocol:     "mqtt",
+		Address:      "home/kitchen/light",
+		Capabilities: []string{"on_off", "brightness"},
+		Config:       DeviceConfig{"brightness_scale": 254.0},
+		Vendor:       "IKEA",
+		Model:        "LED1836G9",
+	}
+	err := db.CreateDevice(ctx, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.ID == 0 {
+		t.Error("expected ID to be set")
+	}
+	if device.CreatedAt.IsZero() {
+		t.Error("expected CreatedAt to be set")
+	}
+
+	// Retrieve device
+	retrieved, err := db.GetDevice(ctx, household.ID, device.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retrieved.Name != "Kitchen light" {
+		t.Errorf("expected name Kitchen light, got %s", retrieved.Name)
+	}
+	if !retrieved.HasCapability("brightness") {
+		t.Errorf("expected brightness capability, got %v", retrieved.Capabilities)
+	}
+	if retrieved.Config["brightness_scale"] != 254.0 {
+		t.Errorf("expected config to be stored, got %v", retrieved.Config)
+	}
+	if retrieved.Vendor != "IKEA" || retrieved.Model != "LED1836G9" {
+		t.Errorf("expected vendor and model to be stored, got %q %q", retrieved.Vendor, retrieved.Model)
+	}
+
+	// Update device
+	retrieved.Name = "Kitchen ceiling"
+	retrieved.Capabilities = []string{"on_off"}
+	err = db.UpdateDevice(ctx, retrieved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retrieved.Name != "Kitchen ceiling" {
+		t.Errorf("expected name Kitchen ceiling, got %s", retrieved.Name)
+	}
+	if retrieved.HasCapability("brightness") {
+		t.Error("expected brightness capability to be removed")
+	}
+
+	// List devices
+	devices, err := db.ListDevices(ctx, household.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, d := range devices {
+		if d.ID == device.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected device %d in list", device.ID)
+	}
+
+	mqttDevices, err := db.ListDevicesByProtocol(ctx, "mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found = false
+	for _, d := range mqttDevices {
+		found = found || d.ID == device.ID
+	}
+	if !found {
+		t.Errorf("expected device %d in the mqtt devices", device.ID)
+	}
+
+	// Delete device
+	err = db.DeleteDevice(ctx, household.ID, device.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.GetDevice(ctx, household.ID, device.ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+
+	err = db.DeleteDevice(ctx, household.ID, device.ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows on second delete, got %v", err)
+	}
+}
+
+func TestUpdateDeviceState(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	device := &Device{HouseholdID: household.ID, Name: "Desk lamp", Kind: "light", Protocol: "virtual"}
+	err := db.CreateDevice(ctx, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.StateUpdatedAt != nil {
+		t.Error("expected StateUpdatedAt to be nil before any state is reported")
+	}
+
+	_, err = db.UpdateDeviceState(ctx, household.ID, device.ID, DeviceState{"on": true, "brightness": 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Partial updates keep attributes that are not mentioned
+	updated, err := db.UpdateDeviceState(ctx, household.ID, device.ID, DeviceState{"on": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.State["on"] != false {
+		t.Errorf("expected on=false, got %v", updated.State["on"])
+	}
+	if updated.State["brightness"] != 80.0 {
+		t.Errorf("expected brightness=80, got %v", updated.State["brightness"])
+	}
+	if updated.StateUpdatedAt == nil {
+		t.Error("expected StateUpdatedAt to be set")
+	}
+
+	_, err = db.UpdateDeviceState(ctx, household.ID+1000, device.ID, DeviceState{"on": true})
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for another household, got %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleGuest  = "guest"
+)
+
+var (
+	HouseholdRoles = []string{RoleOwner, RoleAdmin, RoleMember, RoleGuest}
+	// InvitableRoles excludes owner, ownership is only granted by changing the
+	// role of an existing member.
+	InvitableRoles = []string{RoleAdmin, RoleMember, RoleGuest}
+)
+
+type Household struct {
+	ID        int64     `db:"id"`
+	Name      string    `db:"name"`
+	Timezone  string    `db:"timezone"`  // IANA name such as Europe/London
+	Latitude  *float64  `db:"latitude"`  // Needed for sun triggers
+	Longitude *float64  `db:"longitude"` // Needed for sun triggers
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+const householdColumns = `id, name, timezone, latitude, longitude, created_at, updated_at`
+
+// HouseholdMember is a user's membership of a household, joined with the
+// household name, the user's profile details and the permissions of the role.
+type HouseholdMember struct {
+	HouseholdID   int64          `db:"household_id"`
+	HouseholdName string         `db:"household_name"`
+	UserID        int64          `db:"user_id"`
+	Email         string         `db:"email"`
+	Name          string         `db:"name"`
+	Role          string         `db:"role"`
+	Permissions   pq.StringArray `db:"permissions"`
+	CreatedAt     time.Time      `db:"created_at"`
+}
+
+// Can reports whether the member's role grants permission.
+func (m HouseholdMember) Can(permission string) bool {
+	for _, p := range m.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+type HouseholdInvitation struct {
+	ID          int64     `db:"id"`
+	HouseholdID int64     `db:"household_id"`
+	Email       string    `db:"email"`
+	Role        string    `db:"role"`
+	InvitedBy   *int64    `db:"invited_by"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// CreateHousehold creates a household with ownerID as its only member.
+func (db *DB) CreateHousehold(ctx context.Context, name string, ownerID int64) (*Household, error) {
+	query := `
+		WITH household AS (
+			INSERT INTO households (name)
+			VALUES ($1)
+			RETURNING ` + householdColumns + `
+		), owner AS (
+			INSERT INTO household_members (household_id, user_id, role)
+			SELECT id, $2, 'owner' FROM household
+		)
+		SELECT ` + householdColumns + ` FROM household
+	`
+	var household Household
+	err := db.conn.GetContext(ctx, &household, query, name, ownerID)
+	return &household, err
+}
+
+func (db *DB) GetHousehold(ctx context.Context, id int64) (*Household, error) {
+	query := `SELECT ` + householdColumns + ` FROM households WHERE id = $1`
+	var household Household
+	err := db.conn.GetContext(ctx, &household, query, id)
+	if err != nil {
+		return nil, err
+	}
+	return &household, nil
+}
+
+// UpdateHouseholdLocation saves the timezone and coordinates of a household.
+// It returns sql.ErrNoRows if the household does not exist.
+func (db *DB) UpdateHouseholdLocation(ctx context.Context, household *Household) error {
+	query := `
+		UPDATE households
+		SET timezone = $2, latitude = $3, longitude = $4, updated_at = NOW()
+		WHERE id = $1
+		RETURNING ` + householdColumns
+
+	return db.conn.GetContext(ctx, household, query, household.ID, household.Timezone, household.Latitude, household.Longitude)
+}
+
+const householdMemberQuery = `
+	SELECT hm.household_id, h.name AS household_name, hm.user_id, u.email, u.name, hm.role,
+		ARRAY(SELECT rp.permission FROM role_permissions rp WHERE rp.role = hm.role ORDER BY rp.permission) AS permissions,
+		hm.created_at
+	FROM household_members hm
+	JOIN households h ON h.id = hm.household_id
+	JOIN users u ON u.id = hm.user_id
+`
+
+func (db *DB) GetHouseholdMember(ctx context.Context, householdID, userID int64) (*HouseholdMember, error) {
+	query := householdMemberQuery + ` WHERE hm.household_id = $1 AND hm.user_id = $2`
+	var member HouseholdMember
+	err := db.conn.GetContext(ctx, &member, query, householdID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (db *DB) ListHouseholdMembers(ctx context.Context, householdID int64) ([]HouseholdMember, error) {
+	query := householdMemberQuery + ` WHERE hm.household_id = $1 ORDER BY hm.created_at, u.name`
+	members := []HouseholdMember{}
+	err := db.conn.SelectContext(ctx, &members, query, householdID)
+	return members, err
+}
+
+// ListUserHouseholds returns every membership of a user, oldest first.
+func (db *DB) ListUserHouseholds(ctx context.Context, userID int64) ([]HouseholdMember, error) {
+	query := householdMemberQuery + ` WHERE hm.user_id = $1 ORDER BY hm.created_at, h.id`
+	members := []HouseholdMember{}
+	err := db.conn.SelectContext(ctx, &members, query, userID)
+	return members, err
+}
+
+// UpdateHouseholdMemberRole changes the role of a member. It returns
+// sql.ErrNoRows if the user is not a member of the household.
+func (db *DB) UpdateHouseholdMemberRole(ctx context.Context, householdID, userID int64, role string) error {
+	query := `UPDATE household_members SET role = $3 WHERE household_id = $1 AND user_id = $2`
+	result, err := db.conn.ExecContext(ctx, query, householdID, userID, role)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
+
+// RemoveHouseholdMember removes a user from a household. It returns
+// sql.ErrNoRows if the user is not a member of the household.
+func (db *DB) RemoveHouseholdMember(ctx context.Context, householdID, userID int64) error {
+	query := `DELETE FROM household_members WHERE household_id = $1 AND user_id = $2`
+	result, err := db.conn.ExecContext(ctx, query, householdID, userID)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
+
+// CreateHouseholdInvitation invites an email address to a household. Inviting
+// the same address again replaces the role of the pending invitation.
+func (db *DB) CreateHouseholdInvitation(ctx context.Context, householdID int64, email, role string, invitedBy int64) (*HouseholdInvitation, error) {
+	query := `
+		INSERT INTO household_invitations (household_id, email, role, invited_by)
+		VALUES ($1, LOWER($2), $3, $4)
+		ON CONFLICT (household_id, email)
+		DO UPDATE SET
+			role = EXCLUDED.role,
+			invited_by = EXCLUDED.invited_by
+		RETURNING id, household_id, email, role, invited_by, created_at
+	`
+	var invitation HouseholdInvitation
+	err := db.conn.GetContext(ctx, &invitation, query, householdID, email, role, invitedBy)
+	return &invitation, err
+}
+
+func (db *DB) ListHouseholdInvitations(ctx context.Context, householdID int64) ([]HouseholdInvitation, error) {
+	query := `
+		SELECT id, household_id, email, role, invited_by, created_at
+		FROM household_invitations
+		WHERE household_id = $1
+		ORDER BY created_at
+	`
+	invitations := []HouseholdInvitation{}
+	err := db.conn.SelectContext(ctx, &invitations, query, householdID)
+	return invitations, err
+}
+
+// DeleteHouseholdInvitation withdraws a pending invitation. It returns
+// sql.ErrNoRows if the invitation does not exist.
+func (db *DB) DeleteHouseholdInvitation(ctx context.Context, householdID, id int64) error {
+	query := `DELETE FROM household_invitations WHERE household_id = $1 AND id = $2`
+	result, err := db.conn.ExecContext(ctx, query, householdID, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
+
+// AcceptHouseholdInvitations turns every pending invitation for email into a
+// membership for userID and returns the number of households joined.
+func (db *DB) AcceptHouseholdInvitations(ctx context.Context, userID int64, email string) (int64, error) {
+	query := `
+		WITH accepted AS (
+			DELETE FROM household_invitations
+			WHERE email = LOWER($2)
+			RETURNING household_id, role
+		)
+		INSERT INTO household_members (household_id, user_id, role)
+		SELECT household_id, $1, role FROM accepted
+		ON CONFLICT (household_id, user_id) DO NOTHING
+	`
+	result, err := db.conn.ExecContext(ctx, query, userID, email)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
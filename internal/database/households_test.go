@@ -0,0 +1,109 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestCreateHousehold(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+
+	owner, err := db.UpsertUser(ctx, "test|household-"+t.Name(), "owner@example.com", "Owner", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	household, err := db.CreateHousehold(ctx, "Beach house", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if household.ID == 0 {
+		t.Error("expected ID to be set")
+	}
+
+	member, err := db.GetHouseholdMember(ctx, household.ID, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member.Role != RoleOwner {
+		t.Errorf("expected role %s, got %s", RoleOwner, member.Role)
+	}
+	if member.HouseholdName != "Beach house" {
+		t.Errorf("expected household name Beach house, got %s", member.HouseholdName)
+	}
+	if !member.Can(PermissionAdminUsers) {
+		t.Errorf("expected owner to have %s, got %v", PermissionAdminUsers, member.Permissions)
+	}
+}
+
+func TestHouseholdInvitationLifecycle(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+
+	owner, err := db.UpsertUser(ctx, "test|inviter-"+t.Name(), "inviter@example.com", "Inviter", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	household, err := db.CreateHousehold(ctx, "Home", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invite with mixed case, the address is matched case-insensitively
+	invitation, err := db.CreateHouseholdInvitation(ctx, household.ID, "Guest@Example.com", RoleGuest, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invitation.Email != "guest@example.com" {
+		t.Errorf("expected lower-cased email, got %s", invitation.Email)
+	}
+
+	guest, err := db.UpsertUser(ctx, "test|invitee-"+t.Name(), "guest@example.com", "Guest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	joined, err := db.AcceptHouseholdInvitations(ctx, guest.ID, guest.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined != 1 {
+		t.Errorf("expected 1 household joined, got %d", joined)
+	}
+
+	member, err := db.GetHouseholdMember(ctx, household.ID, guest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member.Role != RoleGuest {
+		t.Errorf("expected role %s, got %s", RoleGuest, member.Role)
+	}
+	if !member.Can(PermissionDevicesControl) || member.Can(PermissionAutomationsEdit) {
+		t.Errorf("unexpected guest permissions %v", member.Permissions)
+	}
+
+	invitations, err := db.ListHouseholdInvitations(ctx, household.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invitations) != 0 {
+		t.Errorf("expected invitation to be consumed, got %d", len(invitations))
+	}
+
+	// Remove the guest again
+	err = db.RemoveHouseholdMember(ctx, household.ID, guest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetHouseholdMember(ctx, household.ID, guest.ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
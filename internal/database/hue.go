@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// HueBridge is a Philips Hue bridge paired with a household.
+type HueBridge struct {
+	ID             int64     `db:"id"`
+	HouseholdID    int64     `db:"household_id"`
+	BridgeID       string    `db:"bridge_id"`       // The bridge's own id, such as 001788fffe123456
+	Address        string    `db:"address"`         // Host name or IP address
+	ApplicationKey []byte    `db:"application_key"` // Encrypted with the server's secret key
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+const hueBridgeColumns = `id, household_id, bridge_id, address, application_key, created_at, updated_at`
+
+// SaveHueBridge stores a newly paired bridge. A bridge that was paired with
+// the household before is updated with its new address and key.
+func (db *DB) SaveHueBridge(ctx context.Context, bridge *HueBridge) error {
+	query := `
+		INSERT INTO hue_bridges (household_id, bridge_id, address, application_key)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (household_id, bridge_id)
+		DO UPDATE SET address = EXCLUDED.address, application_key = EXCLUDED.application_key, updated_at = NOW()
+		RETURNING ` + hueBridgeColumns
+
+	return db.conn.GetContext(ctx, bridge, query, bridge.HouseholdID, bridge.BridgeID, bridge.Address, bridge.ApplicationKey)
+}
+
+func (db *DB) GetHueBridge(ctx context.Context, householdID, id int64) (*HueBridge, error) {
+	query := `SELECT ` + hueBridgeColumns + ` FROM hue_bridges WHERE household_id = $1 AND id = $2`
+	var bridge HueBridge
+	err := db.conn.GetContext(ctx, &bridge, query, householdID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &bridge, nil
+}
+
+// ListHueBridges returns the bridges of every household.
+func (db *DB) ListHueBridges(ctx context.Context) ([]HueBridge, error) {
+	query := `SELECT ` + hueBridgeColumns + ` FROM hue_bridges ORDER BY id`
+	bridges := []HueBridge{}
+	err := db.conn.SelectContext(ctx, &bridges, query)
+	return bridges, err
+}
+
+func (db *DB) ListHouseholdHueBridges(ctx context.Context, householdID int64) ([]HueBridge, error) {
+	query := `SELECT ` + hueBridgeColumns + ` FROM hue_bridges WHERE household_id = $1 ORDER BY id`
+	bridges := []HueBridge{}
+	err := db.conn.SelectContext(ctx, &bridges, query, householdID)
+	return bridges, err
+}
+
+// DeleteHueBridge removes a bridge. Its devices are kept. It returns
+// sql.ErrNoRows if the bridge does not exist.
+func (db *DB) DeleteHueBridge(ctx context.Context, householdID, id int64) error {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM hue_bridges WHERE household_id = $1 AND id = $2`, householdID, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
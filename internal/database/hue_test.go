@@ -0,0 +1,65 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestHueBridges(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	bridge := &HueBridge{HouseholdID: household.ID, BridgeID: "001788fffe123456", Address: "192.168.1.2", ApplicationKey: []byte{1, 2, 3}}
+	err := db.SaveHueBridge(ctx, bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bridge.ID == 0 || bridge.CreatedAt.IsZero() {
+		t.Errorf("expected the bridge to be created, got %+v", bridge)
+	}
+
+	// Pairing again updates the bridge
+	again := &HueBridge{HouseholdID: household.ID, BridgeID: "001788fffe123456", Address: "192.168.1.3", ApplicationKey: []byte{4, 5, 6}}
+	err = db.SaveHueBridge(ctx, again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != bridge.ID {
+		t.Errorf("expected bridge %d to be updated, got %d", bridge.ID, again.ID)
+	}
+
+	got, err := db.GetHueBridge(ctx, household.ID, bridge.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Address != "192.168.1.3" || !bytes.Equal(got.ApplicationKey, []byte{4, 5, 6}) {
+		t.Errorf("unexpected bridge %+v", got)
+	}
+
+	bridges, err := db.ListHouseholdHueBridges(ctx, household.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bridges) != 1 {
+		t.Errorf("expected 1 bridge, got %d", len(bridges))
+	}
+
+	err = db.DeleteHueBridge(ctx, household.ID, bridge.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetHueBridge(ctx, household.ID, bridge.ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+	err = db.DeleteHueBridge(ctx, household.ID, bridge.ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
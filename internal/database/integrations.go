@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+)
+
+// IntegrationEntry is an integration added to a household, with the settings
+// described by the integration's schema.
+type IntegrationEntry struct {
+	ID          int64             `db:"id"`
+	HouseholdID int64             `db:"household_id"`
+	Integration string            `db:"integration"` // The integration's name, which is the protocol of its devices
+	Enabled     bool              `db:"enabled"`
+	Config      IntegrationConfig `db:"config"`
+	CreatedAt   time.Time         `db:"created_at"`
+	UpdatedAt   time.Time         `db:"updated_at"`
+}
+
+// IntegrationConfig holds the settings of an integration entry, such as
+// {"import_scenes": true}.
+type IntegrationConfig map[string]any
+
+func (c IntegrationConfig) Value() (driver.Value, error) { return DeviceState(c).Value() }
+
+func (c *IntegrationConfig) Scan(src any) error {
+	var state DeviceState
+	err := state.Scan(src)
+	*c = IntegrationConfig(state)
+	return err
+}
+
+const integrationEntryColumns = `id, household_id, integration, enabled, config, created_at, updated_at`
+
+// SaveIntegrationEntry adds an integration to a household, or updates the
+// settings and whether it is enabled if it was added before.
+func (db *DB) SaveIntegrationEntry(ctx context.Context, entry *IntegrationEntry) error {
+	query := `
+		INSERT INTO integration_entries (household_id, integration, enabled, config)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (household_id, integration)
+		DO UPDATE SET enabled = EXCLUDED.enabled, config = EXCLUDED.config, updated_at = NOW()
+		RETURNING ` + integrationEntryColumns
+
+	return db.conn.GetContext(ctx, entry, query, entry.HouseholdID, entry.Integration, entry.Enabled, entry.Config)
+}
+
+// GetIntegrationEntry returns the entry of an integration in a household. It
+// returns sql.ErrNoRows if the household has not added the integration.
+func (db *DB) GetIntegrationEntry(ctx context.Context, householdID int64, integration string) (*IntegrationEntry, error) {
+	query := `SELECT ` + integrationEntryColumns + ` FROM integration_entries WHERE household_id = $1 AND integration = $2`
+	var entry IntegrationEntry
+	err := db.conn.GetContext(ctx, &entry, query, householdID, integration)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (db *DB) ListIntegrationEntries(ctx context.Context, householdID int64) ([]IntegrationEntry, error) {
+	query := `SELECT ` + integrationEntryColumns + ` FROM integration_entries WHERE household_id = $1 ORDER BY integration`
+	entries := []IntegrationEntry{}
+	err := db.conn.SelectContext(ctx, &entries, query, householdID)
+	return entries, err
+}
+
+// ListIntegrationEntriesByName returns the entries of an integration in every
+// household.
+func (db *DB) ListIntegrationEntriesByName(ctx context.Context, integration string) ([]IntegrationEntry, error) {
+	query := `SELECT ` + integrationEntryColumns + ` FROM integration_entries WHERE integration = $1 ORDER BY id`
+	entries := []IntegrationEntry{}
+	err := db.conn.SelectContext(ctx, &entries, query, integration)
+	return entries, err
+}
+
+// SetIntegrationEntryEnabled enables or disables an integration in a
+// household. It returns sql.ErrNoRows if the household has not added it.
+func (db *DB) SetIntegrationEntryEnabled(ctx context.Context, householdID int64, integration string, enabled bool) error {
+	query := `UPDATE integration_entries SET enabled = $3, updated_at = NOW() WHERE household_id = $1 AND integration = $2`
+	result, err := db.conn.ExecContext(ctx, query, householdID, integration, enabled)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
+
+// DeleteIntegrationEntry removes an integration from a household. Its devices
+// are kept. It returns sql.ErrNoRows if the household has not added it.
+func (db *DB) DeleteIntegrationEntry(ctx context.Context, householdID int64, integration string) error {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM integration_entries WHERE household_id = $1 AND integration = $2`, householdID, integration)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
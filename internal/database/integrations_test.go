@@ -0,0 +1,80 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestIntegrationEntries(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	entry := &IntegrationEntry{HouseholdID: household.ID, Integration: "hue", Enabled: true, Config: IntegrationConfig{"import_scenes": true}}
+	err := db.SaveIntegrationEntry(ctx, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.ID == 0 || entry.CreatedAt.IsZero() {
+		t.Errorf("expected the entry to be created, got %+v", entry)
+	}
+
+	// Saving again updates the settings
+	again := &IntegrationEntry{HouseholdID: household.ID, Integration: "hue", Enabled: true, Config: IntegrationConfig{"import_scenes": false}}
+	err = db.SaveIntegrationEntry(ctx, again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != entry.ID {
+		t.Errorf("expected entry %d to be updated, got %d", entry.ID, again.ID)
+	}
+
+	err = db.SetIntegrationEntryEnabled(ctx, household.ID, "hue", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetIntegrationEntry(ctx, household.ID, "hue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Enabled || got.Config["import_scenes"] != false {
+		t.Errorf("unexpected entry %+v", got)
+	}
+
+	entries, err := db.ListIntegrationEntriesByName(ctx, "hue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, e := range entries {
+		found = found || e.ID == entry.ID
+	}
+	if !found {
+		t.Errorf("expected entry %d to be listed, got %+v", entry.ID, entries)
+	}
+
+	err = db.DeleteIntegrationEntry(ctx, household.ID, "hue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetIntegrationEntry(ctx, household.ID, "hue")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+	err = db.SetIntegrationEntryEnabled(ctx, household.ID, "hue", true)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+
+	entries, err = db.ListIntegrationEntries(ctx, household.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no entries, got %+v", entries)
+	}
+}
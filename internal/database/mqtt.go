@@ -0,0 +1,109 @@
+package database
+
+import "context"
+
+// MQTTSession is a persistent session of a client of the embedded MQTT
+// broker. Data is the broker's own JSON encoding of the session, as are the
+// subscriptions and messages stored below.
+type MQTTSession struct {
+	ClientID    string `db:"client_id"`
+	HouseholdID *int64 `db:"household_id"` // nil for the server's own client
+	Data        []byte `db:"data"`
+}
+
+func (db *DB) ListMQTTSessions(ctx context.Context) ([]MQTTSession, error) {
+	query := `SELECT client_id, household_id, data FROM mqtt_sessions`
+	sessions := []MQTTSession{}
+	err := db.conn.SelectContext(ctx, &sessions, query)
+	return sessions, err
+}
+
+func (db *DB) SaveMQTTSession(ctx context.Context, session *MQTTSession) error {
+	query := `
+		INSERT INTO mqtt_sessions (client_id, household_id, data)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (client_id)
+		DO UPDATE SET household_id = EXCLUDED.household_id, data = EXCLUDED.data, updated_at = NOW()`
+
+	_, err := db.conn.ExecContext(ctx, query, session.ClientID, session.HouseholdID, session.Data)
+	return err
+}
+
+// DeleteMQTTSession deletes a session along with its subscriptions and
+// inflight messages.
+func (db *DB) DeleteMQTTSession(ctx context.Context, clientID string) error {
+	query := `
+		WITH subscriptions AS (DELETE FROM mqtt_subscriptions WHERE client_id = $1),
+			inflight AS (DELETE FROM mqtt_inflight_messages WHERE client_id = $1)
+		DELETE FROM mqtt_sessions WHERE client_id = $1`
+
+	_, err := db.conn.ExecContext(ctx, query, clientID)
+	return err
+}
+
+func (db *DB) ListMQTTSubscriptions(ctx context.Context) ([][]byte, error) {
+	subscriptions := [][]byte{}
+	err := db.conn.SelectContext(ctx, &subscriptions, `SELECT data FROM mqtt_subscriptions`)
+	return subscriptions, err
+}
+
+func (db *DB) SaveMQTTSubscription(ctx context.Context, clientID, filter string, data []byte) error {
+	query := `
+		INSERT INTO mqtt_subscriptions (client_id, filter, data)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (client_id, filter) DO UPDATE SET data = EXCLUDED.data`
+
+	_, err := db.conn.ExecContext(ctx, query, clientID, filter, data)
+	return err
+}
+
+func (db *DB) DeleteMQTTSubscription(ctx context.Context, clientID, filter string) error {
+	query := `DELETE FROM mqtt_subscriptions WHERE client_id = $1 AND filter = $2`
+	_, err := db.conn.ExecContext(ctx, query, clientID, filter)
+	return err
+}
+
+func (db *DB) ListMQTTInflightMessages(ctx context.Context) ([][]byte, error) {
+	messages := [][]byte{}
+	err := db.conn.SelectContext(ctx, &messages, `SELECT data FROM mqtt_inflight_messages ORDER BY client_id, packet_id`)
+	return messages, err
+}
+
+func (db *DB) SaveMQTTInflightMessage(ctx context.Context, clientID string, packetID uint16, data []byte) error {
+	query := `
+		INSERT INTO mqtt_inflight_messages (client_id, packet_id, data)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (client_id, packet_id) DO UPDATE SET data = EXCLUDED.data`
+
+	_, err := db.conn.ExecContext(ctx, query, clientID, int(packetID), data)
+	return err
+}
+
+func (db *DB) DeleteMQTTInflightMessage(ctx context.Context, clientID string, packetID uint16) error {
+	query := `DELETE FROM mqtt_inflight_messages WHERE client_id = $1 AND packet_id = $2`
+	_, err := db.conn.ExecContext(ctx, query, clientID, int(packetID))
+	return err
+}
+
+func (db *DB) ListMQTTRetainedMessages(ctx context.Context) ([][]byte, error) {
+	messages := [][]byte{}
+	err := db.conn.SelectContext(ctx, &messages, `SELECT data FROM mqtt_retained_messages`)
+	return messages, err
+}
+
+// SaveMQTTRetainedMessage stores the retained message of a topic, replacing
+// the previous one.
+func (db *DB) SaveMQTTRetainedMessage(ctx context.Context, topic string, data []byte) error {
+	query := `
+		INSERT INTO mqtt_retained_messages (topic, data)
+		VALUES ($1, $2)
+		ON CONFLICT (topic) DO UPDATE SET data = EXCLUDED.data, updated_at = NOW()`
+
+	_, err := db.conn.ExecContext(ctx, query, topic, data)
+	return err
+}
+
+func (db *DB) DeleteMQTTRetainedMessage(ctx context.Context, topic string) error {
+	_, err := db.conn.ExecContext(ctx, `DELETE FROM mqtt_retained_messages WHERE topic = $1`, topic)
+	return err
+}
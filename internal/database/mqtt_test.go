@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestMQTTSessions(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	session := &MQTTSession{ClientID: "test-lamp", HouseholdID: &household.ID, Data: []byte(`{"id": "test-lamp"}`)}
+	for range 2 {
+		err := db.SaveMQTTSession(ctx, session)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := db.SaveMQTTSubscription(ctx, "test-lamp", "lamp/set", []byte(`{"filter": "lamp/set"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SaveMQTTInflightMessage(ctx, "test-lamp", 7, []byte(`{"packet_id": 7}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := db.ListMQTTSessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := slices.ContainsFunc(sessions, func(s MQTTSession) bool {
+		return s.ClientID == "test-lamp" && s.HouseholdID != nil && *s.HouseholdID == household.ID
+	})
+	if !found {
+		t.Fatalf("expected the session to be stored, got %+v", sessions)
+	}
+
+	subscriptions, err := db.ListMQTTSubscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(subscriptions, func(data []byte) bool { return string(data) == `{"filter": "lamp/set"}` }) {
+		t.Errorf("expected the subscription to be stored, got %d", len(subscriptions))
+	}
+
+	// Deleting the session deletes its subscriptions and inflight messages
+	err = db.DeleteMQTTSession(ctx, "test-lamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptions, err = db.ListMQTTSubscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inflight, err := db.ListMQTTInflightMessages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.ContainsFunc(subscriptions, func(data []byte) bool { return string(data) == `{"filter": "lamp/set"}` }) ||
+		slices.ContainsFunc(inflight, func(data []byte) bool { return string(data) == `{"packet_id": 7}` }) {
+		t.Error("expected the session's subscriptions and inflight messages to be deleted")
+	}
+}
+
+func TestMQTTRetainedMessages(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+
+	for _, data := range []string{`{"payload": "first"}`, `{"payload": "second"}`} {
+		err := db.SaveMQTTRetainedMessage(ctx, "test/lamp", []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, err := db.ListMQTTRetainedMessages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(messages, func(data []byte) bool { return string(data) == `{"payload": "second"}` }) {
+		t.Error("expected the retained message to be replaced")
+	}
+
+	err = db.DeleteMQTTRetainedMessage(ctx, "test/lamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err = db.ListMQTTRetainedMessages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.ContainsFunc(messages, func(data []byte) bool { return string(data) == `{"payload": "second"}` }) {
+		t.Error("expected the retained message to be deleted")
+	}
+}
@@ -0,0 +1,39 @@
+package database
+
+import "math"
+
+// Page selects a 1-indexed page of results.
+type Page struct {
+	Number int
+	Size   int
+}
+
+func (p Page) limit() int {
+	return p.Size
+}
+
+func (p Page) offset() int {
+	return (p.Number - 1) * p.Size
+}
+
+type PageMetadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records"`
+}
+
+func calculatePageMetadata(totalRecords int, page Page) PageMetadata {
+	if totalRecords == 0 {
+		return PageMetadata{}
+	}
+
+	return PageMetadata{
+		CurrentPage:  page.Number,
+		PageSize:     page.Size,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(page.Size))),
+		TotalRecords: totalRecords,
+	}
+}
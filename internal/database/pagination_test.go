@@ -0,0 +1,30 @@
+package database
+
+import "testing"
+
+func TestCalculatePageMetadata(t *testing.T) {
+	metadata := calculatePageMetadata(45, Page{Number: 2, Size: 20})
+
+	if metadata.LastPage != 3 {
+		t.Errorf("expected last page 3, got %d", metadata.LastPage)
+	}
+	if metadata.CurrentPage != 2 || metadata.TotalRecords != 45 {
+		t.Errorf("unexpected metadata %+v", metadata)
+	}
+
+	empty := calculatePageMetadata(0, Page{Number: 1, Size: 20})
+	if empty != (PageMetadata{}) {
+		t.Errorf("expected empty metadata, got %+v", empty)
+	}
+}
+
+func TestPageOffset(t *testing.T) {
+	page := Page{Number: 3, Size: 25}
+
+	if page.offset() != 50 {
+		t.Errorf("expected offset 50, got %d", page.offset())
+	}
+	if page.limit() != 25 {
+		t.Errorf("expected limit 25, got %d", page.limit())
+	}
+}
@@ -0,0 +1,44 @@
+package database
+
+import "context"
+
+// Permissions are granted to household roles through the role_permissions
+// table and checked with HouseholdMember.Can.
+const (
+	PermissionDevicesView     = "devices:view"
+	PermissionDevicesControl  = "devices:control"
+	PermissionDevicesEdit     = "devices:edit"
+	PermissionAutomationsView = "automations:view"
+	PermissionAutomationsEdit = "automations:edit"
+	PermissionAdminUsers      = "admin:users"
+	PermissionAdminDiscovery  = "admin:discovery" // Devices discovered on the server's network
+)
+
+var Permissions = []string{
+	PermissionDevicesView,
+	PermissionDevicesControl,
+	PermissionDevicesEdit,
+	PermissionAutomationsView,
+	PermissionAutomationsEdit,
+	PermissionAdminUsers,
+	PermissionAdminDiscovery,
+}
+
+// ListRolePermissions returns the permissions granted to every role.
+func (db *DB) ListRolePermissions(ctx context.Context) (map[string][]string, error) {
+	var rows []struct {
+		Role       string `db:"role"`
+		Permission string `db:"permission"`
+	}
+
+	err := db.conn.SelectContext(ctx, &rows, `SELECT role, permission FROM role_permissions ORDER BY role, permission`)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := map[string][]string{}
+	for _, row := range rows {
+		permissions[row.Role] = append(permissions[row.Role], row.Permission)
+	}
+	return permissions, nil
+}
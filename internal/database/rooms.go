@@ -0,0 +1,132 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+type Floor struct {
+	ID          int64     `db:"id" json:"id"`
+	HouseholdID int64     `db:"household_id" json:"household_id"`
+	Name        string    `db:"name" json:"name"`
+	Level       int       `db:"level" json:"level"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+type Room struct {
+	ID          int64     `db:"id" json:"id"`
+	HouseholdID int64     `db:"household_id" json:"household_id"`
+	FloorID     *int64    `db:"floor_id" json:"floor_id"` // nil for areas that are not on a floor, e.g. the garden
+	Name        string    `db:"name" json:"name"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at" json:"updated_at"`
+}
+
+func (db *DB) CreateFloor(ctx context.Context, householdID int64, name string, level int) (*Floor, error) {
+	query := `
+		INSERT INTO floors (household_id, name, level)
+		VALUES ($1, $2, $3)
+		RETURNING id, household_id, name, level, created_at
+	`
+	var floor Floor
+	err := db.conn.GetContext(ctx, &floor, query, householdID, name, level)
+	return &floor, err
+}
+
+func (db *DB) ListFloors(ctx context.Context, householdID int64) ([]Floor, error) {
+	query := `SELECT id, household_id, name, level, created_at FROM floors WHERE household_id = $1 ORDER BY level, name`
+	floors := []Floor{}
+	err := db.conn.SelectContext(ctx, &floors, query, householdID)
+	return floors, err
+}
+
+// DeleteFloor removes a floor. Rooms on the floor are kept and become
+// unassigned. It returns sql.ErrNoRows if the floor does not exist.
+func (db *DB) DeleteFloor(ctx context.Context, householdID, id int64) error {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM floors WHERE household_id = $1 AND id = $2`, householdID, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
+
+const roomColumns = `id, household_id, floor_id, name, created_at, updated_at`
+
+func (db *DB) CreateRoom(ctx context.Context, room *Room) error {
+	query := `
+		INSERT INTO rooms (household_id, floor_id, name)
+		VALUES ($1, $2, $3)
+		RETURNING ` + roomColumns
+
+	return db.conn.GetContext(ctx, room, query, room.HouseholdID, room.FloorID, room.Name)
+}
+
+func (db *DB) GetRoom(ctx context.Context, householdID, id int64) (*Room, error) {
+	query := `SELECT ` + roomColumns + ` FROM rooms WHERE household_id = $1 AND id = $2`
+	var room Room
+	err := db.conn.GetContext(ctx, &room, query, householdID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// ListRoomsPaged returns one page of a household's rooms along with the
+// pagination metadata.
+func (db *DB) ListRoomsPaged(ctx context.Context, householdID int64, page Page) ([]Room, PageMetadata, error) {
+	query := `
+		SELECT COUNT(*) OVER() AS total_records, ` + roomColumns + `
+		FROM rooms
+		WHERE household_id = $1
+		ORDER BY name, id
+		LIMIT $2 OFFSET $3
+	`
+	var rows []struct {
+		TotalRecords int `db:"total_records"`
+		Room
+	}
+	err := db.conn.SelectContext(ctx, &rows, query, householdID, page.limit(), page.offset())
+	if err != nil {
+		return nil, PageMetadata{}, err
+	}
+
+	rooms := make([]Room, 0, len(rows))
+	totalRecords := 0
+	for _, row := range rows {
+		totalRecords = row.TotalRecords
+		rooms = append(rooms, row.Room)
+	}
+
+	return rooms, calculatePageMetadata(totalRecords, page), nil
+}
+
+func (db *DB) ListRooms(ctx context.Context, householdID int64) ([]Room, error) {
+	query := `SELECT ` + roomColumns + ` FROM rooms WHERE household_id = $1 ORDER BY name, id`
+	rooms := []Room{}
+	err := db.conn.SelectContext(ctx, &rooms, query, householdID)
+	return rooms, err
+}
+
+// UpdateRoom saves the name and floor of room. It returns sql.ErrNoRows if the
+// room does not exist.
+func (db *DB) UpdateRoom(ctx context.Context, room *Room) error {
+	query := `
+		UPDATE rooms
+		SET floor_id = $2, name = $3, updated_at = NOW()
+		WHERE id = $1 AND household_id = $4
+		RETURNING ` + roomColumns
+
+	return db.conn.GetContext(ctx, room, query, room.ID, room.FloorID, room.Name, room.HouseholdID)
+}
+
+// DeleteRoom removes a room. Devices in the room are kept and become
+// unassigned. It returns sql.ErrNoRows if the room does not exist.
+func (db *DB) DeleteRoom(ctx context.Context, householdID, id int64) error {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM rooms WHERE household_id = $1 AND id = $2`, householdID, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRoomHierarchy(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	floor, err := db.CreateFloor(ctx, household.ID, "Ground floor", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	room := &Room{HouseholdID: household.ID, Name: "Kitchen", FloorID: &floor.ID}
+	err = db.CreateRoom(ctx, room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.ID == 0 {
+		t.Error("expected ID to be set")
+	}
+
+	device := &Device{HouseholdID: household.ID, Name: "Kettle", Kind: "outlet", Protocol: "wifi"}
+	err = db.CreateDevice(ctx, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Move device into room
+	err = db.SetDeviceRoom(ctx, household.ID, device.ID, &room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := db.ListDevicesInRoom(ctx, household.ID, room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].ID != device.ID {
+		t.Fatalf("expected device %d in room, got %v", device.ID, devices)
+	}
+
+	// Deleting the floor keeps the room
+	err = db.DeleteFloor(ctx, household.ID, floor.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err = db.GetRoom(ctx, household.ID, room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.FloorID != nil {
+		t.Errorf("expected floor to be cleared, got %d", *room.FloorID)
+	}
+
+	// Deleting the room keeps the device
+	err = db.DeleteRoom(ctx, household.ID, room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err = db.GetDevice(ctx, household.ID, device.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.RoomID != nil {
+		t.Errorf("expected room to be cleared, got %d", *device.RoomID)
+	}
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+)
+
+// Scene is a set of target states for several devices that are applied
+// together, such as "Movie night".
+type Scene struct {
+	ID          int64        `db:"id" json:"id"`
+	HouseholdID int64        `db:"household_id" json:"household_id"`
+	RoomID      *int64       `db:"room_id" json:"room_id"` // The room it was captured in, if any
+	Name        string       `db:"name" json:"name"`
+	Targets     SceneTargets `db:"targets" json:"targets"`
+	CreatedAt   time.Time    `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time    `db:"updated_at" json:"updated_at"`
+}
+
+type SceneTarget struct {
+	DeviceID int64       `json:"device_id"`
+	State    DeviceState `json:"state"`
+}
+
+type SceneTargets []SceneTarget
+
+func (t SceneTargets) Value() (driver.Value, error) { return jsonValue(t) }
+func (t *SceneTargets) Scan(src any) error          { return scanJSON(src, t) }
+
+const sceneColumns = `id, household_id, room_id, name, targets, created_at, updated_at`
+
+func (db *DB) CreateScene(ctx context.Context, scene *Scene) error {
+	query := `
+		INSERT INTO scenes (household_id, room_id, name, targets)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + sceneColumns
+
+	return db.conn.GetContext(ctx, scene, query, scene.HouseholdID, scene.RoomID, scene.Name, scene.Targets)
+}
+
+func (db *DB) GetScene(ctx context.Context, householdID, id int64) (*Scene, error) {
+	query := `SELECT ` + sceneColumns + ` FROM scenes WHERE household_id = $1 AND id = $2`
+
+	var scene Scene
+	err := db.conn.GetContext(ctx, &scene, query, householdID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &scene, nil
+}
+
+func (db *DB) ListScenes(ctx context.Context, householdID int64) ([]Scene, error) {
+	query := `SELECT ` + sceneColumns + ` FROM scenes WHERE household_id = $1 ORDER BY name, id`
+	scenes := []Scene{}
+	err := db.conn.SelectContext(ctx, &scenes, query, householdID)
+	return scenes, err
+}
+
+func (db *DB) ListScenesInRoom(ctx context.Context, householdID, roomID int64) ([]Scene, error) {
+	query := `SELECT ` + sceneColumns + ` FROM scenes WHERE household_id = $1 AND room_id = $2 ORDER BY name, id`
+	scenes := []Scene{}
+	err := db.conn.SelectContext(ctx, &scenes, query, householdID, roomID)
+	return scenes, err
+}
+
+func (db *DB) UpdateScene(ctx context.Context, scene *Scene) error {
+	query := `
+		UPDATE scenes
+		SET room_id = $2, name = $3, targets = $4, updated_at = NOW()
+		WHERE id = $1 AND household_id = $5
+		RETURNING ` + sceneColumns
+
+	return db.conn.GetContext(ctx, scene, query, scene.ID, scene.RoomID, scene.Name, scene.Targets, scene.HouseholdID)
+}
+
+// DeleteScene removes a scene. It returns sql.ErrNoRows if the scene does not
+// exist.
+func (db *DB) DeleteScene(ctx context.Context, householdID, id int64) error {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM scenes WHERE household_id = $1 AND id = $2`, householdID, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result)
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestScenes(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	room := &Room{HouseholdID: household.ID, Name: "Living room"}
+	err := db.CreateRoom(ctx, room)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scene := &Scene{
+		HouseholdID: household.ID,
+		RoomID:      &room.ID,
+		Name:        "Movie night",
+		Targets: SceneTargets{
+			{DeviceID: 1, State: DeviceState{"on": true, "brightness": 20.0}},
+			{DeviceID: 2, State: DeviceState{"position": 0.0}},
+		},
+	}
+	err = db.CreateScene(ctx, scene)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.GetScene(ctx, household.ID, scene.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Targets) != 2 || got.Targets[0].State["brightness"] != 20.0 {
+		t.Errorf("unexpected targets %+v", got.Targets)
+	}
+
+	got.Targets[0].State["brightness"] = 10.0
+	err = db.UpdateScene(ctx, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Targets[0].State["brightness"] != 10.0 || got.Name != "Movie night" {
+		t.Errorf("unexpected updated scene %+v", got)
+	}
+
+	err = db.CreateScene(ctx, &Scene{HouseholdID: household.ID, Name: "Away", Targets: SceneTargets{{DeviceID: 3, State: DeviceState{"locked": true}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inRoom, err := db.ListScenesInRoom(ctx, household.ID, room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inRoom) != 1 || inRoom[0].ID != scene.ID {
+		t.Errorf("expected only the movie night scene in the room, got %+v", inRoom)
+	}
+
+	all, err := db.ListScenes(ctx, household.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Errorf("expected 2 scenes, got %d", len(all))
+	}
+
+	// Removing the room keeps its scenes
+	err = db.DeleteRoom(ctx, household.ID, room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = db.GetScene(ctx, household.ID, scene.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RoomID != nil {
+		t.Errorf("expected scene to lose its room, got %d", *got.RoomID)
+	}
+
+	err = db.DeleteScene(ctx, household.ID, scene.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetScene(ctx, household.ID, scene.ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
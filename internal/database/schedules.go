@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ScheduledAutomation is an enabled automation with at least one scheduled
+// trigger, joined with the location of its household.
+type ScheduledAutomation struct {
+	Automation
+	Timezone  string   `db:"timezone"`
+	Latitude  *float64 `db:"latitude"`
+	Longitude *float64 `db:"longitude"`
+}
+
+// ScheduleRun is the next time a scheduled trigger fires. Spec describes the
+// trigger and location it was computed from.
+type ScheduleRun struct {
+	AutomationID int64     `db:"automation_id"`
+	TriggerIndex int       `db:"trigger_index"`
+	Spec         string    `db:"spec"`
+	NextRunAt    time.Time `db:"next_run_at"`
+}
+
+// ListScheduledAutomations returns the enabled automations of every household
+// that have a time, cron or sun trigger.
+func (db *DB) ListScheduledAutomations(ctx context.Context) ([]ScheduledAutomation, error) {
+	query := `
+		SELECT a.id, a.household_id, a.name, a.enabled, a.triggers, a.conditions, a.actions,
+			a.last_triggered_at, a.created_at, a.updated_at,
+			h.timezone, h.latitude, h.longitude
+		FROM automations a
+		JOIN households h ON h.id = a.household_id
+		WHERE a.enabled AND EXISTS (
+			SELECT 1 FROM jsonb_array_elements(a.triggers) t WHERE t->>'type' = ANY($1)
+		)
+		ORDER BY a.id`
+
+	automations := []ScheduledAutomation{}
+	err := db.conn.SelectContext(ctx, &automations, query, pq.StringArray(ScheduledTriggerTypes))
+	return automations, err
+}
+
+func (db *DB) ListScheduleRuns(ctx context.Context) ([]ScheduleRun, error) {
+	query := `SELECT automation_id, trigger_index, spec, next_run_at FROM schedule_runs`
+	runs := []ScheduleRun{}
+	err := db.conn.SelectContext(ctx, &runs, query)
+	return runs, err
+}
+
+// SaveScheduleRun records the next run of a trigger, replacing any earlier one.
+func (db *DB) SaveScheduleRun(ctx context.Context, run *ScheduleRun) error {
+	query := `
+		INSERT INTO schedule_runs (automation_id, trigger_index, spec, next_run_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (automation_id, trigger_index)
+		DO UPDATE SET spec = EXCLUDED.spec, next_run_at = EXCLUDED.next_run_at`
+
+	_, err := db.conn.ExecContext(ctx, query, run.AutomationID, run.TriggerIndex, run.Spec, run.NextRunAt)
+	return err
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScheduleRuns(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	lat, lon := 51.5, -0.12
+	household.Timezone = "Europe/London"
+	household.Latitude = &lat
+	household.Longitude = &lon
+	err := db.UpdateHouseholdLocation(ctx, household)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sunset := &Automation{
+		HouseholdID: household.ID,
+		Name:        "Sunset",
+		Enabled:     true,
+		Triggers:    Triggers{{Type: TriggerState, DeviceID: 1}, {Type: TriggerSun, Sun: Sunset, Offset: -15}},
+		Actions:     Actions{{Type: ActionNotification, Message: "Close the blinds"}},
+	}
+	err = db.CreateAutomation(ctx, sunset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled, err := db.ListScheduledAutomations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *ScheduledAutomation
+	for i := range scheduled {
+		if scheduled[i].ID == sunset.ID {
+			found = &scheduled[i]
+		}
+	}
+	if found == nil {
+		t.Fatal("expected the sunset automation to be scheduled")
+	}
+	if found.Timezone != "Europe/London" || found.Latitude == nil || *found.Latitude != lat {
+		t.Errorf("unexpected location %s %v %v", found.Timezone, found.Latitude, found.Longitude)
+	}
+
+	next := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, spec := range []string{"first", "second"} {
+		err = db.SaveScheduleRun(ctx, &ScheduleRun{AutomationID: sunset.ID, TriggerIndex: 1, Spec: spec, NextRunAt: next})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runs, err := db.ListScheduleRuns(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []ScheduleRun
+	for _, run := range runs {
+		if run.AutomationID == sunset.ID {
+			saved = append(saved, run)
+		}
+	}
+	if len(saved) != 1 || saved[0].Spec != "second" || saved[0].TriggerIndex != 1 || !saved[0].NextRunAt.Equal(next) {
+		t.Errorf("expected the second run to replace the first, got %+v", saved)
+	}
+}
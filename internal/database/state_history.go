@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// pruneBatchSize limits how many rows a single DELETE removes, so pruning a
+// large backlog does not hold locks for long.
+const pruneBatchSize = 10_000
+
+type StateHistoryEntry struct {
+	ID          int64       `db:"id" json:"id"`
+	HouseholdID int64       `db:"household_id" json:"-"`
+	DeviceID    int64       `db:"device_id" json:"device_id"`
+	State       DeviceState `db:"state" json:"state"`
+	Changes     DeviceState `db:"changes" json:"changes"`
+	RecordedAt  time.Time   `db:"recorded_at" json:"recorded_at"`
+}
+
+// StateHistoryFilter selects history entries of one device within [From, To).
+type StateHistoryFilter struct {
+	DeviceID  int64
+	From      time.Time
+	To        time.Time
+	Attribute string // Only entries that changed this attribute, if set
+	Limit     int
+}
+
+// HistoryBucket summarises the values of one attribute over a time bucket.
+// Booleans are counted as 0 and 1, so Avg is the fraction of time spent on.
+type HistoryBucket struct {
+	Start   time.Time `db:"bucket" json:"start"`
+	Min     float64   `db:"min" json:"min"`
+	Max     float64   `db:"max" json:"max"`
+	Avg     float64   `db:"avg" json:"avg"`
+	Samples int       `db:"samples" json:"samples"`
+}
+
+const stateHistoryColumns = `id, household_id, device_id, state, changes, recorded_at`
+
+func (db *DB) RecordStateChange(ctx context.Context, entry *StateHistoryEntry) error {
+	query := `
+		INSERT INTO state_history (household_id, device_id, state, changes, recorded_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING ` + stateHistoryColumns
+
+	return db.conn.GetContext(ctx, entry, query,
+		entry.HouseholdID, entry.DeviceID, entry.State, entry.Changes, entry.RecordedAt)
+}
+
+// ListStateHistory returns the matching entries, oldest first.
+func (db *DB) ListStateHistory(ctx context.Context, householdID int64, filter StateHistoryFilter) ([]StateHistoryEntry, error) {
+	query := `
+		SELECT ` + stateHistoryColumns + `
+		FROM state_history
+		WHERE household_id = $1 AND device_id = $2
+			AND recorded_at >= $3 AND recorded_at < $4
+			AND ($5 = '' OR changes ? $5)
+		ORDER BY recorded_at, id
+		LIMIT $6`
+
+	entries := []StateHistoryEntry{}
+	err := db.conn.SelectContext(ctx, &entries, query,
+		householdID, filter.DeviceID, filter.From, filter.To, filter.Attribute, filter.Limit)
+	return entries, err
+}
+
+// AggregateStateHistory downsamples filter.Attribute into buckets of the
+// given size starting at filter.From. Buckets without samples are omitted
+// and filter.Limit is ignored.
+func (db *DB) AggregateStateHistory(ctx context.Context, householdID int64, filter StateHistoryFilter, bucket time.Duration) ([]HistoryBucket, error) {
+	query := `
+		SELECT $3::timestamptz + floor(extract(epoch FROM recorded_at - $3::timestamptz) / $5::bigint) * $5::bigint * interval '1 second' AS bucket,
+			MIN(value) AS min, MAX(value) AS max, AVG(value) AS avg, COUNT(*) AS samples
+		FROM (
+			SELECT recorded_at,
+				CASE jsonb_typeof(state -> $6)
+					WHEN 'number' THEN (state ->> $6)::double precision
+					WHEN 'boolean' THEN CASE WHEN (state -> $6)::boolean THEN 1 ELSE 0 END
+				END AS value
+			FROM state_history
+			WHERE household_id = $1 AND device_id = $2
+				AND recorded_at >= $3 AND recorded_at < $4
+		) samples
+		WHERE value IS NOT NULL
+		GROUP BY bucket
+		ORDER BY bucket`
+
+	buckets := []HistoryBucket{}
+	err := db.conn.SelectContext(ctx, &buckets, query,
+		householdID, filter.DeviceID, filter.From, filter.To, int64(bucket.Seconds()), filter.Attribute)
+	return buckets, err
+}
+
+// PruneStateHistory deletes entries recorded before the given time and returns
+// how many were removed.
+func (db *DB) PruneStateHistory(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+		DELETE FROM state_history
+		WHERE id IN (
+			SELECT id FROM state_history WHERE recorded_at < $1 LIMIT $2
+		)`
+
+	var total int64
+	for {
+		result, err := db.conn.ExecContext(ctx, query, before, pruneBatchSize)
+		if err != nil {
+			return total, err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+
+		if n < pruneBatchSize {
+			return total, nil
+		}
+	}
+}
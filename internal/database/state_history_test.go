@@ -0,0 +1,132 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStateHistory(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	device := &Device{HouseholdID: household.ID, Name: "Garage door", Kind: "cover", Protocol: "zigbee"}
+	err := db.CreateDevice(ctx, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	changes := []struct {
+		ago     time.Duration
+		changes DeviceState
+	}{
+		{40 * 24 * time.Hour, DeviceState{"position": 100.0}},
+		{10 * time.Hour, DeviceState{"position": 100.0}},
+		{9 * time.Hour, DeviceState{"position": 0.0}},
+		{8 * time.Hour, DeviceState{"battery": 80.0}},
+	}
+	for _, c := range changes {
+		entry := &StateHistoryEntry{HouseholdID: household.ID, DeviceID: device.ID, State: c.changes, Changes: c.changes, RecordedAt: now.Add(-c.ago)}
+		err = db.RecordStateChange(ctx, entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// When did the door move last night?
+	entries, err := db.ListStateHistory(ctx, household.ID, StateHistoryFilter{
+		DeviceID:  device.ID,
+		From:      now.Add(-24 * time.Hour),
+		To:        now,
+		Attribute: "position",
+		Limit:     100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 position changes, got %d", len(entries))
+	}
+	if !entries[0].RecordedAt.Before(entries[1].RecordedAt) {
+		t.Error("expected entries oldest first")
+	}
+	if entries[1].Changes["position"] != 0.0 {
+		t.Errorf("expected the door to close last, got %v", entries[1].Changes)
+	}
+
+	// Other households cannot read the history
+	entries, err = db.ListStateHistory(ctx, household.ID+1000, StateHistoryFilter{DeviceID: device.ID, From: now.Add(-24 * time.Hour), To: now, Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no entries for another household, got %d", len(entries))
+	}
+
+	deleted, err := db.PruneStateHistory(ctx, now.AddDate(0, 0, -30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 entry pruned, got %d", deleted)
+	}
+}
+
+func TestAggregateStateHistory(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	household := createTestHousehold(t, db)
+
+	device := &Device{HouseholdID: household.ID, Name: "Thermostat", Kind: "thermostat", Protocol: "zigbee"}
+	err := db.CreateDevice(ctx, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	samples := []struct {
+		offset time.Duration
+		state  DeviceState
+	}{
+		{10 * time.Minute, DeviceState{"temperature": 19.0, "on": true}},
+		{20 * time.Minute, DeviceState{"temperature": 21.0, "on": false}},
+		{70 * time.Minute, DeviceState{"temperature": 22.0, "on": true}},
+		{80 * time.Minute, DeviceState{"humidity": 40.0}},
+	}
+	for _, s := range samples {
+		entry := &StateHistoryEntry{HouseholdID: household.ID, DeviceID: device.ID, State: s.state, Changes: s.state, RecordedAt: from.Add(s.offset)}
+		err = db.RecordStateChange(ctx, entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filter := StateHistoryFilter{DeviceID: device.ID, From: from, To: from.Add(2 * time.Hour), Attribute: "temperature"}
+	buckets, err := db.AggregateStateHistory(ctx, household.ID, filter, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(buckets))
+	}
+	first := buckets[0]
+	if !first.Start.Equal(from) || first.Min != 19 || first.Max != 21 || first.Avg != 20 || first.Samples != 2 {
+		t.Errorf("unexpected first bucket %+v", first)
+	}
+
+	// Booleans are aggregated as 0 and 1
+	filter.Attribute = "on"
+	buckets, err = db.AggregateStateHistory(ctx, household.ID, filter, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 || buckets[0].Avg != 0.5 || buckets[1].Max != 1 {
+		t.Errorf("unexpected boolean buckets %+v", buckets)
+	}
+}
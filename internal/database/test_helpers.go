@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -27,3 +28,20 @@ func getTestDB(t *testing.T) *DB {
 	// Wrap the transaction so each test is isolated
 	return &DB{dsn: dsn, conn: tx}
 }
+
+// createTestHousehold creates a household owned by a fresh test user.
+func createTestHousehold(t *testing.T, db *DB) *Household {
+	t.Helper()
+
+	owner, err := db.UpsertUser(context.Background(), "test|owner-"+t.Name(), "owner@example.com", "Owner", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	household, err := db.CreateHousehold(context.Background(), "Test home", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return household
+}
@@ -0,0 +1,310 @@
+// Package discovery finds devices on the local network from their mDNS and
+// SSDP announcements. It listens to both multicast groups for devices that
+// announce themselves, and queries for mDNS services and searches for SSDP
+// devices when started and every QueryInterval. Each device heard is matched
+// against the registered integrations, and forgotten once it says goodbye or
+// has not been heard from for Expiry.
+package discovery
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/integrations"
+)
+
+const (
+	DefaultMDNSAddress   = "224.0.0.251:5353"
+	DefaultSSDPAddress   = "239.255.255.250:1900"
+	DefaultQueryInterval = 5 * time.Minute
+	DefaultExpiry        = 15 * time.Minute
+
+	maxPacketSize = 9000
+
+	// maxFound is how many devices are remembered, so a network flooded with
+	// announcements cannot grow the list without bound. The device heard
+	// from least recently is forgotten to make room.
+	maxFound = 500
+)
+
+// DefaultServices are the mDNS services queried for: HomeKit accessories,
+// Shelly relays, ESPHome nodes, Hue bridges and WLED controllers.
+var DefaultServices = []string{"_hap._tcp", "_shelly._tcp", "_esphomelib._tcp", "_hue._tcp", "_wled._tcp"}
+
+type Config struct {
+	// MDNSAddress and SSDPAddress are the multicast groups listened to and
+	// queried.
+	MDNSAddress string
+	SSDPAddress string
+
+	// Services are the mDNS service types listened for, such as
+	// "_hue._tcp". Announcements of other services are ignored.
+	Services []string
+
+	// QueryInterval is how often services are queried for, which must be
+	// well under Expiry for devices that only answer queries to be kept.
+	QueryInterval time.Duration
+	Expiry        time.Duration
+}
+
+// Found is a device heard on the local network.
+type Found struct {
+	Announcement integrations.Announcement
+	Integration  integrations.Integration // nil when no integration handles the device
+	Discovery    integrations.Discovery   // The device as matched by the integration
+	LastSeen     time.Time
+}
+
+// Name returns the name of the device, as matched or as announced.
+func (f Found) Name() string {
+	return cmp.Or(f.Discovery.Name, f.Announcement.Name)
+}
+
+// heard is an announcement read from a packet.
+type heard struct {
+	integrations.Announcement
+	gone bool // The device said goodbye
+}
+
+// listener is how the devices of a protocol are heard.
+type listener struct {
+	name          string
+	announcements net.PacketConn // Joined to the multicast group
+	replies       net.PacketConn // Sends queries, and receives the replies sent to it directly
+	group         net.Addr
+	query         []byte
+	parse         func(packet []byte, src net.IP) []heard
+}
+
+type Discoverer struct {
+	cfg      Config
+	registry *integrations.Registry
+	logger   *slog.Logger
+	now      func() time.Time
+
+	mu    sync.Mutex
+	found map[string]*Found // By integration and address, or by announced name
+}
+
+func New(cfg Config, registry *integrations.Registry, logger *slog.Logger) *Discoverer {
+	cfg.MDNSAddress = cmp.Or(cfg.MDNSAddress, DefaultMDNSAddress)
+	cfg.SSDPAddress = cmp.Or(cfg.SSDPAddress, DefaultSSDPAddress)
+	cfg.QueryInterval = cmp.Or(cfg.QueryInterval, DefaultQueryInterval)
+	cfg.Expiry = cmp.Or(cfg.Expiry, DefaultExpiry)
+	if cfg.Services == nil {
+		cfg.Services = DefaultServices
+	}
+
+	return &Discoverer{
+		cfg:      cfg,
+		registry: registry,
+		logger:   logger,
+		now:      time.Now,
+		found:    map[string]*Found{},
+	}
+}
+
+// Run listens for devices until ctx is cancelled. A protocol that cannot be
+// listened to, such as when another program holds its port exclusively, is
+// logged and left out. An error is only returned if neither can be.
+func (d *Discoverer) Run(ctx context.Context) error {
+	query, err := mdnsQuery(d.cfg.Services)
+	if err != nil {
+		return err
+	}
+
+	mdns := &listener{name: "mDNS", query: query, parse: d.parseMDNS}
+	ssdp := &listener{name: "SSDP", query: ssdpSearch(d.cfg.SSDPAddress), parse: parseSSDP}
+
+	var (
+		listeners []*listener
+		errs      []error
+	)
+	for l, address := range map[*listener]string{mdns: d.cfg.MDNSAddress, ssdp: d.cfg.SSDPAddress} {
+		err := l.open(address)
+		if err != nil {
+			d.logger.Warn("discovery unavailable", "protocol", l.name, "address", address, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return errors.Join(errs...)
+	}
+
+	return d.run(ctx, listeners...)
+}
+
+// open joins the multicast group at address, and opens the socket queries
+// are sent from.
+func (l *listener) open(address string) error {
+	group, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return err
+	}
+	if !group.IP.IsMulticast() {
+		return errors.New("address is not a multicast group")
+	}
+
+	l.announcements, err = net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+
+	l.replies, err = net.ListenUDP("udp4", nil)
+	if err != nil {
+		l.announcements.Close()
+		return err
+	}
+
+	l.group = group
+	return nil
+}
+
+// run reads packets from the listeners, querying every QueryInterval, until
+// ctx is cancelled. It closes the listeners' connections.
+func (d *Discoverer) run(ctx context.Context, listeners ...*listener) error {
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		for _, conn := range []net.PacketConn{l.announcements, l.replies} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.read(l, conn)
+			}()
+		}
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.announcements.Close()
+			l.replies.Close()
+		}
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(d.cfg.QueryInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, l := range listeners {
+			_, err := l.replies.WriteTo(l.query, l.group)
+			if err != nil {
+				d.logger.Warn("failed to send discovery query", "protocol", l.name, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// read handles the packets received on conn until it is closed.
+func (d *Discoverer) read(l *listener, conn net.PacketConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				d.logger.Warn("discovery stopped listening", "protocol", l.name, "error", err)
+			}
+			return
+		}
+
+		src, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		for _, h := range l.parse(buf[:n], src.IP) {
+			d.handle(h)
+		}
+	}
+}
+
+// handle records a device that was heard, matched against the registered
+// integrations, or forgets it if it said goodbye.
+func (d *Discoverer) handle(h heard) {
+	f := &Found{Announcement: h.Announcement}
+	key := h.Source + " " + strings.ToLower(h.Name)
+	for _, integration := range d.registry.All() {
+		m, ok := integration.(integrations.Matcher)
+		if !ok {
+			continue
+		}
+		if discovery, ok := m.Match(h.Announcement); ok {
+			f.Integration, f.Discovery = integration, discovery
+			key = integration.Name() + " " + discovery.Address
+			break
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if h.gone {
+		delete(d.found, key)
+		return
+	}
+	f.LastSeen = d.now()
+	if _, ok := d.found[key]; !ok {
+		d.prune()
+		if len(d.found) >= maxFound {
+			d.forgetOldest()
+		}
+		d.logger.Debug("device discovered", "source", h.Source, "service", h.Service, "name", h.Name, "address", h.Address())
+	}
+	d.found[key] = f
+}
+
+// List returns the devices heard within the expiry, ordered by name.
+func (d *Discoverer) List() []Found {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.prune()
+
+	found := []Found{}
+	for _, f := range d.found {
+		found = append(found, *f)
+	}
+	slices.SortFunc(found, func(a, b Found) int {
+		return cmp.Or(
+			strings.Compare(strings.ToLower(a.Name()), strings.ToLower(b.Name())),
+			strings.Compare(a.Announcement.Address(), b.Announcement.Address()),
+		)
+	})
+	return found
+}
+
+// prune forgets the devices not heard from within the expiry. d.mu must be
+// held.
+func (d *Discoverer) prune() {
+	now := d.now()
+	for key, f := range d.found {
+		if now.Sub(f.LastSeen) > d.cfg.Expiry {
+			delete(d.found, key)
+		}
+	}
+}
+
+// forgetOldest forgets the device heard from least recently. d.mu must be
+// held.
+func (d *Discoverer) forgetOldest() {
+	var oldest string
+	for key, f := range d.found {
+		if oldest == "" || f.LastSeen.Before(d.found[oldest].LastSeen) {
+			oldest = key
+		}
+	}
+	delete(d.found, oldest)
+}
@@ -0,0 +1,316 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/integrations"
+	"github.com/wumbabum/home_assist/internal/integrations/hue"
+	"github.com/wumbabum/home_assist/internal/integrations/shelly"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// listenLoopback opens a UDP socket on loopback, closed when the test ends.
+func listenLoopback(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// instance is a service instance to announce in an mDNS response.
+type instance struct {
+	service string
+	name    string
+	host    string
+	ip      [4]byte
+	port    uint16
+	txt     []string
+	ttl     uint32
+}
+
+// mdnsResponse builds a response announcing instances, with the SRV, TXT
+// and A records as additionals.
+func mdnsResponse(t *testing.T, instances ...instance) []byte {
+	t.Helper()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	header := func(name string, ttl uint32) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+
+	must(b.StartAnswers())
+	for _, in := range instances {
+		must(b.PTRResource(header(in.service+".local.", in.ttl), dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(in.name + "." + in.service + ".local.")}))
+	}
+	must(b.StartAdditionals())
+	for _, in := range instances {
+		full := in.name + "." + in.service + ".local."
+		must(b.SRVResource(header(full, 120), dnsmessage.SRVResource{Target: dnsmessage.MustNewName(in.host + ".local."), Port: in.port}))
+		must(b.TXTResource(header(full, 120), dnsmessage.TXTResource{TXT: in.txt}))
+		must(b.AResource(header(in.host+".local.", 120), dnsmessage.AResource{A: in.ip}))
+	}
+
+	packet, err := b.Finish()
+	must(err)
+	return packet
+}
+
+// receive reads a packet sent to conn.
+func receive(t *testing.T, conn net.PacketConn) ([]byte, net.Addr) {
+	t.Helper()
+
+	buf := make([]byte, maxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n], addr
+}
+
+func send(t *testing.T, from net.PacketConn, packet []byte, to net.Addr) {
+	t.Helper()
+
+	_, err := from.WriteTo(packet, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls the devices found until cond holds for them.
+func waitFor(t *testing.T, d *Discoverer, desc string, cond func(found []Found) bool) []Found {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		found := d.List()
+		if cond(found) {
+			return found
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s, found %+v", desc, found)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiscoverer(t *testing.T) {
+	registry := integrations.NewRegistry()
+	registry.Register(&shelly.Integration{})
+	registry.Register(&hue.Integration{})
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	d := New(Config{QueryInterval: time.Hour}, registry, logger)
+
+	query, err := mdnsQuery(d.cfg.Services)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The groups are stood in for by sockets that receive the queries, and
+	// devices announce themselves by sending to the listeners directly
+	mdnsGroup, ssdpGroup := listenLoopback(t), listenLoopback(t)
+	mdns := &listener{name: "mDNS", announcements: listenLoopback(t), replies: listenLoopback(t), group: mdnsGroup.LocalAddr(), query: query, parse: d.parseMDNS}
+	ssdp := &listener{name: "SSDP", announcements: listenLoopback(t), replies: listenLoopback(t), group: ssdpGroup.LocalAddr(), query: ssdpSearch(DefaultSSDPAddress), parse: parseSSDP}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- d.run(ctx, mdns, ssdp)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Services are queried for, and a relay replies directly
+	packet, from := receive(t, mdnsGroup)
+	var p dnsmessage.Parser
+	if _, err := p.Start(packet); err != nil {
+		t.Fatal(err)
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(questions) != len(DefaultServices) || questions[1].Name.String() != "_shelly._tcp.local." || questions[1].Type != dnsmessage.TypePTR {
+		t.Errorf("unexpected questions %+v", questions)
+	}
+	send(t, mdnsGroup, mdnsResponse(t, instance{
+		service: "_shelly._tcp", name: "shellyplus1pm-a8032ab12345", host: "shellyplus1pm-a8032ab12345",
+		ip: [4]byte{192, 168, 1, 20}, port: 80, txt: []string{"gen=2", "app=Plus1PM", "ver=1.0.8"}, ttl: 120,
+	}), from)
+
+	// Devices are searched for, and a Hue bridge replies directly
+	packet, from = receive(t, ssdpGroup)
+	if !strings.HasPrefix(string(packet), "M-SEARCH * HTTP/1.1\r\n") || !strings.Contains(string(packet), "ST: ssdp:all\r\n") {
+		t.Errorf("unexpected search %q", packet)
+	}
+	send(t, ssdpGroup, []byte("HTTP/1.1 200 OK\r\n"+
+		"CACHE-CONTROL: max-age=100\r\n"+
+		"LOCATION: http://192.168.1.2:80/description.xml\r\n"+
+		"SERVER: Hue/1.0 UPnP/1.0 IpBridge/1.56.0\r\n"+
+		"hue-bridgeid: 001788FFFE23BFC2\r\n"+
+		"ST: upnp:rootdevice\r\n"+
+		"USN: uuid:2f402f80-da50-11e1-9b23-001788255acc::upnp:rootdevice\r\n\r\n"), from)
+
+	// Devices also announce themselves unprompted. Services that are not
+	// listened for are ignored, and devices no integration handles are
+	// found without a match.
+	device := listenLoopback(t)
+	send(t, device, mdnsResponse(t,
+		instance{service: "_hap._tcp", name: "Eve Energy 50FF", host: "eve-energy", ip: [4]byte{192, 168, 1, 30}, port: 51827, txt: []string{"md=Eve Energy", "ci=7"}, ttl: 4500},
+		instance{service: "_printer._tcp", name: "Office printer", host: "printer", ip: [4]byte{192, 168, 1, 40}, port: 515, ttl: 4500},
+	), mdns.announcements.LocalAddr())
+	send(t, device, []byte("NOTIFY * HTTP/1.1\r\n"+
+		"HOST: 239.255.255.250:1900\r\n"+
+		"LOCATION: http://192.168.1.2:80/description.xml\r\n"+
+		"NT: uuid:2f402f80-da50-11e1-9b23-001788255acc\r\n"+
+		"NTS: ssdp:alive\r\n"+
+		"hue-bridgeid: 001788FFFE23BFC2\r\n"+
+		"USN: uuid:2f402f80-da50-11e1-9b23-001788255acc\r\n\r\n"), ssdp.announcements.LocalAddr())
+
+	// The bridge's two announcements are the same device
+	found := waitFor(t, d, "three devices", func(found []Found) bool { return len(found) == 3 })
+
+	if f := found[0]; f.Name() != "Eve Energy 50FF" || f.Integration != nil || f.Announcement.Address() != "192.168.1.30:51827" || f.Announcement.Properties["md"] != "Eve Energy" {
+		t.Errorf("unexpected HomeKit accessory %+v", f)
+	}
+	if f := found[1]; f.Name() != "Hue bridge 001788fffe23bfc2" || f.Integration == nil || f.Integration.Name() != hue.Protocol ||
+		f.Discovery.Address != "192.168.1.2" || f.Discovery.SetupPath != "/hue?address=192.168.1.2" {
+		t.Errorf("unexpected Hue bridge %+v", f)
+	}
+	if f := found[2]; f.Name() != "shellyplus1pm-a8032ab12345" || f.Integration == nil || f.Integration.Name() != shelly.Protocol ||
+		f.Discovery.Address != "192.168.1.20" || f.Discovery.Kind != "switch" || f.Discovery.Model != "Plus1PM" ||
+		strings.Join(f.Discovery.Capabilities, ",") != "on_off,power" {
+		t.Errorf("unexpected Shelly relay %+v", f)
+	}
+
+	// Devices that say goodbye are forgotten
+	send(t, device, mdnsResponse(t,
+		instance{service: "_hap._tcp", name: "Eve Energy 50FF", host: "eve-energy", ip: [4]byte{192, 168, 1, 30}, port: 51827, ttl: 0},
+	), mdns.announcements.LocalAddr())
+	waitFor(t, d, "the accessory to be forgotten", func(found []Found) bool { return len(found) == 2 })
+
+	// As are those not heard from within the expiry
+	d.mu.Lock()
+	d.now = func() time.Time { return time.Now().Add(DefaultExpiry + time.Minute) }
+	d.mu.Unlock()
+	waitFor(t, d, "every device to expire", func(found []Found) bool { return len(found) == 0 })
+}
+
+func TestDiscovererLimit(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	d := New(Config{}, integrations.NewRegistry(), logger)
+
+	now := time.Now()
+	d.now = func() time.Time { return now }
+	announce := func(name string) {
+		now = now.Add(time.Second)
+		d.handle(heard{Announcement: integrations.Announcement{Source: "mdns", Name: name}})
+	}
+
+	// Once full, the device heard from least recently makes room
+	for i := range maxFound {
+		announce(fmt.Sprintf("device %d", i))
+	}
+	announce("device 0")
+	announce("newcomer")
+	if len(d.found) != maxFound {
+		t.Fatalf("got %d devices, want %d", len(d.found), maxFound)
+	}
+	if _, ok := d.found["mdns device 1"]; ok {
+		t.Error("the oldest device was not forgotten")
+	}
+	if _, ok := d.found["mdns device 0"]; !ok {
+		t.Error("a device heard again was forgotten")
+	}
+
+	// Expired devices are forgotten as new ones are heard
+	now = now.Add(DefaultExpiry - time.Second)
+	announce("latecomer")
+	if len(d.found) != 2 {
+		t.Errorf("got %d devices after expiry, want 2", len(d.found))
+	}
+}
+
+func TestParseSSDP(t *testing.T) {
+	src := net.IPv4(192, 168, 1, 50)
+
+	tests := []struct {
+		name   string
+		packet string
+		want   []heard
+	}{
+		{
+			name:   "Search",
+			packet: string(ssdpSearch(DefaultSSDPAddress)),
+		},
+		{
+			name:   "Without location",
+			packet: "NOTIFY * HTTP/1.1\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:abc::upnp:rootdevice\r\n\r\n",
+			want: []heard{{Announcement: integrations.Announcement{
+				Source: "ssdp", Service: "upnp:rootdevice", Name: "uuid:abc", Host: "192.168.1.50",
+				Properties: map[string]string{"nt": "upnp:rootdevice", "nts": "ssdp:alive", "usn": "uuid:abc::upnp:rootdevice"},
+			}}},
+		},
+		{
+			name:   "Goodbye",
+			packet: "NOTIFY * HTTP/1.1\r\nNT: upnp:rootdevice\r\nNTS: ssdp:byebye\r\nUSN: uuid:abc::upnp:rootdevice\r\n\r\n",
+			want: []heard{{gone: true, Announcement: integrations.Announcement{
+				Source: "ssdp", Service: "upnp:rootdevice", Name: "uuid:abc", Host: "192.168.1.50",
+				Properties: map[string]string{"nt": "upnp:rootdevice", "nts": "ssdp:byebye", "usn": "uuid:abc::upnp:rootdevice"},
+			}}},
+		},
+		{
+			name:   "Without USN",
+			packet: "NOTIFY * HTTP/1.1\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\n\r\n",
+		},
+		{
+			name:   "Not SSDP",
+			packet: "\x00\x01\x02",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseSSDP([]byte(tt.packet), src)
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+			for i := range got {
+				if got[i].gone != tt.want[i].gone || got[i].Name != tt.want[i].Name || got[i].Service != tt.want[i].Service ||
+					got[i].Address() != tt.want[i].Address() || len(got[i].Properties) != len(tt.want[i].Properties) {
+					t.Errorf("expected %+v, got %+v", tt.want[i], got[i])
+				}
+				for k, v := range tt.want[i].Properties {
+					if got[i].Properties[k] != v {
+						t.Errorf("expected %s %q, got %q", k, v, got[i].Properties[k])
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/integrations"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsQuery asks for the instances of services. It is sent from a port other
+// than 5353, so devices reply to it directly as well as to the group.
+func mdnsQuery(services []string) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.EnableCompression()
+
+	err := b.StartQuestions()
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		name, err := dnsmessage.NewName(service + ".local.")
+		if err != nil {
+			return nil, err
+		}
+		err = b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// srv is where a service instance is served.
+type srv struct {
+	target string
+	port   int
+}
+
+// parseMDNS returns the instances of the listened for services a response
+// announces. Instances are described across its records: a PTR record names
+// each instance of a service, whose SRV record gives its host and port, its
+// TXT record its properties, and the host's A record its address. Instances
+// whose host has no A record are taken to be at the address the response
+// came from. A PTR record with a TTL of 0 says goodbye.
+func (d *Discoverer) parseMDNS(packet []byte, src net.IP) []heard {
+	var p dnsmessage.Parser
+	header, err := p.Start(packet)
+	if err != nil || !header.Response {
+		return nil
+	}
+	err = p.SkipAllQuestions()
+	if err != nil {
+		return nil
+	}
+
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return nil
+	}
+	err = p.SkipAllAuthorities()
+	if err != nil {
+		return nil
+	}
+	// Some devices leave out the additional records, or send invalid ones
+	additionals, _ := p.AllAdditionals()
+
+	var (
+		ptrs  []dnsmessage.Resource
+		srvs  = map[string]srv{}
+		txts  = map[string][]string{}
+		hosts = map[string]net.IP{}
+	)
+	for _, r := range append(answers, additionals...) {
+		name := strings.ToLower(r.Header.Name.String())
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			ptrs = append(ptrs, r)
+		case *dnsmessage.SRVResource:
+			srvs[name] = srv{target: strings.ToLower(body.Target.String()), port: int(body.Port)}
+		case *dnsmessage.TXTResource:
+			txts[name] = body.TXT
+		case *dnsmessage.AResource:
+			hosts[name] = net.IP(body.A[:])
+		}
+	}
+
+	var found []heard
+	for _, r := range ptrs {
+		service := strings.TrimSuffix(r.Header.Name.String(), ".local.")
+		i := slices.IndexFunc(d.cfg.Services, func(s string) bool { return strings.EqualFold(s, service) })
+		if i == -1 {
+			continue
+		}
+		service = d.cfg.Services[i]
+
+		instance := r.Body.(*dnsmessage.PTRResource).PTR.String()
+		key := strings.ToLower(instance)
+		name := instance
+		if suffix := "." + strings.ToLower(r.Header.Name.String()); strings.HasSuffix(key, suffix) {
+			name = instance[:len(instance)-len(suffix)]
+		}
+
+		a := integrations.Announcement{
+			Source:     "mdns",
+			Service:    service,
+			Name:       name,
+			Host:       src.String(),
+			Properties: map[string]string{},
+		}
+		if s, ok := srvs[key]; ok {
+			a.Port = s.port
+			if ip, ok := hosts[s.target]; ok {
+				a.Host = ip.String()
+			}
+		}
+		for _, txt := range txts[key] {
+			k, v, _ := strings.Cut(txt, "=")
+			if k != "" {
+				a.Properties[strings.ToLower(k)] = v
+			}
+		}
+
+		found = append(found, heard{Announcement: a, gone: r.Header.TTL == 0})
+	}
+	return found
+}
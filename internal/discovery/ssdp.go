@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/integrations"
+)
+
+// ssdpSearch asks every device in the SSDP group at address to reply within
+// two seconds.
+func ssdpSearch(address string) []byte {
+	return fmt.Appendf(nil, "M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\nST: ssdp:all\r\n\r\n", address)
+}
+
+// parseSSDP returns the device a NOTIFY announcement or a reply to a search
+// is from. The device is named by its unique service name, without the
+// service it ends with, and its address is that of its LOCATION URL, falling
+// back to the address the packet came from. Searches, including those sent
+// by the discoverer itself, are ignored.
+func parseSSDP(packet []byte, src net.IP) []heard {
+	r := bufio.NewReader(bytes.NewReader(packet))
+
+	var (
+		header  http.Header
+		service string
+		gone    bool
+	)
+	if bytes.HasPrefix(packet, []byte("HTTP/")) {
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return nil
+		}
+		header, service = resp.Header, resp.Header.Get("ST")
+	} else {
+		req, err := http.ReadRequest(r)
+		if err != nil || req.Method != "NOTIFY" {
+			return nil
+		}
+		header, service = req.Header, req.Header.Get("NT")
+		gone = req.Header.Get("NTS") == "ssdp:byebye"
+	}
+
+	name, _, _ := strings.Cut(header.Get("USN"), "::")
+	if name == "" {
+		return nil
+	}
+
+	a := integrations.Announcement{
+		Source:     "ssdp",
+		Service:    service,
+		Name:       name,
+		Host:       src.String(),
+		Properties: map[string]string{},
+	}
+	if location, err := url.Parse(header.Get("LOCATION")); err == nil && location.Hostname() != "" {
+		a.Host = location.Hostname()
+		a.Port, _ = strconv.Atoi(location.Port())
+	}
+	for k, v := range header {
+		a.Properties[strings.ToLower(k)] = v[0]
+	}
+
+	return []heard{{Announcement: a, gone: gone}}
+}
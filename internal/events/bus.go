@@ -0,0 +1,234 @@
+package events
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policy decides what happens when a subscriber's buffer is full.
+type Policy int
+
+const (
+	// DropOldest discards the oldest buffered event to make room. It suits
+	// consumers that only care about the latest state, such as live views.
+	DropOldest Policy = iota
+	// DropNewest discards the event being published.
+	DropNewest
+	// Block makes the publisher wait for room, up to BlockTimeout, before
+	// dropping the event. It suits consumers that should see every event,
+	// such as history and automations.
+	Block
+)
+
+const (
+	defaultBuffer       = 64
+	defaultBlockTimeout = time.Second
+)
+
+// Filter selects the events a subscriber receives. Zero values match
+// everything.
+type Filter struct {
+	Types       []Type
+	HouseholdID int64
+}
+
+func (f Filter) matches(e Event) bool {
+	if len(f.Types) > 0 && !slices.Contains(f.Types, e.Type) {
+		return false
+	}
+	if f.HouseholdID != 0 && f.HouseholdID != e.HouseholdID {
+		return false
+	}
+	return true
+}
+
+type SubscribeOptions struct {
+	Name         string // Used in log messages
+	Filter       Filter
+	Buffer       int // Defaults to 64
+	Policy       Policy
+	BlockTimeout time.Duration // Defaults to 1s, only used by Block
+}
+
+// Bus fans published events out to subscribers. It is safe for concurrent use.
+type Bus struct {
+	logger *slog.Logger
+
+	mu          sync.RWMutex
+	subscribers map[*Subscriber]struct{}
+	closed      bool
+}
+
+func NewBus(logger *slog.Logger) *Bus {
+	return &Bus{
+		logger:      logger,
+		subscribers: make(map[*Subscriber]struct{}),
+	}
+}
+
+// Subscribe registers a new subscriber. The subscriber's channel is closed
+// when it is unsubscribed or the bus is closed.
+func (b *Bus) Subscribe(opts SubscribeOptions) *Subscriber {
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultBuffer
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = defaultBlockTimeout
+	}
+
+	s := &Subscriber{
+		bus:  b,
+		opts: opts,
+		ch:   make(chan Event, opts.Buffer),
+		done: make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		s.close()
+		return s
+	}
+
+	b.subscribers[s] = struct{}{}
+	return s
+}
+
+// Publish delivers an event to every matching subscriber. It only waits for
+// subscribers using the Block policy, and then no longer than their timeout.
+// Publishing on a closed bus does nothing.
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return
+	}
+	subscribers := make([]*Subscriber, 0, len(b.subscribers))
+	for s := range b.subscribers {
+		if s.opts.Filter.matches(e) {
+			subscribers = append(subscribers, s)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, s := range subscribers {
+		if s.deliver(e) {
+			dropped := s.dropped.Add(1)
+			b.logger.Warn("event dropped", "subscriber", s.opts.Name, "type", e.Type, "dropped", dropped)
+		}
+	}
+}
+
+// Close unsubscribes everyone, closing their channels so consumers can finish.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	subscribers := b.subscribers
+	b.subscribers = make(map[*Subscriber]struct{})
+	b.closed = true
+	b.mu.Unlock()
+
+	for s := range subscribers {
+		s.close()
+	}
+}
+
+type Subscriber struct {
+	bus     *Bus
+	opts    SubscribeOptions
+	dropped atomic.Uint64
+
+	// mu guards sends on ch against it being closed; done wakes up blocked
+	// publishers first so that closing never waits on a full buffer.
+	mu        sync.RWMutex
+	ch        chan Event
+	done      chan struct{}
+	closeOnce sync.Once
+	closed    bool
+}
+
+// Events returns the channel events are delivered on.
+func (s *Subscriber) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns how many events did not fit in the buffer.
+func (s *Subscriber) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Unsubscribe stops delivery and closes the channel. It is safe to call more
+// than once.
+func (s *Subscriber) Unsubscribe() {
+	s.bus.mu.Lock()
+	delete(s.bus.subscribers, s)
+	s.bus.mu.Unlock()
+
+	s.close()
+}
+
+func (s *Subscriber) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	})
+}
+
+// deliver buffers an event for the subscriber and reports whether an event,
+// either this one or an older one, had to be dropped to do so.
+func (s *Subscriber) deliver(e Event) (dropped bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return false
+	}
+
+	select {
+	case s.ch <- e:
+		return false
+	default:
+	}
+
+	switch s.opts.Policy {
+	case DropOldest:
+		for {
+			select {
+			case <-s.ch:
+			default:
+			}
+			select {
+			case s.ch <- e:
+				return true
+			default:
+			}
+		}
+
+	case Block:
+		timer := time.NewTimer(s.opts.BlockTimeout)
+		defer timer.Stop()
+
+		select {
+		case s.ch <- e:
+			return false
+		case <-s.done:
+			return false
+		case <-timer.C:
+			return true
+		}
+
+	default:
+		return true
+	}
+}
@@ -0,0 +1,154 @@
+package events
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func newTestBus() *Bus {
+	return NewBus(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func receive(t *testing.T, s *Subscriber) Event {
+	t.Helper()
+
+	select {
+	case e, ok := <-s.Events():
+		if !ok {
+			t.Fatal("subscriber channel closed")
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return Event{}
+}
+
+func TestPublishFiltering(t *testing.T) {
+	bus := newTestBus()
+	defer bus.Close()
+
+	all := bus.Subscribe(SubscribeOptions{Name: "all"})
+	states := bus.Subscribe(SubscribeOptions{Name: "states", Filter: Filter{Types: []Type{TypeStateChanged}}})
+	household := bus.Subscribe(SubscribeOptions{Name: "household", Filter: Filter{HouseholdID: 2}})
+
+	bus.Publish(NewDeviceAdded(1, DeviceAdded{DeviceID: 10}))
+	bus.Publish(NewStateChanged(2, StateChanged{DeviceID: 20, State: map[string]any{"on": true}}))
+
+	if e := receive(t, all); e.Type != TypeDeviceAdded || e.Time.IsZero() {
+		t.Errorf("expected device_added with a time, got %+v", e)
+	}
+	if e := receive(t, all); e.Type != TypeStateChanged {
+		t.Errorf("expected state_changed, got %s", e.Type)
+	}
+
+	e := receive(t, states)
+	payload, ok := e.Payload.(StateChanged)
+	if !ok || payload.DeviceID != 20 {
+		t.Errorf("expected state change for device 20, got %+v", e.Payload)
+	}
+
+	if e := receive(t, household); e.HouseholdID != 2 {
+		t.Errorf("expected event for household 2, got %d", e.HouseholdID)
+	}
+
+	if len(states.Events()) != 0 || len(household.Events()) != 0 {
+		t.Error("expected filtered subscribers to receive a single event")
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	tests := []struct {
+		policy  Policy
+		first   int64
+		dropped uint64
+	}{
+		{DropOldest, 2, 1},
+		{DropNewest, 1, 1},
+		{Block, 1, 1},
+	}
+
+	for _, tt := range tests {
+		bus := newTestBus()
+		s := bus.Subscribe(SubscribeOptions{Buffer: 2, Policy: tt.policy, BlockTimeout: 10 * time.Millisecond})
+
+		for id := int64(1); id <= 3; id++ {
+			bus.Publish(NewStateChanged(1, StateChanged{DeviceID: id}))
+		}
+
+		if e := receive(t, s); e.Payload.(StateChanged).DeviceID != tt.first {
+			t.Errorf("policy %d: expected device %d first, got %d", tt.policy, tt.first, e.Payload.(StateChanged).DeviceID)
+		}
+		if s.Dropped() != tt.dropped {
+			t.Errorf("policy %d: expected %d dropped, got %d", tt.policy, tt.dropped, s.Dropped())
+		}
+
+		bus.Close()
+	}
+}
+
+func TestBlockWaitsForConsumer(t *testing.T) {
+	bus := newTestBus()
+	defer bus.Close()
+
+	s := bus.Subscribe(SubscribeOptions{Buffer: 1, Policy: Block, BlockTimeout: time.Second})
+
+	bus.Publish(NewDeviceAdded(1, DeviceAdded{DeviceID: 1}))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-s.Events()
+	}()
+
+	bus.Publish(NewDeviceAdded(1, DeviceAdded{DeviceID: 2}))
+
+	if e := receive(t, s); e.Payload.(DeviceAdded).DeviceID != 2 {
+		t.Errorf("expected device 2, got %+v", e.Payload)
+	}
+	if s.Dropped() != 0 {
+		t.Errorf("expected no drops, got %d", s.Dropped())
+	}
+}
+
+func TestClose(t *testing.T) {
+	bus := newTestBus()
+
+	s := bus.Subscribe(SubscribeOptions{Buffer: 1, Policy: Block, BlockTimeout: time.Minute})
+	bus.Publish(NewDeviceAdded(1, DeviceAdded{}))
+
+	// A publisher blocked on a full buffer is released by Close
+	published := make(chan struct{})
+	go func() {
+		bus.Publish(NewDeviceAdded(1, DeviceAdded{}))
+		close(published)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	bus.Close()
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publisher still blocked after Close")
+	}
+
+	// Buffered events are drained before the channel reports closed
+	count := 0
+	for range s.Events() {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expected 1 buffered event, got %d", count)
+	}
+
+	// Publishing and subscribing after Close are harmless
+	bus.Publish(NewDeviceAdded(1, DeviceAdded{}))
+	late := bus.Subscribe(SubscribeOptions{})
+	if _, ok := <-late.Events(); ok {
+		t.Error("expected subscriber of a closed bus to be closed")
+	}
+
+	s.Unsubscribe()
+}
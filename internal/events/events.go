@@ -0,0 +1,122 @@
+// Package events is an in-process publish/subscribe bus used to tell
+// automations, history, live views and integrations about changes in the home.
+package events
+
+import (
+	"context"
+	"time"
+)
+
+type Type string
+
+const (
+	TypeStateChanged        Type = "state_changed"
+	TypeDeviceAdded         Type = "device_added"
+	TypeAutomationTriggered Type = "automation_triggered"
+	TypeWebhookReceived     Type = "webhook_received"
+	TypeNotification        Type = "notification"
+	TypeScheduleFired       Type = "schedule_fired"
+)
+
+// Event is a single occurrence published on the bus. Payload holds one of the
+// payload types below, matching Type.
+type Event struct {
+	Type        Type      `json:"type"`
+	HouseholdID int64     `json:"household_id"`
+	Time        time.Time `json:"time"`
+	Payload     any       `json:"payload"`
+	Origin      *Origin   `json:"origin,omitempty"` // nil unless published by an automation
+}
+
+// Origin is the automation run an event was published by. Depth counts the
+// runs in the chain that led to it, each fired by an event of the one before,
+// so that automations firing each other can be stopped.
+type Origin struct {
+	AutomationID int64 `json:"automation_id"`
+	Depth        int   `json:"depth"`
+}
+
+type originKey struct{}
+
+// WithOrigin returns a context for the actions of an automation run, whose
+// events are published with OriginFrom.
+func WithOrigin(ctx context.Context, origin Origin) context.Context {
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+// OriginFrom returns the automation run ctx belongs to, or nil.
+func OriginFrom(ctx context.Context) *Origin {
+	origin, ok := ctx.Value(originKey{}).(Origin)
+	if !ok {
+		return nil
+	}
+	return &origin
+}
+
+// StateChanged is published after a device state has been stored. State is the
+// full new state and Changes only the attributes that were written.
+type StateChanged struct {
+	DeviceID int64          `json:"device_id"`
+	State    map[string]any `json:"state"`
+	Changes  map[string]any `json:"changes"`
+}
+
+type DeviceAdded struct {
+	DeviceID int64  `json:"device_id"`
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Protocol string `json:"protocol"`
+}
+
+type AutomationTriggered struct {
+	AutomationID int64  `json:"automation_id"`
+	Name         string `json:"name"`
+	Trigger      string `json:"trigger"`
+}
+
+// WebhookReceived is published when a webhook trigger URL is called. Data is
+// the JSON body of the request, if any.
+type WebhookReceived struct {
+	WebhookID string         `json:"webhook_id"`
+	Data      map[string]any `json:"data,omitempty"`
+}
+
+// Notification is a message for the members of a household, sent by an
+// automation.
+type Notification struct {
+	AutomationID int64  `json:"automation_id"`
+	Title        string `json:"title"`
+	Message      string `json:"message"`
+}
+
+// ScheduleFired is published by the scheduler when a time, cron or sun
+// trigger is due. Trigger is the index of the trigger in the automation.
+type ScheduleFired struct {
+	AutomationID int64     `json:"automation_id"`
+	Trigger      int       `json:"trigger"`
+	ScheduledAt  time.Time `json:"scheduled_at"`
+}
+
+func NewStateChanged(householdID int64, payload StateChanged) Event {
+	return Event{Type: TypeStateChanged, HouseholdID: householdID, Payload: payload}
+}
+
+func NewDeviceAdded(householdID int64, payload DeviceAdded) Event {
+	return Event{Type: TypeDeviceAdded, HouseholdID: householdID, Payload: payload}
+}
+
+func NewAutomationTriggered(householdID int64, payload AutomationTriggered) Event {
+	return Event{Type: TypeAutomationTriggered, HouseholdID: householdID, Payload: payload}
+}
+
+func NewWebhookReceived(householdID int64, payload WebhookReceived) Event {
+	return Event{Type: TypeWebhookReceived, HouseholdID: householdID, Payload: payload}
+}
+
+func NewNotification(householdID int64, payload Notification) Event {
+	return Event{Type: TypeNotification, HouseholdID: householdID, Payload: payload}
+}
+
+func NewScheduleFired(householdID int64, payload ScheduleFired) Event {
+	return Event{Type: TypeScheduleFired, HouseholdID: householdID, Payload: payload}
+}
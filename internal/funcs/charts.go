@@ -0,0 +1,116 @@
+package funcs
+
+import (
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chart is a time series drawn by the "chart" template func as an inline SVG.
+type Chart struct {
+	Title  string
+	From   time.Time
+	To     time.Time
+	Step   bool // Draw steps instead of lines, for on/off values
+	Points []ChartPoint
+}
+
+// ChartPoint is a downsampled value. The area between Min and Max is shaded
+// behind the line through Avg.
+type ChartPoint struct {
+	Time time.Time
+	Min  float64
+	Max  float64
+	Avg  float64
+}
+
+const (
+	chartWidth  = 600
+	chartHeight = 200
+	chartLeft   = 48
+	chartRight  = 8
+	chartTop    = 8
+	chartBottom = 24
+)
+
+func chart(c Chart) template.HTML {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg class="chart" viewBox="0 0 %d %d" role="img" aria-label="%s">`, chartWidth, chartHeight, template.HTMLEscapeString(c.Title))
+	fmt.Fprintf(&b, `<title>%s</title>`, template.HTMLEscapeString(c.Title))
+
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	plotHeight := float64(chartHeight - chartTop - chartBottom)
+	fmt.Fprintf(&b, `<rect class="chart-plot" x="%d" y="%d" width="%g" height="%g"/>`, chartLeft, chartTop, plotWidth, plotHeight)
+
+	if len(c.Points) == 0 || !c.To.After(c.From) {
+		fmt.Fprintf(&b, `<text class="chart-empty" x="%g" y="%g" text-anchor="middle">No data for this period</text>`, chartLeft+plotWidth/2, chartTop+plotHeight/2)
+		b.WriteString(`</svg>`)
+		return template.HTML(b.String())
+	}
+
+	low, high := c.Points[0].Min, c.Points[0].Max
+	for _, p := range c.Points {
+		low = min(low, p.Min)
+		high = max(high, p.Max)
+	}
+	if c.Step {
+		low, high = min(low, 0), max(high, 1)
+	}
+	if high == low {
+		low, high = low-1, high+1
+	}
+
+	span := c.To.Sub(c.From).Seconds()
+	x := func(t time.Time) float64 {
+		return chartLeft + t.Sub(c.From).Seconds()/span*plotWidth
+	}
+	y := func(v float64) float64 {
+		return chartTop + (high-v)/(high-low)*plotHeight
+	}
+
+	if !c.Step {
+		var band strings.Builder
+		for _, p := range c.Points {
+			fmt.Fprintf(&band, "%.1f,%.1f ", x(p.Time), y(p.Max))
+		}
+		for i := len(c.Points) - 1; i >= 0; i-- {
+			fmt.Fprintf(&band, "%.1f,%.1f ", x(c.Points[i].Time), y(c.Points[i].Min))
+		}
+		fmt.Fprintf(&b, `<polygon class="chart-band" points="%s"/>`, strings.TrimSpace(band.String()))
+	}
+
+	var path strings.Builder
+	for i, p := range c.Points {
+		switch {
+		case i == 0:
+			fmt.Fprintf(&path, "M%.1f %.1f", x(p.Time), y(p.Avg))
+		case c.Step:
+			fmt.Fprintf(&path, " H%.1f V%.1f", x(p.Time), y(p.Avg))
+		default:
+			fmt.Fprintf(&path, " L%.1f %.1f", x(p.Time), y(p.Avg))
+		}
+	}
+	if c.Step {
+		// Hold the last value until the end of the period
+		fmt.Fprintf(&path, " H%.1f", x(c.To))
+	}
+	fmt.Fprintf(&b, `<path class="chart-line" d="%s"/>`, path.String())
+
+	labelY := func(v float64) {
+		fmt.Fprintf(&b, `<text class="chart-label" x="%d" y="%.1f" text-anchor="end" dominant-baseline="middle">%s</text>`, chartLeft-4, y(v), strconv.FormatFloat(v, 'g', 4, 64))
+	}
+	labelY(high)
+	labelY(low)
+
+	labelX := func(t time.Time, anchor string) {
+		fmt.Fprintf(&b, `<text class="chart-label" x="%.1f" y="%d" text-anchor="%s">%s</text>`, x(t), chartHeight-6, anchor, t.Format("2 Jan 15:04"))
+	}
+	labelX(c.From, "start")
+	labelX(c.To, "end")
+
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
@@ -6,6 +6,7 @@ import (
 	"html/template"
 	"math"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -31,7 +32,8 @@ var TemplateFuncs = template.FuncMap{
 	"slugify":   slugify,
 	"safeHTML":  safeHTML,
 
-	"join": strings.Join,
+	"join":     strings.Join,
+	"contains": slices.Contains[[]string],
 
 	"incr":        incr,
 	"decr":        decr,
@@ -42,6 +44,8 @@ var TemplateFuncs = template.FuncMap{
 
 	"urlSetParam": urlSetParam,
 	"urlDelParam": urlDelParam,
+
+	"chart": chart,
 }
 
 func formatTime(format string, t time.Time) string {
@@ -0,0 +1,44 @@
+package integrations
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Background runs the Run method of an integration's client until stopped,
+// for integrations to start in Setup and stop in Shutdown.
+type Background struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start calls run in a goroutine, logging the error it returns.
+func (b *Background) Start(name string, run func(ctx context.Context) error, logger *slog.Logger) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	b.done = make(chan struct{})
+
+	go func() {
+		defer close(b.done)
+		err := run(ctx)
+		if err != nil {
+			logger.Error("integration stopped", "integration", name, "error", err)
+		}
+	}()
+}
+
+// Stop cancels the context given to run, waiting for it to return or ctx to
+// be cancelled.
+func (b *Background) Stop(ctx context.Context) error {
+	if b.cancel == nil {
+		return nil
+	}
+
+	b.cancel()
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,314 @@
+package hue
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/color"
+)
+
+// ErrLinkButton is returned by Pair until the bridge's link button has been
+// pressed.
+var ErrLinkButton = errors.New("the link button on the bridge has not been pressed")
+
+// maxResponseSize limits the size of responses, the largest being the lists
+// of resources of bridges with many lights.
+const maxResponseSize = 8 << 20
+
+// signifyRootCA issues the certificates of bridges, which name the bridge id
+// rather than the address.
+//
+//go:embed signify_root_ca.pem
+var signifyRootCA []byte
+
+// newRootCAs returns the pool of Signify's certificate authority.
+func newRootCAs() *x509.CertPool {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(signifyRootCA) {
+		panic("hue: invalid Signify root certificate")
+	}
+	return pool
+}
+
+// newHTTPClient returns a client for the bridge with bridgeID, or for any
+// bridge if bridgeID is empty. Bridge certificates are issued for the bridge
+// id rather than the address, so Go's check of the host name is replaced by
+// verifyBridge rather than left out.
+func newHTTPClient(roots *x509.CertPool, bridgeID string) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   verifyBridge(roots, bridgeID),
+	}
+	return &http.Client{Transport: transport}
+}
+
+// verifyBridge checks that a bridge's certificate was issued by one of roots
+// and, unless bridgeID is empty, that its common name is bridgeID.
+func verifyBridge(roots *x509.CertPool, bridgeID string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("hue: the bridge sent no certificate")
+		}
+
+		leaf := cs.PeerCertificates[0]
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		if err != nil {
+			return fmt.Errorf("hue: the certificate is not that of a Hue bridge: %w", err)
+		}
+		if bridgeID != "" && !strings.EqualFold(leaf.Subject.CommonName, bridgeID) {
+			return fmt.Errorf("hue: the certificate is that of bridge %s rather than %s", leaf.Subject.CommonName, bridgeID)
+		}
+		return nil
+	}
+}
+
+// reference identifies another resource, as in {"rid": "...", "rtype": "device"}.
+type reference struct {
+	RID   string `json:"rid"`
+	RType string `json:"rtype"`
+}
+
+type metadata struct {
+	Name string `json:"name"`
+}
+
+// lightState is the state of a light, as found in lights, scene actions and
+// events, and sent to change it. Only the fields that are set are sent.
+type lightState struct {
+	On               *onState          `json:"on,omitempty"`
+	Dimming          *dimming          `json:"dimming,omitempty"`
+	Color            *lightColor       `json:"color,omitempty"`
+	ColorTemperature *colorTemperature `json:"color_temperature,omitempty"`
+}
+
+type onState struct {
+	On bool `json:"on"`
+}
+
+type dimming struct {
+	Brightness float64 `json:"brightness"` // Percent
+}
+
+type lightColor struct {
+	XY color.XY `json:"xy"`
+}
+
+type colorTemperature struct {
+	Mirek *float64 `json:"mirek"` // nil while the light shows a color
+}
+
+type light struct {
+	ID       string    `json:"id"`
+	Owner    reference `json:"owner"` // The device of the light
+	Metadata metadata  `json:"metadata"`
+	lightState
+}
+
+type device struct {
+	ID          string   `json:"id"`
+	Metadata    metadata `json:"metadata"`
+	ProductData struct {
+		ModelID          string `json:"model_id"`
+		ManufacturerName string `json:"manufacturer_name"`
+	} `json:"product_data"`
+}
+
+type room struct {
+	ID       string      `json:"id"`
+	Metadata metadata    `json:"metadata"`
+	Children []reference `json:"children"` // The devices in the room
+}
+
+type scene struct {
+	ID       string    `json:"id"`
+	Metadata metadata  `json:"metadata"`
+	Group    reference `json:"group"` // The room or zone of the scene
+	Actions  []struct {
+		Target reference  `json:"target"`
+		Action lightState `json:"action"`
+	} `json:"actions"`
+}
+
+// event is an event of the event stream, in which data holds the fields of
+// the resources that changed.
+type event struct {
+	Type string `json:"type"` // add, update, delete or error
+	Data []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		lightState
+	} `json:"data"`
+}
+
+// conn makes requests to a paired bridge.
+type conn struct {
+	address string
+	key     string
+	client  *http.Client
+}
+
+// get fetches every resource of a type, such as light, into v.
+func (c *conn) get(ctx context.Context, resourceType string, v any) error {
+	return c.do(ctx, http.MethodGet, "/clip/v2/resource/"+resourceType, nil, v)
+}
+
+// put changes a resource.
+func (c *conn) put(ctx context.Context, resourceType, id string, body any) error {
+	return c.do(ctx, http.MethodPut, "/clip/v2/resource/"+resourceType+"/"+id, body, nil)
+}
+
+func (c *conn) do(ctx context.Context, method, path string, body, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	var r io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+c.address+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("hue-application-key", c.key)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Errors []struct {
+			Description string `json:"description"`
+		} `json:"errors"`
+		Data json.RawMessage `json:"data"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&result)
+	switch {
+	case err == nil && len(result.Errors) > 0:
+		var descriptions []string
+		for _, e := range result.Errors {
+			descriptions = append(descriptions, e.Description)
+		}
+		return fmt.Errorf("hue: %s", strings.Join(descriptions, ", "))
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("hue: unexpected response status %s", resp.Status)
+	case err != nil:
+		return fmt.Errorf("hue: invalid response: %w", err)
+	case v == nil:
+		return nil
+	}
+
+	return json.Unmarshal(result.Data, v)
+}
+
+// Pairing is what a bridge returns when paired with.
+type Pairing struct {
+	BridgeID       string // Such as 001788fffe123456
+	ApplicationKey string
+}
+
+// Pair asks the bridge at address for an application key, which it gives in
+// the 30 seconds after its link button is pressed. Until then it returns
+// ErrLinkButton.
+func (c *Client) Pair(ctx context.Context, address string) (*Pairing, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	// The config is public, and has the bridge's id. Any bridge's
+	// certificate is accepted until then.
+	var config struct {
+		BridgeID string `json:"bridgeid"`
+	}
+	err := c.request(ctx, c.httpClient(""), http.MethodGet, "https://"+address+"/api/0/config", nil, &config)
+	if err != nil {
+		return nil, err
+	}
+	if config.BridgeID == "" {
+		return nil, fmt.Errorf("hue: %s is not a Hue bridge", address)
+	}
+	bridgeID := strings.ToLower(config.BridgeID)
+
+	var results []struct {
+		Error *struct {
+			Type        int    `json:"type"`
+			Description string `json:"description"`
+		} `json:"error"`
+		Success *struct {
+			Username string `json:"username"`
+		} `json:"success"`
+	}
+	body := map[string]any{"devicetype": c.cfg.DeviceType, "generateclientkey": true}
+	err = c.request(ctx, c.httpClient(bridgeID), http.MethodPost, "https://"+address+"/api", body, &results)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		switch {
+		case result.Error != nil && result.Error.Type == 101:
+			return nil, ErrLinkButton
+		case result.Error != nil:
+			return nil, fmt.Errorf("hue: %s", result.Error.Description)
+		case result.Success != nil && result.Success.Username != "":
+			return &Pairing{BridgeID: bridgeID, ApplicationKey: result.Success.Username}, nil
+		}
+	}
+	return nil, errors.New("hue: unexpected pairing response")
+}
+
+// request makes a request to the bridge's original API, used for pairing.
+func (c *Client) request(ctx context.Context, client *http.Client, method, url string, body, v any) error {
+	var r io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hue: unexpected response status %s", resp.Status)
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+	if err != nil {
+		return fmt.Errorf("hue: invalid response: %w", err)
+	}
+	return nil
+}
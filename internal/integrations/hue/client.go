@@ -0,0 +1,389 @@
+// Package hue controls Philips Hue lights through the local CLIP v2 API of
+// their bridges. Bridges are paired by pressing their link button, after
+// which their lights, rooms and scenes can be imported. The state of the
+// lights is followed through each bridge's event stream.
+package hue
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+const (
+	DefaultDeviceType = "home_assist#server"
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+
+	requestTimeout = 10 * time.Second
+)
+
+// ErrNoBridge is returned for lights whose bridge is not paired.
+var ErrNoBridge = errors.New("the light's Hue bridge is not paired")
+
+type Config struct {
+	// DeviceType is the name the server pairs with, which the Hue app shows
+	// as "<app>#<device>".
+	DeviceType string
+
+	// RootCAs are the authorities bridge certificates must be issued by,
+	// Signify's by default.
+	RootCAs *x509.CertPool
+
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Store is the data the client needs, implemented by *database.DB.
+type Store interface {
+	ListHueBridges(ctx context.Context) ([]database.HueBridge, error)
+	ListDevicesByProtocol(ctx context.Context, protocol string) ([]database.Device, error)
+
+	// Used to import a bridge's lights, rooms and scenes
+	ListDevices(ctx context.Context, householdID int64) ([]database.Device, error)
+	CreateDevice(ctx context.Context, device *database.Device) error
+	UpdateDevice(ctx context.Context, device *database.Device) error
+	ListRooms(ctx context.Context, householdID int64) ([]database.Room, error)
+	CreateRoom(ctx context.Context, room *database.Room) error
+	ListScenes(ctx context.Context, householdID int64) ([]database.Scene, error)
+	CreateScene(ctx context.Context, scene *database.Scene) error
+	UpdateScene(ctx context.Context, scene *database.Scene) error
+}
+
+// Keys decrypts the application keys stored with bridges, implemented by
+// *secrets.Cipher.
+type Keys interface {
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// StateFunc receives the state a light reported. Only the attributes that
+// changed are set.
+type StateFunc func(ctx context.Context, device database.Device, state database.DeviceState)
+
+// bridgeKey identifies a bridge within the households.
+type bridgeKey struct {
+	householdID int64
+	bridgeID    string
+}
+
+// watcher follows the event stream of a bridge until cancelled.
+type watcher struct {
+	bridge database.HueBridge
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type Client struct {
+	cfg     Config
+	store   Store
+	keys    Keys
+	onState StateFunc
+	logger  *slog.Logger
+	reload  chan struct{}
+
+	mu      sync.Mutex
+	conns   map[bridgeKey]*conn
+	devices map[bridgeKey]map[string]database.Device // By light id
+	clients map[string]*http.Client                  // By bridge id, "" for any bridge
+}
+
+func New(cfg Config, store Store, keys Keys, onState StateFunc, logger *slog.Logger) *Client {
+	cfg.DeviceType = cmp.Or(cfg.DeviceType, DefaultDeviceType)
+	cfg.MinBackoff = cmp.Or(cfg.MinBackoff, DefaultMinBackoff)
+	cfg.MaxBackoff = max(cmp.Or(cfg.MaxBackoff, DefaultMaxBackoff), cfg.MinBackoff)
+	if cfg.RootCAs == nil {
+		cfg.RootCAs = newRootCAs()
+	}
+
+	return &Client{
+		cfg:     cfg,
+		store:   store,
+		keys:    keys,
+		onState: onState,
+		logger:  logger,
+		reload:  make(chan struct{}, 1),
+		conns:   map[bridgeKey]*conn{},
+		devices: map[bridgeKey]map[string]database.Device{},
+		clients: map[string]*http.Client{},
+	}
+}
+
+// Reload makes the client read the bridges and lights again, after either
+// has been saved or deleted. It does not block.
+func (c *Client) Reload() {
+	select {
+	case c.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Run follows the event stream of every paired bridge until ctx is
+// cancelled.
+func (c *Client) Run(ctx context.Context) error {
+	watchers := map[int64]*watcher{}
+	defer func() {
+		for _, w := range watchers {
+			w.cancel()
+			<-w.done
+		}
+	}()
+
+	c.sync(ctx, watchers)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.reload:
+			c.sync(ctx, watchers)
+		}
+	}
+}
+
+// sync loads the bridges and lights, starting a watcher for each new or
+// re-paired bridge and stopping those of bridges that were removed.
+func (c *Client) sync(ctx context.Context, watchers map[int64]*watcher) {
+	bridges, err := c.store.ListHueBridges(ctx)
+	if err != nil {
+		c.logger.Error("failed to load Hue bridges", "error", err)
+		return
+	}
+
+	lights, err := c.store.ListDevicesByProtocol(ctx, Protocol)
+	if err != nil {
+		c.logger.Error("failed to load Hue lights", "error", err)
+		return
+	}
+
+	conns := map[bridgeKey]*conn{}
+	for _, bridge := range bridges {
+		cn, err := c.conn(&bridge)
+		if err != nil {
+			c.logger.Error("Hue bridge not followed", "bridge_id", bridge.BridgeID, "error", err)
+			continue
+		}
+		conns[bridgeKey{bridge.HouseholdID, bridge.BridgeID}] = cn
+	}
+
+	devices := map[bridgeKey]map[string]database.Device{}
+	for _, device := range lights {
+		cfg, err := ParseDeviceConfig(&device)
+		if err != nil {
+			c.logger.Warn("Hue light not followed", "device_id", device.ID, "error", err)
+			continue
+		}
+		key := bridgeKey{device.HouseholdID, cfg.BridgeID}
+		if devices[key] == nil {
+			devices[key] = map[string]database.Device{}
+		}
+		devices[key][device.Address] = device
+	}
+
+	c.mu.Lock()
+	c.conns = conns
+	c.devices = devices
+	c.mu.Unlock()
+
+	current := map[int64]bool{}
+	for _, bridge := range bridges {
+		cn, ok := conns[bridgeKey{bridge.HouseholdID, bridge.BridgeID}]
+		if !ok {
+			continue
+		}
+		current[bridge.ID] = true
+
+		if w, ok := watchers[bridge.ID]; ok {
+			if w.bridge.Address == bridge.Address && bytes.Equal(w.bridge.ApplicationKey, bridge.ApplicationKey) {
+				continue
+			}
+			w.cancel()
+			<-w.done
+		}
+
+		wctx, cancel := context.WithCancel(ctx)
+		w := &watcher{bridge: bridge, cancel: cancel, done: make(chan struct{})}
+		watchers[bridge.ID] = w
+		go func() {
+			defer close(w.done)
+			c.watch(wctx, w.bridge, cn)
+		}()
+	}
+
+	for id, w := range watchers {
+		if !current[id] {
+			w.cancel()
+			<-w.done
+			delete(watchers, id)
+		}
+	}
+}
+
+// conn returns a connection to a bridge, with its key decrypted.
+func (c *Client) conn(bridge *database.HueBridge) (*conn, error) {
+	key, err := c.keys.Decrypt(bridge.ApplicationKey)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{address: bridge.Address, key: string(key), client: c.httpClient(bridge.BridgeID)}, nil
+}
+
+// httpClient returns the client for requests to the bridge with bridgeID,
+// which only accepts that bridge's certificate. Clients have no timeout,
+// which would end the event streams.
+func (c *Client) httpClient(bridgeID string) *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, ok := c.clients[bridgeID]
+	if !ok {
+		client = newHTTPClient(c.cfg.RootCAs, bridgeID)
+		c.clients[bridgeID] = client
+	}
+	return client
+}
+
+// watch follows a bridge's event stream, reconnecting with exponential
+// backoff when it is lost.
+func (c *Client) watch(ctx context.Context, bridge database.HueBridge, cn *conn) {
+	key := bridgeKey{bridge.HouseholdID, bridge.BridgeID}
+	logger := c.logger.With("bridge_id", bridge.BridgeID, "address", bridge.Address)
+	backoff := c.cfg.MinBackoff
+
+	for {
+		start := time.Now()
+		err := c.stream(ctx, key, cn)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A stream that was up for a while starts over from the shortest wait
+		if time.Since(start) > c.cfg.MaxBackoff {
+			backoff = c.cfg.MinBackoff
+		}
+		logger.Warn("lost Hue event stream", "error", err, "retry_in", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, c.cfg.MaxBackoff)
+	}
+}
+
+// stream connects to a bridge's event stream and reports the state of its
+// lights, then every change, until the stream ends or ctx is cancelled.
+func (c *Client) stream(ctx context.Context, key bridgeKey, cn *conn) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+cn.address+"/eventstream/clip/v2", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("hue-application-key", cn.key)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := cn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hue: unexpected event stream status %s", resp.Status)
+	}
+
+	// Changes made while disconnected are caught up with once subscribed
+	var lights []light
+	err = cn.get(ctx, "light", &lights)
+	if err != nil {
+		return err
+	}
+	for _, l := range lights {
+		c.report(ctx, key, l.ID, l.lightState)
+	}
+
+	// Each message is a JSON array of events on one or more data lines,
+	// ended by a blank line
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), maxResponseSize)
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if rest, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data.Write(bytes.TrimPrefix(rest, []byte(" ")))
+			continue
+		}
+		if len(line) > 0 || data.Len() == 0 {
+			continue
+		}
+
+		var events []event
+		err := json.Unmarshal(data.Bytes(), &events)
+		data.Reset()
+		if err != nil {
+			c.logger.Debug("invalid Hue event", "error", err)
+			continue
+		}
+
+		for _, e := range events {
+			if e.Type != "update" {
+				continue
+			}
+			for _, r := range e.Data {
+				if r.Type == "light" {
+					c.report(ctx, key, r.ID, r.lightState)
+				}
+			}
+		}
+	}
+
+	err = scanner.Err()
+	if err == nil {
+		err = errors.New("hue: event stream ended")
+	}
+	return err
+}
+
+// report passes the state of a light to its device, if it was imported.
+func (c *Client) report(ctx context.Context, key bridgeKey, lightID string, s lightState) {
+	c.mu.Lock()
+	device, ok := c.devices[key][lightID]
+	c.mu.Unlock()
+
+	state := s.state()
+	if ok && len(state) > 0 {
+		c.onState(ctx, device, state)
+	}
+}
+
+// Publish asks a light to change to state. It does not wait for the light to
+// report its new state.
+func (c *Client) Publish(ctx context.Context, device *database.Device, state database.DeviceState) error {
+	cfg, err := ParseDeviceConfig(device)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	cn, ok := c.conns[bridgeKey{device.HouseholdID, cfg.BridgeID}]
+	c.mu.Unlock()
+	if !ok {
+		return ErrNoBridge
+	}
+
+	body, err := command(state)
+	if err != nil {
+		return err
+	}
+	return cn.put(ctx, "light", device.Address, body)
+}
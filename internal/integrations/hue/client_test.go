@@ -0,0 +1,607 @@
+package hue
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations"
+	"github.com/wumbabum/home_assist/internal/secrets"
+)
+
+const (
+	testBridgeID = "001788fffe123456"
+	testKey      = "8CHfCBW4yEmb2nhzRafI9hHDGUTu5E8Kz0zBpyoa"
+)
+
+var testResources = map[string]string{
+	"device": `[
+		{"id": "dev-1", "type": "device", "metadata": {"name": "Sofa lamp"}, "product_data": {"model_id": "LCA001", "manufacturer_name": "Signify Netherlands B.V."}},
+		{"id": "dev-2", "type": "device", "metadata": {"name": "Hallway"}, "product_data": {"model_id": "LWB010", "manufacturer_name": "Signify Netherlands B.V."}},
+		{"id": "dev-3", "type": "device", "metadata": {"name": "Hue Bridge"}, "product_data": {"model_id": "BSB002", "manufacturer_name": "Signify Netherlands B.V."}}
+	]`,
+	"light": `[
+		{"id": "light-1", "type": "light", "owner": {"rid": "dev-1", "rtype": "device"}, "metadata": {"name": "Hue color lamp 1"},
+		 "on": {"on": true}, "dimming": {"brightness": 50.0}, "color": {"xy": {"x": 0.3127, "y": 0.329}}, "color_temperature": {"mirek": null}},
+		{"id": "light-2", "type": "light", "owner": {"rid": "dev-2", "rtype": "device"}, "metadata": {"name": "Hue white lamp 1"},
+		 "on": {"on": false}, "dimming": {"brightness": 100.0}}
+	]`,
+	"room": `[
+		{"id": "room-1", "type": "room", "metadata": {"name": "Living room"}, "children": [{"rid": "dev-1", "rtype": "device"}]},
+		{"id": "room-2", "type": "room", "metadata": {"name": "Hallway"}, "children": [{"rid": "dev-2", "rtype": "device"}]}
+	]`,
+	"scene": `[
+		{"id": "scene-1", "type": "scene", "metadata": {"name": "Relax"}, "group": {"rid": "room-1", "rtype": "room"}, "actions": [
+			{"target": {"rid": "light-1", "rtype": "light"}, "action": {"on": {"on": true}, "dimming": {"brightness": 40.0}, "color_temperature": {"mirek": 447}}}
+		]},
+		{"id": "scene-2", "type": "scene", "metadata": {"name": "Nightlight"}, "group": {"rid": "zone-1", "rtype": "zone"}, "actions": [
+			{"target": {"rid": "light-2", "rtype": "light"}, "action": {"on": {"on": true}, "dimming": {"brightness": 1.0}}}
+		]}
+	]`,
+}
+
+// fakeBridge is a stand-in for a Hue bridge, with the lights, rooms and
+// scenes in testResources.
+type fakeBridge struct {
+	t          *testing.T
+	server     *httptest.Server
+	roots      *x509.CertPool // Issued the bridge's certificate
+	linkButton atomic.Bool
+
+	puts   chan string // The path and body of every change
+	events chan string // Sent on the event stream
+}
+
+func newFakeBridge(t *testing.T) *fakeBridge {
+	return newFakeBridgeWithID(t, testBridgeID)
+}
+
+// newFakeBridgeWithID returns a bridge whose certificate names bridgeID,
+// issued by a certificate authority of its own.
+func newFakeBridgeWithID(t *testing.T, bridgeID string) *fakeBridge {
+	t.Helper()
+
+	b := &fakeBridge{
+		t:      t,
+		puts:   make(chan string, 10),
+		events: make(chan string, 10),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/0/config", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"name": "Hue Bridge", "bridgeid": "001788FFFE123456", "apiversion": "1.62.0"}`)
+	})
+	mux.HandleFunc("POST /api", func(w http.ResponseWriter, r *http.Request) {
+		if !b.linkButton.Load() {
+			io.WriteString(w, `[{"error": {"type": 101, "address": "", "description": "link button not pressed"}}]`)
+			return
+		}
+		io.WriteString(w, `[{"success": {"username": "`+testKey+`", "clientkey": "E3B550C65F78022EFD9E52E28378583"}}]`)
+	})
+	mux.HandleFunc("GET /clip/v2/resource/{type}", b.authorized(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"errors": [], "data": `+testResources[r.PathValue("type")]+`}`)
+	}))
+	mux.HandleFunc("PUT /clip/v2/resource/light/{id}", b.authorized(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		b.puts <- r.URL.Path + " " + string(body)
+		io.WriteString(w, `{"errors": [], "data": [{"rid": "`+r.PathValue("id")+`", "rtype": "light"}]}`)
+	}))
+	mux.HandleFunc("GET /eventstream/clip/v2", b.authorized(b.serveEvents))
+
+	cert, roots := newBridgeCertificate(t, bridgeID)
+	b.roots = roots
+	b.server = httptest.NewUnstartedServer(mux)
+	b.server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	b.server.StartTLS()
+	t.Cleanup(b.server.Close)
+	return b
+}
+
+// newBridgeCertificate returns a certificate for bridgeID, like those of
+// bridges, and the pool of the authority that issued it.
+func newBridgeCertificate(t *testing.T, bridgeID string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root-bridge"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err = x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: bridgeID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+func (b *fakeBridge) address() string {
+	return b.server.Listener.Addr().String()
+}
+
+func (b *fakeBridge) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("hue-application-key") != testKey {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"errors": [{"description": "unauthorized user"}], "data": []}`)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (b *fakeBridge) serveEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	io.WriteString(w, ": hi\n\n")
+	w.(http.Flusher).Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data := <-b.events:
+			// Events are sent on a single data line, as bridges do
+			var js bytes.Buffer
+			json.Compact(&js, []byte(data))
+			io.WriteString(w, "id: 1700000000:0\ndata: "+js.String()+"\n\n")
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+type fakeStore struct {
+	mu      sync.Mutex
+	nextID  int64
+	bridges []database.HueBridge
+	devices []database.Device
+	rooms   []database.Room
+	scenes  []database.Scene
+}
+
+func (s *fakeStore) id() int64 {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *fakeStore) ListHueBridges(ctx context.Context) ([]database.HueBridge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.bridges), nil
+}
+
+func (s *fakeStore) ListDevicesByProtocol(ctx context.Context, protocol string) ([]database.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var devices []database.Device
+	for _, d := range s.devices {
+		if d.Protocol == protocol {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+func (s *fakeStore) ListDevices(ctx context.Context, householdID int64) ([]database.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.devices), nil
+}
+
+func (s *fakeStore) CreateDevice(ctx context.Context, device *database.Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device.ID = s.id()
+	s.devices = append(s.devices, *device)
+	return nil
+}
+
+func (s *fakeStore) UpdateDevice(ctx context.Context, device *database.Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.devices {
+		if s.devices[i].ID == device.ID {
+			s.devices[i] = *device
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) ListRooms(ctx context.Context, householdID int64) ([]database.Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.rooms), nil
+}
+
+func (s *fakeStore) CreateRoom(ctx context.Context, room *database.Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room.ID = s.id()
+	s.rooms = append(s.rooms, *room)
+	return nil
+}
+
+func (s *fakeStore) ListScenes(ctx context.Context, householdID int64) ([]database.Scene, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.scenes), nil
+}
+
+func (s *fakeStore) CreateScene(ctx context.Context, scene *database.Scene) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scene.ID = s.id()
+	s.scenes = append(s.scenes, *scene)
+	return nil
+}
+
+func (s *fakeStore) UpdateScene(ctx context.Context, scene *database.Scene) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.scenes {
+		if s.scenes[i].ID == scene.ID {
+			s.scenes[i] = *scene
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) device(address string) database.Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		if d.Address == address {
+			return d
+		}
+	}
+	return database.Device{}
+}
+
+type report struct {
+	deviceID int64
+	state    database.DeviceState
+}
+
+// newTestClient returns a client for the fake bridge, paired with household
+// 1, and the states reported to it.
+func newTestClient(t *testing.T, b *fakeBridge, store *fakeStore) (*Client, <-chan report) {
+	t.Helper()
+
+	keys, err := secrets.NewCipher(bytes.Repeat([]byte{1}, secrets.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keys.Encrypt([]byte(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.bridges = append(store.bridges, database.HueBridge{ID: 1, HouseholdID: 1, BridgeID: testBridgeID, Address: b.address(), ApplicationKey: key})
+
+	reports := make(chan report, 10)
+	onState := func(ctx context.Context, device database.Device, state database.DeviceState) {
+		reports <- report{deviceID: device.ID, state: state}
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return New(Config{RootCAs: b.roots}, store, keys, onState, logger), reports
+}
+
+func TestPair(t *testing.T) {
+	b := newFakeBridge(t)
+	client, _ := newTestClient(t, b, &fakeStore{})
+	ctx := context.Background()
+
+	_, err := client.Pair(ctx, b.address())
+	if !errors.Is(err, ErrLinkButton) {
+		t.Errorf("expected ErrLinkButton, got %v", err)
+	}
+
+	b.linkButton.Store(true)
+	pairing, err := client.Pair(ctx, b.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pairing != (Pairing{BridgeID: testBridgeID, ApplicationKey: testKey}) {
+		t.Errorf("unexpected pairing %+v", pairing)
+	}
+}
+
+func TestBridgeCertificate(t *testing.T) {
+	ctx := context.Background()
+
+	// Bridges must have a certificate issued by Signify
+	b := newFakeBridge(t)
+	b.linkButton.Store(true)
+	client, _ := newTestClient(t, b, &fakeStore{})
+	client.cfg.RootCAs = x509.NewCertPool()
+	_, err := client.Pair(ctx, b.address())
+	if err == nil {
+		t.Error("expected a certificate from another authority to be rejected")
+	}
+
+	// The certificate must be that of the paired bridge
+	other := newFakeBridgeWithID(t, "001788fffe654321")
+	store := &fakeStore{}
+	client, _ = newTestClient(t, other, store)
+	_, err = client.Import(ctx, &store.bridges[0], ImportOptions{})
+	if err == nil {
+		t.Error("expected the certificate of another bridge to be rejected")
+	}
+}
+
+func TestImport(t *testing.T) {
+	b := newFakeBridge(t)
+	store := &fakeStore{nextID: 10, rooms: []database.Room{{ID: 1, HouseholdID: 1, Name: "living room"}}}
+	client, reports := newTestClient(t, b, store)
+	ctx := context.Background()
+
+	result, err := client.Import(ctx, &store.bridges[0], ImportOptions{Rooms: true, Scenes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 2 || result.Updated != 0 || result.Rooms != 1 || result.Scenes != 2 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	// Lights are put in the rooms of the same name
+	hallway := store.rooms[1]
+	if hallway.Name != "Hallway" {
+		t.Fatalf("expected the hallway to be created, got %+v", store.rooms)
+	}
+
+	tests := []struct {
+		address      string
+		name         string
+		roomID       int64
+		model        string
+		capabilities []string
+	}{
+		{"light-1", "Sofa lamp", 1, "LCA001", []string{"on_off", "brightness", "color", "color_temperature"}},
+		{"light-2", "Hallway", hallway.ID, "LWB010", []string{"on_off", "brightness"}},
+	}
+	for _, tt := range tests {
+		d := store.device(tt.address)
+		if d.Name != tt.name || d.RoomID == nil || *d.RoomID != tt.roomID || d.Kind != "light" || d.Protocol != Protocol {
+			t.Errorf("%s: unexpected device %+v", tt.address, d)
+		}
+		if d.Vendor != "Signify Netherlands B.V." || d.Model != tt.model || d.Config["bridge_id"] != testBridgeID {
+			t.Errorf("%s: unexpected device details %+v", tt.address, d)
+		}
+		if !slices.Equal(d.Capabilities, tt.capabilities) {
+			t.Errorf("%s: expected capabilities %v, got %v", tt.address, tt.capabilities, d.Capabilities)
+		}
+	}
+
+	// The state of new lights is reported
+	for range 2 {
+		select {
+		case <-reports:
+		case <-time.After(time.Second):
+			t.Fatal("expected the state of the new lights")
+		}
+	}
+
+	lamp := store.device("light-1")
+	relax := store.scenes[0]
+	if relax.Name != "Relax" || relax.RoomID == nil || *relax.RoomID != 1 {
+		t.Errorf("unexpected scene %+v", relax)
+	}
+	want := database.SceneTargets{{DeviceID: lamp.ID, State: database.DeviceState{"on": true, "brightness": 40.0, "color_temperature": 2237.0}}}
+	if !reflect.DeepEqual(relax.Targets, want) {
+		t.Errorf("expected targets %+v, got %+v", want, relax.Targets)
+	}
+	if nightlight := store.scenes[1]; nightlight.Name != "Nightlight" || nightlight.RoomID != nil {
+		t.Errorf("expected the zone's scene not to be in a room, got %+v", nightlight)
+	}
+
+	// Importing again changes nothing, and keeps the names given
+	store.devices[0].Name = "Reading lamp"
+	result, err = client.Import(ctx, &store.bridges[0], ImportOptions{Rooms: true, Scenes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 0 || result.Updated != 0 || result.Rooms != 0 || result.Scenes != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if len(store.devices) != 2 || store.devices[0].Name != "Reading lamp" {
+		t.Errorf("unexpected devices %+v", store.devices)
+	}
+}
+
+func TestImportOptions(t *testing.T) {
+	b := newFakeBridge(t)
+	store := &fakeStore{nextID: 10, rooms: []database.Room{{ID: 1, HouseholdID: 1, Name: "Living room"}}}
+	client, _ := newTestClient(t, b, store)
+	ctx := context.Background()
+
+	// Lights are still put in the rooms that exist
+	result, err := client.Import(ctx, &store.bridges[0], ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 2 || result.Rooms != 0 || result.Scenes != 0 || len(store.rooms) != 1 || len(store.scenes) != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if lamp := store.device("light-1"); lamp.RoomID == nil || *lamp.RoomID != 1 {
+		t.Errorf("expected the lamp in the living room, got %+v", lamp)
+	}
+	if hallway := store.device("light-2"); hallway.RoomID != nil {
+		t.Errorf("expected the hallway light not to be in a room, got %+v", hallway)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	b := newFakeBridge(t)
+	store := &fakeStore{nextID: 10}
+	client, _ := newTestClient(t, b, store)
+	ctx := context.Background()
+
+	store.devices = append(store.devices, database.Device{
+		ID: 1, HouseholdID: 1, Protocol: Protocol, Address: "light-2", Config: database.DeviceConfig{"bridge_id": testBridgeID},
+	})
+
+	found, err := client.Discover(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []integrations.Discovery{{
+		Name: "Sofa lamp", Kind: "light", Address: "light-1", Capabilities: []string{"on_off", "brightness", "color", "color_temperature"},
+		Config: database.DeviceConfig{"bridge_id": testBridgeID}, Vendor: "Signify Netherlands B.V.", Model: "LCA001",
+	}}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("expected %+v, got %+v", want, found)
+	}
+
+	found, err = client.Discover(ctx, 2)
+	if err != nil || len(found) != 0 {
+		t.Errorf("expected nothing for a household without bridges, got %+v, %v", found, err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	b := newFakeBridge(t)
+	store := &fakeStore{}
+	client, reports := newTestClient(t, b, store)
+
+	_, err := client.Import(context.Background(), &store.bridges[0], ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-reports
+	<-reports
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// The state of every light is reported on connecting
+	lamp, hallway := store.device("light-1"), store.device("light-2")
+	got := map[int64]database.DeviceState{}
+	for range 2 {
+		select {
+		case r := <-reports:
+			got[r.deviceID] = r.state
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for the lights' state")
+		}
+	}
+	if !reflect.DeepEqual(got[hallway.ID], database.DeviceState{"on": false, "brightness": 100.0}) || got[lamp.ID]["on"] != true {
+		t.Errorf("unexpected states %v", got)
+	}
+
+	// Changes are reported from the event stream
+	b.events <- `[{"creationtime": "2024-01-01T12:00:00Z", "id": "event-1", "type": "update", "data": [
+		{"id": "light-1", "id_v1": "/lights/1", "type": "light", "owner": {"rid": "dev-1", "rtype": "device"}, "on": {"on": false}},
+		{"id": "grouped-1", "type": "grouped_light", "on": {"on": false}}
+	]}]`
+	select {
+	case r := <-reports:
+		want := report{deviceID: lamp.ID, state: database.DeviceState{"on": false}}
+		if !reflect.DeepEqual(r, want) {
+			t.Errorf("expected %+v, got %+v", want, r)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the event")
+	}
+
+	// Commands are sent to the light
+	err = client.Publish(ctx, &hallway, database.DeviceState{"on": true, "brightness": 30.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case put := <-b.puts:
+		if put != `/clip/v2/resource/light/light-2 {"on":{"on":true},"dimming":{"brightness":30}}` {
+			t.Errorf("unexpected change %s", put)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the change")
+	}
+
+	other := hallway
+	other.HouseholdID = 2
+	err = client.Publish(ctx, &other, database.DeviceState{"on": true})
+	if !errors.Is(err, ErrNoBridge) {
+		t.Errorf("expected ErrNoBridge, got %v", err)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	got, err := command(database.DeviceState{"color": "#ff0000", "color_temperature": 10000.0, "on": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case got.On == nil || !got.On.On, got.Dimming != nil:
+		t.Errorf("unexpected command %+v", got)
+	case got.Color == nil || math.Abs(got.Color.XY.X-0.64) > 0.001 || math.Abs(got.Color.XY.Y-0.33) > 0.001:
+		t.Errorf("unexpected color %+v", got.Color)
+	case got.ColorTemperature == nil || *got.ColorTemperature.Mirek != minMirek:
+		t.Errorf("expected the color temperature to be clamped, got %+v", got.ColorTemperature)
+	}
+
+	for _, invalid := range []database.DeviceState{{"on": "yes"}, {"color": "red"}, {"position": 50.0}} {
+		_, err := command(invalid)
+		if err == nil {
+			t.Errorf("%v: expected an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package hue
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/wumbabum/home_assist/internal/color"
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+// Protocol is the device protocol handled by this package.
+const Protocol = "hue"
+
+// Hue lights take color temperatures from 153 to 500 mireds, about 6500K to
+// 2000K.
+const (
+	minMirek = 153
+	maxMirek = 500
+)
+
+// DeviceConfig is the Hue settings of a light, stored in
+// database.Device.Config. The device address is the id of the light resource.
+type DeviceConfig struct {
+	BridgeID string `json:"bridge_id"` // The bridge the light is connected to
+}
+
+// ParseDeviceConfig decodes and validates the Hue settings of a device.
+func ParseDeviceConfig(device *database.Device) (DeviceConfig, error) {
+	var cfg DeviceConfig
+
+	js, err := json.Marshal(device.Config)
+	if err != nil {
+		return cfg, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg)
+	switch {
+	case err != nil:
+		return cfg, fmt.Errorf("invalid Hue config: %w", err)
+	case cfg.BridgeID == "":
+		return cfg, errors.New("bridge_id is required")
+	case device.Address == "":
+		return cfg, errors.New("address must be the id of the light")
+	}
+	return cfg, nil
+}
+
+// capabilities returns the capabilities of a light, from the features its
+// state has.
+func (s lightState) capabilities() []string {
+	capabilities := []string{"on_off"}
+	if s.Dimming != nil {
+		capabilities = append(capabilities, "brightness")
+	}
+	if s.Color != nil {
+		capabilities = append(capabilities, "color")
+	}
+	if s.ColorTemperature != nil {
+		capabilities = append(capabilities, "color_temperature")
+	}
+	return capabilities
+}
+
+// state converts the fields that are set to device state.
+func (s lightState) state() database.DeviceState {
+	state := database.DeviceState{}
+	if s.On != nil {
+		state["on"] = s.On.On
+	}
+	if s.Dimming != nil {
+		state["brightness"] = s.Dimming.Brightness
+	}
+	if s.Color != nil && s.Color.XY.Y > 0 {
+		state["color"] = color.XYToHex(s.Color.XY)
+	}
+	if s.ColorTemperature != nil && s.ColorTemperature.Mirek != nil && *s.ColorTemperature.Mirek > 0 {
+		state["color_temperature"] = math.Round(1e6 / *s.ColorTemperature.Mirek)
+	}
+	return state
+}
+
+// command translates a state change into the light state sent to the bridge.
+func command(state database.DeviceState) (lightState, error) {
+	var s lightState
+
+	attrs := make([]string, 0, len(state))
+	for attr := range state {
+		attrs = append(attrs, attr)
+	}
+	slices.Sort(attrs)
+
+	for _, attr := range attrs {
+		switch value := state[attr]; attr {
+		case "on":
+			on, ok := value.(bool)
+			if !ok {
+				return s, errors.New("on must be a boolean")
+			}
+			s.On = &onState{On: on}
+
+		case "brightness":
+			brightness, ok := value.(float64)
+			if !ok {
+				return s, errors.New("brightness must be a number")
+			}
+			s.Dimming = &dimming{Brightness: brightness}
+
+		case "color":
+			hex, _ := value.(string)
+			xy, err := color.HexToXY(hex)
+			if err != nil {
+				return s, err
+			}
+			s.Color = &lightColor{XY: xy}
+
+		case "color_temperature":
+			kelvin, ok := value.(float64)
+			if !ok || kelvin <= 0 {
+				return s, errors.New("color_temperature must be a positive number")
+			}
+			mirek := min(max(math.Round(1e6/kelvin), minMirek), maxMirek)
+			s.ColorTemperature = &colorTemperature{Mirek: &mirek}
+
+		default:
+			return s, fmt.Errorf("%s is not supported by Hue lights", attr)
+		}
+	}
+	return s, nil
+}
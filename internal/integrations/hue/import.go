@@ -0,0 +1,347 @@
+package hue
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations"
+)
+
+// ImportResult is what an import changed.
+type ImportResult struct {
+	Added   []database.Device // The lights created
+	Updated int               // The lights updated
+	Rooms   int               // The rooms created
+	Scenes  int               // The scenes created or updated
+}
+
+// Summary describes the result in a sentence for a flash message.
+func (r *ImportResult) Summary() string {
+	return fmt.Sprintf("Imported %s, updated %s, created %s and imported %s.",
+		plural(len(r.Added), "new light"), plural(r.Updated, "light"), plural(r.Rooms, "room"), plural(r.Scenes, "scene"))
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// ImportOptions are what an import creates besides lights.
+type ImportOptions struct {
+	Rooms  bool // Create the rooms the household does not have
+	Scenes bool // Create and update scenes
+}
+
+// Import creates a device for every light of a bridge and, unless disabled
+// by opts, a scene for every Hue scene. New lights are put in the room named
+// as their Hue room, which is created if the household has none. Lights
+// imported before keep the name and room they were given, and scenes are
+// updated from the bridge.
+func (c *Client) Import(ctx context.Context, bridge *database.HueBridge, opts ImportOptions) (*ImportResult, error) {
+	cn, err := c.conn(bridge)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		devices []device
+		lights  []light
+		rooms   []room
+		scenes  []scene
+	)
+	for resourceType, v := range map[string]any{"device": &devices, "light": &lights, "room": &rooms, "scene": &scenes} {
+		err := cn.get(ctx, resourceType, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ImportResult{}
+
+	roomIDs, deviceRooms, err := c.importRooms(ctx, bridge.HouseholdID, rooms, opts.Rooms, result)
+	if err != nil {
+		return nil, err
+	}
+
+	lightDevices, err := c.importLights(ctx, bridge, devices, lights, deviceRooms, result)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Scenes {
+		err = c.importScenes(ctx, bridge.HouseholdID, scenes, roomIDs, lightDevices, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.Reload()
+	return result, nil
+}
+
+// importRooms finds, or if create is set creates, a room for every Hue room,
+// returning the room ids by Hue room id and by the id of the Hue devices in
+// them.
+func (c *Client) importRooms(ctx context.Context, householdID int64, rooms []room, create bool, result *ImportResult) (map[string]int64, map[string]int64, error) {
+	existing, err := c.store.ListRooms(ctx, householdID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	roomIDs := map[string]int64{}
+	deviceRooms := map[string]int64{}
+	for _, r := range rooms {
+		name := strings.TrimSpace(r.Metadata.Name)
+		if name == "" {
+			continue
+		}
+
+		i := slices.IndexFunc(existing, func(room database.Room) bool {
+			return strings.EqualFold(room.Name, name)
+		})
+		if i < 0 && !create {
+			continue
+		}
+		if i < 0 {
+			room := database.Room{HouseholdID: householdID, Name: name}
+			err := c.store.CreateRoom(ctx, &room)
+			if err != nil {
+				return nil, nil, err
+			}
+			existing = append(existing, room)
+			i = len(existing) - 1
+			result.Rooms++
+		}
+
+		roomIDs[r.ID] = existing[i].ID
+		for _, child := range r.Children {
+			if child.RType == "device" {
+				deviceRooms[child.RID] = existing[i].ID
+			}
+		}
+	}
+	return roomIDs, deviceRooms, nil
+}
+
+// importLights creates or updates a device for every light, returning the
+// device ids by light id.
+func (c *Client) importLights(ctx context.Context, bridge *database.HueBridge, devices []device, lights []light, deviceRooms map[string]int64, result *ImportResult) (map[string]int64, error) {
+	all, err := c.store.ListDevices(ctx, bridge.HouseholdID)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[string]database.Device{}
+	for _, d := range all {
+		cfg, err := ParseDeviceConfig(&d)
+		if d.Protocol == Protocol && err == nil && cfg.BridgeID == bridge.BridgeID {
+			existing[d.Address] = d
+		}
+	}
+
+	owners := map[string]device{}
+	for _, d := range devices {
+		owners[d.ID] = d
+	}
+
+	lightDevices := map[string]int64{}
+	for _, l := range lights {
+		owner := owners[l.Owner.RID]
+
+		d, ok := existing[l.ID]
+		before := d
+		d.Kind = "light"
+		d.Protocol = Protocol
+		d.Address = l.ID
+		d.Capabilities = l.capabilities()
+		d.Config = database.DeviceConfig{"bridge_id": bridge.BridgeID}
+		d.Vendor = owner.ProductData.ManufacturerName
+		d.Model = owner.ProductData.ModelID
+
+		if ok {
+			lightDevices[l.ID] = d.ID
+			if d.Kind == before.Kind && slices.Equal(d.Capabilities, before.Capabilities) && reflect.DeepEqual(d.Config, before.Config) &&
+				d.Vendor == before.Vendor && d.Model == before.Model {
+				continue
+			}
+
+			err := c.store.UpdateDevice(ctx, &d)
+			if err != nil {
+				return nil, err
+			}
+			result.Updated++
+			continue
+		}
+
+		d.HouseholdID = bridge.HouseholdID
+		d.Name = truncate(cmp.Or(owner.Metadata.Name, l.Metadata.Name, "Hue light"), 100)
+		if roomID, ok := deviceRooms[l.Owner.RID]; ok {
+			d.RoomID = &roomID
+		}
+
+		err := c.store.CreateDevice(ctx, &d)
+		if err != nil {
+			return nil, err
+		}
+		lightDevices[l.ID] = d.ID
+		result.Added = append(result.Added, d)
+
+		// Lights report their state when it next changes
+		if state := l.state(); len(state) > 0 {
+			c.onState(ctx, d, state)
+		}
+	}
+	return lightDevices, nil
+}
+
+// importScenes creates or updates a scene for every Hue scene with imported
+// lights, matching scenes by name within their room.
+func (c *Client) importScenes(ctx context.Context, householdID int64, scenes []scene, roomIDs, lightDevices map[string]int64, result *ImportResult) error {
+	existing, err := c.store.ListScenes(ctx, householdID)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range scenes {
+		name := strings.TrimSpace(s.Metadata.Name)
+
+		var targets database.SceneTargets
+		for _, action := range s.Actions {
+			deviceID, ok := lightDevices[action.Target.RID]
+			state := action.Action.state()
+			if action.Target.RType != "light" || !ok || len(state) == 0 {
+				continue
+			}
+			targets = append(targets, database.SceneTarget{DeviceID: deviceID, State: state})
+		}
+		if name == "" || len(targets) == 0 {
+			continue
+		}
+
+		var roomID *int64
+		if id, ok := roomIDs[s.Group.RID]; ok {
+			roomID = &id
+		}
+
+		i := slices.IndexFunc(existing, func(scene database.Scene) bool {
+			return strings.EqualFold(scene.Name, name) && equalIDs(scene.RoomID, roomID)
+		})
+		if i >= 0 {
+			scene := existing[i]
+			if reflect.DeepEqual(scene.Targets, targets) {
+				continue
+			}
+			scene.Targets = targets
+			err := c.store.UpdateScene(ctx, &scene)
+			if err != nil {
+				return err
+			}
+			result.Scenes++
+			continue
+		}
+
+		scene := database.Scene{HouseholdID: householdID, RoomID: roomID, Name: truncate(name, 100), Targets: targets}
+		err := c.store.CreateScene(ctx, &scene)
+		if err != nil {
+			return err
+		}
+		existing = append(existing, scene)
+		result.Scenes++
+	}
+	return nil
+}
+
+// Discover returns the lights of a household's bridges that have not been
+// imported.
+func (c *Client) Discover(ctx context.Context, householdID int64) ([]integrations.Discovery, error) {
+	bridges, err := c.store.ListHueBridges(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := c.store.ListDevices(ctx, householdID)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := map[bridgeKey]map[string]bool{}
+	for _, d := range devices {
+		cfg, err := ParseDeviceConfig(&d)
+		if d.Protocol != Protocol || err != nil {
+			continue
+		}
+		key := bridgeKey{householdID, cfg.BridgeID}
+		if imported[key] == nil {
+			imported[key] = map[string]bool{}
+		}
+		imported[key][d.Address] = true
+	}
+
+	var found []integrations.Discovery
+	for _, bridge := range bridges {
+		if bridge.HouseholdID != householdID {
+			continue
+		}
+
+		cn, err := c.conn(&bridge)
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			owners []device
+			lights []light
+		)
+		err = cn.get(ctx, "device", &owners)
+		if err != nil {
+			return nil, err
+		}
+		err = cn.get(ctx, "light", &lights)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, l := range lights {
+			if imported[bridgeKey{householdID, bridge.BridgeID}][l.ID] {
+				continue
+			}
+			i := slices.IndexFunc(owners, func(d device) bool { return d.ID == l.Owner.RID })
+			var owner device
+			if i >= 0 {
+				owner = owners[i]
+			}
+			found = append(found, integrations.Discovery{
+				Name:         truncate(cmp.Or(owner.Metadata.Name, l.Metadata.Name, "Hue light"), 100),
+				Kind:         "light",
+				Address:      l.ID,
+				Capabilities: l.capabilities(),
+				Config:       database.DeviceConfig{"bridge_id": bridge.BridgeID},
+				Vendor:       owner.ProductData.ManufacturerName,
+				Model:        owner.ProductData.ModelID,
+			})
+		}
+	}
+	return found, nil
+}
+
+func equalIDs(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
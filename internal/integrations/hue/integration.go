@@ -0,0 +1,135 @@
+package hue
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations"
+)
+
+func init() {
+	integrations.Register(&Integration{})
+}
+
+// Schema is the settings households give the Hue integration, deciding what
+// is imported from their bridges besides lights.
+var Schema = integrations.Schema{
+	{Name: "import_rooms", Label: "Create rooms", Help: "Create the rooms of the Hue app that the household does not have.", Type: integrations.FieldBool, Default: true},
+	{Name: "import_scenes", Label: "Import scenes", Help: "Create and update a scene for every scene of the Hue app.", Type: integrations.FieldBool, Default: true},
+}
+
+// Integration plugs the client into the server, following the lights of the
+// households that enabled it. It is unavailable without a SECRET_KEY, which
+// encrypts the application keys of bridges.
+type Integration struct {
+	client     *Client
+	background integrations.Background
+}
+
+func (i *Integration) Name() string  { return Protocol }
+func (i *Integration) Title() string { return "Philips Hue" }
+
+func (i *Integration) ConfigSchema() integrations.Schema { return Schema }
+
+func (i *Integration) Setup(ctx context.Context, host integrations.Host) error {
+	if host.Secrets == nil {
+		return integrations.ErrUnavailable
+	}
+
+	i.client = New(Config{}, store{host.DB}, host.Secrets, StateFunc(host.OnState), host.Logger)
+	i.background.Start(Protocol, i.client.Run, host.Logger)
+	return nil
+}
+
+// Pair asks the bridge at address for an application key, returning
+// ErrLinkButton until its link button has been pressed.
+func (i *Integration) Pair(ctx context.Context, address string) (*Pairing, error) {
+	return i.client.Pair(ctx, address)
+}
+
+// Import imports the lights of a paired bridge and, as opts say, its rooms
+// and scenes.
+func (i *Integration) Import(ctx context.Context, bridge *database.HueBridge, opts ImportOptions) (*ImportResult, error) {
+	return i.client.Import(ctx, bridge, opts)
+}
+
+func (i *Integration) Reload() { i.client.Reload() }
+
+// Discover returns the lights of the household's bridges that have not been
+// imported.
+func (i *Integration) Discover(ctx context.Context, entry *database.IntegrationEntry) ([]integrations.Discovery, error) {
+	return i.client.Discover(ctx, entry.HouseholdID)
+}
+
+// Match recognises bridges, announced as _hue._tcp or by SSDP with their id
+// in a hue-bridgeid header. Bridges are set up by pairing them, so they are
+// found with the page to pair them on. Their API is always on port 443, so
+// the address is the host.
+func (i *Integration) Match(a integrations.Announcement) (integrations.Discovery, bool) {
+	var id, model string
+	switch {
+	case a.Source == "mdns" && a.Service == "_hue._tcp":
+		id, model = a.Properties["bridgeid"], a.Properties["modelid"]
+	case a.Source == "ssdp" && a.Properties["hue-bridgeid"] != "":
+		id = a.Properties["hue-bridgeid"]
+	default:
+		return integrations.Discovery{}, false
+	}
+
+	return integrations.Discovery{
+		Name:      strings.TrimSpace("Hue bridge " + strings.ToLower(id)),
+		Address:   a.Host,
+		Vendor:    "Signify",
+		Model:     model,
+		SetupPath: "/hue?" + url.Values{"address": {a.Host}}.Encode(),
+	}, true
+}
+
+func (i *Integration) HandleCommand(ctx context.Context, device *database.Device, state database.DeviceState) error {
+	return i.client.Publish(ctx, device, state)
+}
+
+func (i *Integration) Shutdown(ctx context.Context) error {
+	return i.background.Stop(ctx)
+}
+
+// ImportOptionsFor returns the options of an import from the settings of a
+// household's entry.
+func ImportOptionsFor(entry *database.IntegrationEntry) ImportOptions {
+	return ImportOptions{
+		Rooms:  Schema.Bool(entry.Config, "import_rooms"),
+		Scenes: Schema.Bool(entry.Config, "import_scenes"),
+	}
+}
+
+// store only gives the client the bridges and lights of the households that
+// enabled the integration.
+type store struct {
+	*database.DB
+}
+
+func (s store) ListHueBridges(ctx context.Context) ([]database.HueBridge, error) {
+	households, err := integrations.EnabledHouseholds(ctx, s.DB, Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	bridges, err := s.DB.ListHueBridges(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := []database.HueBridge{}
+	for _, bridge := range bridges {
+		if households[bridge.HouseholdID] {
+			enabled = append(enabled, bridge)
+		}
+	}
+	return enabled, nil
+}
+
+func (s store) ListDevicesByProtocol(ctx context.Context, protocol string) ([]database.Device, error) {
+	return integrations.DeviceStore{DB: s.DB}.ListDevicesByProtocol(ctx, protocol)
+}
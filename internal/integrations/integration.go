@@ -0,0 +1,210 @@
+// Package integrations defines the interface protocols implement to be
+// plugged into the server, and the registry they add themselves to. Each
+// integration registers itself from an init function, so it is enabled by
+// importing its package:
+//
+//	import _ "github.com/wumbabum/home_assist/internal/integrations/shelly"
+//
+// The server gives integrations its configuration of them, such as how often
+// to poll devices, in the Host they are set up with. Households then add an
+// entry for each integration they use, holding its settings. Integrations
+// only follow and command the devices of households whose entry is enabled.
+package integrations
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/secrets"
+)
+
+// ErrUnavailable is returned by Setup when the server is not configured for
+// the integration, such as Hue without a SECRET_KEY.
+var ErrUnavailable = errors.New("integration unavailable")
+
+// Integration connects the server to the devices of a protocol.
+type Integration interface {
+	// Name identifies the integration, and is the protocol of its devices
+	// if it has any of its own.
+	Name() string
+
+	// Title is the name shown to users, such as "Philips Hue".
+	Title() string
+
+	// ConfigSchema describes the settings households give the integration in
+	// their entry.
+	ConfigSchema() Schema
+
+	// Setup starts following the state of devices, returning once started.
+	Setup(ctx context.Context, host Host) error
+
+	// Reload makes the integration read the devices and entries again, after
+	// either has been saved or deleted. It does not block.
+	Reload()
+
+	// Discover finds the devices of a household that have not been added,
+	// such as the lights of a paired Hue bridge. Integrations that cannot
+	// find devices themselves return nil.
+	Discover(ctx context.Context, entry *database.IntegrationEntry) ([]Discovery, error)
+
+	// HandleCommand asks a device to change to state. It does not wait for
+	// the device to report its new state.
+	HandleCommand(ctx context.Context, device *database.Device, state database.DeviceState) error
+
+	// Shutdown stops following devices, waiting until done or ctx is
+	// cancelled.
+	Shutdown(ctx context.Context) error
+}
+
+// StateFunc receives the state a device reported.
+type StateFunc func(ctx context.Context, device database.Device, state database.DeviceState)
+
+// ChangeFunc is called after an integration created, updated or deleted
+// devices of a household by itself, such as those announced with MQTT
+// discovery, with the devices it created.
+type ChangeFunc func(ctx context.Context, householdID int64, added []database.Device)
+
+// Host is what the server gives integrations to run.
+type Host struct {
+	DB       *database.DB
+	Secrets  *secrets.Cipher // nil when no SECRET_KEY is configured
+	OnState  StateFunc
+	OnChange ChangeFunc
+	Logger   *slog.Logger
+
+	// Config holds the server's configuration of integrations by name, of
+	// the type each integration documents, such as a shelly.Config.
+	Config map[string]any
+
+	// Integrations are those set up so far by name, which includes the one
+	// a Dependent integration depends on.
+	Integrations map[string]Integration
+}
+
+// Discovery is a device an integration found, which can be added as is.
+type Discovery struct {
+	Name         string
+	Kind         string
+	Address      string
+	Capabilities []string
+	Config       database.DeviceConfig
+	Vendor       string
+	Model        string
+
+	// SetupPath is the page devices that cannot be added as is are set up
+	// on, such as a Hue bridge that must be paired. Empty for devices.
+	SetupPath string
+}
+
+// Announcement is a device announcing itself on the local network, by mDNS
+// or SSDP.
+type Announcement struct {
+	Source     string            // "mdns" or "ssdp"
+	Service    string            // The mDNS service type, such as "_hue._tcp", or the SSDP notification type
+	Name       string            // The mDNS instance name, or the SSDP unique service name
+	Host       string            // The device's IP address
+	Port       int               // 0 when not announced
+	Properties map[string]string // The mDNS TXT records, or the SSDP headers with lower case names
+}
+
+// Address returns the host and port of the device, leaving out the port if
+// it was not announced or is the default HTTP port.
+func (a Announcement) Address() string {
+	if a.Port == 0 || a.Port == 80 {
+		return a.Host
+	}
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// CheckAddress returns an error describing why address is not the address of
+// a device on the local network, a host name or IP address with an optional
+// port.
+func CheckAddress(address string) error {
+	if address == "" {
+		return errors.New("address is required")
+	}
+
+	u, err := url.Parse("http://" + address)
+	if err != nil || u.Host != address || u.Hostname() == "" {
+		return errors.New("address must be a host name or IP address, optionally followed by a port")
+	}
+	return nil
+}
+
+// Matcher is implemented by integrations whose devices announce themselves
+// on the local network, to recognise their announcements.
+type Matcher interface {
+	// Match returns the device an announcement is from, if it can be
+	// handled by the integration.
+	Match(a Announcement) (Discovery, bool)
+}
+
+// Dependent is implemented by integrations that run on another, such as
+// Zigbee2MQTT on the connection of the MQTT integration. They are set up
+// after it, and are unavailable without it.
+type Dependent interface {
+	// DependsOn returns the name of the integration it runs on.
+	DependsOn() string
+}
+
+// Effects are the names of the effects and palettes a device can show.
+type Effects struct {
+	Effects  []string
+	Palettes []string
+}
+
+// EffectLister is implemented by integrations whose devices show effects,
+// such as WLED, to list them on the page of devices.
+type EffectLister interface {
+	// Effects returns the effects and palettes of a device, or nil until
+	// they are known.
+	Effects(device *database.Device) *Effects
+}
+
+// EnabledHouseholds returns the households that have enabled an
+// integration.
+func EnabledHouseholds(ctx context.Context, db *database.DB, name string) (map[int64]bool, error) {
+	entries, err := db.ListIntegrationEntriesByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	households := map[int64]bool{}
+	for _, entry := range entries {
+		if entry.Enabled {
+			households[entry.HouseholdID] = true
+		}
+	}
+	return households, nil
+}
+
+// DeviceStore lists the devices of an integration in the households that
+// have enabled it. It is the store of integrations that only need devices.
+type DeviceStore struct {
+	DB *database.DB
+}
+
+func (s DeviceStore) ListDevicesByProtocol(ctx context.Context, protocol string) ([]database.Device, error) {
+	households, err := EnabledHouseholds(ctx, s.DB, protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := s.DB.ListDevicesByProtocol(ctx, protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := []database.Device{}
+	for _, device := range devices {
+		if households[device.HouseholdID] {
+			enabled = append(enabled, device)
+		}
+	}
+	return enabled, nil
+}
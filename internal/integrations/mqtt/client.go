@@ -0,0 +1,384 @@
+// Package mqtt connects devices with the mqtt protocol to an MQTT broker. It
+// subscribes to the state topics of every device, turning payloads into
+// device state, and publishes commands to their command topics. Devices that
+// announce themselves with Home Assistant MQTT discovery are parsed into
+// devices with ParseDiscovery, and created by the Integration.
+package mqtt
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	DefaultClientID   = "home_assist"
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+
+	connectTimeout = 10 * time.Second
+)
+
+// ErrNotConnected is returned by Publish while the broker is unreachable.
+var ErrNotConnected = errors.New("not connected to the MQTT broker")
+
+type Config struct {
+	Broker     string // URL such as tcp://localhost:1883 or ssl://broker:8883
+	ClientID   string
+	Username   string
+	Password   string
+	QoS        byte // 0, 1 or 2, used for subscriptions and commands
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Store is the data the client needs, implemented by *database.DB.
+type Store interface {
+	ListDevicesByProtocol(ctx context.Context, protocol string) ([]database.Device, error)
+}
+
+// StateFunc receives the state a device reported. Only the attributes found
+// in the payload are set.
+type StateFunc func(ctx context.Context, device database.Device, state database.DeviceState)
+
+// MessageFunc receives a message on a topic subscribed to with Subscribe.
+type MessageFunc func(ctx context.Context, topic string, payload []byte)
+
+type subscriber struct {
+	device  database.Device
+	mapping *mapping
+}
+
+type Client struct {
+	cfg     Config
+	store   Store
+	onState StateFunc
+	logger  *slog.Logger
+	reload  chan struct{}
+
+	mu          sync.Mutex
+	ctx         context.Context // Passed to onState, the ctx given to Run
+	conn        paho.Client     // nil while disconnected
+	subscribers map[string][]subscriber
+	handlers    map[string]MessageFunc
+	subscribed  map[string]bool
+}
+
+func New(cfg Config, store Store, onState StateFunc, logger *slog.Logger) *Client {
+	cfg.ClientID = cmp.Or(cfg.ClientID, DefaultClientID)
+	cfg.MinBackoff = cmp.Or(cfg.MinBackoff, DefaultMinBackoff)
+	cfg.MaxBackoff = max(cmp.Or(cfg.MaxBackoff, DefaultMaxBackoff), cfg.MinBackoff)
+
+	return &Client{
+		cfg:         cfg,
+		store:       store,
+		onState:     onState,
+		logger:      logger,
+		reload:      make(chan struct{}, 1),
+		ctx:         context.Background(),
+		subscribers: map[string][]subscriber{},
+		handlers:    map[string]MessageFunc{},
+		subscribed:  map[string]bool{},
+	}
+}
+
+// Reload makes the client read the devices again and update its
+// subscriptions, after a device has been saved or deleted. It does not block.
+func (c *Client) Reload() {
+	select {
+	case c.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Subscribe calls fn with every message on the topics matching filter, which
+// may contain wildcards. The subscription is kept across reconnects.
+func (c *Client) Subscribe(filter string, fn MessageFunc) {
+	c.mu.Lock()
+	c.handlers[filter] = fn
+	c.mu.Unlock()
+
+	c.Reload()
+}
+
+// Unsubscribe stops calling the function subscribed to filter. Subscribing
+// to it again receives its retained messages again.
+func (c *Client) Unsubscribe(filter string) {
+	c.mu.Lock()
+	delete(c.handlers, filter)
+	c.mu.Unlock()
+
+	c.Reload()
+}
+
+// Run keeps the client connected until ctx is cancelled, reconnecting with
+// exponential backoff when the broker is unreachable.
+func (c *Client) Run(ctx context.Context) error {
+	c.mu.Lock()
+	c.ctx = ctx
+	c.mu.Unlock()
+
+	backoff := c.cfg.MinBackoff
+
+	for {
+		conn, lost, err := c.connect(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			c.logger.Warn("failed to connect to MQTT broker", "broker", c.cfg.Broker, "error", err, "retry_in", backoff)
+		} else {
+			c.logger.Info("connected to MQTT broker", "broker", c.cfg.Broker)
+			backoff = c.cfg.MinBackoff
+			c.sync(ctx)
+
+			err = c.serve(ctx, lost)
+			c.setConn(nil)
+			if err == nil {
+				conn.Disconnect(250)
+				return nil
+			}
+			c.logger.Warn("lost connection to MQTT broker", "broker", c.cfg.Broker, "error", err, "retry_in", backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, c.cfg.MaxBackoff)
+	}
+}
+
+// serve handles reloads until ctx is cancelled, returning nil, or the
+// connection is lost.
+func (c *Client) serve(ctx context.Context, lost <-chan error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.reload:
+			c.sync(ctx)
+		case err := <-lost:
+			return err
+		}
+	}
+}
+
+func (c *Client) connect(ctx context.Context) (paho.Client, <-chan error, error) {
+	lost := make(chan error, 1)
+
+	opts := paho.NewClientOptions().
+		AddBroker(c.cfg.Broker).
+		SetClientID(c.cfg.ClientID).
+		SetUsername(c.cfg.Username).
+		SetPassword(c.cfg.Password).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetConnectTimeout(connectTimeout).
+		// Subscriptions have no handler of their own, so that a message
+		// matching several of them is still handled once
+		SetDefaultPublishHandler(c.handle).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			select {
+			case lost <- err:
+			default:
+			}
+		})
+
+	conn := paho.NewClient(opts)
+	err := wait(ctx, conn.Connect())
+	if err != nil {
+		conn.Disconnect(0)
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	// A clean session starts without subscriptions
+	c.subscribed = map[string]bool{}
+	c.mu.Unlock()
+
+	return conn, lost, nil
+}
+
+func (c *Client) setConn(conn paho.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+}
+
+// sync loads the devices and subscribes to the state topics and filters that
+// are new since the last sync, unsubscribing from those no longer used.
+func (c *Client) sync(ctx context.Context) {
+	devices, err := c.store.ListDevicesByProtocol(ctx, Protocol)
+	if err != nil {
+		c.logger.Error("failed to load MQTT devices", "error", err)
+		return
+	}
+
+	subscribers := map[string][]subscriber{}
+	for _, device := range devices {
+		m, err := deviceMapping(&device)
+		if err != nil {
+			c.logger.Warn("MQTT device not subscribed", "device_id", device.ID, "error", err)
+			continue
+		}
+		for _, topic := range m.stateTopics() {
+			subscribers[topic] = append(subscribers[topic], subscriber{device: device, mapping: m})
+		}
+	}
+
+	c.mu.Lock()
+	conn := c.conn
+	c.subscribers = subscribers
+
+	filters := map[string]byte{}
+	for topic := range subscribers {
+		if !c.subscribed[topic] {
+			filters[topic] = c.cfg.QoS
+		}
+	}
+	for filter := range c.handlers {
+		if !c.subscribed[filter] {
+			filters[filter] = c.cfg.QoS
+		}
+	}
+	var stale []string
+	for topic := range c.subscribed {
+		_, device := subscribers[topic]
+		_, handler := c.handlers[topic]
+		if !device && !handler {
+			stale = append(stale, topic)
+		}
+	}
+	c.mu.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	if len(stale) > 0 {
+		err := wait(ctx, conn.Unsubscribe(stale...))
+		if err != nil {
+			c.logger.Warn("failed to unsubscribe from MQTT topics", "topics", stale, "error", err)
+		}
+		c.mu.Lock()
+		for _, topic := range stale {
+			delete(c.subscribed, topic)
+		}
+		c.mu.Unlock()
+	}
+
+	if len(filters) > 0 {
+		err := wait(ctx, conn.SubscribeMultiple(filters, nil))
+		if err != nil {
+			c.logger.Error("failed to subscribe to MQTT topics", "topics", len(filters), "error", err)
+			return
+		}
+		c.mu.Lock()
+		for topic := range filters {
+			c.subscribed[topic] = true
+		}
+		c.mu.Unlock()
+	}
+}
+
+// handle passes the state in a message to every device using the topic, and
+// the message to the handlers of the filters it matches.
+func (c *Client) handle(_ paho.Client, msg paho.Message) {
+	c.mu.Lock()
+	subscribers := c.subscribers[msg.Topic()]
+	var handlers []MessageFunc
+	for filter, fn := range c.handlers {
+		if match(filter, msg.Topic()) {
+			handlers = append(handlers, fn)
+		}
+	}
+	ctx := c.ctx
+	c.mu.Unlock()
+
+	for _, fn := range handlers {
+		fn(ctx, msg.Topic(), msg.Payload())
+	}
+
+	for _, s := range subscribers {
+		state := s.mapping.state(msg.Topic(), msg.Payload())
+		if len(state) == 0 {
+			c.logger.Debug("MQTT message has no device state", "device_id", s.device.ID, "topic", msg.Topic())
+			continue
+		}
+		c.onState(ctx, s.device, state)
+	}
+}
+
+// Publish sends a command asking device to change to state. It does not wait
+// for the device to report its new state.
+func (c *Client) Publish(ctx context.Context, device *database.Device, state database.DeviceState) error {
+	m, err := deviceMapping(device)
+	if err != nil {
+		return err
+	}
+
+	messages, err := m.commands(state)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		err := c.PublishMessage(ctx, msg.topic, m.retain, msg.payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PublishMessage publishes a payload to a topic.
+func (c *Client) PublishMessage(ctx context.Context, topic string, retain bool, payload []byte) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	return wait(ctx, conn.Publish(topic, c.cfg.QoS, retain, payload))
+}
+
+// match reports whether a topic matches a subscription filter.
+func match(filter, topic string) bool {
+	levels := strings.Split(topic, "/")
+	filterLevels := strings.Split(filter, "/")
+	for i, level := range filterLevels {
+		switch {
+		case level == "#":
+			return true
+		case i >= len(levels):
+			return false
+		case level != "+" && level != levels[i]:
+			return false
+		}
+	}
+	return len(filterLevels) == len(levels)
+}
+
+// wait blocks until the token completes or ctx is cancelled.
+func wait(ctx context.Context, token paho.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,269 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+type fakeStore struct {
+	mu      sync.Mutex
+	devices []database.Device
+}
+
+func (s *fakeStore) ListDevicesByProtocol(ctx context.Context, protocol string) ([]database.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.devices, nil
+}
+
+type reported struct {
+	deviceID int64
+	state    database.DeviceState
+}
+
+// newBroker starts an in-process broker as a stand-in for a real one.
+func newBroker(t *testing.T, address string) (*server.Server, string) {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	broker := server.New(&server.Options{InlineClient: true, Logger: logger})
+
+	err := broker.AddHook(new(auth.AllowHook), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: address})
+	err = broker.AddListener(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return broker, tcp.Address()
+}
+
+func receive(t *testing.T, ch <-chan reported) reported {
+	t.Helper()
+
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for device state")
+		return reported{}
+	}
+}
+
+// eventually retries fn until it succeeds, as the client notices a lost
+// connection asynchronously.
+func eventually(t *testing.T, fn func() error) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestClient(t *testing.T) {
+	broker, address := newBroker(t, "127.0.0.1:0")
+
+	lamp := database.Device{ID: 1, Kind: "light", Address: "zigbee2mqtt/lamp", Capabilities: []string{"on_off", "brightness"}}
+	store := &fakeStore{devices: []database.Device{lamp}}
+
+	states := make(chan reported, 10)
+	onState := func(ctx context.Context, device database.Device, state database.DeviceState) {
+		states <- reported{device.ID, state}
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	client := New(Config{Broker: "tcp://" + address, QoS: 1, MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}, store, onState, logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- client.Run(ctx) }()
+
+	// Retained state is delivered when the client subscribes
+	err := broker.Publish("zigbee2mqtt/lamp", []byte(`{"state": "ON", "brightness": 40}`), true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := receive(t, states)
+	if r.deviceID != 1 || r.state["on"] != true || r.state["brightness"] != 40.0 {
+		t.Errorf("unexpected state %+v", r)
+	}
+
+	// Commands are published to the command topic
+	commands := make(chan string, 10)
+	err = broker.Subscribe("zigbee2mqtt/lamp/set", 1, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		commands <- string(pk.Payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Publish(ctx, &lamp, database.DeviceState{"on": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case payload := <-commands:
+		if payload != `{"state":"OFF"}` {
+			t.Errorf("unexpected command %s", payload)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the command")
+	}
+
+	// A device added while running is subscribed after a reload
+	store.mu.Lock()
+	store.devices = append(store.devices, database.Device{ID: 2, Kind: "sensor", Address: "sensors/hall", Capabilities: []string{"temperature"}})
+	store.mu.Unlock()
+	client.Reload()
+
+	err = broker.Publish("sensors/hall", []byte(`{"temperature": 21.5}`), true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = receive(t, states)
+	if r.deviceID != 2 || r.state["temperature"] != 21.5 {
+		t.Errorf("unexpected state %+v", r)
+	}
+
+	// Handlers receive each message matching their filter once, alongside
+	// the devices using the topic
+	messages := make(chan string, 10)
+	handler := func(ctx context.Context, topic string, payload []byte) {
+		messages <- topic + " " + string(payload)
+	}
+	client.Subscribe("sensors/#", handler)
+
+	select {
+	case msg := <-messages:
+		if msg != `sensors/hall {"temperature": 21.5}` {
+			t.Errorf("unexpected message %q", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+	r = receive(t, states)
+	if r.deviceID != 2 {
+		t.Errorf("unexpected state %+v", r)
+	}
+	select {
+	case msg := <-messages:
+		t.Errorf("expected the message once, got %q again", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Handlers subscribed again receive the retained messages again
+	client.Unsubscribe("sensors/#")
+	eventually(t, func() error {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		if client.subscribed["sensors/#"] {
+			return errors.New("expected the filter to be unsubscribed from")
+		}
+		return nil
+	})
+	client.Subscribe("sensors/#", handler)
+
+	select {
+	case msg := <-messages:
+		if msg != `sensors/hall {"temperature": 21.5}` {
+			t.Errorf("unexpected message %q", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the retained message")
+	}
+	r = receive(t, states)
+	if r.deviceID != 2 {
+		t.Errorf("unexpected state %+v", r)
+	}
+
+	// The client reconnects and resubscribes when the broker restarts
+	err = broker.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, func() error {
+		err := client.Publish(ctx, &lamp, database.DeviceState{"on": true})
+		if !errors.Is(err, ErrNotConnected) {
+			return fmt.Errorf("expected ErrNotConnected, got %v", err)
+		}
+		return nil
+	})
+
+	broker, _ = newBroker(t, address)
+	defer broker.Close()
+
+	err = broker.Publish("zigbee2mqtt/lamp", []byte(`{"state": "OFF"}`), true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = receive(t, states)
+	if r.deviceID != 1 || r.state["on"] != false {
+		t.Errorf("unexpected state %+v", r)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return when ctx is cancelled")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"homeassistant/#", "homeassistant/light/lamp/config", true},
+		{"homeassistant/#", "homeassistant", true},
+		{"households/+/homeassistant/#", "households/1/homeassistant/switch/plug/config", true},
+		{"households/+/homeassistant/#", "households/1/zigbee2mqtt/lamp", false},
+		{"sensors/+", "sensors/hall", true},
+		{"sensors/+", "sensors/hall/temperature", false},
+		{"sensors/hall", "sensors/hall", true},
+		{"sensors/hall", "sensors", false},
+	}
+
+	for _, tt := range tests {
+		if got := match(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("match(%q, %q): expected %t, got %t", tt.filter, tt.topic, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,519 @@
+package mqtt
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/broker"
+	"github.com/wumbabum/home_assist/internal/color"
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+// Protocol is the device protocol handled by this package.
+const Protocol = "mqtt"
+
+// DeviceConfig describes how a device's state and commands map to topics and
+// payloads. It is stored in database.Device.Config and every field is
+// optional, a device with only an address reads {"state": "ON"} style JSON
+// from the address and publishes commands to address/set.
+type DeviceConfig struct {
+	// StateTopic is where the device reports its state, the device address
+	// by default.
+	StateTopic string `json:"state_topic,omitempty"`
+
+	// CommandTopic is where commands are published, the state topic followed
+	// by /set by default.
+	CommandTopic string `json:"command_topic,omitempty"`
+
+	// Attributes maps state attributes to where they are found in the
+	// payloads, for example {"temperature": "$.sensors[0].value"}. "$" is the
+	// whole payload, for devices that publish a bare value. Attributes
+	// default to "$.<attribute>", except on which defaults to "$.state".
+	Attributes map[string]Attribute `json:"attributes,omitempty"`
+
+	// PayloadOn and PayloadOff are the values of on and the other boolean
+	// attributes, such as motion and locked, "ON" and "OFF" by default. A
+	// boolean payload is always understood.
+	PayloadOn  string `json:"payload_on,omitempty"`
+	PayloadOff string `json:"payload_off,omitempty"`
+
+	// BrightnessScale is the device's maximum brightness, such as 254 for
+	// Zigbee lights, 100 by default. Brightness is stored as a percentage.
+	BrightnessScale float64 `json:"brightness_scale,omitempty"`
+
+	// ColorFormat is how colors are published, "hex" strings such as
+	// "#ff8800" by default or "rgb" objects such as {"r": 255, "g": 136,
+	// "b": 0}. Both are understood in state payloads.
+	ColorFormat string `json:"color_format,omitempty"`
+
+	// ColorTemperatureUnit is the unit of color temperatures in payloads,
+	// "kelvin" by default or "mired" as used by Zigbee. Color temperature is
+	// stored in kelvin.
+	ColorTemperatureUnit string `json:"color_temperature_unit,omitempty"`
+
+	// Retain publishes commands as retained messages.
+	Retain bool `json:"retain,omitempty"`
+
+	// DiscoveryTopic is the Home Assistant discovery topic the device was
+	// announced on, for devices created by discovery.
+	DiscoveryTopic string `json:"discovery_topic,omitempty"`
+
+	// Metadata is kept for the integration that created the device, such as
+	// the IEEE address of a Zigbee2MQTT device, and is not used here.
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+// Attribute is where a state attribute is found. In JSON it is either just
+// the path, or an object for attributes with topics of their own, as in
+// {"path": "$.POWER", "state_topic": "stat/plug/RESULT",
+// "command_topic": "cmnd/plug/POWER", "command_path": "$"}.
+type Attribute struct {
+	Path         string `json:"path,omitempty"`
+	StateTopic   string `json:"state_topic,omitempty"`   // The device's state topic by default
+	CommandTopic string `json:"command_topic,omitempty"` // The device's command topic by default
+	CommandPath  string `json:"command_path,omitempty"`  // Path by default
+	PayloadOn    string `json:"payload_on,omitempty"`    // The device's payload_on by default
+	PayloadOff   string `json:"payload_off,omitempty"`   // The device's payload_off by default
+}
+
+func (a *Attribute) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*a = Attribute{Path: s}
+		return nil
+	}
+
+	// The decoder's options do not reach custom unmarshalers
+	type plain Attribute
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(a))
+}
+
+func (a Attribute) MarshalJSON() ([]byte, error) {
+	if a == (Attribute{Path: a.Path}) {
+		return json.Marshal(a.Path)
+	}
+	type plain Attribute
+	return json.Marshal(plain(a))
+}
+
+// Topics returns every topic set in the config, so that they can be checked
+// before the config is saved.
+func (c DeviceConfig) Topics() []string {
+	var topics []string
+	for _, topic := range []string{c.StateTopic, c.CommandTopic} {
+		if topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	for _, a := range c.Attributes {
+		for _, topic := range []string{a.StateTopic, a.CommandTopic} {
+			if topic != "" {
+				topics = append(topics, topic)
+			}
+		}
+	}
+	return topics
+}
+
+// TopicError is returned by CheckHouseholdTopics for a topic outside the
+// household's.
+type TopicError struct {
+	Topic          string
+	HouseholdTopic string // The prefix the topic must have, with a trailing /
+}
+
+func (e *TopicError) Error() string {
+	return fmt.Sprintf("topic %s must be below %s", e.Topic, e.HouseholdTopic)
+}
+
+// CheckHouseholdTopics returns a *TopicError unless the address and every
+// topic of cfg are below the household's topic on the embedded broker. The
+// server's client reads and writes every household's topics, so a
+// household's devices must stay within its own.
+func CheckHouseholdTopics(householdID int64, cfg DeviceConfig, address string) error {
+	householdTopic := broker.HouseholdTopic(householdID) + "/"
+
+	topics := cfg.Topics()
+	if address != "" {
+		topics = append([]string{address}, topics...)
+	}
+	for _, topic := range topics {
+		if !strings.HasPrefix(topic, householdTopic) {
+			return &TopicError{Topic: topic, HouseholdTopic: householdTopic}
+		}
+	}
+	return nil
+}
+
+// capabilityAttributes maps capabilities to the state attribute they report.
+var capabilityAttributes = map[string]string{
+	"on_off": "on",
+	"lock":   "locked",
+}
+
+// booleanAttributes are parsed with the device's payload_on and payload_off.
+var booleanAttributes = map[string]bool{
+	"on":       true,
+	"motion":   true,
+	"contact":  true,
+	"presence": true,
+	"locked":   true,
+}
+
+// mapping is a parsed DeviceConfig, resolved against the device it belongs to.
+type mapping struct {
+	attributes      map[string]attribute
+	brightnessScale float64
+	colorFormat     string
+	mireds          bool
+	retain          bool
+}
+
+type attribute struct {
+	stateTopic   string
+	path         path
+	commandTopic string
+	commandPath  path
+	payloadOn    string
+	payloadOff   string
+}
+
+// message is a payload to publish.
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// ParseDeviceConfig decodes and validates the MQTT settings of a device.
+func ParseDeviceConfig(device *database.Device) (DeviceConfig, error) {
+	cfg, err := decodeConfig(device)
+	if err != nil {
+		return cfg, err
+	}
+
+	_, err = newMapping(device, cfg)
+	return cfg, err
+}
+
+func deviceMapping(device *database.Device) (*mapping, error) {
+	cfg, err := decodeConfig(device)
+	if err != nil {
+		return nil, err
+	}
+	return newMapping(device, cfg)
+}
+
+func decodeConfig(device *database.Device) (DeviceConfig, error) {
+	var cfg DeviceConfig
+
+	js, err := json.Marshal(device.Config)
+	if err != nil {
+		return cfg, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid MQTT config: %w", err)
+	}
+	return cfg, nil
+}
+
+// EncodeDeviceConfig converts cfg to the form stored in database.Device.
+func EncodeDeviceConfig(cfg DeviceConfig) (database.DeviceConfig, error) {
+	js, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var config database.DeviceConfig
+	err = json.Unmarshal(js, &config)
+	return config, err
+}
+
+func newMapping(device *database.Device, cfg DeviceConfig) (*mapping, error) {
+	m := &mapping{
+		attributes:      map[string]attribute{},
+		brightnessScale: cfg.BrightnessScale,
+		colorFormat:     cmp.Or(cfg.ColorFormat, "hex"),
+		retain:          cfg.Retain,
+	}
+
+	stateTopic := cmp.Or(cfg.StateTopic, device.Address)
+	if stateTopic == "" {
+		return nil, errors.New("an address or state_topic is required")
+	}
+	commandTopic := cmp.Or(cfg.CommandTopic, stateTopic+"/set")
+
+	if m.brightnessScale == 0 {
+		m.brightnessScale = 100
+	}
+	if m.brightnessScale < 0 {
+		return nil, errors.New("brightness_scale must be positive")
+	}
+	if m.colorFormat != "hex" && m.colorFormat != "rgb" {
+		return nil, errors.New(`color_format must be "hex" or "rgb"`)
+	}
+	switch cfg.ColorTemperatureUnit {
+	case "", "kelvin":
+	case "mired":
+		m.mireds = true
+	default:
+		return nil, errors.New(`color_temperature_unit must be "kelvin" or "mired"`)
+	}
+
+	names := map[string]bool{}
+	for _, capability := range device.Capabilities {
+		attr := capability
+		if a, ok := capabilityAttributes[capability]; ok {
+			attr = a
+		}
+		names[attr] = true
+	}
+	if device.Kind == "thermostat" {
+		names["target_temperature"] = true
+	}
+	for attr := range cfg.Attributes {
+		names[attr] = true
+	}
+
+	topics := []string{stateTopic, commandTopic}
+	for attr := range names {
+		a := cfg.Attributes[attr]
+
+		p := path{attr}
+		if attr == "on" {
+			p = path{"state"}
+		}
+		if a.Path != "" {
+			var err error
+			p, err = parsePath(a.Path)
+			if err != nil {
+				return nil, fmt.Errorf("attribute %s: %w", attr, err)
+			}
+		}
+
+		commandPath := p
+		if a.CommandPath != "" {
+			var err error
+			commandPath, err = parsePath(a.CommandPath)
+			if err != nil {
+				return nil, fmt.Errorf("attribute %s: %w", attr, err)
+			}
+		}
+
+		m.attributes[attr] = attribute{
+			stateTopic:   cmp.Or(a.StateTopic, stateTopic),
+			path:         p,
+			commandTopic: cmp.Or(a.CommandTopic, commandTopic),
+			commandPath:  commandPath,
+			payloadOn:    cmp.Or(a.PayloadOn, cfg.PayloadOn, "ON"),
+			payloadOff:   cmp.Or(a.PayloadOff, cfg.PayloadOff, "OFF"),
+		}
+		topics = append(topics, a.StateTopic, a.CommandTopic)
+	}
+
+	for _, topic := range topics {
+		if strings.ContainsAny(topic, "+#") {
+			return nil, errors.New("topics must not contain the wildcards + or #")
+		}
+	}
+
+	return m, nil
+}
+
+// stateTopics returns the topics the device reports its attributes on.
+func (m *mapping) stateTopics() []string {
+	var topics []string
+	for _, a := range m.attributes {
+		if !slices.Contains(topics, a.stateTopic) {
+			topics = append(topics, a.stateTopic)
+		}
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+// state extracts the attributes reported on topic from a state payload.
+// Payloads that are not JSON are treated as a single string value.
+func (m *mapping) state(topic string, payload []byte) database.DeviceState {
+	var doc any
+	err := json.Unmarshal(payload, &doc)
+	if err != nil {
+		doc = string(payload)
+	}
+
+	state := database.DeviceState{}
+	for attr, a := range m.attributes {
+		if a.stateTopic != topic {
+			continue
+		}
+
+		value, ok := a.path.get(doc)
+		if !ok || value == nil {
+			continue
+		}
+
+		switch {
+		case booleanAttributes[attr]:
+			value, ok = a.parseBool(value)
+		case attr == "brightness":
+			var n float64
+			n, ok = value.(float64)
+			value = math.Round(min(max(n/m.brightnessScale*100, 0), 100))
+		case attr == "color":
+			value, ok = parseColor(value)
+		case attr == "color_temperature" && m.mireds:
+			var n float64
+			n, ok = value.(float64)
+			ok = ok && n > 0
+			value = convertMireds(n)
+		}
+		if !ok {
+			continue
+		}
+
+		state[attr] = value
+	}
+	return state
+}
+
+func (a *attribute) parseBool(value any) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		switch {
+		case strings.EqualFold(v, a.payloadOn):
+			return true, true
+		case strings.EqualFold(v, a.payloadOff):
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// parseColor returns a color as a hex string, from a hex string, an object of
+// r, g and b values or a CIE 1931 x and y chromaticity, as Zigbee lights
+// report.
+func parseColor(value any) (string, bool) {
+	v, ok := value.(map[string]any)
+	if !ok {
+		s, ok := value.(string)
+		return s, ok
+	}
+
+	r, rok := v["r"].(float64)
+	g, gok := v["g"].(float64)
+	b, bok := v["b"].(float64)
+	if rok && gok && bok {
+		return fmt.Sprintf("#%02x%02x%02x", int(r), int(g), int(b)), true
+	}
+
+	x, xok := v["x"].(float64)
+	y, yok := v["y"].(float64)
+	if xok && yok && y > 0 {
+		return color.XYToHex(color.XY{X: x, Y: y}), true
+	}
+	return "", false
+}
+
+// convertMireds converts between mireds and kelvin, the conversion being its
+// own inverse.
+func convertMireds(n float64) float64 {
+	return math.Round(1e6 / n)
+}
+
+// commands builds the payloads that ask the device to change to state, one
+// for each command topic used. Attributes without a mapping are rejected.
+func (m *mapping) commands(state database.DeviceState) ([]message, error) {
+	docs := map[string]map[string]any{}
+	raws := map[string]any{}
+
+	for attr, value := range state {
+		a, ok := m.attributes[attr]
+		if !ok {
+			return nil, fmt.Errorf("no MQTT mapping for %s", attr)
+		}
+
+		switch {
+		case booleanAttributes[attr]:
+			on, _ := value.(bool)
+			value = a.payloadOff
+			if on {
+				value = a.payloadOn
+			}
+		case attr == "brightness":
+			if n, ok := value.(float64); ok {
+				value = math.Round(n / 100 * m.brightnessScale)
+			}
+		case attr == "color" && m.colorFormat == "rgb":
+			var r, g, b int
+			if s, ok := value.(string); ok {
+				if _, err := fmt.Sscanf(s, "#%02x%02x%02x", &r, &g, &b); err == nil {
+					value = map[string]any{"r": r, "g": g, "b": b}
+				}
+			}
+		case attr == "color_temperature" && m.mireds:
+			if n, ok := value.(float64); ok && n > 0 {
+				value = convertMireds(n)
+			}
+		}
+
+		if len(a.commandPath) == 0 {
+			if _, ok := raws[a.commandTopic]; ok {
+				return nil, errors.New("only one attribute can be published as the whole payload")
+			}
+			raws[a.commandTopic] = value
+			continue
+		}
+
+		doc, ok := docs[a.commandTopic]
+		if !ok {
+			doc = map[string]any{}
+			docs[a.commandTopic] = doc
+		}
+		err := a.commandPath.set(doc, value)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", attr, err)
+		}
+	}
+
+	var messages []message
+	for topic, raw := range raws {
+		if _, ok := docs[topic]; ok {
+			return nil, errors.New("cannot publish the whole payload together with other attributes")
+		}
+
+		payload, ok := raw.(string)
+		if !ok {
+			js, err := json.Marshal(raw)
+			if err != nil {
+				return nil, err
+			}
+			payload = string(js)
+		}
+		messages = append(messages, message{topic: topic, payload: []byte(payload)})
+	}
+	for topic, doc := range docs {
+		payload, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message{topic: topic, payload: payload})
+	}
+
+	slices.SortFunc(messages, func(a, b message) int {
+		return strings.Compare(a.topic, b.topic)
+	})
+	return messages, nil
+}
@@ -0,0 +1,446 @@
+package mqtt
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+func TestPath(t *testing.T) {
+	var doc any
+	err := json.Unmarshal([]byte(`{"state": "ON", "color": {"hex": "#ff8800"}, "channels": [{"power": 12.5}]}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		want  any
+		found bool
+	}{
+		{path: "$.state", want: "ON", found: true},
+		{path: "$.color.hex", want: "#ff8800", found: true},
+		{path: "$.channels[0].power", want: 12.5, found: true},
+		{path: "$.channels[1].power"},
+		{path: "$.missing"},
+		{path: "$.state.nested"},
+		{path: "$", want: doc, found: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			p, err := parsePath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, found := p.get(doc)
+			if found != tt.found || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v (%t), got %v (%t)", tt.want, tt.found, got, found)
+			}
+		})
+	}
+
+	for _, invalid := range []string{"state", "$.", "$..state", "$[x]", "$[-1]", "$[0", "$state"} {
+		_, err := parsePath(invalid)
+		if err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestParseDeviceConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		device database.Device
+		valid  bool
+	}{
+		{
+			name:   "Address only",
+			device: database.Device{Address: "zigbee2mqtt/lamp"},
+			valid:  true,
+		},
+		{
+			name: "Topics and attributes",
+			device: database.Device{Config: database.DeviceConfig{
+				"state_topic":   "shellies/plug/relay/0",
+				"command_topic": "shellies/plug/relay/0/command",
+				"attributes":    map[string]any{"on": "$"},
+				"payload_on":    "on",
+				"payload_off":   "off",
+			}},
+			valid: true,
+		},
+		{
+			name:   "No topic",
+			device: database.Device{},
+		},
+		{
+			name:   "Wildcard",
+			device: database.Device{Address: "sensors/+/temperature"},
+		},
+		{
+			name:   "Unknown field",
+			device: database.Device{Address: "lamp", Config: database.DeviceConfig{"topic": "lamp"}},
+		},
+		{
+			name:   "Invalid path",
+			device: database.Device{Address: "lamp", Config: database.DeviceConfig{"attributes": map[string]any{"on": "state"}}},
+		},
+		{
+			name: "Attribute topics",
+			device: database.Device{Address: "tasmota/plug", Config: database.DeviceConfig{
+				"attributes": map[string]any{"on": map[string]any{
+					"path":          "$.POWER",
+					"state_topic":   "stat/plug/RESULT",
+					"command_topic": "cmnd/plug/POWER",
+					"command_path":  "$",
+				}},
+			}},
+			valid: true,
+		},
+		{
+			name:   "Unknown attribute field",
+			device: database.Device{Address: "lamp", Config: database.DeviceConfig{"attributes": map[string]any{"on": map[string]any{"topic": "lamp"}}}},
+		},
+		{
+			name:   "Attribute wildcard",
+			device: database.Device{Address: "lamp", Config: database.DeviceConfig{"attributes": map[string]any{"on": map[string]any{"state_topic": "lamp/#"}}}},
+		},
+		{
+			name:   "Unknown color format",
+			device: database.Device{Address: "lamp", Config: database.DeviceConfig{"color_format": "hsv"}},
+		},
+		{
+			name:   "Negative brightness scale",
+			device: database.Device{Address: "lamp", Config: database.DeviceConfig{"brightness_scale": -1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseDeviceConfig(&tt.device)
+			if tt.valid && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestMappingState(t *testing.T) {
+	light := &database.Device{
+		Kind:         "light",
+		Address:      "zigbee2mqtt/lamp",
+		Capabilities: []string{"on_off", "brightness", "color"},
+		Config: database.DeviceConfig{
+			"brightness_scale": 254,
+			"attributes":       map[string]any{"color": "$.color.hex"},
+		},
+	}
+	plug := &database.Device{
+		Kind:         "outlet",
+		Address:      "shellies/plug/relay/0",
+		Capabilities: []string{"on_off"},
+		Config:       database.DeviceConfig{"attributes": map[string]any{"on": "$"}, "payload_on": "on", "payload_off": "off"},
+	}
+	thermostat := &database.Device{
+		Kind:         "thermostat",
+		Address:      "thermostat/current",
+		Capabilities: []string{"temperature"},
+		Config: database.DeviceConfig{"attributes": map[string]any{
+			"temperature":        "$",
+			"target_temperature": map[string]any{"path": "$.target", "state_topic": "thermostat/target"},
+		}},
+	}
+	strip := &database.Device{
+		Kind:         "light",
+		Address:      "strip",
+		Capabilities: []string{"color"},
+	}
+	bulb := &database.Device{
+		Kind:         "light",
+		Address:      "zigbee2mqtt/bulb",
+		Capabilities: []string{"color", "color_temperature"},
+		Config:       database.DeviceConfig{"color_temperature_unit": "mired", "attributes": map[string]any{"color_temperature": "$.color_temp"}},
+	}
+	lock := &database.Device{
+		Kind:         "lock",
+		Address:      "zigbee2mqtt/door",
+		Capabilities: []string{"lock"},
+		Config:       database.DeviceConfig{"attributes": map[string]any{"locked": map[string]any{"path": "$.state", "payload_on": "LOCK", "payload_off": "UNLOCK"}}},
+	}
+	motion := &database.Device{
+		Kind:         "sensor",
+		Address:      "zigbee2mqtt/hallway",
+		Capabilities: []string{"motion"},
+		Config:       database.DeviceConfig{"attributes": map[string]any{"motion": "$.occupancy"}},
+	}
+
+	tests := []struct {
+		name    string
+		device  *database.Device
+		topic   string
+		payload string
+		want    database.DeviceState
+	}{
+		{
+			name:    "JSON payload",
+			device:  light,
+			payload: `{"state": "ON", "brightness": 127, "color": {"hex": "#ff8800"}, "linkquality": 120}`,
+			want:    database.DeviceState{"on": true, "brightness": 50.0, "color": "#ff8800"},
+		},
+		{
+			name:    "Partial payload",
+			device:  light,
+			payload: `{"state": "off"}`,
+			want:    database.DeviceState{"on": false},
+		},
+		{
+			name:    "Boolean on",
+			device:  light,
+			payload: `{"state": true}`,
+			want:    database.DeviceState{"on": true},
+		},
+		{
+			name:    "Unknown on value",
+			device:  light,
+			payload: `{"state": "TOGGLE"}`,
+			want:    database.DeviceState{},
+		},
+		{
+			name:    "Bare payload",
+			device:  plug,
+			payload: `on`,
+			want:    database.DeviceState{"on": true},
+		},
+		{
+			name:    "RGB color",
+			device:  strip,
+			payload: `{"color": {"r": 255, "g": 136, "b": 0}}`,
+			want:    database.DeviceState{"color": "#ff8800"},
+		},
+		{
+			name:    "XY color",
+			device:  bulb,
+			payload: `{"color": {"x": 0.3127, "y": 0.329}, "color_temp": 250}`,
+			want:    database.DeviceState{"color": "#ffffff", "color_temperature": 4000.0},
+		},
+		{
+			name:    "Attribute payloads",
+			device:  lock,
+			payload: `{"state": "UNLOCK"}`,
+			want:    database.DeviceState{"locked": false},
+		},
+		{
+			name:    "Device topic",
+			device:  thermostat,
+			payload: `21.5`,
+			want:    database.DeviceState{"temperature": 21.5},
+		},
+		{
+			name:    "Attribute topic",
+			device:  thermostat,
+			topic:   "thermostat/target",
+			payload: `{"target": 20}`,
+			want:    database.DeviceState{"target_temperature": 20.0},
+		},
+		{
+			name:    "Boolean attribute",
+			device:  motion,
+			payload: `{"occupancy": "ON", "battery": 80}`,
+			want:    database.DeviceState{"motion": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := deviceMapping(tt.device)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			topic := cmp.Or(tt.topic, tt.device.Address)
+			got := m.state(topic, []byte(tt.payload))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMappingCommand(t *testing.T) {
+	light := &database.Device{
+		Kind:         "light",
+		Address:      "zigbee2mqtt/lamp",
+		Capabilities: []string{"on_off", "brightness", "color"},
+		Config: database.DeviceConfig{
+			"brightness_scale": 254,
+			"attributes":       map[string]any{"color": "$.color.hex"},
+		},
+	}
+	plug := &database.Device{
+		Kind:         "outlet",
+		Address:      "shellies/plug/relay/0",
+		Capabilities: []string{"on_off", "power"},
+		Config:       database.DeviceConfig{"attributes": map[string]any{"on": "$", "power": "$"}, "payload_on": "on", "payload_off": "off"},
+	}
+	// A light with a topic for each attribute, like Home Assistant's default
+	// light schema
+	bulb := &database.Device{
+		Kind:         "light",
+		Address:      "bulb/state",
+		Capabilities: []string{"on_off", "brightness"},
+		Config: database.DeviceConfig{
+			"command_topic":    "bulb/switch",
+			"brightness_scale": 255,
+			"attributes": map[string]any{
+				"on":         "$",
+				"brightness": map[string]any{"path": "$", "state_topic": "bulb/brightness", "command_topic": "bulb/brightness/set"},
+			},
+		},
+	}
+	zigbee := &database.Device{
+		Kind:         "light",
+		Address:      "zigbee2mqtt/bulb",
+		Capabilities: []string{"color_temperature"},
+		Config:       database.DeviceConfig{"color_temperature_unit": "mired", "attributes": map[string]any{"color_temperature": "$.color_temp"}},
+	}
+	lock := &database.Device{
+		Kind:         "lock",
+		Address:      "zigbee2mqtt/door",
+		Capabilities: []string{"lock"},
+		Config:       database.DeviceConfig{"attributes": map[string]any{"locked": map[string]any{"path": "$.state", "payload_on": "LOCK", "payload_off": "UNLOCK"}}},
+	}
+	rgb := &database.Device{
+		Kind:         "light",
+		Address:      "strip",
+		Capabilities: []string{"on_off", "color"},
+		Config:       database.DeviceConfig{"color_format": "rgb"},
+	}
+
+	tests := []struct {
+		name   string
+		device *database.Device
+		state  database.DeviceState
+		want   string
+		valid  bool
+	}{
+		{
+			name:   "JSON command",
+			device: light,
+			state:  database.DeviceState{"on": true, "brightness": 50.0, "color": "#ff8800"},
+			want:   `zigbee2mqtt/lamp/set {"brightness":127,"color":{"hex":"#ff8800"},"state":"ON"}`,
+			valid:  true,
+		},
+		{
+			name:   "Bare command",
+			device: plug,
+			state:  database.DeviceState{"on": false},
+			want:   `shellies/plug/relay/0/set off`,
+			valid:  true,
+		},
+		{
+			name:   "Several topics",
+			device: bulb,
+			state:  database.DeviceState{"on": true, "brightness": 50.0},
+			want:   "bulb/brightness/set 128\nbulb/switch ON",
+			valid:  true,
+		},
+		{
+			name:   "Mireds",
+			device: zigbee,
+			state:  database.DeviceState{"color_temperature": 2700.0},
+			want:   `zigbee2mqtt/bulb/set {"color_temp":370}`,
+			valid:  true,
+		},
+		{
+			name:   "Attribute payloads",
+			device: lock,
+			state:  database.DeviceState{"locked": true},
+			want:   `zigbee2mqtt/door/set {"state":"LOCK"}`,
+			valid:  true,
+		},
+		{
+			name:   "RGB color",
+			device: rgb,
+			state:  database.DeviceState{"on": true, "color": "#ff8800"},
+			want:   `strip/set {"color":{"b":0,"g":136,"r":255},"state":"ON"}`,
+			valid:  true,
+		},
+		{
+			name:   "Unmapped attribute",
+			device: light,
+			state:  database.DeviceState{"position": 50.0},
+		},
+		{
+			name:   "Two bare attributes",
+			device: plug,
+			state:  database.DeviceState{"on": true, "power": 10.0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := deviceMapping(tt.device)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages, err := m.commands(tt.state)
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("expected an error, got %v", messages)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var lines []string
+			for _, msg := range messages {
+				lines = append(lines, msg.topic+" "+string(msg.payload))
+			}
+			if got := strings.Join(lines, "\n"); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckHouseholdTopics(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     DeviceConfig
+		address string
+		topic   string // Of the error, none if empty
+	}{
+		{"within", DeviceConfig{CommandTopic: "households/1/lamp/set"}, "households/1/lamp", ""},
+		{"address outside", DeviceConfig{}, "households/2/lamp", "households/2/lamp"},
+		{"prefix of another household", DeviceConfig{}, "households/10/lamp", "households/10/lamp"},
+		{"attribute outside", DeviceConfig{Attributes: map[string]Attribute{"power": {StateTopic: "power/lamp"}}}, "households/1/lamp", "power/lamp"},
+		{"no address", DeviceConfig{StateTopic: "households/1/lamp"}, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckHouseholdTopics(1, tt.cfg, tt.address)
+
+			var topicErr *TopicError
+			switch {
+			case tt.topic == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tt.topic != "" && (!errors.As(err, &topicErr) || topicErr.Topic != tt.topic):
+				t.Errorf("expected an error for topic %s, got %v", tt.topic, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,460 @@
+package mqtt
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+// DefaultDiscoveryPrefix is the topic Home Assistant discovery payloads are
+// published below, as in homeassistant/light/kitchen/config.
+const DefaultDiscoveryPrefix = "homeassistant"
+
+// ErrUnsupported is returned by ParseDiscovery for components, device classes
+// and templates that have no equivalent here.
+var ErrUnsupported = errors.New("unsupported discovery payload")
+
+// A Discovery is a device announced with Home Assistant MQTT discovery.
+type Discovery struct {
+	Topic        string // The topic the config was published on
+	Name         string
+	Kind         string
+	Capabilities []string
+	Config       DeviceConfig
+}
+
+// discoveryPayload holds the discovery options that are understood. Options
+// for features without an equivalent, such as availability, are ignored.
+type discoveryPayload struct {
+	Name                       any      `json:"name"` // A string, or null for the device's name
+	UniqueID                   string   `json:"unique_id"`
+	StateTopic                 string   `json:"state_topic"`
+	CommandTopic               string   `json:"command_topic"`
+	ValueTemplate              string   `json:"value_template"`
+	StateValueTemplate         string   `json:"state_value_template"`
+	PayloadOn                  any      `json:"payload_on"`
+	PayloadOff                 any      `json:"payload_off"`
+	DeviceClass                string   `json:"device_class"`
+	Schema                     string   `json:"schema"`
+	Brightness                 bool     `json:"brightness"`
+	BrightnessScale            float64  `json:"brightness_scale"`
+	BrightnessStateTopic       string   `json:"brightness_state_topic"`
+	BrightnessCommandTopic     string   `json:"brightness_command_topic"`
+	BrightnessValueTemplate    string   `json:"brightness_value_template"`
+	RGB                        bool     `json:"rgb"`
+	SupportedColorModes        []string `json:"supported_color_modes"`
+	PositionTopic              string   `json:"position_topic"`
+	PositionTemplate           string   `json:"position_template"`
+	SetPositionTopic           string   `json:"set_position_topic"`
+	CurrentTemperatureTopic    string   `json:"current_temperature_topic"`
+	CurrentTemperatureTemplate string   `json:"current_temperature_template"`
+	TemperatureStateTopic      string   `json:"temperature_state_topic"`
+	TemperatureStateTemplate   string   `json:"temperature_state_template"`
+	TemperatureCommandTopic    string   `json:"temperature_command_topic"`
+	Retain                     bool     `json:"retain"`
+	Device                     struct {
+		Name string `json:"name"`
+	} `json:"device"`
+}
+
+// abbreviations are the short option names devices may use to keep their
+// payloads small.
+var abbreviations = map[string]string{
+	"bri_cmd_t":     "brightness_command_topic",
+	"bri_scl":       "brightness_scale",
+	"bri_stat_t":    "brightness_state_topic",
+	"bri_val_tpl":   "brightness_value_template",
+	"cmd_t":         "command_topic",
+	"curr_temp_t":   "current_temperature_topic",
+	"curr_temp_tpl": "current_temperature_template",
+	"dev":           "device",
+	"dev_cla":       "device_class",
+	"pl_off":        "payload_off",
+	"pl_on":         "payload_on",
+	"pos_t":         "position_topic",
+	"pos_tpl":       "position_template",
+	"ret":           "retain",
+	"set_pos_t":     "set_position_topic",
+	"stat_t":        "state_topic",
+	"stat_val_tpl":  "state_value_template",
+	"sup_clrm":      "supported_color_modes",
+	"temp_cmd_t":    "temperature_command_topic",
+	"temp_stat_t":   "temperature_state_topic",
+	"temp_stat_tpl": "temperature_state_template",
+	"uniq_id":       "unique_id",
+	"val_tpl":       "value_template",
+}
+
+// sensorClasses maps the device classes of sensors to capabilities.
+var sensorClasses = map[string]string{
+	"temperature": "temperature",
+	"humidity":    "humidity",
+	"power":       "power",
+	"battery":     "battery",
+}
+
+// binarySensorClasses maps the device classes of binary sensors to
+// capabilities.
+var binarySensorClasses = map[string]string{
+	"motion":      "motion",
+	"occupancy":   "motion",
+	"presence":    "presence",
+	"door":        "contact",
+	"garage_door": "contact",
+	"opening":     "contact",
+	"window":      "contact",
+}
+
+// ParseDiscovery parses a config published on a discovery topic below
+// prefix, such as homeassistant/switch/plug/config or, with a node ID,
+// homeassistant/switch/tasmota_1A2B3C/relay_0/config. Switches, sensors,
+// binary sensors, lights, covers and climate devices are supported.
+func ParseDiscovery(prefix, topic string, payload []byte) (*Discovery, error) {
+	rest, ok := strings.CutPrefix(topic, prefix+"/")
+	levels := strings.Split(rest, "/")
+	if !ok || len(levels) < 3 || len(levels) > 4 || levels[len(levels)-1] != "config" {
+		return nil, fmt.Errorf("%q is not a discovery topic", topic)
+	}
+	component, objectID := levels[0], levels[len(levels)-2]
+
+	var options map[string]any
+	err := json.Unmarshal(payload, &options)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discovery payload: %w", err)
+	}
+	expandOptions(options)
+
+	js, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	var p discoveryPayload
+	err = json.Unmarshal(js, &p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discovery payload: %w", err)
+	}
+
+	d := &Discovery{
+		Topic: topic,
+		Name:  p.name(objectID),
+		Config: DeviceConfig{
+			Attributes:     map[string]Attribute{},
+			PayloadOn:      optionString(p.PayloadOn),
+			PayloadOff:     optionString(p.PayloadOff),
+			Retain:         p.Retain,
+			DiscoveryTopic: topic,
+		},
+	}
+
+	switch component {
+	case "switch":
+		err = p.parseSwitch(d)
+	case "sensor":
+		err = p.parseSensor(d)
+	case "binary_sensor":
+		err = p.parseBinarySensor(d)
+	case "light":
+		err = p.parseLight(d)
+	case "cover":
+		err = p.parseCover(d)
+	case "climate":
+		err = p.parseClimate(d)
+	default:
+		err = fmt.Errorf("%w: component %s", ErrUnsupported, component)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(d.Config.Attributes) == 0 {
+		d.Config.Attributes = nil
+	}
+	return d, nil
+}
+
+// expandOptions replaces abbreviated option names with the full ones, and
+// the ~ at the start or end of a topic with the base topic.
+func expandOptions(options map[string]any) {
+	for short, long := range abbreviations {
+		if v, ok := options[short]; ok {
+			delete(options, short)
+			if _, ok := options[long]; !ok {
+				options[long] = v
+			}
+		}
+	}
+
+	base, _ := options["~"].(string)
+	if base == "" {
+		return
+	}
+	for key, v := range options {
+		topic, ok := v.(string)
+		if !ok || !strings.HasSuffix(key, "_topic") {
+			continue
+		}
+		if after, ok := strings.CutPrefix(topic, "~"); ok {
+			options[key] = base + after
+		} else if before, ok := strings.CutSuffix(topic, "~"); ok {
+			options[key] = before + base
+		}
+	}
+}
+
+// optionString returns an option that may be a string, number or boolean as
+// a string.
+func optionString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		js, _ := json.Marshal(v)
+		return string(js)
+	}
+}
+
+// name returns the entity's name, prefixed with the device's name to tell
+// apart the entities of one device, such as its temperature and humidity.
+func (p *discoveryPayload) name(objectID string) string {
+	entity := optionString(p.Name)
+	device := p.Device.Name
+
+	name := entity
+	switch {
+	case entity == "":
+		name = cmp.Or(device, p.UniqueID, objectID)
+	case device != "" && !strings.HasPrefix(entity, device):
+		name = device + " " + entity
+	}
+
+	return database.TruncateName(name)
+}
+
+func (p *discoveryPayload) parseSwitch(d *Discovery) error {
+	path, err := templatePath(p.ValueTemplate)
+	if err != nil {
+		return err
+	}
+
+	d.Kind = "switch"
+	d.Capabilities = []string{"on_off"}
+	// Without a state topic the switch is optimistic, and its state is the
+	// last command
+	d.Config.StateTopic = cmp.Or(p.StateTopic, p.CommandTopic)
+	d.Config.CommandTopic = p.CommandTopic
+	d.Config.Attributes["on"] = Attribute{Path: path, CommandPath: "$"}
+	return requireTopic(d)
+}
+
+func (p *discoveryPayload) parseSensor(d *Discovery) error {
+	capability, ok := sensorClasses[p.DeviceClass]
+	if !ok {
+		return fmt.Errorf("%w: sensor device class %q", ErrUnsupported, p.DeviceClass)
+	}
+
+	path, err := templatePath(p.ValueTemplate)
+	if err != nil {
+		return err
+	}
+
+	d.Kind = "sensor"
+	d.Capabilities = []string{capability}
+	d.Config.StateTopic = p.StateTopic
+	d.Config.Attributes[capability] = Attribute{Path: path}
+	return requireTopic(d)
+}
+
+func (p *discoveryPayload) parseBinarySensor(d *Discovery) error {
+	capability, ok := binarySensorClasses[p.DeviceClass]
+	if !ok {
+		return fmt.Errorf("%w: binary sensor device class %q", ErrUnsupported, p.DeviceClass)
+	}
+
+	path, err := templatePath(p.ValueTemplate)
+	if err != nil {
+		return err
+	}
+
+	d.Kind = "sensor"
+	d.Capabilities = []string{capability}
+	d.Config.StateTopic = p.StateTopic
+	d.Config.Attributes[capability] = Attribute{Path: path}
+
+	// Home Assistant's openings are on when open, while contact is true
+	// when closed, as with Zigbee contact sensors
+	if capability == "contact" {
+		d.Config.PayloadOn, d.Config.PayloadOff = cmp.Or(d.Config.PayloadOff, "OFF"), cmp.Or(d.Config.PayloadOn, "ON")
+	}
+	return requireTopic(d)
+}
+
+func (p *discoveryPayload) parseLight(d *Discovery) error {
+	d.Kind = "light"
+	d.Capabilities = []string{"on_off"}
+	d.Config.StateTopic = cmp.Or(p.StateTopic, p.CommandTopic)
+	d.Config.CommandTopic = p.CommandTopic
+
+	switch p.Schema {
+	case "json":
+		// Color modes other than onoff all include brightness
+		brightness := p.Brightness
+		for _, mode := range p.SupportedColorModes {
+			brightness = brightness || mode != "onoff"
+		}
+		if brightness {
+			d.Capabilities = append(d.Capabilities, "brightness")
+			d.Config.BrightnessScale = cmp.Or(p.BrightnessScale, 255)
+		}
+		if p.RGB || slices.Contains(p.SupportedColorModes, "rgb") {
+			d.Capabilities = append(d.Capabilities, "color")
+			d.Config.ColorFormat = "rgb"
+		}
+
+	case "", "default":
+		path, err := templatePath(p.StateValueTemplate)
+		if err != nil {
+			return err
+		}
+		d.Config.Attributes["on"] = Attribute{Path: path, CommandPath: "$"}
+
+		if p.BrightnessCommandTopic != "" {
+			path, err := templatePath(p.BrightnessValueTemplate)
+			if err != nil {
+				return err
+			}
+			d.Capabilities = append(d.Capabilities, "brightness")
+			d.Config.BrightnessScale = cmp.Or(p.BrightnessScale, 255)
+			d.Config.Attributes["brightness"] = Attribute{
+				Path:         path,
+				StateTopic:   cmp.Or(p.BrightnessStateTopic, p.BrightnessCommandTopic),
+				CommandTopic: p.BrightnessCommandTopic,
+				CommandPath:  "$",
+			}
+		}
+
+	default:
+		return fmt.Errorf("%w: light schema %q", ErrUnsupported, p.Schema)
+	}
+
+	return requireTopic(d)
+}
+
+func (p *discoveryPayload) parseCover(d *Discovery) error {
+	if p.PositionTopic == "" && p.SetPositionTopic == "" {
+		return fmt.Errorf("%w: cover without a position", ErrUnsupported)
+	}
+
+	path, err := templatePath(p.PositionTemplate)
+	if err != nil {
+		return err
+	}
+
+	d.Kind = "cover"
+	d.Capabilities = []string{"position"}
+	d.Config.StateTopic = cmp.Or(p.PositionTopic, p.SetPositionTopic)
+	d.Config.CommandTopic = p.SetPositionTopic
+	d.Config.Attributes["position"] = Attribute{Path: path, CommandPath: "$"}
+	return requireTopic(d)
+}
+
+func (p *discoveryPayload) parseClimate(d *Discovery) error {
+	if p.CurrentTemperatureTopic == "" && p.TemperatureCommandTopic == "" {
+		return fmt.Errorf("%w: climate without a temperature", ErrUnsupported)
+	}
+
+	d.Kind = "thermostat"
+	d.Config.StateTopic = cmp.Or(p.CurrentTemperatureTopic, p.TemperatureStateTopic, p.TemperatureCommandTopic)
+
+	if p.CurrentTemperatureTopic != "" {
+		path, err := templatePath(p.CurrentTemperatureTemplate)
+		if err != nil {
+			return err
+		}
+		d.Capabilities = []string{"temperature"}
+		d.Config.Attributes["temperature"] = Attribute{Path: path, StateTopic: p.CurrentTemperatureTopic}
+	}
+
+	path, err := templatePath(p.TemperatureStateTemplate)
+	if err != nil {
+		return err
+	}
+	d.Config.Attributes["target_temperature"] = Attribute{
+		Path:         path,
+		StateTopic:   cmp.Or(p.TemperatureStateTopic, p.TemperatureCommandTopic, p.CurrentTemperatureTopic),
+		CommandTopic: p.TemperatureCommandTopic,
+		CommandPath:  "$",
+	}
+	return requireTopic(d)
+}
+
+func requireTopic(d *Discovery) error {
+	if d.Config.StateTopic == "" {
+		return errors.New("discovery payload has no state topic")
+	}
+	return nil
+}
+
+var (
+	rgxTemplateValue = regexp.MustCompile(`^value_json(\.\w+|\[\d+\]|\[\s*'[^']+'\s*\]|\[\s*"[^"]+"\s*\])*$`)
+	rgxTemplateKey   = regexp.MustCompile(`\[\s*['"]([^'"]+)['"]\s*\]`)
+)
+
+// templatePath converts the simple value templates devices use, such as
+// "{{ value_json.temperature }}" or "{{ value }}", to a path. Filters such as
+// "| float" are ignored, the value is kept as it is in the payload. Other
+// templates are not supported.
+func templatePath(template string) (string, error) {
+	if template == "" {
+		return "$", nil
+	}
+
+	expr, ok := strings.CutPrefix(strings.TrimSpace(template), "{{")
+	if ok {
+		expr, ok = strings.CutSuffix(expr, "}}")
+	}
+	expr, _, _ = strings.Cut(expr, "|")
+	expr = strings.TrimSpace(expr)
+
+	var p string
+	switch {
+	case !ok:
+	case expr == "value":
+		p = "$"
+	case rgxTemplateValue.MatchString(expr):
+		p = "$" + rgxTemplateKey.ReplaceAllString(strings.TrimPrefix(expr, "value_json"), ".$1")
+	}
+
+	if p == "" {
+		return "", fmt.Errorf("%w: template %q", ErrUnsupported, template)
+	}
+	return p, nil
+}
+
+// Apply sets the kind, address, capabilities and settings of device to those
+// discovered, leaving its name and room to the user.
+func (d *Discovery) Apply(device *database.Device) error {
+	config, err := EncodeDeviceConfig(d.Config)
+	if err != nil {
+		return err
+	}
+
+	device.Kind = d.Kind
+	device.Protocol = Protocol
+	device.Address = d.Config.StateTopic
+	device.Capabilities = d.Capabilities
+	device.Config = config
+	if device.Name == "" {
+		device.Name = d.Name
+	}
+
+	_, err = ParseDeviceConfig(device)
+	return err
+}
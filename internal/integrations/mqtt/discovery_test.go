@@ -0,0 +1,273 @@
+package mqtt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+func TestTemplatePath(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"", "$"},
+		{"{{ value }}", "$"},
+		{"{{value_json.temperature}}", "$.temperature"},
+		{"{{ value_json.ENERGY.Power | float }}", "$.ENERGY.Power"},
+		{"{{ value_json['POWER'] }}", "$.POWER"},
+		{"{{ value_json.channels[0].power }}", "$.channels[0].power"},
+	}
+
+	for _, tt := range tests {
+		got, err := templatePath(tt.template)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.template, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected %s, got %s", tt.template, tt.want, got)
+		}
+	}
+
+	for _, unsupported := range []string{"value_json.state", "{{ 'ON' if value_json.power > 0 else 'OFF' }}", "{% if value %}ON{% endif %}"} {
+		_, err := templatePath(unsupported)
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%q: expected ErrUnsupported, got %v", unsupported, err)
+		}
+	}
+}
+
+func TestParseDiscovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		want    Discovery
+	}{
+		{
+			name:  "Tasmota switch",
+			topic: "homeassistant/switch/1A2B3C/relay_0/config",
+			payload: `{
+				"name": "Relay", "uniq_id": "1A2B3C_RL_1",
+				"dev": {"name": "Kitchen Plug"},
+				"~": "tasmota/plug/",
+				"stat_t": "~stat/RESULT", "val_tpl": "{{value_json.POWER}}",
+				"cmd_t": "~cmnd/POWER", "pl_on": "ON", "pl_off": "OFF"
+			}`,
+			want: Discovery{
+				Name:         "Kitchen Plug Relay",
+				Kind:         "switch",
+				Capabilities: []string{"on_off"},
+				Config: DeviceConfig{
+					StateTopic:   "tasmota/plug/stat/RESULT",
+					CommandTopic: "tasmota/plug/cmnd/POWER",
+					Attributes:   map[string]Attribute{"on": {Path: "$.POWER", CommandPath: "$"}},
+					PayloadOn:    "ON",
+					PayloadOff:   "OFF",
+				},
+			},
+		},
+		{
+			name:    "Temperature sensor",
+			topic:   "homeassistant/sensor/bedroom_temperature/config",
+			payload: `{"name": null, "device": {"name": "Bedroom Sensor"}, "device_class": "temperature", "state_topic": "esphome/bedroom/temperature"}`,
+			want: Discovery{
+				Name:         "Bedroom Sensor",
+				Kind:         "sensor",
+				Capabilities: []string{"temperature"},
+				Config: DeviceConfig{
+					StateTopic: "esphome/bedroom/temperature",
+					Attributes: map[string]Attribute{"temperature": {Path: "$"}},
+				},
+			},
+		},
+		{
+			name:    "Door sensor",
+			topic:   "homeassistant/binary_sensor/front_door/config",
+			payload: `{"name": "Front Door", "dev_cla": "door", "stat_t": "zigbee2mqtt/front_door", "val_tpl": "{{ value_json.open }}", "pl_on": true, "pl_off": false}`,
+			want: Discovery{
+				Name:         "Front Door",
+				Kind:         "sensor",
+				Capabilities: []string{"contact"},
+				Config: DeviceConfig{
+					StateTopic: "zigbee2mqtt/front_door",
+					Attributes: map[string]Attribute{"contact": {Path: "$.open"}},
+					PayloadOn:  "false",
+					PayloadOff: "true",
+				},
+			},
+		},
+		{
+			name:  "JSON light",
+			topic: "homeassistant/light/0x00158d0001/light/config",
+			payload: `{
+				"name": "Desk Lamp", "schema": "json",
+				"stat_t": "zigbee2mqtt/desk", "cmd_t": "zigbee2mqtt/desk/set",
+				"brightness": true, "brightness_scale": 254, "sup_clrm": ["rgb", "color_temp"]
+			}`,
+			want: Discovery{
+				Name:         "Desk Lamp",
+				Kind:         "light",
+				Capabilities: []string{"on_off", "brightness", "color"},
+				Config: DeviceConfig{
+					StateTopic:      "zigbee2mqtt/desk",
+					CommandTopic:    "zigbee2mqtt/desk/set",
+					BrightnessScale: 254,
+					ColorFormat:     "rgb",
+				},
+			},
+		},
+		{
+			name:  "Default light",
+			topic: "homeassistant/light/porch/config",
+			payload: `{
+				"name": "Porch", "stat_t": "porch/state", "cmd_t": "porch/switch",
+				"bri_stat_t": "porch/brightness", "bri_cmd_t": "porch/brightness/set"
+			}`,
+			want: Discovery{
+				Name:         "Porch",
+				Kind:         "light",
+				Capabilities: []string{"on_off", "brightness"},
+				Config: DeviceConfig{
+					StateTopic:      "porch/state",
+					CommandTopic:    "porch/switch",
+					BrightnessScale: 255,
+					Attributes: map[string]Attribute{
+						"on":         {Path: "$", CommandPath: "$"},
+						"brightness": {Path: "$", StateTopic: "porch/brightness", CommandTopic: "porch/brightness/set", CommandPath: "$"},
+					},
+				},
+			},
+		},
+		{
+			name:    "Cover",
+			topic:   "homeassistant/cover/blinds/config",
+			payload: `{"name": "Blinds", "pos_t": "blinds/position", "set_pos_t": "blinds/position/set", "cmd_t": "blinds/set"}`,
+			want: Discovery{
+				Name:         "Blinds",
+				Kind:         "cover",
+				Capabilities: []string{"position"},
+				Config: DeviceConfig{
+					StateTopic:   "blinds/position",
+					CommandTopic: "blinds/position/set",
+					Attributes:   map[string]Attribute{"position": {Path: "$", CommandPath: "$"}},
+				},
+			},
+		},
+		{
+			name:  "Climate",
+			topic: "homeassistant/climate/hallway/config",
+			payload: `{
+				"name": "Hallway", "curr_temp_t": "hallway/state", "curr_temp_tpl": "{{ value_json.temperature }}",
+				"temp_stat_t": "hallway/state", "temp_stat_tpl": "{{ value_json.target }}", "temp_cmd_t": "hallway/target/set"
+			}`,
+			want: Discovery{
+				Name:         "Hallway",
+				Kind:         "thermostat",
+				Capabilities: []string{"temperature"},
+				Config: DeviceConfig{
+					StateTopic: "hallway/state",
+					Attributes: map[string]Attribute{
+						"temperature":        {Path: "$.temperature", StateTopic: "hallway/state"},
+						"target_temperature": {Path: "$.target", StateTopic: "hallway/state", CommandTopic: "hallway/target/set", CommandPath: "$"},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDiscovery(DefaultDiscoveryPrefix, tt.topic, []byte(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.want.Topic = tt.topic
+			tt.want.Config.DiscoveryTopic = tt.topic
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, *got)
+			}
+
+			// The discovered config is a valid device config
+			var device database.Device
+			err = got.Apply(&device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if device.Name != tt.want.Name || device.Protocol != Protocol || device.Address != tt.want.Config.StateTopic {
+				t.Errorf("unexpected device %+v", device)
+			}
+		})
+	}
+}
+
+func TestParseDiscoveryErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		topic       string
+		payload     string
+		unsupported bool
+	}{
+		{name: "Not a config topic", topic: "homeassistant/switch/plug/state", payload: `{}`},
+		{name: "Other prefix", topic: "zigbee2mqtt/switch/plug/config", payload: `{}`},
+		{name: "Invalid JSON", topic: "homeassistant/switch/plug/config", payload: `{`},
+		{name: "No state topic", topic: "homeassistant/sensor/hall/config", payload: `{"device_class": "humidity"}`},
+		{name: "Unknown component", topic: "homeassistant/vacuum/robot/config", payload: `{"stat_t": "robot"}`, unsupported: true},
+		{name: "Unknown device class", topic: "homeassistant/sensor/hall/config", payload: `{"dev_cla": "pm25", "stat_t": "hall"}`, unsupported: true},
+		{name: "Template light", topic: "homeassistant/light/hall/config", payload: `{"schema": "template", "stat_t": "hall"}`, unsupported: true},
+		{name: "Complex template", topic: "homeassistant/switch/plug/config", payload: `{"stat_t": "plug", "val_tpl": "{{ value_json.power > 0 }}"}`, unsupported: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseDiscovery(DefaultDiscoveryPrefix, tt.topic, []byte(tt.payload))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if errors.Is(err, ErrUnsupported) != tt.unsupported {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestDiscoveredDevice(t *testing.T) {
+	d, err := ParseDiscovery(DefaultDiscoveryPrefix, "homeassistant/switch/1A2B3C/relay_0/config", []byte(`{
+		"name": "Plug", "stat_t": "stat/plug/RESULT", "val_tpl": "{{ value_json.POWER }}", "cmd_t": "cmnd/plug/POWER"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A renamed device keeps its name when it is announced again
+	device := database.Device{Name: "Kettle"}
+	err = d.Apply(&device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Name != "Kettle" {
+		t.Errorf("expected the name to be kept, got %q", device.Name)
+	}
+
+	m, err := deviceMapping(&device)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := m.state("stat/plug/RESULT", []byte(`{"POWER": "ON"}`))
+	if !reflect.DeepEqual(state, database.DeviceState{"on": true}) {
+		t.Errorf("unexpected state %v", state)
+	}
+
+	messages, err := m.commands(database.DeviceState{"on": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].topic != "cmnd/plug/POWER" || string(messages[0].payload) != "OFF" {
+		t.Errorf("unexpected commands %v", messages)
+	}
+}
@@ -0,0 +1,291 @@
+package mqtt
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/broker"
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations"
+)
+
+func init() {
+	integrations.Register(&Integration{})
+}
+
+// IntegrationConfig is the server's configuration of the integration, given
+// in the Host's Config. Without a broker the integration is unavailable.
+type IntegrationConfig struct {
+	Config
+
+	// HouseholdTopics is set on the embedded broker, where each household
+	// announces its devices below its household topic, as in
+	// households/1/homeassistant/switch/plug/config. Otherwise the devices
+	// announced on the broker belong to HouseholdID.
+	HouseholdTopics bool
+	HouseholdID     int64
+
+	DiscoveryPrefix string // Home Assistant discovery is disabled when empty
+}
+
+// Integration plugs the client into the server, following the devices of
+// the households that enabled it. It creates the devices those households
+// announce with Home Assistant discovery, keeping the name and room a device
+// was given when it is announced again.
+type Integration struct {
+	cfg        IntegrationConfig
+	client     *Client
+	db         *database.DB
+	onChange   integrations.ChangeFunc
+	logger     *slog.Logger
+	reload     chan struct{}
+	followed   map[int64]bool // The households whose discovery topics are subscribed to
+	background integrations.Background
+}
+
+func (i *Integration) Name() string  { return Protocol }
+func (i *Integration) Title() string { return "MQTT" }
+
+func (i *Integration) ConfigSchema() integrations.Schema { return nil }
+
+func (i *Integration) Setup(ctx context.Context, host integrations.Host) error {
+	cfg, _ := host.Config[Protocol].(IntegrationConfig)
+	if cfg.Broker == "" {
+		return integrations.ErrUnavailable
+	}
+
+	if cfg.DiscoveryPrefix != "" && !cfg.HouseholdTopics && cfg.HouseholdID == 0 {
+		host.Logger.Info("MQTT discovery disabled, no household configured for the broker")
+		cfg.DiscoveryPrefix = ""
+	}
+
+	i.cfg = cfg
+	i.db = host.DB
+	i.onChange = host.OnChange
+	i.logger = host.Logger
+	i.reload = make(chan struct{}, 1)
+	i.followed = map[int64]bool{}
+	i.client = New(cfg.Config, integrations.DeviceStore{DB: host.DB}, StateFunc(host.OnState), host.Logger)
+
+	i.background.Start(Protocol, i.run, host.Logger)
+	return nil
+}
+
+// Client returns the client, for integrations running on its connection. It
+// is nil unless the integration has been set up.
+func (i *Integration) Client() *Client { return i.client }
+
+func (i *Integration) Reload() {
+	i.client.Reload()
+
+	select {
+	case i.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Discover returns nil, as devices are added by topic or announce
+// themselves.
+func (i *Integration) Discover(ctx context.Context, entry *database.IntegrationEntry) ([]integrations.Discovery, error) {
+	return nil, nil
+}
+
+func (i *Integration) HandleCommand(ctx context.Context, device *database.Device, state database.DeviceState) error {
+	return i.client.Publish(ctx, device, state)
+}
+
+func (i *Integration) Shutdown(ctx context.Context) error {
+	return i.background.Stop(ctx)
+}
+
+// run keeps the client connected, subscribed to the discovery topics of the
+// households that enabled the integration, until ctx is cancelled.
+func (i *Integration) run(ctx context.Context) error {
+	if i.cfg.DiscoveryPrefix == "" {
+		return i.client.Run(ctx)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		i.follow(ctx)
+	}()
+	defer func() { <-done }()
+
+	return i.client.Run(ctx)
+}
+
+// follow updates the subscriptions to discovery topics after every reload.
+// Configs are retained, so a household that enables the integration has its
+// devices created as soon as its topics are subscribed to.
+func (i *Integration) follow(ctx context.Context) {
+	for {
+		households, err := integrations.EnabledHouseholds(ctx, i.db, Protocol)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			i.logger.Error("failed to load the households of the MQTT integration", "error", err)
+		case err == nil:
+			i.subscribe(households)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-i.reload:
+		}
+	}
+}
+
+// subscribe subscribes to the discovery topics of households, unsubscribing
+// from those of other households.
+func (i *Integration) subscribe(households map[int64]bool) {
+	for householdID := range i.followed {
+		if !households[householdID] {
+			i.client.Unsubscribe(i.discoveryFilter(householdID))
+			delete(i.followed, householdID)
+		}
+	}
+
+	for householdID := range households {
+		if i.followed[householdID] || (!i.cfg.HouseholdTopics && householdID != i.cfg.HouseholdID) {
+			continue
+		}
+		i.client.Subscribe(i.discoveryFilter(householdID), i.handleDiscovery)
+		i.followed[householdID] = true
+	}
+}
+
+func (i *Integration) discoveryFilter(householdID int64) string {
+	if i.cfg.HouseholdTopics {
+		return broker.HouseholdTopic(householdID) + "/" + i.cfg.DiscoveryPrefix + "/#"
+	}
+	return i.cfg.DiscoveryPrefix + "/#"
+}
+
+func (i *Integration) handleDiscovery(ctx context.Context, topic string, payload []byte) {
+	err := i.discoverDevice(ctx, topic, payload)
+	switch {
+	case errors.Is(err, ErrUnsupported):
+		i.logger.Debug("MQTT discovery ignored", "topic", topic, "error", err)
+	case err != nil:
+		i.logger.Warn("failed to handle MQTT discovery", "topic", topic, "error", err)
+	}
+}
+
+// discoverDevice creates or updates the device announced on a discovery
+// topic, or deletes it when the config is cleared.
+func (i *Integration) discoverDevice(ctx context.Context, topic string, payload []byte) error {
+	householdID, prefix, err := i.discoveryHousehold(topic)
+	if err != nil {
+		return err
+	}
+
+	device, err := i.discoveredDevice(ctx, householdID, topic)
+	if err != nil {
+		return err
+	}
+
+	if len(payload) == 0 {
+		if device == nil {
+			return nil
+		}
+
+		err := i.db.DeleteDevice(ctx, householdID, device.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		i.logger.Info("discovered device removed", "device_id", device.ID, "name", device.Name, "topic", topic)
+		i.onChange(ctx, householdID, nil)
+		return nil
+	}
+
+	d, err := ParseDiscovery(prefix, topic, payload)
+	if err != nil {
+		return err
+	}
+
+	if i.cfg.HouseholdTopics {
+		err := CheckHouseholdTopics(householdID, d.Config, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	if device == nil {
+		device = &database.Device{HouseholdID: householdID}
+		err = d.Apply(device)
+		if err != nil {
+			return err
+		}
+
+		err = i.db.CreateDevice(ctx, device)
+		if err != nil {
+			return err
+		}
+
+		i.logger.Info("discovered device created", "device_id", device.ID, "name", device.Name, "topic", topic)
+		i.onChange(ctx, householdID, []database.Device{*device})
+		return nil
+	}
+
+	// Configs are retained, so they are received again on every reconnect
+	before := *device
+	err = d.Apply(device)
+	if err != nil {
+		return err
+	}
+	if device.Kind == before.Kind && device.Address == before.Address &&
+		slices.Equal(device.Capabilities, before.Capabilities) && reflect.DeepEqual(device.Config, before.Config) {
+		return nil
+	}
+
+	err = i.db.UpdateDevice(ctx, device)
+	if err != nil {
+		return err
+	}
+
+	i.logger.Info("discovered device updated", "device_id", device.ID, "name", device.Name, "topic", topic)
+	i.onChange(ctx, householdID, nil)
+	return nil
+}
+
+// discoveryHousehold returns the household a discovery topic belongs to, and
+// the prefix the topic is below.
+func (i *Integration) discoveryHousehold(topic string) (int64, string, error) {
+	if !i.cfg.HouseholdTopics {
+		return i.cfg.HouseholdID, i.cfg.DiscoveryPrefix, nil
+	}
+
+	rest, _ := strings.CutPrefix(topic, "households/")
+	id, _, _ := strings.Cut(rest, "/")
+	householdID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("no household in topic %s", topic)
+	}
+
+	return householdID, broker.HouseholdTopic(householdID) + "/" + i.cfg.DiscoveryPrefix, nil
+}
+
+// discoveredDevice returns the device created for a discovery topic, or nil.
+func (i *Integration) discoveredDevice(ctx context.Context, householdID int64, topic string) (*database.Device, error) {
+	devices, err := i.db.ListDevices(ctx, householdID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, device := range devices {
+		if device.Protocol != Protocol || device.Config["discovery_topic"] != topic {
+			continue
+		}
+		return &device, nil
+	}
+	return nil, nil
+}
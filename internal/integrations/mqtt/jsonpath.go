@@ -0,0 +1,101 @@
+package mqtt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A path selects a value in a JSON payload. The supported syntax is the
+// subset devices need: "$" for the whole payload, then .key or [index]
+// steps, as in "$.color.hex" or "$.channels[0].power".
+type path []any // string keys and int indexes
+
+func parsePath(s string) (path, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("path %q must start with $", s)
+	}
+
+	var p path
+	rest := s[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("path %q has an empty key", s)
+			}
+			p = append(p, key)
+			rest = rest[end+1:]
+
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("path %q has an unclosed [", s)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("path %q has an invalid index", s)
+			}
+			p = append(p, index)
+			rest = rest[end+1:]
+
+		default:
+			return nil, fmt.Errorf("path %q is not valid, use $.key or $[index]", s)
+		}
+	}
+
+	return p, nil
+}
+
+// get returns the value at the path, and false if any step is missing.
+func (p path) get(v any) (any, bool) {
+	for _, step := range p {
+		switch step := step.(type) {
+		case string:
+			obj, ok := v.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			v, ok = obj[step]
+			if !ok {
+				return nil, false
+			}
+		case int:
+			arr, ok := v.([]any)
+			if !ok || step >= len(arr) {
+				return nil, false
+			}
+			v = arr[step]
+		}
+	}
+	return v, true
+}
+
+// set stores value at the path in obj, creating objects on the way. Paths
+// with indexes cannot be set, commands are always JSON objects.
+func (p path) set(obj map[string]any, value any) error {
+	for i, step := range p {
+		key, ok := step.(string)
+		if !ok {
+			return fmt.Errorf("cannot publish to a path with an index")
+		}
+
+		if i == len(p)-1 {
+			obj[key] = value
+			return nil
+		}
+
+		next, ok := obj[key].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			obj[key] = next
+		}
+		obj = next
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package integrations
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Registry holds integrations by name.
+type Registry struct {
+	mu           sync.RWMutex
+	integrations map[string]Integration
+}
+
+func NewRegistry() *Registry {
+	return &Registry{integrations: map[string]Integration{}}
+}
+
+// Register adds an integration. It panics if an integration with the same
+// name has been registered, as two packages claim the same protocol.
+func (r *Registry) Register(integration Integration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := integration.Name()
+	if _, ok := r.integrations[name]; ok {
+		panic(fmt.Sprintf("integrations: %s registered twice", name))
+	}
+	r.integrations[name] = integration
+}
+
+// Get returns the integration named name.
+func (r *Registry) Get(name string) (Integration, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	integration, ok := r.integrations[name]
+	return integration, ok
+}
+
+// All returns every integration, ordered by title.
+func (r *Registry) All() []Integration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := make([]Integration, 0, len(r.integrations))
+	for _, integration := range r.integrations {
+		all = append(all, integration)
+	}
+	slices.SortFunc(all, func(a, b Integration) int {
+		return strings.Compare(a.Title(), b.Title())
+	})
+	return all
+}
+
+// Default is the registry integrations add themselves to.
+var Default = NewRegistry()
+
+// Register adds an integration to the default registry.
+func Register(integration Integration) {
+	Default.Register(integration)
+}
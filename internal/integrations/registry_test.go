@@ -0,0 +1,54 @@
+package integrations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+type fakeIntegration struct {
+	name, title string
+}
+
+func (f *fakeIntegration) Name() string                               { return f.name }
+func (f *fakeIntegration) Title() string                              { return f.title }
+func (f *fakeIntegration) ConfigSchema() Schema                       { return nil }
+func (f *fakeIntegration) Setup(ctx context.Context, host Host) error { return nil }
+func (f *fakeIntegration) Reload()                                    {}
+func (f *fakeIntegration) Shutdown(ctx context.Context) error         { return nil }
+func (f *fakeIntegration) Discover(ctx context.Context, entry *database.IntegrationEntry) ([]Discovery, error) {
+	return nil, nil
+}
+func (f *fakeIntegration) HandleCommand(ctx context.Context, device *database.Device, state database.DeviceState) error {
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	wled := &fakeIntegration{name: "wled", title: "WLED"}
+	hue := &fakeIntegration{name: "hue", title: "Philips Hue"}
+	r.Register(wled)
+	r.Register(hue)
+
+	got, ok := r.Get("hue")
+	if !ok || got != hue {
+		t.Errorf("expected the hue integration, got %v", got)
+	}
+	_, ok = r.Get("zwave")
+	if ok {
+		t.Error("expected no zwave integration")
+	}
+
+	all := r.All()
+	if len(all) != 2 || all[0] != hue || all[1] != wled {
+		t.Errorf("expected the integrations ordered by title, got %v", all)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a name twice to panic")
+		}
+	}()
+	r.Register(&fakeIntegration{name: "hue", title: "Another Hue"})
+}
@@ -0,0 +1,110 @@
+package integrations
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+type FieldType string
+
+const (
+	FieldBool   FieldType = "bool"
+	FieldInt    FieldType = "int"
+	FieldString FieldType = "string"
+)
+
+// Field is a setting of an integration.
+type Field struct {
+	Name    string // The key in the entry's config
+	Label   string
+	Help    string
+	Type    FieldType
+	Default any // A bool, int or string, matching Type
+
+	Required bool // String fields must not be blank
+	Min, Max int  // The range of int fields
+}
+
+// Schema describes the settings of an integration.
+type Schema []Field
+
+// Defaults returns the config with every setting at its default.
+func (s Schema) Defaults() database.IntegrationConfig {
+	config := database.IntegrationConfig{}
+	for _, field := range s {
+		if field.Default != nil {
+			config[field.Name] = field.Default
+		}
+	}
+	return config
+}
+
+// Values converts a config into the values of a form, keyed by field name.
+// Settings missing from the config are given their default.
+func (s Schema) Values(config database.IntegrationConfig) map[string]string {
+	values := map[string]string{}
+	for _, field := range s {
+		value, ok := config[field.Name]
+		if !ok {
+			value = field.Default
+		}
+		if value != nil {
+			values[field.Name] = fmt.Sprint(value)
+		}
+	}
+	return values
+}
+
+// Parse converts the values of a form into a config, adding an error to v
+// for each value that is invalid, keyed by field name. Unchecked boxes are
+// not sent, so missing bool values are false.
+func (s Schema) Parse(values map[string]string, v *validator.Validator) database.IntegrationConfig {
+	config := database.IntegrationConfig{}
+	for _, field := range s {
+		value := strings.TrimSpace(values[field.Name])
+
+		switch field.Type {
+		case FieldBool:
+			config[field.Name] = value == "true"
+
+		case FieldInt:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				v.AddFieldError(field.Name, fmt.Sprintf("%s must be a whole number", field.Label))
+				continue
+			}
+			v.CheckField(validator.Between(n, field.Min, field.Max), field.Name, fmt.Sprintf("%s must be between %d and %d", field.Label, field.Min, field.Max))
+			config[field.Name] = n
+
+		case FieldString:
+			if field.Required {
+				v.CheckField(validator.NotBlank(value), field.Name, fmt.Sprintf("%s is required", field.Label))
+			}
+			v.CheckField(validator.MaxRunes(value, 255), field.Name, fmt.Sprintf("%s must not be more than 255 characters", field.Label))
+			config[field.Name] = value
+		}
+	}
+	return config
+}
+
+// Bool returns a bool setting of config, or its default if it is not set.
+func (s Schema) Bool(config database.IntegrationConfig, name string) bool {
+	value, ok := config[name].(bool)
+	if !ok {
+		value, _ = s.field(name).Default.(bool)
+	}
+	return value
+}
+
+func (s Schema) field(name string) Field {
+	for _, field := range s {
+		if field.Name == name {
+			return field
+		}
+	}
+	return Field{}
+}
@@ -0,0 +1,56 @@
+package integrations
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/validator"
+)
+
+var testSchema = Schema{
+	{Name: "import_scenes", Label: "Import scenes", Type: FieldBool, Default: true},
+	{Name: "poll_seconds", Label: "Poll interval", Type: FieldInt, Default: 30, Min: 5, Max: 3600},
+	{Name: "token", Label: "Token", Type: FieldString, Required: true},
+}
+
+func TestSchemaParse(t *testing.T) {
+	var v validator.Validator
+	got := testSchema.Parse(map[string]string{"poll_seconds": " 60 ", "token": "abc"}, &v)
+	if v.HasErrors() {
+		t.Fatalf("expected no errors, got %v", v.FieldErrors)
+	}
+	want := database.IntegrationConfig{"import_scenes": false, "poll_seconds": 60, "token": "abc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	tests := []struct {
+		values map[string]string
+		field  string
+	}{
+		{map[string]string{"poll_seconds": "often", "token": "abc"}, "poll_seconds"},
+		{map[string]string{"poll_seconds": "1", "token": "abc"}, "poll_seconds"},
+		{map[string]string{"poll_seconds": "30", "token": " "}, "token"},
+	}
+	for _, tt := range tests {
+		var v validator.Validator
+		testSchema.Parse(tt.values, &v)
+		if _, ok := v.FieldErrors[tt.field]; !ok || len(v.FieldErrors) != 1 {
+			t.Errorf("%v: expected an error for %s, got %v", tt.values, tt.field, v.FieldErrors)
+		}
+	}
+}
+
+func TestSchemaValues(t *testing.T) {
+	// Settings read from the database hold numbers as float64
+	got := testSchema.Values(database.IntegrationConfig{"poll_seconds": 60.0})
+	want := map[string]string{"import_scenes": "true", "poll_seconds": "60"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if !testSchema.Bool(database.IntegrationConfig{}, "import_scenes") || testSchema.Bool(database.IntegrationConfig{"import_scenes": false}, "import_scenes") {
+		t.Error("expected import_scenes to default to true")
+	}
+}
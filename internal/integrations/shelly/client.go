@@ -0,0 +1,179 @@
+// Package shelly controls Shelly Gen2 relays with their local JSON-RPC API.
+// Commands are sent with Switch.Set over HTTP. The state of every device is
+// followed through status notifications on its WebSocket, falling back to
+// polling Switch.GetStatus while the WebSocket is unavailable.
+package shelly
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	DefaultSource = "home_assist"
+
+	requestTimeout = 10 * time.Second
+)
+
+type Config struct {
+	// Source is the name the client gives devices, which send their
+	// notifications to it.
+	Source string
+
+	// PollInterval is how often devices are polled while their WebSocket is
+	// unavailable, which is also how often it is tried again.
+	PollInterval time.Duration
+
+	HTTPClient *http.Client
+}
+
+type Client struct {
+	cfg     Config
+	watcher *integrations.Watcher
+	logger  *slog.Logger
+	ids     atomic.Int64
+}
+
+func New(cfg Config, store integrations.DeviceLister, onState integrations.StateFunc, logger *slog.Logger) *Client {
+	cfg.Source = cmp.Or(cfg.Source, DefaultSource)
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{}
+	}
+
+	c := &Client{cfg: cfg, logger: logger}
+	c.watcher = integrations.NewWatcher(integrations.WatcherConfig{
+		Protocol:     Protocol,
+		Title:        "Shelly",
+		PollInterval: cfg.PollInterval,
+		Check: func(device *database.Device) error {
+			_, err := ParseDeviceConfig(device)
+			return err
+		},
+		Listen: c.listen,
+		Poll:   c.status,
+	}, store, onState, logger)
+	return c
+}
+
+// Reload makes the client read the devices again, after a device has been
+// saved or deleted. It does not block.
+func (c *Client) Reload() {
+	c.watcher.Reload()
+}
+
+// Run follows the state of every shelly device until ctx is cancelled.
+func (c *Client) Run(ctx context.Context) error {
+	return c.watcher.Run(ctx)
+}
+
+// listen connects to the device's WebSocket and reports its status, then
+// every status notification, until the connection is lost or ctx is
+// cancelled.
+func (c *Client) listen(ctx context.Context, device database.Device, report func(database.DeviceState)) error {
+	cfg, err := ParseDeviceConfig(&device)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := integrations.DialWebSocket(ctx, "ws://"+device.Address+"/rpc", c.cfg.HTTPClient, maxFrameSize, c.watcher.PollInterval())
+	if err != nil {
+		return err
+	}
+	defer conn.CloseNow()
+
+	// The device sends its notifications to the source of this request
+	req := c.newRequest("Switch.GetStatus", map[string]int{"id": cfg.Channel})
+	js, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	err = conn.Write(ctx, websocket.MessageText, js)
+	if err != nil {
+		return err
+	}
+
+	component := fmt.Sprintf("switch:%d", cfg.Channel)
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			return err
+		}
+
+		var f frame
+		err = json.Unmarshal(data, &f)
+		if err != nil {
+			c.logger.Debug("invalid Shelly frame", "device_id", device.ID, "error", err)
+			continue
+		}
+
+		var status json.RawMessage
+		switch {
+		case f.ID == req.ID && f.Error != nil:
+			return f.Error
+		case f.ID == req.ID:
+			status = f.Result
+		case f.Method == "NotifyStatus" || f.Method == "NotifyFullStatus":
+			var params map[string]json.RawMessage
+			if json.Unmarshal(f.Params, &params) != nil {
+				continue
+			}
+			status = params[component]
+		}
+		if status == nil {
+			continue
+		}
+
+		var s switchStatus
+		err = json.Unmarshal(status, &s)
+		if err != nil {
+			c.logger.Debug("invalid Shelly switch status", "device_id", device.ID, "error", err)
+			continue
+		}
+		report(s.state(&device))
+	}
+}
+
+// status polls the state of a device's switch.
+func (c *Client) status(ctx context.Context, device *database.Device) (database.DeviceState, error) {
+	cfg, err := ParseDeviceConfig(device)
+	if err != nil {
+		return nil, err
+	}
+
+	var s switchStatus
+	err = c.call(ctx, device.Address, "Switch.GetStatus", map[string]int{"id": cfg.Channel}, &s)
+	if err != nil {
+		return nil, err
+	}
+	return s.state(device), nil
+}
+
+// Publish asks device to change to state. It does not wait for the device to
+// report its new state.
+func (c *Client) Publish(ctx context.Context, device *database.Device, state database.DeviceState) error {
+	cfg, err := ParseDeviceConfig(device)
+	if err != nil {
+		return err
+	}
+
+	params, err := command(cfg, state)
+	if err != nil {
+		return err
+	}
+
+	return c.call(ctx, device.Address, "Switch.Set", params, nil)
+}
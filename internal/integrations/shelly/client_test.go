@@ -0,0 +1,295 @@
+package shelly
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/testhelpers"
+
+	"github.com/coder/websocket"
+)
+
+// fakeShelly is a stand-in for a Shelly Plus 2PM with two switches,
+// answering RPC requests over HTTP and, unless disabled, its WebSocket.
+type fakeShelly struct {
+	t         *testing.T
+	server    *httptest.Server
+	webSocket bool
+	auth      atomic.Bool // Requests are unauthorized when set
+
+	mu       sync.Mutex
+	switches []switchStatus
+	conns    map[*websocket.Conn]string // The src notifications are sent to
+}
+
+func newFakeShelly(t *testing.T, webSocket bool) *fakeShelly {
+	t.Helper()
+
+	off, power := false, 0.0
+	s := &fakeShelly{
+		t:         t,
+		webSocket: webSocket,
+		switches:  []switchStatus{{ID: 0, Output: &off, APower: &power}, {ID: 1, Output: &off, APower: &power}},
+		conns:     map[*websocket.Conn]string{},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *fakeShelly) address() string {
+	return strings.TrimPrefix(s.server.URL, "http://")
+}
+
+func (s *fakeShelly) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path != "/rpc":
+		http.NotFound(w, r)
+	case s.auth.Load():
+		w.WriteHeader(http.StatusUnauthorized)
+	case r.Method == http.MethodPost:
+		var req request
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(s.handle(req))
+	case r.Method == http.MethodGet && s.webSocket:
+		s.serveWebSocket(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeShelly) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.CloseNow()
+	}()
+
+	for {
+		_, data, err := conn.Read(r.Context())
+		if err != nil {
+			return
+		}
+
+		var req request
+		err = json.Unmarshal(data, &req)
+		if err != nil {
+			s.t.Error(err)
+			return
+		}
+
+		s.mu.Lock()
+		if _, ok := s.conns[conn]; !ok {
+			s.conns[conn] = req.Src
+		}
+		s.mu.Unlock()
+
+		js, _ := json.Marshal(s.handle(req))
+		err = conn.Write(r.Context(), websocket.MessageText, js)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeShelly) handle(req request) any {
+	params, _ := req.Params.(map[string]any)
+	id, _ := params["id"].(float64)
+
+	response := map[string]any{"id": req.ID, "src": "shellyplus2pm-a8032ab12345", "dst": req.Src}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if int(id) >= len(s.switches) {
+		response["error"] = RPCError{Code: -105, Message: fmt.Sprintf("Argument 'id', value %d not found!", int(id))}
+		return response
+	}
+	sw := s.switches[int(id)]
+
+	switch req.Method {
+	case "Switch.GetStatus":
+		response["result"] = sw
+	case "Switch.Set":
+		on := params["on"].(bool)
+		response["result"] = map[string]any{"was_on": *sw.Output}
+		go s.set(int(id), on)
+	default:
+		response["error"] = RPCError{Code: -114, Message: fmt.Sprintf("Method %s failed: No handler!", req.Method)}
+	}
+	return response
+}
+
+// set changes a switch, as if it was pressed, notifying the clients.
+func (s *fakeShelly) set(id int, on bool) {
+	power := 0.0
+	if on {
+		power = 42.5
+	}
+
+	s.mu.Lock()
+	s.switches[id] = switchStatus{ID: id, Output: &on, APower: &power}
+	conns := map[*websocket.Conn]string{}
+	for conn, dst := range s.conns {
+		conns[conn] = dst
+	}
+	s.mu.Unlock()
+
+	for conn, dst := range conns {
+		js, _ := json.Marshal(map[string]any{
+			"src":    "shellyplus2pm-a8032ab12345",
+			"dst":    dst,
+			"method": "NotifyStatus",
+			"params": map[string]any{"ts": 1700000000.5, fmt.Sprintf("switch:%d", id): map[string]any{"id": id, "output": on}},
+		})
+		conn.Write(context.Background(), websocket.MessageText, js)
+	}
+}
+
+func (s *fakeShelly) output(id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.switches[id].Output
+}
+
+func TestClientNotifications(t *testing.T) {
+	shelly := newFakeShelly(t, true)
+	client := New(Config{}, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	devices := []database.Device{
+		{ID: 1, Protocol: Protocol, Address: shelly.address(), Capabilities: []string{"on_off", "power"}},
+		{ID: 2, Protocol: Protocol, Address: shelly.address(), Capabilities: []string{"on_off"}, Config: database.DeviceConfig{"channel": float64(1)}},
+	}
+
+	first := testhelpers.Listen(t, client.listen, devices[0])
+	second := testhelpers.Listen(t, client.listen, devices[1])
+
+	// The status is reported on connecting
+	testhelpers.ReceiveState(t, first, database.DeviceState{"on": false, "power": 0.0})
+	testhelpers.ReceiveState(t, second, database.DeviceState{"on": false})
+
+	// Changes are notified, to the device of the switch that changed
+	err := client.Publish(context.Background(), &devices[1], database.DeviceState{"on": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelpers.ReceiveState(t, second, database.DeviceState{"on": true})
+
+	shelly.set(0, true)
+	testhelpers.ReceiveState(t, first, database.DeviceState{"on": true})
+}
+
+func TestClientStatus(t *testing.T) {
+	shelly := newFakeShelly(t, false)
+	client := New(Config{}, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	device := database.Device{ID: 1, Protocol: Protocol, Address: shelly.address(), Capabilities: []string{"on_off", "power"}}
+
+	for _, want := range []database.DeviceState{{"on": false, "power": 0.0}, {"on": true, "power": 42.5}} {
+		state, err := client.status(context.Background(), &device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(state, want) {
+			t.Errorf("expected %v, got %v", want, state)
+		}
+		shelly.set(0, true)
+	}
+}
+
+func TestClientPublish(t *testing.T) {
+	shelly := newFakeShelly(t, false)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	client := New(Config{}, nil, nil, logger)
+	ctx := context.Background()
+
+	device := database.Device{ID: 1, Protocol: Protocol, Address: shelly.address(), Config: database.DeviceConfig{"channel": float64(1)}}
+	err := client.Publish(ctx, &device, database.DeviceState{"on": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for !shelly.output(1) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected switch 1 to be turned on")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if shelly.output(0) {
+		t.Error("expected switch 0 to stay off")
+	}
+
+	err = client.Publish(ctx, &device, database.DeviceState{"brightness": 40.0})
+	if err == nil {
+		t.Error("expected an error for an unsupported attribute")
+	}
+
+	device.Config = database.DeviceConfig{"channel": float64(3)}
+	err = client.Publish(ctx, &device, database.DeviceState{"on": true})
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -105 {
+		t.Errorf("expected an RPC error for a missing switch, got %v", err)
+	}
+
+	shelly.auth.Store(true)
+	err = client.Publish(ctx, &device, database.DeviceState{"on": true})
+	if !errors.Is(err, ErrAuthRequired) {
+		t.Errorf("expected ErrAuthRequired, got %v", err)
+	}
+}
+
+func TestParseDeviceConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		config  database.DeviceConfig
+		want    DeviceConfig
+		wantErr bool
+	}{
+		{name: "IP address", address: "192.168.1.20", want: DeviceConfig{}},
+		{name: "Host name and port", address: "shellyplus2pm-a8032ab12345.local:8080", config: database.DeviceConfig{"channel": float64(1)}, want: DeviceConfig{Channel: 1}},
+		{name: "No address", wantErr: true},
+		{name: "URL", address: "http://192.168.1.20/rpc", wantErr: true},
+		{name: "Negative channel", address: "192.168.1.20", config: database.DeviceConfig{"channel": float64(-1)}, wantErr: true},
+		{name: "Unknown setting", address: "192.168.1.20", config: database.DeviceConfig{"relay": float64(1)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDeviceConfig(&database.Device{Address: tt.address, Config: tt.config})
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
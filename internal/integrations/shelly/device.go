@@ -0,0 +1,103 @@
+package shelly
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations"
+)
+
+// Protocol is the device protocol handled by this package.
+const Protocol = "shelly"
+
+// DeviceConfig is the Shelly settings of a device, stored in
+// database.Device.Config. The device address is the relay's host name or IP
+// address, optionally followed by a port.
+type DeviceConfig struct {
+	// Channel is the id of the relay's switch, 0 by default. Each switch of
+	// relays with several, such as the Plus 2PM, is added as a device.
+	Channel int `json:"channel,omitempty"`
+}
+
+// ParseDeviceConfig decodes and validates the Shelly settings of a device.
+func ParseDeviceConfig(device *database.Device) (DeviceConfig, error) {
+	var cfg DeviceConfig
+
+	err := integrations.CheckAddress(device.Address)
+	if err != nil {
+		return cfg, err
+	}
+
+	js, err := json.Marshal(device.Config)
+	if err != nil {
+		return cfg, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid Shelly config: %w", err)
+	}
+
+	if cfg.Channel < 0 {
+		return cfg, errors.New("channel must not be negative")
+	}
+	return cfg, nil
+}
+
+// switchStatus is the status of a switch component, as returned by
+// Switch.GetStatus. Notifications only include the fields that changed.
+type switchStatus struct {
+	ID     int      `json:"id"`
+	Output *bool    `json:"output"`
+	APower *float64 `json:"apower"` // Watts, on relays that measure power
+}
+
+func (s switchStatus) state(device *database.Device) database.DeviceState {
+	state := database.DeviceState{}
+	if s.Output != nil {
+		state["on"] = *s.Output
+	}
+	if s.APower != nil && device.HasCapability("power") {
+		state["power"] = *s.APower
+	}
+	return state
+}
+
+// switchSetParams are the parameters of Switch.Set.
+type switchSetParams struct {
+	ID int  `json:"id"`
+	On bool `json:"on"`
+}
+
+// command translates a state change into the parameters of Switch.Set.
+func command(cfg DeviceConfig, state database.DeviceState) (switchSetParams, error) {
+	params := switchSetParams{ID: cfg.Channel}
+
+	attrs := make([]string, 0, len(state))
+	for attr := range state {
+		attrs = append(attrs, attr)
+	}
+	slices.Sort(attrs)
+
+	for _, attr := range attrs {
+		if attr != "on" {
+			return params, fmt.Errorf("%s is not supported by Shelly switches", attr)
+		}
+		on, ok := state[attr].(bool)
+		if !ok {
+			return params, errors.New("on must be a boolean")
+		}
+		params.On = on
+	}
+
+	if _, ok := state["on"]; !ok {
+		return params, errors.New("no state to set")
+	}
+	return params, nil
+}
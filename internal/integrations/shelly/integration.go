@@ -0,0 +1,78 @@
+package shelly
+
+import (
+	"context"
+	"strings"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations"
+)
+
+func init() {
+	integrations.Register(&Integration{})
+}
+
+// Integration plugs the client into the server, following the devices of
+// the households that enabled it. The server sets how often relays are
+// polled with a Config in the Host's Config.
+type Integration struct {
+	client     *Client
+	background integrations.Background
+}
+
+func (i *Integration) Name() string  { return Protocol }
+func (i *Integration) Title() string { return "Shelly" }
+
+func (i *Integration) ConfigSchema() integrations.Schema { return nil }
+
+func (i *Integration) Setup(ctx context.Context, host integrations.Host) error {
+	cfg, _ := host.Config[Protocol].(Config)
+
+	i.client = New(cfg, integrations.DeviceStore{DB: host.DB}, host.OnState, host.Logger)
+
+	i.background.Start(Protocol, i.client.Run, host.Logger)
+	return nil
+}
+
+func (i *Integration) Reload() { i.client.Reload() }
+
+// Discover returns nil, as relays are added by address or found on the
+// local network.
+func (i *Integration) Discover(ctx context.Context, entry *database.IntegrationEntry) ([]integrations.Discovery, error) {
+	return nil, nil
+}
+
+// Match recognises the relays announced as _shelly._tcp, which are those of
+// the second generation onwards. Their TXT records name the app, such as
+// "Plus1PM", which tells plugs and relays that measure power apart. Relays
+// with several switches are found as their first.
+func (i *Integration) Match(a integrations.Announcement) (integrations.Discovery, bool) {
+	if a.Source != "mdns" || a.Service != "_shelly._tcp" || a.Properties["gen"] == "1" {
+		return integrations.Discovery{}, false
+	}
+
+	app := a.Properties["app"]
+	d := integrations.Discovery{
+		Name:         a.Name,
+		Kind:         "switch",
+		Address:      a.Address(),
+		Capabilities: []string{"on_off"},
+		Vendor:       "Shelly",
+		Model:        app,
+	}
+	if strings.Contains(app, "Plug") {
+		d.Kind = "outlet"
+	}
+	if strings.Contains(app, "PM") || strings.Contains(app, "Plug") {
+		d.Capabilities = append(d.Capabilities, "power")
+	}
+	return d, true
+}
+
+func (i *Integration) HandleCommand(ctx context.Context, device *database.Device, state database.DeviceState) error {
+	return i.client.Publish(ctx, device, state)
+}
+
+func (i *Integration) Shutdown(ctx context.Context) error {
+	return i.background.Stop(ctx)
+}
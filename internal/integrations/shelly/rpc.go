@@ -0,0 +1,101 @@
+package shelly
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxFrameSize limits the size of responses and notifications, which are a
+// few kilobytes at most.
+const maxFrameSize = 1 << 20
+
+// ErrAuthRequired is returned for devices with authentication enabled, which
+// is not supported.
+var ErrAuthRequired = errors.New("the Shelly device requires authentication")
+
+// request is a JSON-RPC request. Src names the client, and notifications on
+// a WebSocket are sent to the src of its first request.
+type request struct {
+	ID     int64  `json:"id"`
+	Src    string `json:"src"`
+	Method string `json:"method"`
+	Params any    `json:"params,omitempty"`
+}
+
+// frame is a response to a request, or a notification such as
+//
+//	{"src": "shellyplus1pm-a8032ab12345", "dst": "home_assist",
+//	 "method": "NotifyStatus", "params": {"ts": 1700000000.5, "switch:0": {"id": 0, "output": true}}}
+type frame struct {
+	ID     int64           `json:"id"`
+	Src    string          `json:"src"`
+	Dst    string          `json:"dst"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// RPCError is an error returned by a device, such as
+// {"code": -105, "message": "Argument 'id', value 3 not found!"}.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("shelly: %s (code %d)", e.Message, e.Code)
+}
+
+func (c *Client) newRequest(method string, params any) request {
+	return request{ID: c.ids.Add(1), Src: c.cfg.Source, Method: method, Params: params}
+}
+
+// call makes a request to the device at address over HTTP, decoding the
+// result into result unless it is nil.
+func (c *Client) call(ctx context.Context, address, method string, params, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(c.newRequest(method, params))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+address+"/rpc", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ErrAuthRequired
+	}
+
+	// Errors are described in the body, whatever the status
+	var f frame
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxFrameSize)).Decode(&f)
+	switch {
+	case err == nil && f.Error != nil:
+		return f.Error
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("shelly: unexpected response status %s", resp.Status)
+	case err != nil:
+		return fmt.Errorf("shelly: invalid response: %w", err)
+	case result == nil:
+		return nil
+	}
+
+	return json.Unmarshal(f.Result, result)
+}
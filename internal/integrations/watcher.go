@@ -0,0 +1,239 @@
+package integrations
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	DefaultPollInterval = 30 * time.Second
+
+	dialTimeout = 10 * time.Second
+)
+
+// DeviceLister lists the devices of a protocol, implemented by DeviceStore.
+type DeviceLister interface {
+	ListDevicesByProtocol(ctx context.Context, protocol string) ([]database.Device, error)
+}
+
+// WatcherConfig describes how a Watcher follows the devices of a protocol.
+type WatcherConfig struct {
+	Protocol string
+	Title    string // Names the devices in logs, such as "Shelly"
+
+	// PollInterval is how often devices are polled while their connection
+	// is unavailable, which is also how often it is tried again.
+	PollInterval time.Duration
+
+	// Check returns an error if a device cannot be followed, such as when
+	// its config is invalid.
+	Check func(device *database.Device) error
+
+	// Listen connects to a device and reports the states it sends, until
+	// the connection is lost or ctx is cancelled.
+	Listen func(ctx context.Context, device database.Device, report func(database.DeviceState)) error
+
+	// Poll returns the current state of a device.
+	Poll func(ctx context.Context, device *database.Device) (database.DeviceState, error)
+}
+
+// Watcher follows the state of every device of a protocol over a connection
+// to each, such as a WebSocket, polling devices whenever theirs cannot be
+// connected or is lost. It is shared by the clients of such protocols, which
+// only implement the connection and the poll.
+type Watcher struct {
+	cfg     WatcherConfig
+	store   DeviceLister
+	onState StateFunc
+	logger  *slog.Logger
+	reload  chan struct{}
+}
+
+// deviceWatcher follows the state of a device until cancelled.
+type deviceWatcher struct {
+	device database.Device
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewWatcher(cfg WatcherConfig, store DeviceLister, onState StateFunc, logger *slog.Logger) *Watcher {
+	cfg.PollInterval = cmp.Or(cfg.PollInterval, DefaultPollInterval)
+
+	return &Watcher{
+		cfg:     cfg,
+		store:   store,
+		onState: onState,
+		logger:  logger,
+		reload:  make(chan struct{}, 1),
+	}
+}
+
+// PollInterval returns how often devices are polled, which clients also
+// ping their connections at.
+func (w *Watcher) PollInterval() time.Duration {
+	return w.cfg.PollInterval
+}
+
+// Reload makes the watcher read the devices again, after a device has been
+// saved or deleted. It does not block.
+func (w *Watcher) Reload() {
+	select {
+	case w.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Run follows the state of every device until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) error {
+	watchers := map[int64]*deviceWatcher{}
+	defer func() {
+		for _, dw := range watchers {
+			dw.cancel()
+			<-dw.done
+		}
+	}()
+
+	w.sync(ctx, watchers)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.reload:
+			w.sync(ctx, watchers)
+		}
+	}
+}
+
+// sync loads the devices, starting a watcher for each new or changed device
+// and stopping those of devices that changed or were deleted.
+func (w *Watcher) sync(ctx context.Context, watchers map[int64]*deviceWatcher) {
+	devices, err := w.store.ListDevicesByProtocol(ctx, w.cfg.Protocol)
+	if err != nil {
+		w.logger.Error("failed to load "+w.cfg.Title+" devices", "error", err)
+		return
+	}
+
+	current := map[int64]bool{}
+	for _, device := range devices {
+		err := w.cfg.Check(&device)
+		if err != nil {
+			w.logger.Warn(w.cfg.Title+" device not followed", "device_id", device.ID, "error", err)
+			continue
+		}
+		current[device.ID] = true
+
+		if dw, ok := watchers[device.ID]; ok {
+			if dw.device.Address == device.Address && reflect.DeepEqual(dw.device.Config, device.Config) &&
+				slices.Equal(dw.device.Capabilities, device.Capabilities) {
+				continue
+			}
+			dw.cancel()
+			<-dw.done
+		}
+
+		wctx, cancel := context.WithCancel(ctx)
+		dw := &deviceWatcher{device: device, cancel: cancel, done: make(chan struct{})}
+		watchers[device.ID] = dw
+		go func() {
+			defer close(dw.done)
+			w.watch(wctx, dw.device)
+		}()
+	}
+
+	for id, dw := range watchers {
+		if !current[id] {
+			dw.cancel()
+			<-dw.done
+			delete(watchers, id)
+		}
+	}
+}
+
+// watch listens to a device, polling it whenever the connection cannot be
+// made or is lost.
+func (w *Watcher) watch(ctx context.Context, device database.Device) {
+	logger := w.logger.With("device_id", device.ID, "address", device.Address)
+	reachable := true
+	report := func(state database.DeviceState) {
+		w.report(ctx, device, state)
+	}
+
+	for {
+		err := w.cfg.Listen(ctx, device, report)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Debug(w.cfg.Title+" connection unavailable, polling", "error", err)
+
+		state, err := w.cfg.Poll(ctx, &device)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil && reachable:
+			logger.Warn(w.cfg.Title+" device unreachable", "error", err)
+			reachable = false
+		case err == nil:
+			if !reachable {
+				logger.Info(w.cfg.Title + " device reachable again")
+				reachable = true
+			}
+			report(state)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.cfg.PollInterval):
+		}
+	}
+}
+
+func (w *Watcher) report(ctx context.Context, device database.Device, state database.DeviceState) {
+	if len(state) > 0 {
+		w.onState(ctx, device, state)
+	}
+}
+
+// DialWebSocket connects to a device's WebSocket at url, limiting messages
+// to readLimit bytes. Until ctx is cancelled the connection is pinged every
+// pingInterval, which finds connections dropped without being closed.
+func DialWebSocket(ctx context.Context, url string, client *http.Client, readLimit int64, pingInterval time.Duration) (*websocket.Conn, error) {
+	dialCtx, dialCancel := context.WithTimeout(ctx, dialTimeout)
+	conn, _, err := websocket.Dial(dialCtx, url, &websocket.DialOptions{HTTPClient: client})
+	dialCancel()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(readLimit)
+
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				pingCtx, pingCancel := context.WithTimeout(ctx, dialTimeout)
+				err := conn.Ping(pingCtx)
+				pingCancel()
+				if err != nil {
+					conn.CloseNow()
+					return
+				}
+			}
+		}
+	}()
+
+	return conn, nil
+}
@@ -0,0 +1,173 @@
+package integrations
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+type fakeLister struct {
+	mu      sync.Mutex
+	devices []database.Device
+}
+
+func (l *fakeLister) ListDevicesByProtocol(ctx context.Context, protocol string) ([]database.Device, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]database.Device(nil), l.devices...), nil
+}
+
+func TestWatcher(t *testing.T) {
+	lister := &fakeLister{devices: []database.Device{
+		{ID: 1, Address: "listens"},
+		{ID: 2, Address: "polled"},
+		{ID: 3, Address: "invalid"},
+	}}
+
+	reports := make(chan int64, 10)
+	onState := func(ctx context.Context, device database.Device, state database.DeviceState) {
+		reports <- device.ID
+	}
+
+	w := NewWatcher(WatcherConfig{
+		Protocol:     "fake",
+		Title:        "Fake",
+		PollInterval: time.Hour,
+		Check: func(device *database.Device) error {
+			if device.Address == "invalid" {
+				return errors.New("invalid address")
+			}
+			return nil
+		},
+		Listen: func(ctx context.Context, device database.Device, report func(database.DeviceState)) error {
+			if device.Address != "listens" {
+				return errors.New("connection refused")
+			}
+			report(database.DeviceState{})
+			report(database.DeviceState{"on": true})
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		Poll: func(ctx context.Context, device *database.Device) (database.DeviceState, error) {
+			return database.DeviceState{"on": false}, nil
+		},
+	}, lister, onState, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Devices that cannot be listened to are polled, empty states are not
+	// reported and invalid devices are not followed
+	got := map[int64]bool{}
+	for range 2 {
+		select {
+		case id := <-reports:
+			got[id] = true
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for the devices' state")
+		}
+	}
+	if !got[1] || !got[2] {
+		t.Errorf("expected states of devices 1 and 2, got %v", got)
+	}
+
+	// Devices added later are followed once reloaded
+	lister.mu.Lock()
+	lister.devices = append(lister.devices, database.Device{ID: 4, Address: "polled"})
+	lister.mu.Unlock()
+	w.Reload()
+
+	select {
+	case id := <-reports:
+		if id != 4 {
+			t.Errorf("expected the state of device 4, got device %d", id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the added device's state")
+	}
+}
+
+func TestWatcherReconnect(t *testing.T) {
+	lister := &fakeLister{devices: []database.Device{{ID: 1, Address: "flaky"}}}
+
+	states := make(chan database.DeviceState, 10)
+	onState := func(ctx context.Context, device database.Device, state database.DeviceState) {
+		states <- state
+	}
+
+	// The connection fails at first, then is made and lost again
+	var mu sync.Mutex
+	attempts := 0
+	w := NewWatcher(WatcherConfig{
+		Protocol:     "fake",
+		Title:        "Fake",
+		PollInterval: 20 * time.Millisecond,
+		Check:        func(device *database.Device) error { return nil },
+		Listen: func(ctx context.Context, device database.Device, report func(database.DeviceState)) error {
+			mu.Lock()
+			attempts++
+			attempt := attempts
+			mu.Unlock()
+
+			if attempt == 2 {
+				report(database.DeviceState{"source": "listen"})
+				return errors.New("connection lost")
+			}
+			return errors.New("connection refused")
+		},
+		Poll: func(ctx context.Context, device *database.Device) (database.DeviceState, error) {
+			return database.DeviceState{"source": "poll"}, nil
+		},
+	}, lister, onState, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Polled while unavailable, listened to once connected and polled again
+	// once the connection is lost
+	for _, want := range []string{"poll", "listen", "poll"} {
+		select {
+		case state := <-states:
+			if state["source"] != want {
+				t.Errorf("expected a state from %s, got %v", want, state)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for a state from %s", want)
+		}
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	for _, address := range []string{"192.168.1.20", "shelly.local:8080", "[fe80::1]:80"} {
+		if err := CheckAddress(address); err != nil {
+			t.Errorf("%s: unexpected error %v", address, err)
+		}
+	}
+	for _, address := range []string{"", "http://192.168.1.20", "192.168.1.20/rpc", ":80"} {
+		if CheckAddress(address) == nil {
+			t.Errorf("%s: expected an error", address)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package wled
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxResponseSize limits the size of responses and WebSocket messages, the
+// largest being the lists of effects and palettes.
+const maxResponseSize = 1 << 20
+
+// wledState is the state of a controller, as returned by /json/state and
+// sent on its WebSocket, and posted to change it. Only the fields that are set
+// are posted.
+type wledState struct {
+	On  *bool     `json:"on,omitempty"`
+	Bri *int      `json:"bri,omitempty"` // 1 to 255
+	PS  *int      `json:"ps,omitempty"`  // The current preset, -1 if none
+	Seg []segment `json:"seg,omitempty"`
+}
+
+type segment struct {
+	ID  int     `json:"id"`
+	Col [][]int `json:"col,omitempty"` // The primary, secondary and tertiary colors, as RGB or RGBW
+	FX  *int    `json:"fx,omitempty"`  // The id of the effect
+	Pal *int    `json:"pal,omitempty"` // The id of the palette
+}
+
+// message is a message of the WebSocket, which sends the full state and info
+// on connecting and whenever the state changes.
+type message struct {
+	State *wledState `json:"state"`
+}
+
+// get fetches a JSON resource of the controller at address, such as
+// /json/state, into v.
+func (c *Client) get(ctx context.Context, address, path string, v any) error {
+	return c.do(ctx, http.MethodGet, address, path, nil, v)
+}
+
+// post changes the state of the controller at address.
+func (c *Client) post(ctx context.Context, address string, s wledState) error {
+	return c.do(ctx, http.MethodPost, address, "/json/state", s, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, address, path string, body, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	var r io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+address+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("wled: unexpected response status %s", resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+	if err != nil {
+		return fmt.Errorf("wled: invalid response: %w", err)
+	}
+	return nil
+}
+
+// fetchLists fetches the names of the effects and palettes of the controller
+// at address.
+func (c *Client) fetchLists(ctx context.Context, address string) (*Lists, error) {
+	var lists Lists
+
+	err := c.get(ctx, address, "/json/eff", &lists.Effects)
+	if err != nil {
+		return nil, err
+	}
+	err = c.get(ctx, address, "/json/pal", &lists.Palettes)
+	if err != nil {
+		return nil, err
+	}
+	return &lists, nil
+}
@@ -0,0 +1,190 @@
+// Package wled controls WLED LED controllers with their JSON API. Commands
+// are posted to /json/state. The state of every device is followed through
+// the controller's WebSocket, which sends the full state whenever it changes,
+// falling back to polling /json/state while the WebSocket is unavailable.
+package wled
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations"
+)
+
+const requestTimeout = 10 * time.Second
+
+type Config struct {
+	// PollInterval is how often devices are polled while their WebSocket is
+	// unavailable, which is also how often it is tried again.
+	PollInterval time.Duration
+
+	HTTPClient *http.Client
+}
+
+type Client struct {
+	cfg     Config
+	watcher *integrations.Watcher
+	logger  *slog.Logger
+
+	mu    sync.Mutex
+	lists map[string]*Lists // By address
+}
+
+func New(cfg Config, store integrations.DeviceLister, onState integrations.StateFunc, logger *slog.Logger) *Client {
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{}
+	}
+
+	c := &Client{cfg: cfg, logger: logger, lists: map[string]*Lists{}}
+	c.watcher = integrations.NewWatcher(integrations.WatcherConfig{
+		Protocol:     Protocol,
+		Title:        "WLED",
+		PollInterval: cfg.PollInterval,
+		Check: func(device *database.Device) error {
+			_, err := ParseDeviceConfig(device)
+			return err
+		},
+		Listen: c.listen,
+		Poll:   c.status,
+	}, store, onState, logger)
+	return c
+}
+
+// Reload makes the client read the devices again, after a device has been
+// saved or deleted. It does not block.
+func (c *Client) Reload() {
+	c.watcher.Reload()
+}
+
+// Lists returns the effects and palettes of a device, as fetched when it was
+// last connected. It returns nil if they have not been fetched.
+func (c *Client) Lists(device *database.Device) *Lists {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lists[device.Address]
+}
+
+// Run follows the state of every wled device until ctx is cancelled.
+func (c *Client) Run(ctx context.Context) error {
+	return c.watcher.Run(ctx)
+}
+
+// loadLists fetches the effects and palettes of a device, unless they have
+// been fetched already.
+func (c *Client) loadLists(ctx context.Context, address string) (*Lists, error) {
+	c.mu.Lock()
+	lists, ok := c.lists[address]
+	c.mu.Unlock()
+	if ok {
+		return lists, nil
+	}
+
+	lists, err := c.fetchLists(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.lists[address] = lists
+	c.mu.Unlock()
+	return lists, nil
+}
+
+// listen connects to the device's WebSocket and reports every state it sends,
+// until the connection is lost or ctx is cancelled. The effects and palettes
+// of devices with the effect capability are fetched again on connecting, as
+// they change when the controller is updated.
+func (c *Client) listen(ctx context.Context, device database.Device, report func(database.DeviceState)) error {
+	cfg, err := ParseDeviceConfig(&device)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := integrations.DialWebSocket(ctx, "ws://"+device.Address+"/ws", c.cfg.HTTPClient, maxResponseSize, c.watcher.PollInterval())
+	if err != nil {
+		return err
+	}
+	defer conn.CloseNow()
+
+	var lists *Lists
+	if device.HasCapability("effect") {
+		lists, err = c.fetchLists(ctx, device.Address)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.lists[device.Address] = lists
+		c.mu.Unlock()
+	}
+
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			return err
+		}
+
+		var m message
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			c.logger.Debug("invalid WLED message", "device_id", device.ID, "error", err)
+			continue
+		}
+		if m.State != nil {
+			report(m.State.state(&device, cfg, lists))
+		}
+	}
+}
+
+// status polls the state of a device.
+func (c *Client) status(ctx context.Context, device *database.Device) (database.DeviceState, error) {
+	cfg, err := ParseDeviceConfig(device)
+	if err != nil {
+		return nil, err
+	}
+
+	var lists *Lists
+	if device.HasCapability("effect") {
+		lists, err = c.loadLists(ctx, device.Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var s wledState
+	err = c.get(ctx, device.Address, "/json/state", &s)
+	if err != nil {
+		return nil, err
+	}
+	return s.state(device, cfg, lists), nil
+}
+
+// Publish asks device to change to state. It does not wait for the device to
+// report its new state.
+func (c *Client) Publish(ctx context.Context, device *database.Device, state database.DeviceState) error {
+	cfg, err := ParseDeviceConfig(device)
+	if err != nil {
+		return err
+	}
+
+	var lists *Lists
+	if state["effect"] != nil || state["palette"] != nil {
+		lists, err = c.loadLists(ctx, device.Address)
+		if err != nil {
+			return err
+		}
+	}
+
+	s, err := command(cfg, state, lists)
+	if err != nil {
+		return err
+	}
+	return c.post(ctx, device.Address, s)
+}
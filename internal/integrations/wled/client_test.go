@@ -0,0 +1,278 @@
+package wled
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/testhelpers"
+
+	"github.com/coder/websocket"
+)
+
+var (
+	testEffects  = []string{"Solid", "Blink", "Breathe", "Rainbow"}
+	testPalettes = []string{"Default", "* Random Cycle", "Party"}
+)
+
+// fakeWLED is a stand-in for a WLED controller with a single segment,
+// answering the JSON API and, unless disabled, sending its state on its
+// WebSocket.
+type fakeWLED struct {
+	t         *testing.T
+	server    *httptest.Server
+	webSocket bool
+
+	mu    sync.Mutex
+	state map[string]any
+	conns map[*websocket.Conn]bool
+}
+
+func newFakeWLED(t *testing.T, webSocket bool) *fakeWLED {
+	t.Helper()
+
+	w := &fakeWLED{
+		t:         t,
+		webSocket: webSocket,
+		state: map[string]any{
+			"on": false, "bri": 128.0, "ps": -1.0,
+			"seg": []any{map[string]any{"id": 0.0, "col": []any{[]any{255.0, 160.0, 0.0}, []any{0.0, 0.0, 0.0}}, "fx": 0.0, "pal": 0.0}},
+		},
+		conns: map[*websocket.Conn]bool{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /json/state", func(rw http.ResponseWriter, r *http.Request) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		json.NewEncoder(rw).Encode(w.state)
+	})
+	mux.HandleFunc("POST /json/state", w.serveSet)
+	mux.HandleFunc("GET /json/eff", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(testEffects)
+	})
+	mux.HandleFunc("GET /json/pal", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(testPalettes)
+	})
+	if webSocket {
+		mux.HandleFunc("GET /ws", w.serveWebSocket)
+	}
+
+	w.server = httptest.NewServer(mux)
+	t.Cleanup(w.server.Close)
+	return w
+}
+
+func (w *fakeWLED) address() string {
+	return strings.TrimPrefix(w.server.URL, "http://")
+}
+
+// serveSet merges the posted state into the state, as WLED does, and sends
+// the new state to the WebSocket clients.
+func (w *fakeWLED) serveSet(rw http.ResponseWriter, r *http.Request) {
+	var change map[string]any
+	err := json.NewDecoder(r.Body).Decode(&change)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.mu.Lock()
+	for key, value := range change {
+		if key != "seg" {
+			w.state[key] = value
+			continue
+		}
+		seg := w.state["seg"].([]any)[0].(map[string]any)
+		for k, v := range value.([]any)[0].(map[string]any) {
+			seg[k] = v
+		}
+	}
+	js, _ := json.Marshal(map[string]any{"state": w.state, "info": map[string]any{"ver": "0.14.4"}})
+	conns := []*websocket.Conn{}
+	for conn := range w.conns {
+		conns = append(conns, conn)
+	}
+	w.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Write(context.Background(), websocket.MessageText, js)
+	}
+	io.WriteString(rw, `{"success":true}`)
+}
+
+func (w *fakeWLED) serveWebSocket(rw http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(rw, r, nil)
+	if err != nil {
+		w.t.Error(err)
+		return
+	}
+	defer conn.CloseNow()
+
+	w.mu.Lock()
+	js, _ := json.Marshal(map[string]any{"state": w.state, "info": map[string]any{"ver": "0.14.4"}})
+	w.conns[conn] = true
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.conns, conn)
+		w.mu.Unlock()
+	}()
+
+	err = conn.Write(r.Context(), websocket.MessageText, js)
+	if err != nil {
+		return
+	}
+
+	// Messages from the client are not used
+	for {
+		_, _, err := conn.Read(r.Context())
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (w *fakeWLED) get(key string) any {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if key == "fx" || key == "pal" || key == "col" {
+		return w.state["seg"].([]any)[0].(map[string]any)[key]
+	}
+	return w.state[key]
+}
+
+func TestClientWebSocket(t *testing.T) {
+	wled := newFakeWLED(t, true)
+	client := New(Config{}, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	device := database.Device{ID: 1, Protocol: Protocol, Address: wled.address(), Capabilities: []string{"on_off", "brightness", "color", "effect", "preset"}}
+
+	states := testhelpers.Listen(t, client.listen, device)
+
+	// The state is sent on connecting
+	testhelpers.ReceiveState(t, states, database.DeviceState{
+		"on": false, "brightness": 50.0, "color": "#ffa000", "effect": "Solid", "palette": "Default",
+	})
+	if lists := client.Lists(&device); lists == nil || !reflect.DeepEqual(lists.Effects, testEffects) || !reflect.DeepEqual(lists.Palettes, testPalettes) {
+		t.Errorf("unexpected lists %+v", lists)
+	}
+
+	// Changes are sent, with effects and palettes named
+	err := client.Publish(context.Background(), &device, database.DeviceState{"on": true, "effect": "Rainbow", "palette": "Party"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelpers.ReceiveState(t, states, database.DeviceState{
+		"on": true, "brightness": 50.0, "color": "#ffa000", "effect": "Rainbow", "palette": "Party",
+	})
+
+	err = client.Publish(context.Background(), &device, database.DeviceState{"preset": 3.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelpers.ReceiveState(t, states, database.DeviceState{
+		"on": true, "brightness": 50.0, "color": "#ffa000", "effect": "Rainbow", "palette": "Party", "preset": 3.0,
+	})
+}
+
+func TestClientStatus(t *testing.T) {
+	wled := newFakeWLED(t, false)
+	client := New(Config{}, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// Effects are not reported for devices without the capability
+	device := database.Device{ID: 1, Protocol: Protocol, Address: wled.address(), Capabilities: []string{"on_off", "brightness", "color"}}
+	state, err := client.status(context.Background(), &device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (database.DeviceState{"on": false, "brightness": 50.0, "color": "#ffa000"}); !reflect.DeepEqual(state, want) {
+		t.Errorf("expected %v, got %v", want, state)
+	}
+
+	err = client.Publish(context.Background(), &device, database.DeviceState{"on": true, "brightness": 100.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err = client.status(context.Background(), &device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (database.DeviceState{"on": true, "brightness": 100.0, "color": "#ffa000"}); !reflect.DeepEqual(state, want) {
+		t.Errorf("expected %v, got %v", want, state)
+	}
+}
+
+func TestClientPublish(t *testing.T) {
+	wled := newFakeWLED(t, false)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	client := New(Config{}, nil, nil, logger)
+	ctx := context.Background()
+
+	device := database.Device{ID: 1, Protocol: Protocol, Address: wled.address(), Capabilities: []string{"on_off", "color", "effect"}}
+	err := client.Publish(ctx, &device, database.DeviceState{"color": "#0080ff", "on": true, "effect": "Breathe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wled.get("on") != true || wled.get("fx") != 2.0 || !reflect.DeepEqual(wled.get("col"), []any{[]any{0.0, 128.0, 255.0}}) {
+		t.Errorf("unexpected state on %v, fx %v, col %v", wled.get("on"), wled.get("fx"), wled.get("col"))
+	}
+
+	// Turning off at brightness 0 keeps the brightness to turn back on with
+	err = client.Publish(ctx, &device, database.DeviceState{"on": false, "brightness": 0.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wled.get("on") != false || wled.get("bri") != 128.0 {
+		t.Errorf("unexpected state on %v, bri %v", wled.get("on"), wled.get("bri"))
+	}
+
+	for _, invalid := range []database.DeviceState{{"effect": "Disco"}, {"palette": "Plaid"}, {"preset": 0.0}, {"preset": 2.5}, {"position": 50.0}} {
+		err := client.Publish(ctx, &device, invalid)
+		if err == nil {
+			t.Errorf("%v: expected an error", invalid)
+		}
+	}
+}
+
+func TestParseDeviceConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		config  database.DeviceConfig
+		want    DeviceConfig
+		wantErr bool
+	}{
+		{name: "IP address", address: "192.168.1.30", want: DeviceConfig{}},
+		{name: "Host name and segment", address: "wled-desk.local", config: database.DeviceConfig{"segment": float64(1)}, want: DeviceConfig{Segment: 1}},
+		{name: "No address", wantErr: true},
+		{name: "URL", address: "http://192.168.1.30/json", wantErr: true},
+		{name: "Negative segment", address: "192.168.1.30", config: database.DeviceConfig{"segment": float64(-1)}, wantErr: true},
+		{name: "Unknown setting", address: "192.168.1.30", config: database.DeviceConfig{"channel": float64(1)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDeviceConfig(&database.Device{Address: tt.address, Config: tt.config})
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package wled
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations"
+)
+
+// Protocol is the device protocol handled by this package.
+const Protocol = "wled"
+
+// DeviceConfig is the WLED settings of a device, stored in
+// database.Device.Config. The device address is the controller's host name
+// or IP address, optionally followed by a port.
+type DeviceConfig struct {
+	// Segment is the id of the segment whose color, effect and palette are
+	// followed and set, 0 by default. Power and brightness are those of the
+	// whole strip.
+	Segment int `json:"segment,omitempty"`
+}
+
+// ParseDeviceConfig decodes and validates the WLED settings of a device.
+func ParseDeviceConfig(device *database.Device) (DeviceConfig, error) {
+	var cfg DeviceConfig
+
+	err := integrations.CheckAddress(device.Address)
+	if err != nil {
+		return cfg, err
+	}
+
+	js, err := json.Marshal(device.Config)
+	if err != nil {
+		return cfg, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid WLED config: %w", err)
+	}
+
+	if cfg.Segment < 0 {
+		return cfg, errors.New("segment must not be negative")
+	}
+	return cfg, nil
+}
+
+// Lists are the names of the effects and palettes of a controller, indexed by
+// their ids, which depend on its version and build.
+type Lists struct {
+	Effects  []string
+	Palettes []string
+}
+
+// state converts the fields of s that are set to device state. The effect,
+// palette and preset are only reported for devices with the capabilities.
+func (s *wledState) state(device *database.Device, cfg DeviceConfig, lists *Lists) database.DeviceState {
+	state := database.DeviceState{}
+	if s.On != nil {
+		state["on"] = *s.On
+	}
+	if s.Bri != nil {
+		state["brightness"] = math.Round(float64(*s.Bri) * 100 / 255)
+	}
+	if s.PS != nil && *s.PS > 0 && device.HasCapability("preset") {
+		state["preset"] = float64(*s.PS)
+	}
+
+	i := slices.IndexFunc(s.Seg, func(seg segment) bool { return seg.ID == cfg.Segment })
+	if i < 0 {
+		return state
+	}
+	seg := s.Seg[i]
+
+	if len(seg.Col) > 0 && len(seg.Col[0]) >= 3 {
+		state["color"] = fmt.Sprintf("#%02x%02x%02x", seg.Col[0][0], seg.Col[0][1], seg.Col[0][2])
+	}
+	if device.HasCapability("effect") && lists != nil {
+		if seg.FX != nil && *seg.FX >= 0 && *seg.FX < len(lists.Effects) {
+			state["effect"] = lists.Effects[*seg.FX]
+		}
+		if seg.Pal != nil && *seg.Pal >= 0 && *seg.Pal < len(lists.Palettes) {
+			state["palette"] = lists.Palettes[*seg.Pal]
+		}
+	}
+	return state
+}
+
+// command translates a state change into the state sent to the controller.
+// Effects and palettes are set by name, which are looked up in lists.
+func command(cfg DeviceConfig, state database.DeviceState, lists *Lists) (wledState, error) {
+	var s wledState
+	seg := segment{ID: cfg.Segment}
+	setSegment := false
+
+	attrs := make([]string, 0, len(state))
+	for attr := range state {
+		attrs = append(attrs, attr)
+	}
+	slices.Sort(attrs)
+
+	for _, attr := range attrs {
+		switch value := state[attr]; attr {
+		case "on":
+			on, ok := value.(bool)
+			if !ok {
+				return s, errors.New("on must be a boolean")
+			}
+			s.On = &on
+
+		case "brightness":
+			brightness, ok := value.(float64)
+			if !ok {
+				return s, errors.New("brightness must be a number")
+			}
+			// Brightness 0 is sent as off, leaving the brightness to turn
+			// back on with
+			if brightness > 0 {
+				bri := max(int(math.Round(brightness*255/100)), 1)
+				s.Bri = &bri
+			}
+
+		case "color":
+			hex, _ := value.(string)
+			rgb, err := parseHex(hex)
+			if err != nil {
+				return s, err
+			}
+			seg.Col = [][]int{rgb}
+			setSegment = true
+
+		case "effect", "palette":
+			if lists == nil {
+				return s, errors.New("the controller's effects and palettes are not known")
+			}
+			name, _ := value.(string)
+			names := lists.Effects
+			if attr == "palette" {
+				names = lists.Palettes
+			}
+			i := slices.Index(names, name)
+			if i < 0 {
+				return s, fmt.Errorf("unknown %s %q", attr, name)
+			}
+			if attr == "effect" {
+				seg.FX = &i
+			} else {
+				seg.Pal = &i
+			}
+			setSegment = true
+
+		case "preset":
+			preset, ok := value.(float64)
+			if !ok || preset != math.Trunc(preset) || preset < 1 || preset > 250 {
+				return s, errors.New("preset must be a whole number between 1 and 250")
+			}
+			ps := int(preset)
+			s.PS = &ps
+
+		default:
+			return s, fmt.Errorf("%s is not supported by WLED", attr)
+		}
+	}
+
+	if setSegment {
+		s.Seg = []segment{seg}
+	}
+	return s, nil
+}
+
+// parseHex parses a color such as #ff8800 into its red, green and blue
+// components.
+func parseHex(hex string) ([]int, error) {
+	if len(hex) != 7 || hex[0] != '#' {
+		return nil, fmt.Errorf("invalid color %q", hex)
+	}
+	v, err := strconv.ParseUint(hex[1:], 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid color %q", hex)
+	}
+	return []int{int(v >> 16), int(v >> 8 & 0xff), int(v & 0xff)}, nil
+}
@@ -0,0 +1,76 @@
+package wled
+
+import (
+	"context"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations"
+)
+
+func init() {
+	integrations.Register(&Integration{})
+}
+
+// Integration plugs the client into the server, following the devices of
+// the households that enabled it, with the Config the server gives in the
+// Host's Config.
+type Integration struct {
+	client     *Client
+	background integrations.Background
+}
+
+func (i *Integration) Name() string  { return Protocol }
+func (i *Integration) Title() string { return "WLED" }
+
+func (i *Integration) ConfigSchema() integrations.Schema { return nil }
+
+func (i *Integration) Setup(ctx context.Context, host integrations.Host) error {
+	cfg, _ := host.Config[Protocol].(Config)
+
+	i.client = New(cfg, integrations.DeviceStore{DB: host.DB}, host.OnState, host.Logger)
+
+	i.background.Start(Protocol, i.client.Run, host.Logger)
+	return nil
+}
+
+// Effects returns the effects and palettes of a controller, known once it
+// has been connected to.
+func (i *Integration) Effects(device *database.Device) *integrations.Effects {
+	lists := i.client.Lists(device)
+	if lists == nil {
+		return nil
+	}
+	return &integrations.Effects{Effects: lists.Effects, Palettes: lists.Palettes}
+}
+
+func (i *Integration) Reload() { i.client.Reload() }
+
+// Discover returns nil, as controllers are added by address or found on the
+// local network.
+func (i *Integration) Discover(ctx context.Context, entry *database.IntegrationEntry) ([]integrations.Discovery, error) {
+	return nil, nil
+}
+
+// Match recognises the controllers announced as _wled._tcp, which are found
+// with every capability of their first segment.
+func (i *Integration) Match(a integrations.Announcement) (integrations.Discovery, bool) {
+	if a.Source != "mdns" || a.Service != "_wled._tcp" {
+		return integrations.Discovery{}, false
+	}
+
+	return integrations.Discovery{
+		Name:         a.Name,
+		Kind:         "light",
+		Address:      a.Address(),
+		Capabilities: []string{"on_off", "brightness", "color", "effect", "preset"},
+		Vendor:       "WLED",
+	}, true
+}
+
+func (i *Integration) HandleCommand(ctx context.Context, device *database.Device, state database.DeviceState) error {
+	return i.client.Publish(ctx, device, state)
+}
+
+func (i *Integration) Shutdown(ctx context.Context) error {
+	return i.background.Stop(ctx)
+}
@@ -0,0 +1,472 @@
+// Package zigbee2mqtt imports the devices of Zigbee2MQTT bridges. Each
+// bridge's device list is kept in sync with the household's devices, which
+// are mqtt devices read and controlled through the bridge's topics by the mqtt
+// package. Devices can be renamed and allowed to join from here.
+package zigbee2mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/broker"
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations/mqtt"
+)
+
+const (
+	DefaultBaseTopic = "zigbee2mqtt"
+
+	// MaxPermitJoin is the longest Zigbee2MQTT lets devices join for.
+	MaxPermitJoin = 254 * time.Second
+)
+
+// ErrNoBridge is returned for households without a bridge.
+var ErrNoBridge = errors.New("no Zigbee2MQTT bridge")
+
+type Config struct {
+	BaseTopic string // zigbee2mqtt by default
+
+	// HouseholdTopics is set on the embedded broker, where each household's
+	// bridge uses a base topic below its household topic, such as
+	// households/1/zigbee2mqtt. Otherwise there is one bridge, whose devices
+	// belong to HouseholdID.
+	HouseholdTopics bool
+	HouseholdID     int64
+}
+
+// Client publishes and subscribes to the broker, implemented by *mqtt.Client.
+type Client interface {
+	Subscribe(filter string, fn mqtt.MessageFunc)
+	Unsubscribe(filter string)
+	PublishMessage(ctx context.Context, topic string, retain bool, payload []byte) error
+}
+
+// Store is the data the bridges need, implemented by *database.DB.
+type Store interface {
+	ListDevices(ctx context.Context, householdID int64) ([]database.Device, error)
+	CreateDevice(ctx context.Context, device *database.Device) error
+	UpdateDevice(ctx context.Context, device *database.Device) error
+	DeleteDevice(ctx context.Context, householdID, id int64) error
+}
+
+// ChangeFunc is called after a bridge's devices have been synced and any
+// were created, updated or deleted.
+type ChangeFunc func(ctx context.Context, householdID int64, added []database.Device)
+
+// Bridge is what a bridge last reported about itself.
+type Bridge struct {
+	Online         bool
+	Version        string
+	PermitJoin     bool
+	PermitJoinEnds time.Time // Zero when joining is allowed until stopped
+	Devices        int       // Excluding the coordinator
+}
+
+// Bridges follows the Zigbee2MQTT bridges of every household.
+type Bridges struct {
+	cfg      Config
+	client   Client
+	store    Store
+	onChange ChangeFunc
+	logger   *slog.Logger
+
+	mu       sync.Mutex
+	bridges  map[int64]Bridge
+	followed map[int64]bool
+}
+
+func New(cfg Config, client Client, store Store, onChange ChangeFunc, logger *slog.Logger) *Bridges {
+	if cfg.BaseTopic == "" {
+		cfg.BaseTopic = DefaultBaseTopic
+	}
+
+	return &Bridges{
+		cfg:      cfg,
+		client:   client,
+		store:    store,
+		onChange: onChange,
+		logger:   logger,
+		bridges:  map[int64]Bridge{},
+		followed: map[int64]bool{},
+	}
+}
+
+// Follow subscribes to the topics of the bridges of households, and
+// unsubscribes from those of other households, forgetting their bridges.
+// Device lists are retained, so a bridge's devices are synced as soon as it
+// is followed.
+func (b *Bridges) Follow(households map[int64]bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for householdID := range b.followed {
+		if !households[householdID] {
+			b.client.Unsubscribe(b.baseTopic(householdID) + "/bridge/+")
+			delete(b.followed, householdID)
+			delete(b.bridges, householdID)
+		}
+	}
+
+	for householdID := range households {
+		if b.followed[householdID] || (!b.cfg.HouseholdTopics && householdID != b.cfg.HouseholdID) {
+			continue
+		}
+		b.client.Subscribe(b.baseTopic(householdID)+"/bridge/+", b.handle)
+		b.followed[householdID] = true
+	}
+}
+
+// Get returns the bridge of a household, and false if none has been seen.
+func (b *Bridges) Get(householdID int64) (Bridge, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bridge, ok := b.bridges[householdID]
+	return bridge, ok
+}
+
+// PermitJoin lets new devices join the household's network for d, which is
+// capped at MaxPermitJoin, or stops them from joining when d is 0.
+func (b *Bridges) PermitJoin(ctx context.Context, householdID int64, d time.Duration) error {
+	if _, ok := b.Get(householdID); !ok {
+		return ErrNoBridge
+	}
+
+	seconds := int(min(d, MaxPermitJoin).Seconds())
+	payload, err := json.Marshal(map[string]any{"value": seconds > 0, "time": seconds})
+	if err != nil {
+		return err
+	}
+	return b.client.PublishMessage(ctx, b.baseTopic(householdID)+"/bridge/request/permit_join", false, payload)
+}
+
+// Rename asks the bridge to rename a device. The device's name and address
+// are updated when the bridge publishes its device list again.
+func (b *Bridges) Rename(ctx context.Context, device *database.Device, name string) error {
+	ieeeAddress := IEEEAddress(device)
+	if ieeeAddress == "" {
+		return fmt.Errorf("device %d is not a Zigbee2MQTT device", device.ID)
+	}
+	if _, ok := b.Get(device.HouseholdID); !ok {
+		return ErrNoBridge
+	}
+
+	err := CheckName(name)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(map[string]string{"from": ieeeAddress, "to": name})
+	if err != nil {
+		return err
+	}
+	return b.client.PublishMessage(ctx, b.baseTopic(device.HouseholdID)+"/bridge/request/device/rename", false, payload)
+}
+
+var rgxEndpointSuffix = regexp.MustCompile(`/\d+$`)
+
+// CheckName returns an error describing why a name cannot be a Zigbee2MQTT
+// friendly name, which is also part of the device's topics.
+func CheckName(name string) error {
+	switch {
+	case strings.ContainsAny(name, "+#"):
+		return errors.New("must not contain + or #")
+	case strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/"):
+		return errors.New("must not start or end with /")
+	case rgxEndpointSuffix.MatchString(name):
+		return errors.New("must not end with / followed by a number")
+	}
+	return nil
+}
+
+// IEEEAddress returns the IEEE address of a device imported from a bridge,
+// or "" for other devices.
+func IEEEAddress(device *database.Device) string {
+	if device.Protocol != mqtt.Protocol {
+		return ""
+	}
+	metadata, _ := device.Config["metadata"].(map[string]any)
+	address, _ := metadata["ieee_address"].(string)
+	return address
+}
+
+func friendlyName(device *database.Device) string {
+	metadata, _ := device.Config["metadata"].(map[string]any)
+	name, _ := metadata["friendly_name"].(string)
+	return name
+}
+
+func (b *Bridges) baseTopic(householdID int64) string {
+	if b.cfg.HouseholdTopics {
+		return broker.HouseholdTopic(householdID) + "/" + b.cfg.BaseTopic
+	}
+	return b.cfg.BaseTopic
+}
+
+// household returns the household whose bridge publishes on topic.
+func (b *Bridges) household(topic string) (int64, bool) {
+	if !b.cfg.HouseholdTopics {
+		return b.cfg.HouseholdID, b.cfg.HouseholdID != 0
+	}
+
+	rest, _ := strings.CutPrefix(topic, "households/")
+	id, _, _ := strings.Cut(rest, "/")
+	householdID, err := strconv.ParseInt(id, 10, 64)
+	return householdID, err == nil
+}
+
+func (b *Bridges) handle(ctx context.Context, topic string, payload []byte) {
+	householdID, ok := b.household(topic)
+	if !ok || !b.following(householdID) {
+		return
+	}
+
+	var err error
+	switch topic[strings.LastIndex(topic, "/")+1:] {
+	case "devices":
+		err = b.syncDevices(ctx, householdID, payload)
+	case "info":
+		err = b.updateInfo(householdID, payload)
+	case "state":
+		b.updateState(householdID, payload)
+	}
+	if err != nil {
+		b.logger.Warn("failed to handle Zigbee2MQTT message", "topic", topic, "error", err)
+	}
+}
+
+// following reports whether a household's bridge is followed, as messages
+// may still arrive after it has been unsubscribed from.
+func (b *Bridges) following(householdID int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.followed[householdID]
+}
+
+func (b *Bridges) update(householdID int64, fn func(*Bridge)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bridge := b.bridges[householdID]
+	fn(&bridge)
+	b.bridges[householdID] = bridge
+}
+
+func (b *Bridges) updateState(householdID int64, payload []byte) {
+	// Older versions publish a bare online or offline
+	state := string(payload)
+	var obj struct {
+		State string `json:"state"`
+	}
+	if json.Unmarshal(payload, &obj) == nil {
+		state = obj.State
+	}
+
+	b.update(householdID, func(bridge *Bridge) {
+		bridge.Online = state == "online"
+	})
+}
+
+func (b *Bridges) updateInfo(householdID int64, payload []byte) error {
+	var info struct {
+		Version           string `json:"version"`
+		PermitJoin        bool   `json:"permit_join"`
+		PermitJoinTimeout int64  `json:"permit_join_timeout"` // Seconds left, before version 2
+		PermitJoinEnd     int64  `json:"permit_join_end"`     // Unix milliseconds, from version 2
+	}
+	err := json.Unmarshal(payload, &info)
+	if err != nil {
+		return err
+	}
+
+	var ends time.Time
+	switch {
+	case !info.PermitJoin:
+	case info.PermitJoinEnd > 0:
+		ends = time.UnixMilli(info.PermitJoinEnd)
+	case info.PermitJoinTimeout > 0:
+		ends = time.Now().Add(time.Duration(info.PermitJoinTimeout) * time.Second)
+	}
+
+	b.update(householdID, func(bridge *Bridge) {
+		bridge.Version = info.Version
+		bridge.PermitJoin = info.PermitJoin
+		bridge.PermitJoinEnds = ends
+	})
+	return nil
+}
+
+// Device is an entry of a bridge's device list.
+type Device struct {
+	IEEEAddress        string      `json:"ieee_address"`
+	FriendlyName       string      `json:"friendly_name"`
+	Type               string      `json:"type"` // Coordinator, Router or EndDevice
+	InterviewCompleted bool        `json:"interview_completed"`
+	Disabled           bool        `json:"disabled"`
+	Definition         *Definition `json:"definition"` // nil for unsupported devices
+}
+
+type Definition struct {
+	Model       string          `json:"model"`
+	Vendor      string          `json:"vendor"`
+	Description string          `json:"description"`
+	Exposes     json.RawMessage `json:"exposes"`
+}
+
+// syncDevices creates, updates and deletes the household's devices to match
+// the bridge's device list.
+func (b *Bridges) syncDevices(ctx context.Context, householdID int64, payload []byte) error {
+	var list []Device
+	err := json.Unmarshal(payload, &list)
+	if err != nil {
+		return err
+	}
+
+	devices, err := b.store.ListDevices(ctx, householdID)
+	if err != nil {
+		return err
+	}
+	existing := map[string]*database.Device{}
+	for i := range devices {
+		if address := IEEEAddress(&devices[i]); address != "" {
+			existing[address] = &devices[i]
+		}
+	}
+
+	var added []database.Device
+	changed := false
+	count := 0
+
+	for _, d := range list {
+		if d.Type == "Coordinator" {
+			continue
+		}
+		count++
+
+		device, ok := existing[d.IEEEAddress]
+		delete(existing, d.IEEEAddress)
+
+		// Devices that are still joining or not supported are left as they
+		// are until the bridge can describe them
+		if d.Definition == nil || !d.InterviewCompleted || d.Disabled {
+			continue
+		}
+
+		if !ok {
+			device = &database.Device{HouseholdID: householdID}
+			err := d.apply(b.baseTopic(householdID), device)
+			if err == nil {
+				err = b.store.CreateDevice(ctx, device)
+			}
+			if err != nil {
+				b.logger.Warn("failed to import Zigbee2MQTT device", "ieee_address", d.IEEEAddress, "error", err)
+				continue
+			}
+
+			b.logger.Info("Zigbee2MQTT device imported", "device_id", device.ID, "name", device.Name)
+			added = append(added, *device)
+			changed = true
+			continue
+		}
+
+		before := *device
+		err := d.apply(b.baseTopic(householdID), device)
+		if err != nil {
+			b.logger.Warn("failed to update Zigbee2MQTT device", "device_id", device.ID, "error", err)
+			continue
+		}
+		if unchanged(&before, device) {
+			continue
+		}
+
+		err = b.store.UpdateDevice(ctx, device)
+		if err != nil {
+			return err
+		}
+		b.logger.Info("Zigbee2MQTT device updated", "device_id", device.ID, "name", device.Name)
+		changed = true
+	}
+
+	// The rest have left the network
+	for _, device := range existing {
+		err := b.store.DeleteDevice(ctx, householdID, device.ID)
+		if err != nil {
+			return err
+		}
+		b.logger.Info("Zigbee2MQTT device removed", "device_id", device.ID, "name", device.Name)
+		changed = true
+	}
+
+	b.update(householdID, func(bridge *Bridge) {
+		bridge.Devices = count
+	})
+
+	if changed {
+		b.onChange(ctx, householdID, added)
+	}
+	return nil
+}
+
+func unchanged(a, b *database.Device) bool {
+	return a.Name == b.Name && a.Kind == b.Kind && a.Address == b.Address &&
+		a.Vendor == b.Vendor && a.Model == b.Model &&
+		slices.Equal(a.Capabilities, b.Capabilities) && reflect.DeepEqual(a.Config, b.Config)
+}
+
+// apply sets device to what the bridge reports. A device renamed in
+// Zigbee2MQTT is renamed here too, otherwise its name is left to the user.
+func (d *Device) apply(baseTopic string, device *database.Device) error {
+	var exposes []Expose
+	var rawExposes any
+	if len(d.Definition.Exposes) > 0 {
+		err := json.Unmarshal(d.Definition.Exposes, &exposes)
+		if err != nil {
+			return err
+		}
+		// Kept whole, with the details not mapped to capabilities
+		err = json.Unmarshal(d.Definition.Exposes, &rawExposes)
+		if err != nil {
+			return err
+		}
+	}
+
+	m := mapExposes(exposes)
+	if len(m.config.Attributes) == 0 {
+		m.config.Attributes = nil
+	}
+	m.config.Metadata = map[string]any{
+		"ieee_address":  d.IEEEAddress,
+		"friendly_name": d.FriendlyName,
+		"description":   d.Definition.Description,
+		"exposes":       rawExposes,
+	}
+
+	config, err := mqtt.EncodeDeviceConfig(m.config)
+	if err != nil {
+		return err
+	}
+
+	if device.Name == "" || friendlyName(device) != d.FriendlyName {
+		device.Name = database.TruncateName(d.FriendlyName)
+	}
+	device.Kind = m.kind
+	device.Protocol = mqtt.Protocol
+	device.Address = baseTopic + "/" + d.FriendlyName
+	device.Capabilities = m.capabilities
+	device.Config = config
+	device.Vendor = d.Definition.Vendor
+	device.Model = d.Definition.Model
+
+	_, err = mqtt.ParseDeviceConfig(device)
+	return err
+}
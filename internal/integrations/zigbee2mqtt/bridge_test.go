@@ -0,0 +1,453 @@
+package zigbee2mqtt
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations/mqtt"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+type fakeStore struct {
+	mu      sync.Mutex
+	devices []database.Device
+	nextID  int64
+}
+
+func (s *fakeStore) ListDevices(ctx context.Context, householdID int64) ([]database.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var devices []database.Device
+	for _, d := range s.devices {
+		if d.HouseholdID == householdID {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+func (s *fakeStore) ListDevicesByProtocol(ctx context.Context, protocol string) ([]database.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.devices), nil
+}
+
+func (s *fakeStore) CreateDevice(ctx context.Context, device *database.Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	device.ID = s.nextID
+	s.devices = append(s.devices, *device)
+	return nil
+}
+
+func (s *fakeStore) UpdateDevice(ctx context.Context, device *database.Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, d := range s.devices {
+		if d.ID == device.ID && d.HouseholdID == device.HouseholdID {
+			s.devices[i] = *device
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (s *fakeStore) DeleteDevice(ctx context.Context, householdID, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.devices = slices.DeleteFunc(s.devices, func(d database.Device) bool {
+		return d.ID == id && d.HouseholdID == householdID
+	})
+	return nil
+}
+
+func (s *fakeStore) find(name string) (database.Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.devices {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return database.Device{}, false
+}
+
+// fakeBridge is a stand-in for Zigbee2MQTT, publishing its retained bridge
+// topics and answering rename and permit join requests.
+type fakeBridge struct {
+	t         *testing.T
+	broker    *server.Server
+	baseTopic string
+
+	mu       sync.Mutex
+	devices  []map[string]any
+	requests chan string
+}
+
+func newFakeBridge(t *testing.T, broker *server.Server, baseTopic string) *fakeBridge {
+	t.Helper()
+
+	z := &fakeBridge{
+		t:         t,
+		broker:    broker,
+		baseTopic: baseTopic,
+		devices: []map[string]any{
+			{"ieee_address": "0x0000", "friendly_name": "Coordinator", "type": "Coordinator", "interview_completed": true},
+			zigbeeDevice("0x0001", "0x0001", "IKEA", "LED1836G9", `[
+				{"type": "light", "features": [
+					{"type": "binary", "name": "state", "property": "state", "value_on": "ON", "value_off": "OFF"},
+					{"type": "numeric", "name": "brightness", "property": "brightness", "value_max": 254},
+					{"type": "numeric", "name": "color_temp", "property": "color_temp", "unit": "mired"},
+					{"type": "composite", "name": "color_xy", "property": "color"}
+				]},
+				{"type": "numeric", "name": "linkquality", "property": "linkquality"}
+			]`),
+			zigbeeDevice("0x0002", "Plug", "Xiaomi", "ZNCZ02LM", `[
+				{"type": "switch", "features": [{"type": "binary", "name": "state", "property": "state", "value_on": "ON", "value_off": "OFF"}]},
+				{"type": "numeric", "name": "power", "property": "power", "unit": "W"}
+			]`),
+			zigbeeDevice("0x0003", "Hallway Sensor", "Philips", "9290012607", `[
+				{"type": "binary", "name": "occupancy", "property": "occupancy", "value_on": true, "value_off": false},
+				{"type": "numeric", "name": "battery", "property": "battery"},
+				{"type": "numeric", "name": "illuminance_lux", "property": "illuminance_lux"}
+			]`),
+			{"ieee_address": "0x0004", "friendly_name": "Unknown", "type": "EndDevice", "interview_completed": true, "definition": nil},
+		},
+		requests: make(chan string, 10),
+	}
+
+	err := broker.Subscribe(baseTopic+"/bridge/request/#", 1, z.handleRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z.publish("bridge/state", `{"state": "online"}`)
+	z.publish("bridge/info", `{"version": "1.40.0", "permit_join": false}`)
+	z.publishDevices()
+	return z
+}
+
+func zigbeeDevice(ieeeAddress, name, vendor, model, exposes string) map[string]any {
+	return map[string]any{
+		"ieee_address":        ieeeAddress,
+		"friendly_name":       name,
+		"type":                "Router",
+		"interview_completed": true,
+		"definition": map[string]any{
+			"vendor":  vendor,
+			"model":   model,
+			"exposes": json.RawMessage(exposes),
+		},
+	}
+}
+
+func (z *fakeBridge) publish(topic, payload string) {
+	err := z.broker.Publish(z.baseTopic+"/"+topic, []byte(payload), true, 0)
+	if err != nil {
+		z.t.Error(err)
+	}
+}
+
+func (z *fakeBridge) publishDevices() {
+	z.mu.Lock()
+	js, err := json.Marshal(z.devices)
+	z.mu.Unlock()
+	if err != nil {
+		z.t.Fatal(err)
+	}
+	z.publish("bridge/devices", string(js))
+}
+
+// rename changes a device's friendly name, as if renamed in Zigbee2MQTT.
+func (z *fakeBridge) rename(from, to string) {
+	z.mu.Lock()
+	for _, d := range z.devices {
+		if d["ieee_address"] == from || d["friendly_name"] == from {
+			d["friendly_name"] = to
+		}
+	}
+	z.mu.Unlock()
+	z.publishDevices()
+}
+
+func (z *fakeBridge) remove(ieeeAddress string) {
+	z.mu.Lock()
+	z.devices = slices.DeleteFunc(z.devices, func(d map[string]any) bool {
+		return d["ieee_address"] == ieeeAddress
+	})
+	z.mu.Unlock()
+	z.publishDevices()
+}
+
+func (z *fakeBridge) handleRequest(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+	z.requests <- pk.TopicName + " " + string(pk.Payload)
+
+	var req map[string]any
+	err := json.Unmarshal(pk.Payload, &req)
+	if err != nil {
+		z.t.Error(err)
+		return
+	}
+
+	switch pk.TopicName {
+	case z.baseTopic + "/bridge/request/device/rename":
+		go z.rename(req["from"].(string), req["to"].(string))
+	case z.baseTopic + "/bridge/request/permit_join":
+		go z.publish("bridge/info", fmt.Sprintf(`{"version": "1.40.0", "permit_join": %t, "permit_join_timeout": %v}`, req["value"], req["time"]))
+	}
+}
+
+func newBroker(t *testing.T) (*server.Server, string) {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	broker := server.New(&server.Options{InlineClient: true, Logger: logger})
+
+	err := broker.AddHook(new(auth.AllowHook), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	err = broker.AddListener(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	return broker, "tcp://" + tcp.Address()
+}
+
+// startBridges connects a client to the broker and follows the bridges.
+func startBridges(t *testing.T, url string, cfg Config, store *fakeStore, households map[int64]bool) (*Bridges, *mqtt.Client, <-chan []database.Device) {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	onState := func(ctx context.Context, device database.Device, state database.DeviceState) {}
+	client := mqtt.New(mqtt.Config{Broker: url, QoS: 1}, store, onState, logger)
+
+	changes := make(chan []database.Device, 10)
+	onChange := func(ctx context.Context, householdID int64, added []database.Device) {
+		changes <- added
+		client.Reload()
+	}
+
+	bridges := New(cfg, client, store, onChange, logger)
+	bridges.Follow(households)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return bridges, client, changes
+}
+
+func receiveChange(t *testing.T, changes <-chan []database.Device) []database.Device {
+	t.Helper()
+
+	select {
+	case added := <-changes:
+		return added
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the devices to change")
+		return nil
+	}
+}
+
+// waitForBridge waits for a household's bridge to be in the expected state,
+// as the retained bridge topics arrive in no particular order.
+func waitForBridge(t *testing.T, bridges *Bridges, householdID int64, ok func(Bridge) bool) Bridge {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		bridge, found := bridges.Get(householdID)
+		if found && ok(bridge) {
+			return bridge
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected bridge %+v", bridge)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBridges(t *testing.T) {
+	broker, url := newBroker(t)
+	z := newFakeBridge(t, broker, DefaultBaseTopic)
+
+	store := &fakeStore{}
+	bridges, client, changes := startBridges(t, url, Config{HouseholdID: 1}, store, map[int64]bool{1: true})
+	ctx := context.Background()
+
+	// The devices are imported, except the coordinator and the unsupported
+	// device
+	added := receiveChange(t, changes)
+	if len(added) != 3 {
+		t.Fatalf("expected 3 devices to be added, got %d", len(added))
+	}
+
+	tests := []struct {
+		name         string
+		kind         string
+		vendor       string
+		capabilities []string
+	}{
+		{"0x0001", "light", "IKEA", []string{"on_off", "brightness", "color", "color_temperature"}},
+		{"Plug", "switch", "Xiaomi", []string{"on_off", "power"}},
+		{"Hallway Sensor", "sensor", "Philips", []string{"motion", "battery"}},
+	}
+	for _, tt := range tests {
+		device, ok := store.find(tt.name)
+		if !ok {
+			t.Errorf("expected a device named %s", tt.name)
+			continue
+		}
+		if device.HouseholdID != 1 || device.Kind != tt.kind || device.Vendor != tt.vendor || device.Address != "zigbee2mqtt/"+tt.name {
+			t.Errorf("unexpected device %+v", device)
+		}
+		if !slices.Equal(device.Capabilities, tt.capabilities) {
+			t.Errorf("%s: expected capabilities %v, got %v", tt.name, tt.capabilities, device.Capabilities)
+		}
+	}
+
+	bridge := waitForBridge(t, bridges, 1, func(b Bridge) bool { return b.Online && b.Version != "" })
+	if bridge.Version != "1.40.0" || bridge.Devices != 4 {
+		t.Errorf("unexpected bridge %+v", bridge)
+	}
+
+	// Commands reach the device through the bridge
+	commands := make(chan string, 10)
+	err := broker.Subscribe("zigbee2mqtt/+/set", 2, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		commands <- pk.TopicName + " " + string(pk.Payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	light, _ := store.find("0x0001")
+	err = client.Publish(ctx, &light, database.DeviceState{"on": true, "color": "#ff8800"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cmd := <-commands:
+		if cmd != `zigbee2mqtt/0x0001/set {"color":{"hex":"#ff8800"},"state":"ON"}` {
+			t.Errorf("unexpected command %s", cmd)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the command")
+	}
+
+	// A device renamed here is renamed in Zigbee2MQTT
+	err = bridges.Rename(ctx, &light, "Desk Lamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiveChange(t, changes)
+	light, ok := store.find("Desk Lamp")
+	if !ok || light.Address != "zigbee2mqtt/Desk Lamp" {
+		t.Errorf("expected the light to be renamed, got %+v", light)
+	}
+
+	// A device renamed in Zigbee2MQTT is renamed here
+	z.rename("Plug", "Kettle")
+	receiveChange(t, changes)
+	if _, ok := store.find("Kettle"); !ok {
+		t.Error("expected the plug to be renamed")
+	}
+
+	// Joining is allowed from here
+	err = bridges.PermitJoin(ctx, 1, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge = waitForBridge(t, bridges, 1, func(b Bridge) bool { return b.PermitJoin })
+	if until := time.Until(bridge.PermitJoinEnds); until <= 0 || until > MaxPermitJoin {
+		t.Errorf("unexpected permit join end in %s", until)
+	}
+
+	// A device that leaves the network is removed
+	z.remove("0x0003")
+	receiveChange(t, changes)
+	if _, ok := store.find("Hallway Sensor"); ok {
+		t.Error("expected the sensor to be removed")
+	}
+}
+
+func TestBridgesHouseholdTopics(t *testing.T) {
+	broker, url := newBroker(t)
+	newFakeBridge(t, broker, "households/2/zigbee2mqtt")
+	newFakeBridge(t, broker, "households/4/zigbee2mqtt")
+
+	// Only the bridges of followed households are imported
+	store := &fakeStore{}
+	bridges, _, changes := startBridges(t, url, Config{HouseholdTopics: true}, store, map[int64]bool{2: true, 3: true})
+
+	receiveChange(t, changes)
+	device, ok := store.find("Plug")
+	if !ok || device.HouseholdID != 2 || device.Address != "households/2/zigbee2mqtt/Plug" {
+		t.Errorf("unexpected device %+v", device)
+	}
+
+	waitForBridge(t, bridges, 2, func(b Bridge) bool { return b.Online })
+	if err := bridges.PermitJoin(context.Background(), 3, time.Minute); err != ErrNoBridge {
+		t.Errorf("expected ErrNoBridge for a household without a bridge, got %v", err)
+	}
+	if _, ok := bridges.Get(4); ok {
+		t.Error("expected the bridge of household 4 not to be followed")
+	}
+
+	// A household followed later has its bridge imported, and one no
+	// longer followed has its bridge forgotten
+	bridges.Follow(map[int64]bool{4: true})
+	receiveChange(t, changes)
+	waitForBridge(t, bridges, 4, func(b Bridge) bool { return b.Online })
+	if _, ok := bridges.Get(2); ok {
+		t.Error("expected the bridge of household 2 to be forgotten")
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	for _, valid := range []string{"Desk Lamp", "kitchen/ceiling", "Lamp 2"} {
+		if err := CheckName(valid); err != nil {
+			t.Errorf("%q: unexpected error %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"lamp/+", "lamp#", "/lamp", "lamp/", "lamp/2"} {
+		if err := CheckName(invalid); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package zigbee2mqtt
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations/mqtt"
+)
+
+// An Expose is a capability a device definition advertises, such as a light
+// with state and brightness features or a numeric temperature.
+type Expose struct {
+	Type     string   `json:"type"`
+	Name     string   `json:"name"`
+	Property string   `json:"property"`
+	ValueOn  any      `json:"value_on"`
+	ValueOff any      `json:"value_off"`
+	ValueMax *float64 `json:"value_max"`
+	Features []Expose `json:"features"`
+}
+
+// binaryExposes maps binary exposes to capabilities.
+var binaryExposes = map[string]string{
+	"occupancy": "motion",
+	"contact":   "contact",
+	"presence":  "presence",
+}
+
+// numericExposes are the numeric exposes with a capability of the same name.
+var numericExposes = []string{"temperature", "humidity", "power", "battery"}
+
+// kinds lists the device kind for each expose type, the first found wins.
+var kinds = []struct{ expose, kind string }{
+	{"light", "light"},
+	{"switch", "switch"},
+	{"lock", "lock"},
+	{"cover", "cover"},
+	{"climate", "thermostat"},
+}
+
+// exposesMapping is the kind, capabilities and MQTT settings derived from a
+// device's exposes.
+type exposesMapping struct {
+	kind         string
+	capabilities []string
+	config       mqtt.DeviceConfig
+}
+
+func mapExposes(exposes []Expose) exposesMapping {
+	m := exposesMapping{
+		config: mqtt.DeviceConfig{Attributes: map[string]mqtt.Attribute{}},
+	}
+
+	// The expose types seen, and those that were mapped to a capability
+	seen := map[string]bool{}
+	found := map[string]bool{}
+	for _, e := range exposes {
+		switch e.Type {
+		case "light", "switch", "lock", "cover", "climate":
+			// Devices with several endpoints, such as double switches, are
+			// mapped by their first
+			if seen[e.Type] {
+				continue
+			}
+			seen[e.Type] = true
+		}
+
+		switch e.Type {
+		case "light", "switch":
+			for _, f := range e.Features {
+				switch f.Name {
+				case "state":
+					m.add("on_off", "on", stateAttribute(f))
+					found[e.Type] = true
+				case "brightness":
+					m.add("brightness", "brightness", attribute(f))
+					if f.ValueMax != nil {
+						m.config.BrightnessScale = *f.ValueMax
+					}
+				case "color_xy", "color_hs":
+					a := attribute(f)
+					a.CommandPath = a.Path + ".hex"
+					m.add("color", "color", a)
+				case "color_temp":
+					m.add("color_temperature", "color_temperature", attribute(f))
+					m.config.ColorTemperatureUnit = "mired"
+				}
+			}
+
+		case "lock":
+			for _, f := range e.Features {
+				// Not child locks, which are locks of their own
+				if f.Name == "state" {
+					m.add("lock", "locked", stateAttribute(f))
+					found[e.Type] = true
+				}
+			}
+
+		case "cover":
+			for _, f := range e.Features {
+				if f.Name == "position" {
+					m.add("position", "position", attribute(f))
+					found[e.Type] = true
+				}
+			}
+
+		case "climate":
+			for _, f := range e.Features {
+				switch f.Name {
+				case "local_temperature":
+					m.add("temperature", "temperature", attribute(f))
+				case "occupied_heating_setpoint", "current_heating_setpoint":
+					if _, ok := m.config.Attributes["target_temperature"]; !ok {
+						m.config.Attributes["target_temperature"] = attribute(f)
+					}
+					found[e.Type] = true
+				}
+			}
+
+		case "binary":
+			if capability, ok := binaryExposes[e.Name]; ok {
+				m.add(capability, capability, stateAttribute(e))
+			}
+
+		case "numeric":
+			if slices.Contains(numericExposes, e.Name) {
+				m.add(e.Name, e.Name, attribute(e))
+			}
+		}
+	}
+
+	for _, k := range kinds {
+		if found[k.expose] {
+			m.kind = k.kind
+			break
+		}
+	}
+	if m.kind == "" {
+		m.kind = "other"
+		if len(m.capabilities) > 0 {
+			m.kind = "sensor"
+		}
+	}
+
+	// Capabilities are kept in a stable order, so that unchanged devices
+	// compare equal
+	slices.SortFunc(m.capabilities, func(a, b string) int {
+		return cmp.Compare(slices.Index(database.DeviceCapabilities, a), slices.Index(database.DeviceCapabilities, b))
+	})
+	return m
+}
+
+// add maps a capability to an attribute, keeping the first mapping found.
+func (m *exposesMapping) add(capability, attr string, a mqtt.Attribute) {
+	if slices.Contains(m.capabilities, capability) {
+		return
+	}
+	m.capabilities = append(m.capabilities, capability)
+	m.config.Attributes[attr] = a
+}
+
+func attribute(e Expose) mqtt.Attribute {
+	return mqtt.Attribute{Path: "$." + e.Property}
+}
+
+// stateAttribute is an attribute with on and off values, such as "ON" and
+// "OFF" for lights or "LOCK" and "UNLOCK" for locks.
+func stateAttribute(e Expose) mqtt.Attribute {
+	a := attribute(e)
+	a.PayloadOn, _ = e.ValueOn.(string)
+	a.PayloadOff, _ = e.ValueOff.(string)
+	return a
+}
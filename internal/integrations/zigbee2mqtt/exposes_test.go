@@ -0,0 +1,79 @@
+package zigbee2mqtt
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestMapExposes(t *testing.T) {
+	tests := []struct {
+		name         string
+		exposes      string
+		kind         string
+		capabilities []string
+	}{
+		{
+			name: "Double switch",
+			exposes: `[
+				{"type": "switch", "endpoint": "l1", "features": [{"type": "binary", "name": "state", "property": "state_l1"}]},
+				{"type": "switch", "endpoint": "l2", "features": [{"type": "binary", "name": "state", "property": "state_l2"}]}
+			]`,
+			kind:         "switch",
+			capabilities: []string{"on_off"},
+		},
+		{
+			name:         "Lock",
+			exposes:      `[{"type": "lock", "features": [{"type": "binary", "name": "state", "property": "state", "value_on": "LOCK", "value_off": "UNLOCK"}]}, {"type": "numeric", "name": "battery", "property": "battery"}]`,
+			kind:         "lock",
+			capabilities: []string{"lock", "battery"},
+		},
+		{
+			name:         "Cover",
+			exposes:      `[{"type": "cover", "features": [{"type": "enum", "name": "state", "property": "state"}, {"type": "numeric", "name": "position", "property": "position"}]}]`,
+			kind:         "cover",
+			capabilities: []string{"position"},
+		},
+		{
+			name: "Radiator valve with a child lock",
+			exposes: `[
+				{"type": "lock", "features": [{"type": "binary", "name": "child_lock", "property": "child_lock"}]},
+				{"type": "climate", "features": [
+					{"type": "numeric", "name": "local_temperature", "property": "local_temperature"},
+					{"type": "numeric", "name": "current_heating_setpoint", "property": "current_heating_setpoint"}
+				]}
+			]`,
+			kind:         "thermostat",
+			capabilities: []string{"temperature"},
+		},
+		{
+			name:         "Door sensor",
+			exposes:      `[{"type": "binary", "name": "contact", "property": "contact", "value_on": false, "value_off": true}, {"type": "numeric", "name": "temperature", "property": "device_temperature"}]`,
+			kind:         "sensor",
+			capabilities: []string{"temperature", "contact"},
+		},
+		{
+			name:    "Remote",
+			exposes: `[{"type": "enum", "name": "action", "property": "action"}]`,
+			kind:    "other",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var exposes []Expose
+			err := json.Unmarshal([]byte(tt.exposes), &exposes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := mapExposes(exposes)
+			if m.kind != tt.kind {
+				t.Errorf("expected kind %s, got %s", tt.kind, m.kind)
+			}
+			if !slices.Equal(m.capabilities, tt.capabilities) {
+				t.Errorf("expected capabilities %v, got %v", tt.capabilities, m.capabilities)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package zigbee2mqtt
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/integrations"
+	"github.com/wumbabum/home_assist/internal/integrations/mqtt"
+)
+
+// Name is the name of the integration. Its devices are mqtt devices, so it
+// has no protocol of its own.
+const Name = "zigbee2mqtt"
+
+func init() {
+	integrations.Register(&Integration{})
+}
+
+// Integration plugs the bridges into the server, on the connection of the
+// MQTT integration. It imports the devices of the bridges of households that
+// enabled both integrations, as MQTT follows and controls the devices. The
+// server gives a Config in the Host's Config, without which, or a household
+// for the bridge of another broker, the integration is unavailable.
+type Integration struct {
+	bridges    *Bridges
+	db         *database.DB
+	logger     *slog.Logger
+	reload     chan struct{}
+	background integrations.Background
+}
+
+func (i *Integration) Name() string      { return Name }
+func (i *Integration) Title() string     { return "Zigbee2MQTT" }
+func (i *Integration) DependsOn() string { return mqtt.Protocol }
+
+func (i *Integration) ConfigSchema() integrations.Schema { return nil }
+
+func (i *Integration) Setup(ctx context.Context, host integrations.Host) error {
+	cfg, _ := host.Config[Name].(Config)
+	m, ok := host.Integrations[mqtt.Protocol].(interface{ Client() *mqtt.Client })
+	if !ok || cfg.BaseTopic == "" || (!cfg.HouseholdTopics && cfg.HouseholdID == 0) {
+		return integrations.ErrUnavailable
+	}
+
+	i.db = host.DB
+	i.logger = host.Logger
+	i.reload = make(chan struct{}, 1)
+	i.bridges = New(cfg, m.Client(), host.DB, ChangeFunc(host.OnChange), host.Logger)
+
+	i.background.Start(Name, i.run, host.Logger)
+	return nil
+}
+
+func (i *Integration) Reload() {
+	select {
+	case i.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Discover returns nil, as devices are imported as soon as the bridge has
+// interviewed them.
+func (i *Integration) Discover(ctx context.Context, entry *database.IntegrationEntry) ([]integrations.Discovery, error) {
+	return nil, nil
+}
+
+// HandleCommand returns an error, as the devices are commanded by the MQTT
+// integration.
+func (i *Integration) HandleCommand(ctx context.Context, device *database.Device, state database.DeviceState) error {
+	return errors.New("Zigbee2MQTT devices are commanded over MQTT")
+}
+
+func (i *Integration) Shutdown(ctx context.Context) error {
+	return i.background.Stop(ctx)
+}
+
+// Bridge returns the bridge of a household, and false if none has been seen.
+func (i *Integration) Bridge(householdID int64) (Bridge, bool) {
+	return i.bridges.Get(householdID)
+}
+
+// PermitJoin lets new devices join the household's network for d, or stops
+// them from joining when d is 0.
+func (i *Integration) PermitJoin(ctx context.Context, householdID int64, d time.Duration) error {
+	return i.bridges.PermitJoin(ctx, householdID, d)
+}
+
+// Rename asks the bridge to rename a device imported from it.
+func (i *Integration) Rename(ctx context.Context, device *database.Device, name string) error {
+	return i.bridges.Rename(ctx, device, name)
+}
+
+// run follows the bridges of the households that enabled the integration
+// and MQTT, again after every reload, until ctx is cancelled.
+func (i *Integration) run(ctx context.Context) error {
+	for {
+		households, err := i.households(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			i.logger.Error("failed to load the households of the Zigbee2MQTT integration", "error", err)
+		case err == nil:
+			i.bridges.Follow(households)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-i.reload:
+		}
+	}
+}
+
+func (i *Integration) households(ctx context.Context) (map[int64]bool, error) {
+	households, err := integrations.EnabledHouseholds(ctx, i.db, Name)
+	if err != nil {
+		return nil, err
+	}
+
+	withMQTT, err := integrations.EnabledHouseholds(ctx, i.db, mqtt.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	for householdID := range households {
+		if !withMQTT[householdID] {
+			delete(households, householdID)
+		}
+	}
+	return households, nil
+}
@@ -1,6 +1,7 @@
 package request
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,10 @@ import (
 	"strings"
 )
 
+// ErrEmpty is wrapped by the error decoding a body or message with no JSON at
+// all, for the callers to whom the JSON is optional.
+var ErrEmpty = errors.New("must not be empty")
+
 func DecodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	return decodeJSON(w, r, dst, false)
 }
@@ -20,7 +25,18 @@ func DecodeJSONStrict(w http.ResponseWriter, r *http.Request, dst interface{}) e
 func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}, disallowUnknownFields bool) error {
 	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
 
-	dec := json.NewDecoder(r.Body)
+	return decodeJSONFrom(r.Body, dst, disallowUnknownFields, "body")
+}
+
+// DecodeJSONMessage decodes a single JSON message that has already been read,
+// such as a WebSocket frame, rejecting unknown keys. Errors are worded like
+// those of DecodeJSONStrict.
+func DecodeJSONMessage(data []byte, dst interface{}) error {
+	return decodeJSONFrom(bytes.NewReader(data), dst, true, "message")
+}
+
+func decodeJSONFrom(rd io.Reader, dst interface{}, disallowUnknownFields bool, subject string) error {
+	dec := json.NewDecoder(rd)
 
 	if disallowUnknownFields {
 		dec.DisallowUnknownFields()
@@ -37,26 +53,26 @@ func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}, disallo
 
 		switch {
 		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
+			return fmt.Errorf("%s %w", subject, ErrEmpty)
 
 		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+			return fmt.Errorf("%s contains badly-formed JSON (at character %d)", subject, syntaxError.Offset)
 
 		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
+			return fmt.Errorf("%s contains badly-formed JSON", subject)
 
 		case errors.As(err, &unmarshalTypeError):
 			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+				return fmt.Errorf("%s contains incorrect JSON type for field %q", subject, unmarshalTypeError.Field)
 			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+			return fmt.Errorf("%s contains incorrect JSON type (at character %d)", subject, unmarshalTypeError.Offset)
 
 		case strings.HasPrefix(err.Error(), "json: unknown field "):
 			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
+			return fmt.Errorf("%s contains unknown key %s", subject, fieldName)
 
 		case errors.As(err, &maxBytesError):
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+			return fmt.Errorf("%s must not be larger than %d bytes", subject, maxBytesError.Limit)
 
 		case errors.As(err, &invalidUnmarshalError):
 			panic(err)
@@ -68,7 +84,7 @@ func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}, disallo
 
 	err = dec.Decode(&struct{}{})
 	if !errors.Is(err, io.EOF) {
-		return errors.New("body must only contain a single JSON value")
+		return fmt.Errorf("%s must only contain a single JSON value", subject)
 	}
 
 	return nil
@@ -0,0 +1,128 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+// Schedule computes when a trigger next fires.
+type Schedule interface {
+	// Next returns the first time strictly after the given one, or the zero
+	// time if the schedule never fires again.
+	Next(after time.Time) time.Time
+}
+
+// Schedules work on wall-clock time in the household's timezone. When clocks
+// go forward the skipped times fire as far after the change as they would
+// have been after the hour before it, so 02:30 becomes 03:30. When clocks go
+// back the repeated times fire once, on their first occurrence.
+
+// Daily fires every day at a time of day.
+type Daily struct {
+	Hour     int
+	Minute   int
+	Location *time.Location
+}
+
+func (d Daily) Next(after time.Time) time.Time {
+	y, m, day := after.In(d.Location).Date()
+
+	for i := 0; i <= 2; i++ {
+		next := localTime(time.Date(y, m, day+i, d.Hour, d.Minute, 0, 0, time.UTC), d.Location)
+		if next.After(after) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// Cron fires at the times matched by a standard five field cron expression.
+type Cron struct {
+	Schedule cron.Schedule
+	Location *time.Location
+}
+
+func (c Cron) Next(after time.Time) time.Time {
+	wall := wallClock(after, c.Location)
+
+	// Repeated times map to their first occurrence, which is before after
+	// when after is in the second one, so keep going until past the repeat.
+	for {
+		wall = c.Schedule.Next(wall)
+		if wall.IsZero() {
+			return time.Time{}
+		}
+		next := localTime(wall, c.Location)
+		if next.After(after) {
+			return next
+		}
+	}
+}
+
+// ParseCron parses a standard five field cron expression, or a descriptor
+// such as @daily. Timezones cannot be given, the household's is always used.
+func ParseCron(spec string) (cron.Schedule, error) {
+	if strings.HasPrefix(spec, "TZ=") || strings.HasPrefix(spec, "CRON_TZ=") {
+		return nil, errors.New("cron expressions cannot set a timezone")
+	}
+	return cron.ParseStandard(spec)
+}
+
+// ForTrigger returns the schedule of a time, cron or sun trigger in the given
+// location. Sun triggers need the latitude and longitude of the household.
+func ForTrigger(trigger database.Trigger, loc *time.Location, latitude, longitude *float64) (Schedule, error) {
+	switch trigger.Type {
+	case database.TriggerTime:
+		t, err := time.Parse("15:04", trigger.At)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q", trigger.At)
+		}
+		return Daily{Hour: t.Hour(), Minute: t.Minute(), Location: loc}, nil
+
+	case database.TriggerCron:
+		schedule, err := ParseCron(trigger.Cron)
+		if err != nil {
+			return nil, err
+		}
+		return Cron{Schedule: schedule, Location: loc}, nil
+
+	case database.TriggerSun:
+		if latitude == nil || longitude == nil {
+			return nil, errors.New("the household has no latitude and longitude")
+		}
+		if trigger.Sun != database.Sunrise && trigger.Sun != database.Sunset {
+			return nil, fmt.Errorf("invalid sun event %q", trigger.Sun)
+		}
+		return Sun{
+			Event:     trigger.Sun,
+			Offset:    time.Duration(trigger.Offset) * time.Minute,
+			Latitude:  *latitude,
+			Longitude: *longitude,
+			Location:  loc,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%s triggers are not scheduled", trigger.Type)
+}
+
+// wallClock returns the wall-clock time of t in loc as a time in UTC, where
+// there are no clock changes.
+func wallClock(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// localTime converts a wall-clock time expressed in UTC to loc. Times that
+// were skipped by a clock change are moved forward by the size of the gap.
+func localTime(wall time.Time, loc *time.Location) time.Time {
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), loc)
+	if gap := wall.Sub(wallClock(t, loc)); gap > 0 {
+		t = t.Add(gap)
+	}
+	return t
+}
@@ -0,0 +1,201 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestDailyDST(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		name  string
+		daily Daily
+		after time.Time
+		want  time.Time
+	}{
+		{
+			name:  "Later today",
+			daily: Daily{Hour: 7, Minute: 30, Location: ny},
+			after: time.Date(2024, 6, 1, 6, 0, 0, 0, ny),
+			want:  time.Date(2024, 6, 1, 7, 30, 0, 0, ny),
+		},
+		{
+			name:  "Tomorrow",
+			daily: Daily{Hour: 7, Minute: 30, Location: ny},
+			after: time.Date(2024, 6, 1, 7, 30, 0, 0, ny),
+			want:  time.Date(2024, 6, 2, 7, 30, 0, 0, ny),
+		},
+		{
+			name:  "Across spring forward",
+			daily: Daily{Hour: 7, Minute: 30, Location: ny},
+			after: time.Date(2024, 3, 9, 8, 0, 0, 0, ny),
+			want:  time.Date(2024, 3, 10, 11, 30, 0, 0, time.UTC),
+		},
+		{
+			name:  "Skipped time",
+			daily: Daily{Hour: 2, Minute: 30, Location: ny},
+			after: time.Date(2024, 3, 10, 0, 0, 0, 0, ny),
+			want:  time.Date(2024, 3, 10, 3, 30, 0, 0, ny),
+		},
+		{
+			name:  "Repeated time fires on first occurrence",
+			daily: Daily{Hour: 1, Minute: 30, Location: ny},
+			after: time.Date(2024, 11, 3, 0, 0, 0, 0, ny),
+			want:  time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC),
+		},
+		{
+			name:  "Repeated time does not fire twice",
+			daily: Daily{Hour: 1, Minute: 30, Location: ny},
+			after: time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC),
+			want:  time.Date(2024, 11, 4, 1, 30, 0, 0, ny),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.daily.Next(tt.after)
+			if !got.Equal(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got.In(ny))
+			}
+		})
+	}
+}
+
+func TestCron(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+
+	next := func(spec string, after time.Time, n int) []time.Time {
+		t.Helper()
+
+		schedule, err := ParseCron(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := Cron{Schedule: schedule, Location: ny}
+
+		var times []time.Time
+		for range n {
+			after = c.Next(after)
+			times = append(times, after)
+		}
+		return times
+	}
+
+	weekdays := next("30 7 * * 1-5", time.Date(2024, 6, 7, 8, 0, 0, 0, ny), 2)
+	if !weekdays[0].Equal(time.Date(2024, 6, 10, 7, 30, 0, 0, ny)) || !weekdays[1].Equal(time.Date(2024, 6, 11, 7, 30, 0, 0, ny)) {
+		t.Errorf("expected Monday and Tuesday at 07:30, got %v", weekdays)
+	}
+
+	skipped := next("30 2 * * *", time.Date(2024, 3, 10, 0, 0, 0, 0, ny), 1)
+	if !skipped[0].Equal(time.Date(2024, 3, 10, 3, 30, 0, 0, ny)) {
+		t.Errorf("expected the skipped 02:30 to fire at 03:30, got %v", skipped[0])
+	}
+
+	repeated := next("30 1 * * *", time.Date(2024, 11, 3, 0, 0, 0, 0, ny), 2)
+	if !repeated[1].Equal(time.Date(2024, 11, 4, 1, 30, 0, 0, ny)) {
+		t.Errorf("expected the repeated 01:30 to fire once, got %v", repeated)
+	}
+
+	_, err := ParseCron("TZ=Europe/London 0 7 * * *")
+	if err == nil {
+		t.Error("expected an error for a cron expression with a timezone")
+	}
+	_, err = ParseCron("every morning")
+	if err == nil {
+		t.Error("expected an error for an invalid cron expression")
+	}
+}
+
+func TestSunTimes(t *testing.T) {
+	london := mustLoadLocation(t, "Europe/London")
+
+	tests := []struct {
+		name            string
+		date            time.Time
+		latitude        float64
+		longitude       float64
+		sunrise, sunset time.Time
+		polar           bool
+	}{
+		{
+			name:      "London midsummer",
+			date:      time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC),
+			latitude:  51.5074,
+			longitude: -0.1278,
+			sunrise:   time.Date(2024, 6, 21, 4, 43, 0, 0, london),
+			sunset:    time.Date(2024, 6, 21, 21, 21, 0, 0, london),
+		},
+		{
+			name:      "London midwinter",
+			date:      time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC),
+			latitude:  51.5074,
+			longitude: -0.1278,
+			sunrise:   time.Date(2024, 12, 21, 8, 4, 0, 0, london),
+			sunset:    time.Date(2024, 12, 21, 15, 53, 0, 0, london),
+		},
+		{
+			name:      "Tromsø in the polar night",
+			date:      time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC),
+			latitude:  69.6492,
+			longitude: 18.9553,
+			polar:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sunrise, sunset, ok := SunTimes(tt.date, tt.latitude, tt.longitude)
+			if tt.polar {
+				if ok {
+					t.Errorf("expected no sunrise, got %v", sunrise)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("expected the sun to rise and set")
+			}
+
+			if diff := sunrise.Sub(tt.sunrise).Abs(); diff > 2*time.Minute {
+				t.Errorf("expected sunrise at %v, got %v", tt.sunrise, sunrise.In(london))
+			}
+			if diff := sunset.Sub(tt.sunset).Abs(); diff > 2*time.Minute {
+				t.Errorf("expected sunset at %v, got %v", tt.sunset, sunset.In(london))
+			}
+		})
+	}
+}
+
+func TestSunNext(t *testing.T) {
+	london := mustLoadLocation(t, "Europe/London")
+	lat, lon := 51.5074, -0.1278
+
+	schedule, err := ForTrigger(database.Trigger{Type: database.TriggerSun, Sun: database.Sunset, Offset: -30}, london, &lat, &lon)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After today's sunset less 30 minutes, the next is tomorrow's
+	got := schedule.Next(time.Date(2024, 6, 21, 21, 0, 0, 0, london))
+	want := time.Date(2024, 6, 22, 20, 51, 0, 0, london)
+	if diff := got.Sub(want).Abs(); diff > 2*time.Minute {
+		t.Errorf("expected about %v, got %v", want, got)
+	}
+
+	_, err = ForTrigger(database.Trigger{Type: database.TriggerSun, Sun: database.Sunrise}, london, nil, nil)
+	if err == nil {
+		t.Error("expected an error without coordinates")
+	}
+}
@@ -0,0 +1,223 @@
+// Package scheduler fires the time, cron and sun triggers of automations by
+// publishing schedule_fired events for the automation engine. The next run of
+// every trigger is stored so that schedules survive restarts.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+)
+
+// maxSleep bounds how long the scheduler waits between checks. Timers follow
+// the monotonic clock, so this also picks up changes to the system clock and
+// time spent suspended.
+const maxSleep = time.Minute
+
+// DefaultMisfireGrace is how late a trigger may fire, after a restart or a
+// pause, before its run is skipped instead.
+const DefaultMisfireGrace = 5 * time.Minute
+
+// Store is the data the scheduler needs, implemented by *database.DB.
+type Store interface {
+	ListScheduledAutomations(ctx context.Context) ([]database.ScheduledAutomation, error)
+	ListScheduleRuns(ctx context.Context) ([]database.ScheduleRun, error)
+	SaveScheduleRun(ctx context.Context, run *database.ScheduleRun) error
+}
+
+type job struct {
+	householdID int64
+	schedule    Schedule
+	run         database.ScheduleRun
+}
+
+type Scheduler struct {
+	store  Store
+	bus    *events.Bus
+	logger *slog.Logger
+	now    func() time.Time
+	reload chan struct{}
+
+	MisfireGrace time.Duration
+}
+
+func New(store Store, bus *events.Bus, logger *slog.Logger) *Scheduler {
+	return &Scheduler{
+		store:        store,
+		bus:          bus,
+		logger:       logger,
+		now:          time.Now,
+		reload:       make(chan struct{}, 1),
+		MisfireGrace: DefaultMisfireGrace,
+	}
+}
+
+// Reload makes the scheduler read the automations again, after one has been
+// saved or deleted or a household has moved. It does not block.
+func (s *Scheduler) Reload() {
+	select {
+	case s.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Run fires triggers as they fall due until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) error {
+	jobs, loaded := s.load(ctx)
+
+	timer := time.NewTimer(s.untilNext(jobs))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-s.reload:
+			jobs, loaded = s.load(ctx)
+
+		case <-timer.C:
+			// Retry a failed load rather than running without schedules
+			if !loaded {
+				jobs, loaded = s.load(ctx)
+			}
+			s.fire(ctx, jobs)
+		}
+
+		timer.Reset(s.untilNext(jobs))
+	}
+}
+
+// load builds the jobs for every scheduled trigger, resuming from the stored
+// next run unless the trigger or the household's location has changed.
+func (s *Scheduler) load(ctx context.Context) ([]*job, bool) {
+	automations, err := s.store.ListScheduledAutomations(ctx)
+	if err != nil {
+		s.logger.Error("failed to load scheduled automations", "error", err)
+		return nil, false
+	}
+
+	stored, err := s.store.ListScheduleRuns(ctx)
+	if err != nil {
+		s.logger.Error("failed to load schedule runs", "error", err)
+		return nil, false
+	}
+
+	type key struct {
+		automationID int64
+		index        int
+	}
+	runs := make(map[key]database.ScheduleRun, len(stored))
+	for _, run := range stored {
+		runs[key{run.AutomationID, run.TriggerIndex}] = run
+	}
+
+	now := s.now()
+	var jobs []*job
+
+	for _, a := range automations {
+		loc, err := time.LoadLocation(a.Timezone)
+		if err != nil {
+			s.logger.Warn("unknown household timezone, using UTC", "household_id", a.HouseholdID, "timezone", a.Timezone)
+			loc = time.UTC
+		}
+
+		for i, trigger := range a.Triggers {
+			if !slices.Contains(database.ScheduledTriggerTypes, trigger.Type) {
+				continue
+			}
+
+			schedule, err := ForTrigger(trigger, loc, a.Latitude, a.Longitude)
+			if err != nil {
+				s.logger.Warn("trigger not scheduled", "automation_id", a.ID, "trigger", i, "error", err)
+				continue
+			}
+
+			j := &job{
+				householdID: a.HouseholdID,
+				schedule:    schedule,
+				run:         database.ScheduleRun{AutomationID: a.ID, TriggerIndex: i, Spec: spec(trigger, a)},
+			}
+
+			run, ok := runs[key{a.ID, i}]
+			if ok && run.Spec == j.run.Spec {
+				j.run.NextRunAt = run.NextRunAt
+			} else {
+				j.run.NextRunAt = schedule.Next(now)
+				s.save(ctx, j)
+			}
+
+			jobs = append(jobs, j)
+		}
+	}
+
+	return jobs, true
+}
+
+// fire publishes the jobs that are due and schedules their next run. Runs
+// missed by more than MisfireGrace, while the server was stopped or the
+// machine suspended, are skipped.
+func (s *Scheduler) fire(ctx context.Context, jobs []*job) {
+	now := s.now()
+
+	for _, j := range jobs {
+		if j.run.NextRunAt.IsZero() || j.run.NextRunAt.After(now) {
+			continue
+		}
+
+		if late := now.Sub(j.run.NextRunAt); late > s.MisfireGrace {
+			s.logger.Warn("missed scheduled run skipped",
+				"automation_id", j.run.AutomationID, "trigger", j.run.TriggerIndex, "scheduled_at", j.run.NextRunAt, "late", late)
+		} else {
+			s.bus.Publish(events.NewScheduleFired(j.householdID, events.ScheduleFired{
+				AutomationID: j.run.AutomationID,
+				Trigger:      j.run.TriggerIndex,
+				ScheduledAt:  j.run.NextRunAt,
+			}))
+		}
+
+		j.run.NextRunAt = j.schedule.Next(now)
+		s.save(ctx, j)
+	}
+}
+
+func (s *Scheduler) save(ctx context.Context, j *job) {
+	// Schedules that never fire again have nothing to resume
+	if j.run.NextRunAt.IsZero() {
+		return
+	}
+
+	err := s.store.SaveScheduleRun(ctx, &j.run)
+	if err != nil {
+		s.logger.Error("failed to save schedule run", "automation_id", j.run.AutomationID, "trigger", j.run.TriggerIndex, "error", err)
+	}
+}
+
+func (s *Scheduler) untilNext(jobs []*job) time.Duration {
+	now := s.now()
+	wait := maxSleep
+
+	for _, j := range jobs {
+		if j.run.NextRunAt.IsZero() {
+			continue
+		}
+		wait = min(wait, j.run.NextRunAt.Sub(now))
+	}
+	return max(wait, 0)
+}
+
+// spec describes everything a trigger's schedule is computed from.
+func spec(trigger database.Trigger, a database.ScheduledAutomation) string {
+	js, _ := json.Marshal(struct {
+		Trigger   database.Trigger `json:"trigger"`
+		Timezone  string           `json:"timezone"`
+		Latitude  *float64         `json:"latitude,omitempty"`
+		Longitude *float64         `json:"longitude,omitempty"`
+	}{trigger, a.Timezone, a.Latitude, a.Longitude})
+	return string(js)
+}
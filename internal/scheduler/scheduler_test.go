@@ -0,0 +1,161 @@
+package scheduler
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+	"github.com/wumbabum/home_assist/internal/events"
+)
+
+type fakeStore struct {
+	mu          sync.Mutex
+	automations []database.ScheduledAutomation
+	runs        map[int64]database.ScheduleRun // By automation ID, tests use one trigger each
+}
+
+func (s *fakeStore) ListScheduledAutomations(ctx context.Context) ([]database.ScheduledAutomation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.automations, nil
+}
+
+func (s *fakeStore) ListScheduleRuns(ctx context.Context) ([]database.ScheduleRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var runs []database.ScheduleRun
+	for _, run := range s.runs {
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func (s *fakeStore) SaveScheduleRun(ctx context.Context, run *database.ScheduleRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs[run.AutomationID] = *run
+	return nil
+}
+
+func scheduled(id int64, trigger database.Trigger) database.ScheduledAutomation {
+	return database.ScheduledAutomation{
+		Automation: database.Automation{
+			ID:          id,
+			HouseholdID: 1,
+			Enabled:     true,
+			Triggers:    database.Triggers{{Type: database.TriggerWebhook, WebhookID: "ignored-by-the-scheduler"}, trigger},
+		},
+		Timezone: "Europe/London",
+	}
+}
+
+func TestSchedulerResume(t *testing.T) {
+	london := mustLoadLocation(t, "Europe/London")
+	now := time.Date(2024, 6, 1, 7, 32, 0, 0, london)
+
+	morning := scheduled(1, database.Trigger{Type: database.TriggerTime, At: "07:30"})
+	night := scheduled(2, database.Trigger{Type: database.TriggerCron, Cron: "0 1 * * *"})
+	changed := scheduled(3, database.Trigger{Type: database.TriggerTime, At: "07:00"})
+
+	store := &fakeStore{
+		automations: []database.ScheduledAutomation{morning, night, changed},
+		runs: map[int64]database.ScheduleRun{
+			// Missed two minutes ago, within the grace period
+			1: {AutomationID: 1, TriggerIndex: 1, Spec: spec(morning.Triggers[1], morning), NextRunAt: now.Add(-2 * time.Minute)},
+			// Missed six hours ago, while the server was stopped
+			2: {AutomationID: 2, TriggerIndex: 1, Spec: spec(night.Triggers[1], night), NextRunAt: now.Add(-6*time.Hour - 32*time.Minute)},
+			// Scheduled before the trigger was edited
+			3: {AutomationID: 3, TriggerIndex: 1, Spec: "old", NextRunAt: now.Add(-time.Minute)},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	bus := events.NewBus(logger)
+	sub := bus.Subscribe(events.SubscribeOptions{Name: "test"})
+
+	s := New(store, bus, logger)
+	s.now = func() time.Time { return now }
+
+	jobs, ok := s.load(context.Background())
+	if !ok || len(jobs) != 3 {
+		t.Fatalf("expected 3 jobs, got %d", len(jobs))
+	}
+	if wait := s.untilNext(jobs); wait != 0 {
+		t.Errorf("expected the missed runs to be due now, got %v", wait)
+	}
+
+	s.fire(context.Background(), jobs)
+
+	select {
+	case ev := <-sub.Events():
+		payload := ev.Payload.(events.ScheduleFired)
+		if payload.AutomationID != 1 || payload.Trigger != 1 || ev.HouseholdID != 1 {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	default:
+		t.Fatal("expected the run missed within the grace period to fire")
+	}
+	select {
+	case ev := <-sub.Events():
+		t.Errorf("expected only one event, got %+v", ev)
+	default:
+	}
+
+	want := map[int64]time.Time{
+		1: time.Date(2024, 6, 2, 7, 30, 0, 0, london),
+		2: time.Date(2024, 6, 2, 1, 0, 0, 0, london),
+		3: time.Date(2024, 6, 2, 7, 0, 0, 0, london),
+	}
+	for id, next := range want {
+		if !store.runs[id].NextRunAt.Equal(next) {
+			t.Errorf("expected automation %d to next run at %v, got %v", id, next, store.runs[id].NextRunAt)
+		}
+	}
+	if store.runs[3].Spec == "old" {
+		t.Error("expected the changed trigger to be rescheduled")
+	}
+}
+
+func TestSchedulerRun(t *testing.T) {
+	store := &fakeStore{runs: map[int64]database.ScheduleRun{}}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	bus := events.NewBus(logger)
+	s := New(store, bus, logger)
+
+	sub := bus.Subscribe(events.SubscribeOptions{Name: "test"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+
+	// A cron trigger added while running fires within a second
+	store.mu.Lock()
+	store.automations = []database.ScheduledAutomation{scheduled(1, database.Trigger{Type: database.TriggerCron, Cron: "@every 1s"})}
+	store.mu.Unlock()
+	s.Reload()
+
+	select {
+	case ev := <-sub.Events():
+		if ev.Type != events.TypeScheduleFired {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the trigger to fire")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return when ctx is cancelled")
+	}
+}
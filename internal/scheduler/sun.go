@@ -0,0 +1,84 @@
+package scheduler
+
+import (
+	"math"
+	"time"
+
+	"github.com/wumbabum/home_assist/internal/database"
+)
+
+// maxSunSearchDays bounds the search for the next sunrise or sunset, which
+// near the poles can be months away.
+const maxSunSearchDays = 366
+
+// Sun fires at sunrise or sunset, moved earlier or later by Offset.
+type Sun struct {
+	Event     string // database.Sunrise or database.Sunset
+	Offset    time.Duration
+	Latitude  float64
+	Longitude float64
+	Location  *time.Location
+}
+
+func (s Sun) Next(after time.Time) time.Time {
+	y, m, d := after.In(s.Location).Date()
+
+	// Start a day early, a large offset can move an event across midnight
+	for i := -1; i <= maxSunSearchDays; i++ {
+		sunrise, sunset, ok := SunTimes(time.Date(y, m, d+i, 0, 0, 0, 0, time.UTC), s.Latitude, s.Longitude)
+		if !ok {
+			continue
+		}
+
+		next := sunset
+		if s.Event == database.Sunrise {
+			next = sunrise
+		}
+		next = next.Add(s.Offset).In(s.Location)
+		if next.After(after) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// SunTimes returns sunrise and sunset on a date at the given coordinates in
+// degrees, using the sunrise equation. The result is within a minute or two
+// of published tables. ok is false on days the sun does not rise or set.
+func SunTimes(date time.Time, latitude, longitude float64) (sunrise, sunset time.Time, ok bool) {
+	const (
+		j2000     = 2451545.0
+		unixEpoch = 2440587.5 // Julian date of 1970-01-01 00:00 UTC
+	)
+
+	sin := func(deg float64) float64 { return math.Sin(deg * math.Pi / 180) }
+	cos := func(deg float64) float64 { return math.Cos(deg * math.Pi / 180) }
+
+	// Days since J2000 of noon on the date, then mean solar noon at the longitude
+	y, m, d := date.Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	n := math.Round(float64(noon.Unix())/86400 + unixEpoch - j2000)
+	meanNoon := n - longitude/360
+
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*sin(anomaly) + 0.0200*sin(2*anomaly) + 0.0003*sin(3*anomaly)
+	eclipticLongitude := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := j2000 + meanNoon + 0.0053*sin(anomaly) - 0.0069*sin(2*eclipticLongitude)
+
+	sinDeclination := sin(eclipticLongitude) * sin(23.4397)
+	cosDeclination := math.Cos(math.Asin(sinDeclination))
+
+	// -0.833° allows for refraction and the radius of the sun's disc
+	cosHourAngle := (sin(-0.833) - sin(latitude)*sinDeclination) / (cos(latitude) * cosDeclination)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+
+	julianTime := func(jd float64) time.Time {
+		seconds := (jd - unixEpoch) * 86400
+		return time.Unix(0, int64(seconds*1e9)).UTC().Truncate(time.Second)
+	}
+
+	return julianTime(transit - hourAngle/360), julianTime(transit + hourAngle/360), true
+}
@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func newTestCipher(t *testing.T, b byte) *Cipher {
+	t.Helper()
+
+	c, err := NewCipher(bytes.Repeat([]byte{b}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCipher(t *testing.T) {
+	c := newTestCipher(t, 1)
+
+	secret := []byte("hue-application-key")
+	ciphertext, err := c.Encrypt(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ciphertext, secret) {
+		t.Error("expected the secret to be encrypted")
+	}
+
+	// Nonces are random, so the same secret encrypts differently
+	again, err := c.Encrypt(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ciphertext, again) {
+		t.Error("expected a different ciphertext for each encryption")
+	}
+
+	plaintext, err := c.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, secret) {
+		t.Errorf("expected %q, got %q", secret, plaintext)
+	}
+
+	tampered := bytes.Clone(ciphertext)
+	tampered[len(tampered)-1] ^= 1
+	for name, ciphertext := range map[string][]byte{"tampered": tampered, "truncated": ciphertext[:4]} {
+		_, err := c.Decrypt(ciphertext)
+		if !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: expected ErrDecrypt, got %v", name, err)
+		}
+	}
+
+	_, err = newTestCipher(t, 2).Decrypt(ciphertext)
+	if !errors.Is(err, ErrDecrypt) {
+		t.Errorf("expected ErrDecrypt with another key, got %v", err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeySize)
+	got, err := ParseKey(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Errorf("expected %v, got %v", key, got)
+	}
+
+	for _, invalid := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(key[:16])} {
+		_, err := ParseKey(invalid)
+		if err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package testhelpers
 
 import (
+	"context"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/wumbabum/home_assist/internal/database"
 )
@@ -20,3 +23,48 @@ func GetTestDB(t *testing.T) *database.DB {
 
 	return db
 }
+
+// ListenFunc connects to a device and reports the states it sends, as an
+// integrations.Watcher listens to the devices of a client.
+type ListenFunc func(ctx context.Context, device database.Device, report func(database.DeviceState)) error
+
+// Listen runs listen for a device until the test ends, returning the states
+// it reports. Empty states are left out, as the watcher does.
+func Listen(t *testing.T, listen ListenFunc, device database.Device) <-chan database.DeviceState {
+	t.Helper()
+
+	states := make(chan database.DeviceState, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := listen(ctx, device, func(state database.DeviceState) {
+			if len(state) > 0 {
+				states <- state
+			}
+		})
+		if ctx.Err() == nil {
+			t.Errorf("device %d stopped listening: %v", device.ID, err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return states
+}
+
+// ReceiveState fails the test unless the next state reported is want.
+func ReceiveState(t *testing.T, states <-chan database.DeviceState, want database.DeviceState) {
+	t.Helper()
+
+	select {
+	case got := <-states:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for %v", want)
+	}
+}